@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/lifebalance/lenslocked/models"
+)
+
+/*
+CLI utility to manage admins, e.g. to create the first one (the admin console
+can't be used before there is one). Use examples:
+
+1. GRANT:  	go run ./cmd/admin grant someone@example.com
+2. REVOKE: 	go run ./cmd/admin revoke someone@example.com
+
+The account must exist (sign up first). The change is recorded in the audit
+log, without an actor. Accounts provisioned from LDAP get their role from the
+directory groups when LDAP_GROUP_ROLES is set, which overrides this.
+*/
+func main() {
+	if len(os.Args) != 3 {
+		usage()
+		os.Exit(2)
+	}
+	var role string
+	switch os.Args[1] {
+	case "grant":
+		role = models.RoleAdmin
+	case "revoke":
+		role = models.RoleUser
+	default:
+		fmt.Printf("invalid command: %s\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	db, err := models.Open(models.DefaultPostgresConfig())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	userService := models.UserService{
+		DB: db,
+		Auditor: models.Auditor{
+			Audit: &models.AuditService{DB: db},
+		},
+	}
+	user, err := userService.SetRole(os.Args[2], role)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			fmt.Printf("no account with the email %s\n", os.Args[2])
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s (user %d) is now: %s\n", user.Email, user.ID, user.Role)
+}
+
+func usage() {
+	fmt.Println("usage: admin grant|revoke <email>")
+}
@@ -1,23 +1,37 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/lifebalance/lenslocked/models"
 	"golang.org/x/crypto/bcrypt"
 )
 
 /*
-CLI utility for hashing passwords. Use examples:
+CLI utility for hashing passwords (bcrypt or argon2id). Use examples:
 
 1. BUILD: 	go build ./cmd/bcrypt
 2. HASH:  	bcrypt hash "some password here"
-3. COMPARE: bcrypt compare "some password here" "some hash here"
+3. HASH:  	bcrypt hash -algo argon2id -time 3 -memory 65536 -threads 2 "some password here"
+4. VERIFY: 	bcrypt verify "some password here" "some hash here"
+5. TUNE: 	bcrypt tune -algo argon2id -target 250ms
+
+The algorithm used by `verify` is detected from the hash itself. `compare` is
+kept as an alias of `verify`.
+
+`tune` finds the parameters that take about -target to hash a password on this
+machine (increasing the bcrypt cost, or the argon2id time for the given memory
+and threads), and prints them as env. vars ready to paste in the .env file.
 
 During development, you may want to build/run in the same step:
 
 1. BUILD/RUN/HASH: 		go run cmd/bcrypt/main.go hash "some password here"
-2. BUILD/RUN/COMPARE: 	go run cmd/bcrypt/main.go compare "abcd" 'hashed'
+2. BUILD/RUN/VERIFY: 	go run cmd/bcrypt/main.go verify "abcd" 'hashed'
 
 IMPORTANT: Use single quotes around the hashed password, so the $ in the string
 are not interpreted as parameter expansion!
@@ -28,21 +42,14 @@ func main() {
 		os.Exit(2)
 	}
 	command := os.Args[1]
-	arg1 := os.Args[2]
+	args := os.Args[2:]
 	switch command {
 	case "hash":
-		if len(os.Args) != 3 {
-			fmt.Println("usage: bcrypt hash <password>")
-			os.Exit(2)
-		}
-		hash(arg1)
-	case "compare":
-		if len(os.Args) != 4 {
-			fmt.Println("usage: bcrypt compare <password> <hash>")
-			os.Exit(2)
-		}
-		arg2 := os.Args[3]
-		compare(arg1, arg2)
+		hash(args)
+	case "verify", "compare":
+		verify(args)
+	case "tune":
+		tune(args)
 	default:
 		fmt.Printf("invalid command: %s\n", command)
 		usage()
@@ -50,27 +57,126 @@ func main() {
 	}
 }
 
-func hash(password string) {
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// Registers the flags shared by `hash` and `tune`.
+func hasherFlags(fs *flag.FlagSet) *models.PasswordHasher {
+	hasher := models.PasswordHasher{}
+	fs.StringVar(&hasher.Algorithm, "algo", models.HashAlgorithmBcrypt, "bcrypt or argon2id")
+	fs.IntVar(&hasher.BcryptCost, "cost", bcrypt.DefaultCost, "bcrypt cost")
+	fs.Func("time", "argon2id iterations", uint32Flag(&hasher.Argon2.Time))
+	fs.Func("memory", "argon2id memory in KiB", uint32Flag(&hasher.Argon2.Memory))
+	fs.Func("threads", "argon2id parallelism", func(s string) error {
+		var threads uint32
+		err := uint32Flag(&threads)(s)
+		hasher.Argon2.Threads = uint8(threads)
+		return err
+	})
+	return &hasher
+}
+
+func hash(args []string) {
+	fs := flag.NewFlagSet("hash", flag.ExitOnError)
+	hasher := hasherFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("usage: bcrypt hash [-algo bcrypt|argon2id] [flags] <password>")
+		os.Exit(2)
+	}
+	hashString, err := hasher.Hash(fs.Arg(0))
 	if err != nil {
-		fmt.Printf("error hashing: %v\n", password)
+		fmt.Printf("error hashing: %v\n", err)
+		os.Exit(1)
 	}
-	hashString := string(hashedBytes)
 	fmt.Println(hashString)
 }
 
-func compare(password string, hash string) {
-	fmt.Println("comparing", password, hash)
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func verify(args []string) {
+	if len(args) != 2 {
+		fmt.Println("usage: bcrypt verify <password> <hash>")
+		os.Exit(2)
+	}
+	password, hash := args[0], args[1]
+	fmt.Println("verifying", password, hash)
+	hasher := models.PasswordHasher{}
+	err := hasher.Verify(hash, password)
+	if errors.Is(err, models.ErrInvalidCredentials) {
+		fmt.Println("password does not match")
+		os.Exit(1)
+	}
 	if err != nil {
-		fmt.Printf("error comparing: %v\n", password)
-		return
+		fmt.Printf("error verifying: %v\n", err)
+		os.Exit(1)
 	}
 	fmt.Println("password matches!")
 }
 
+func tune(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	hasher := hasherFlags(fs)
+	target := fs.Duration("target", 250*time.Millisecond, "how long hashing a password should take")
+	fs.Parse(args)
+
+	switch hasher.Algorithm {
+	case models.HashAlgorithmBcrypt:
+		hasher.BcryptCost = bcrypt.MinCost
+		for {
+			elapsed := timeHash(hasher)
+			fmt.Printf("cost=%d\t%s\n", hasher.BcryptCost, elapsed)
+			if elapsed >= *target || hasher.BcryptCost == bcrypt.MaxCost {
+				break
+			}
+			hasher.BcryptCost++
+		}
+		fmt.Println()
+		fmt.Println("PASSWORD_HASH_ALGORITHM=bcrypt")
+		fmt.Printf("BCRYPT_COST=%d\n", hasher.BcryptCost)
+	case models.HashAlgorithmArgon2id:
+		if hasher.Argon2.Memory == 0 {
+			hasher.Argon2.Memory = models.DefaultArgon2Params.Memory
+		}
+		if hasher.Argon2.Threads == 0 {
+			hasher.Argon2.Threads = models.DefaultArgon2Params.Threads
+		}
+		hasher.Argon2.Time = 1
+		for {
+			elapsed := timeHash(hasher)
+			fmt.Printf("m=%d,t=%d,p=%d\t%s\n", hasher.Argon2.Memory, hasher.Argon2.Time, hasher.Argon2.Threads, elapsed)
+			if elapsed >= *target {
+				break
+			}
+			hasher.Argon2.Time++
+		}
+		fmt.Println()
+		fmt.Println("PASSWORD_HASH_ALGORITHM=argon2id")
+		fmt.Printf("ARGON2_TIME=%d\n", hasher.Argon2.Time)
+		fmt.Printf("ARGON2_MEMORY=%d\n", hasher.Argon2.Memory)
+		fmt.Printf("ARGON2_THREADS=%d\n", hasher.Argon2.Threads)
+	default:
+		fmt.Printf("invalid algorithm: %s\n", hasher.Algorithm)
+		os.Exit(2)
+	}
+}
+
+func timeHash(hasher *models.PasswordHasher) time.Duration {
+	start := time.Now()
+	_, err := hasher.Hash("correct horse battery staple")
+	if err != nil {
+		fmt.Printf("error hashing: %v\n", err)
+		os.Exit(1)
+	}
+	return time.Since(start)
+}
+
+func uint32Flag(p *uint32) func(string) error {
+	return func(s string) error {
+		v, err := strconv.ParseUint(s, 10, 32)
+		*p = uint32(v)
+		return err
+	}
+}
+
 func usage() {
 	fmt.Println("usage:")
-	fmt.Println("  bcrypt hash <password>")
-	fmt.Println("  bcrypt compare <password> <hash>")
+	fmt.Println("  bcrypt hash [-algo bcrypt|argon2id] [-cost n] [-time n -memory kib -threads n] <password>")
+	fmt.Println("  bcrypt verify <password> <hash>")
+	fmt.Println("  bcrypt tune [-algo bcrypt|argon2id] [-target 250ms] [-memory kib -threads n]")
 }
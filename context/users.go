@@ -11,7 +11,10 @@ import (
 type key string
 
 const (
-	userKey key = "user"
+	userKey          key = "user"
+	impersonationKey key = "impersonation"
+	membershipsKey   key = "memberships"
+	workspaceKey     key = "workspace"
 )
 
 // Returns a new context carrying the authenticated *models.User
@@ -43,3 +46,46 @@ func User(ctx context.Context) *models.User {
 	}
 	return user
 }
+
+// Returns a new context recording that the current user is being
+// impersonated by an admin (see UserMiddleware.SetUser).
+func WithImpersonation(ctx context.Context, impersonation *models.Impersonation) context.Context {
+	return context.WithValue(ctx, impersonationKey, impersonation)
+}
+
+// Fetch the ongoing impersonation from the request context, or nil if the
+// current user is who they are.
+func Impersonation(ctx context.Context) *models.Impersonation {
+	impersonation, ok := ctx.Value(impersonationKey).(*models.Impersonation)
+	if !ok {
+		return nil
+	}
+	return impersonation
+}
+
+// Returns a new context carrying the organizations of the current user.
+func WithMemberships(ctx context.Context, memberships []models.Membership) context.Context {
+	return context.WithValue(ctx, membershipsKey, memberships)
+}
+
+// Fetch the organizations of the current user from the request context.
+func Memberships(ctx context.Context) []models.Membership {
+	memberships, _ := ctx.Value(membershipsKey).([]models.Membership)
+	return memberships
+}
+
+// Returns a new context carrying the workspace the current user works in: one
+// of their organizations.
+func WithWorkspace(ctx context.Context, workspace *models.Membership) context.Context {
+	return context.WithValue(ctx, workspaceKey, workspace)
+}
+
+// Fetch the workspace from the request context, or nil if the current user
+// works on their personal galleries.
+func Workspace(ctx context.Context) *models.Membership {
+	workspace, ok := ctx.Value(workspaceKey).(*models.Membership)
+	if !ok {
+		return nil
+	}
+	return workspace
+}
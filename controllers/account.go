@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Data for the account settings template.
+type settingsData struct {
+	Email        string
+	PendingEmail string
+	HasPassword  bool   // Otherwise the forms don't ask for it
+	DeletionDate string // Set when the account is scheduled for deletion
+	Notices      []noticePreference
+	Notice       string
+	Profile      *models.Profile
+}
+
+// Render the account settings page.
+func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	u.renderSettings(w, r, user, "")
+}
+
+// Process form submission to change the password.
+//
+// The current password is required, if there's one: accounts without a
+// password (OIDC, sign in links...) can set one. Every other device is
+// signed out.
+func (u Users) ProcessChangePassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	currentPassword := r.FormValue("current_password")
+	newPassword := r.FormValue("new_password")
+
+	if user.PasswordHash != "" {
+		err := u.checkPassword(r, u.UserService, user.Email, currentPassword)
+		if err != nil {
+			u.renderSettings(w, r, user, "", err)
+			return
+		}
+	}
+	err := u.UserService.WithActor(actor(r)).UpdatePassword(user.ID, newPassword)
+	if err != nil {
+		u.renderSettings(w, r, user, "", u.passwordPolicyError(err))
+		return
+	}
+	u.passwordChanged(r, user)
+	session, err := u.SessionService.WithActor(actor(r)).Upsert(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	setCookie(w, CookieName, session.Token)
+	u.renderSettings(w, r, user, "Your password has been changed. Other devices have been signed out.")
+}
+
+// Process form submission to change the email address.
+//
+// The address isn't changed right away: a confirmation link is sent to the
+// new address, and the change is applied by ConfirmEmailChange.
+func (u Users) ProcessChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	newEmail := r.FormValue("new_email")
+	password := r.FormValue("password")
+
+	// Without a password, RequireRecentAuth is all the confirmation we get.
+	if user.PasswordHash != "" {
+		err := u.checkPassword(r, u.authenticator(), user.Email, password)
+		if err != nil {
+			u.renderSettings(w, r, user, "", err)
+			return
+		}
+	}
+	emailChange, err := u.EmailChangeService.Create(user.ID, newEmail)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrEmailTaken):
+			err = apperrors.Public(err, "That email is already taken")
+		case errors.Is(err, models.ErrInvalidEmail):
+			err = apperrors.Public(err, "Enter a valid email address")
+		}
+		u.renderSettings(w, r, user, "", err)
+		return
+	}
+	vals := url.Values{
+		"token": {emailChange.Token},
+	}
+	confirmUrl := u.PublicURL + "/users/email/confirm?" + vals.Encode()
+	err = u.EmailService.ConfirmEmailChange(emailChange.NewEmail, confirmUrl)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSettings(w, r, user, fmt.Sprintf(
+		"We have sent a confirmation link to %s. Your email will change once you follow it.",
+		emailChange.NewEmail,
+	))
+}
+
+// Process the confirmation link sent to the new email address.
+func (u Users) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	emailChange, err := u.EmailChangeService.Consume(token)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+	user, err := u.UserService.ByID(emailChange.UserID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.UserService.WithActor(actor(r)).UpdateEmail(emailChange.UserID, emailChange.NewEmail)
+	if err != nil {
+		if errors.Is(err, models.ErrEmailTaken) {
+			http.Error(w, "That email is already taken", http.StatusConflict)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// Warn the previous address: that's where the owner is, if the account
+	// was taken over.
+	u.notify(r, user.ID, user.Email, models.NoticeEmailChanged,
+		"The new address is "+emailChange.NewEmail+".")
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func (u Users) renderSettings(
+	w http.ResponseWriter,
+	r *http.Request,
+	user *models.User,
+	notice string,
+	errs ...error,
+) {
+	data := settingsData{
+		Email:       user.Email,
+		HasPassword: user.PasswordHash != "",
+		Notice:      notice,
+	}
+	pending, err := u.EmailChangeService.Pending(user.ID)
+	if err == nil {
+		data.PendingEmail = pending.NewEmail
+	} else if !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err) // rudimentary logging
+	}
+	deletion, err := u.AccountDeletionService.Pending(user.ID)
+	if err == nil {
+		data.DeletionDate = deletion.ScheduledFor.Format("January 2, 2006")
+	} else if !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err) // rudimentary logging
+	}
+	data.Profile, err = u.ProfileService.ByUserId(user.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		data.Profile = &models.Profile{UserID: user.ID}
+	}
+	prefs, err := u.NotificationService.Preferences(user.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	for _, kind := range models.NoticeKinds {
+		data.Notices = append(data.Notices, noticePreference{
+			Kind:    kind,
+			Label:   models.NoticeLabel(kind),
+			Enabled: prefs == nil || prefs[kind],
+		})
+	}
+	u.Templates.Settings.Execute(w, r, data, errs...)
+}
+
+// Download a ZIP file with all the user's data.
+func (u Users) ExportData(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="lenslocked-export.zip"`)
+	err := u.ExportService.Write(w, user)
+	if err != nil {
+		// Headers (and maybe part of the file) are already sent, so all we
+		// can do is log it; the download will be broken.
+		fmt.Println(err)
+	}
+}
+
+// Process form submission to delete the account. The password is required.
+// The account is only deleted after a grace period, and the user gets an
+// email with a link to cancel it.
+func (u Users) ProcessDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	password := r.FormValue("password")
+
+	// Without a password, RequireRecentAuth is all the confirmation we get.
+	if user.PasswordHash != "" {
+		err := u.checkPassword(r, u.authenticator(), user.Email, password)
+		if err != nil {
+			u.renderSettings(w, r, user, "", err)
+			return
+		}
+	}
+	// Organizations can't be left without an owner.
+	soleOwnerships, err := u.OrganizationService.SoleOwnerships(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if len(soleOwnerships) > 0 {
+		err = apperrors.Public(models.ErrLastOwner, fmt.Sprintf(
+			"You are the only owner of %s: make someone else owner, or delete it, first.",
+			soleOwnerships[0].Name,
+		))
+		u.renderSettings(w, r, user, "", err)
+		return
+	}
+	deletion, err := u.AccountDeletionService.Schedule(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"token": {deletion.Token},
+	}
+	cancelUrl := u.PublicURL + "/users/delete/cancel?" + vals.Encode()
+	err = u.EmailService.AccountDeletionScheduled(user.Email, cancelUrl, deletion.ScheduledFor)
+	if err != nil {
+		fmt.Println(err) // The deletion can still be canceled from the settings.
+	}
+	u.renderSettings(w, r, user, "Your account has been scheduled for deletion.")
+}
+
+// Cancel the deletion from the account settings.
+func (u Users) ProcessCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.AccountDeletionService.CancelForUser(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	u.renderSettings(w, r, user, "The deletion of your account has been canceled.")
+}
+
+// Cancel the deletion through the link sent by email (no need to sign in).
+func (u Users) CancelDeletion(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	_, err := u.AccountDeletionService.Cancel(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link is invalid or the deletion was already canceled", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "The deletion of your account has been canceled.")
+}
@@ -0,0 +1,329 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// When the server started, for the dashboard.
+var startedAt = time.Now()
+
+const adminUserEventsLimit = 20
+
+// The admin area: dashboard, users, galleries, audit log, invitations...
+// Every route is behind UserMiddleware.RequireAdmin.
+type Admin struct {
+	Templates struct {
+		Dashboard      Template
+		Users          Template
+		User           Template
+		Galleries      Template
+		Audit          Template
+		Invitations    Template
+		Impersonations Template
+	}
+	UserService          *models.UserService
+	SessionService       *models.SessionService
+	PasswordResetService *models.PasswordResetService
+	MagicLinkService     *models.MagicLinkService
+	GalleryService       *models.GalleryService
+	StatsService         *models.StatsService
+	AuditService         *models.AuditService
+	InvitationService    *models.InvitationService
+	ImpersonationService *models.ImpersonationService
+	EmailService         *models.EmailService
+	// Used to build the links sent by email, e.g. "https://lenslocked.com"
+	PublicURL string
+}
+
+// Render the dashboard: what's in the DB, and how the server is doing.
+func (a Admin) Dashboard(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Stats      *models.SystemStats
+		Uptime     string
+		Goroutines int
+		MemoryMB   uint64
+		GoVersion  string
+		DBOpen     int
+		DBInUse    int
+	}
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	data.Uptime = time.Since(startedAt).Round(time.Second).String()
+	data.Goroutines = runtime.NumGoroutine()
+	data.MemoryMB = memStats.Alloc / 1024 / 1024
+	data.GoVersion = runtime.Version()
+	dbStats := a.StatsService.DB.Stats()
+	data.DBOpen = dbStats.OpenConnections
+	data.DBInUse = dbStats.InUse
+	stats, err := a.StatsService.Stats()
+	if err != nil {
+		a.Templates.Dashboard.Execute(w, r, data, err)
+		return
+	}
+	data.Stats = stats
+	a.Templates.Dashboard.Execute(w, r, data)
+}
+
+// Links to the previous and next pages of a list.
+type pagination struct {
+	PrevURL string
+	NextURL string
+}
+
+// Reads the page number from the query string. Returns the offset of the
+// page, and a function to build the links once the number of rows is known.
+func paginate(r *http.Request, limit int) (int, func(rows int) pagination) {
+	page, err := strconv.Atoi(r.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	pageURL := func(page int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page))
+		return r.URL.Path + "?" + query.Encode()
+	}
+	return (page - 1) * limit, func(rows int) pagination {
+		var p pagination
+		if page > 1 {
+			p.PrevURL = pageURL(page - 1)
+		}
+		if rows == limit {
+			p.NextURL = pageURL(page + 1)
+		}
+		return p
+	}
+}
+
+type adminUserRow struct {
+	ID        uint
+	Email     string
+	Role      string
+	CreatedAt string
+	Galleries int
+	SignedIn  bool
+	Disabled  bool
+	Locked    bool
+}
+
+func newAdminUserRow(summary models.UserSummary) adminUserRow {
+	return adminUserRow{
+		ID:        summary.ID,
+		Email:     summary.Email,
+		Role:      summary.Role,
+		CreatedAt: summary.CreatedAt.UTC().Format("2006-01-02"),
+		Galleries: summary.Galleries,
+		SignedIn:  summary.SignedIn,
+		Disabled:  summary.Disabled(),
+		Locked:    summary.Locked(),
+	}
+}
+
+// List and search the users.
+func (a Admin) Users(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Query  string
+		Role   string
+		Status string
+		Users  []adminUserRow
+		Pages  pagination
+	}
+	data.Query = r.FormValue("q")
+	data.Role = r.FormValue("role")
+	data.Status = r.FormValue("status")
+	offset, pages := paginate(r, models.DefaultUserSearchLimit)
+	users, err := a.UserService.Search(models.UserSearch{
+		Query:  data.Query,
+		Role:   data.Role,
+		Status: data.Status,
+		Offset: offset,
+	})
+	if err != nil {
+		a.Templates.Users.Execute(w, r, data, err)
+		return
+	}
+	for _, user := range users {
+		data.Users = append(data.Users, newAdminUserRow(user))
+	}
+	data.Pages = pages(len(users))
+	a.Templates.Users.Execute(w, r, data)
+}
+
+// Render a user: their account, galleries and recent activity, with the
+// actions admins can take.
+func (a Admin) User(w http.ResponseWriter, r *http.Request) {
+	a.renderUser(w, r)
+}
+
+func (a Admin) renderUser(w http.ResponseWriter, r *http.Request, errs ...error) {
+	userId, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	var data struct {
+		User        adminUserRow
+		LockedUntil string
+		DisabledAt  string
+		Self        bool // Admins can't disable (or impersonate) their own account
+		Galleries   []models.Gallery
+		Events      []auditEventRow
+	}
+	summary, err := a.UserService.Summary(uint(userId))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.User = newAdminUserRow(*summary)
+	if summary.Locked() {
+		data.LockedUntil = summary.LockedUntil.UTC().Format("2006-01-02 15:04 MST")
+	}
+	if summary.Disabled() {
+		data.DisabledAt = summary.DisabledAt.UTC().Format("2006-01-02 15:04 MST")
+	}
+	data.Self = summary.ID == context.User(r.Context()).ID
+	data.Galleries, err = a.GalleryService.GalleriesByUserId(summary.ID)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	events, err := a.AuditService.ByUserId(summary.ID, adminUserEventsLimit)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, event := range events {
+		data.Events = append(data.Events, newAuditEventRow(event))
+	}
+	a.Templates.User.Execute(w, r, data, errs...)
+}
+
+// Disable an account, and sign it out everywhere.
+func (a Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	a.userAction(w, r, func(user *models.User) error {
+		if user.ID == context.User(r.Context()).ID {
+			return apperrors.Public(errors.New("admin disabling themselves"), "You can't disable your own account")
+		}
+		err := a.UserService.WithActor(actor(r)).Disable(user.ID)
+		if err != nil {
+			return err
+		}
+		return a.signOutEverywhere(r, user.ID)
+	})
+}
+
+// Re-enable a disabled account.
+func (a Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	a.userAction(w, r, func(user *models.User) error {
+		return a.UserService.WithActor(actor(r)).Enable(user.ID)
+	})
+}
+
+// Remove the password of an account, sign it out everywhere, and email it a
+// link to choose a new password.
+func (a Admin) ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	a.userAction(w, r, func(user *models.User) error {
+		if user.ID == context.User(r.Context()).ID {
+			return apperrors.Public(errors.New("admin resetting their own password"), "Change your own password from your account settings")
+		}
+		err := a.UserService.WithActor(actor(r)).RequirePasswordReset(user.ID)
+		if err != nil {
+			return err
+		}
+		err = a.signOutEverywhere(r, user.ID)
+		if err != nil {
+			return err
+		}
+		pwdReset, err := a.PasswordResetService.WithActor(actor(r)).Create(user.Email)
+		if err != nil {
+			return err
+		}
+		vals := url.Values{
+			"token": {pwdReset.Token},
+		}
+		resetURL := a.PublicURL + "/reset-pwd?" + vals.Encode()
+		sendInBackground(func() error {
+			return a.EmailService.ForgotPassword(user.Email, resetURL)
+		})
+		return nil
+	})
+}
+
+// Sign an account out everywhere.
+func (a Admin) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	a.userAction(w, r, func(user *models.User) error {
+		return a.signOutEverywhere(r, user.ID)
+	})
+}
+
+// Runs an action on the user of the URL, then goes back to their page (or
+// shows it with the error).
+func (a Admin) userAction(w http.ResponseWriter, r *http.Request, action func(*models.User) error) {
+	userId, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	user, err := a.UserService.ByID(uint(userId))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = action(user)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		a.renderUser(w, r, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusFound)
+}
+
+// Ends the sessions of the user, and cancels the sign in links they didn't
+// use yet.
+func (a Admin) signOutEverywhere(r *http.Request, userId uint) error {
+	err := a.SessionService.WithActor(actor(r)).DeleteForUser(userId)
+	if err != nil {
+		return err
+	}
+	return a.MagicLinkService.DeleteForUser(userId)
+}
+
+// List and search the galleries.
+func (a Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Query     string
+		Galleries []models.GallerySummary
+		Pages     pagination
+	}
+	data.Query = r.FormValue("q")
+	offset, pages := paginate(r, models.DefaultGallerySearchLimit)
+	galleries, err := a.GalleryService.Search(models.GallerySearch{
+		Query:  data.Query,
+		Offset: offset,
+	})
+	if err != nil {
+		a.Templates.Galleries.Execute(w, r, data, err)
+		return
+	}
+	data.Galleries = galleries
+	data.Pages = pages(len(galleries))
+	a.Templates.Galleries.Execute(w, r, data)
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// An annotation on the page of an image, drawn over it.
+type annotationView struct {
+	Number int // shown on the image and in the list
+	ID     int
+	Author string
+	Body   string
+	Status string
+	Point  bool
+	// Position and size on the image, in percents.
+	Left   string
+	Top    string
+	Width  string
+	Height string
+	// Where the forms post, "" for those who can't use them.
+	StatusPath string
+	DeletePath string
+}
+
+// The annotations on the image that the user may see (see
+// models.Annotation), for the page of the image.
+func (g Galleries) annotationViews(gallery *models.Gallery, filename string, userId uint, canEdit bool) ([]annotationView, error) {
+	annotations, err := g.AnnotationService.ForImage(gallery.ID, filename, userId, canEdit)
+	if err != nil {
+		return nil, err
+	}
+	percent := func(v float64) string {
+		return strconv.FormatFloat(v*100, 'f', 3, 64)
+	}
+	var views []annotationView
+	for i, annotation := range annotations {
+		view := annotationView{
+			Number: i + 1,
+			ID:     annotation.ID,
+			Author: annotation.Author,
+			Body:   annotation.Body,
+			Status: annotation.Status,
+			Point:  annotation.Region.IsPoint(),
+			Left:   percent(annotation.Region.X),
+			Top:    percent(annotation.Region.Y),
+			Width:  percent(annotation.Region.Width),
+			Height: percent(annotation.Region.Height),
+		}
+		if view.Author == "" {
+			view.Author = "Someone"
+		}
+		if canEdit {
+			view.StatusPath = fmt.Sprintf("/galleries/%d/annotations/%d/status", gallery.ID, annotation.ID)
+		}
+		if canEdit || (userId != 0 && annotation.UserID == userId) {
+			view.DeletePath = fmt.Sprintf("%s/annotations/%d/delete", imagePagePath(gallery, filename), annotation.ID)
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// Process the annotation form of the page of an image of the gallery at
+// /galleries/{id}.
+func (g Galleries) Annotate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, reachableById(g.GalleryService), userCanViewGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.annotate(w, r, gallery)
+}
+
+// Same as Annotate, for the gallery at /u/{handle}/{slug}.
+func (g Galleries) AnnotateBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r, userCanViewGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.annotate(w, r, gallery)
+}
+
+func (g Galleries) annotate(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	user := context.User(r.Context())
+	filename := chi.URLParam(r, "filename")
+	var region models.Region
+	var err error
+	for _, field := range []struct {
+		name string
+		v    *float64
+	}{
+		{"x", &region.X},
+		{"y", &region.Y},
+		{"width", &region.Width},
+		{"height", &region.Height},
+	} {
+		value := r.FormValue(field.name)
+		if value == "" && (field.name == "width" || field.name == "height") {
+			continue // a point
+		}
+		*field.v, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		_, err = g.AnnotationService.Create(gallery, filename, user.ID, region, r.FormValue("body"))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "image not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrInvalidAnnotation):
+			g.renderImagePage(w, r, gallery, "", apperrors.Public(err, "Say what to retouch, in at most 1000 characters"))
+		case errors.Is(err, models.ErrInvalidRegion), errors.Is(err, strconv.ErrSyntax), errors.Is(err, strconv.ErrRange):
+			g.renderImagePage(w, r, gallery, "", apperrors.Public(err, "Click on the image, or drag over it, to mark what to retouch"))
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, imagePagePath(gallery, filename)+"#annotations", http.StatusFound)
+}
+
+// Delete an annotation on the image of the gallery at /galleries/{id}.
+func (g Galleries) DeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, reachableById(g.GalleryService), userCanViewGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.deleteAnnotation(w, r, gallery)
+}
+
+// Same as DeleteAnnotation, for the gallery at /u/{handle}/{slug}.
+func (g Galleries) DeleteAnnotationBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r, userCanViewGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.deleteAnnotation(w, r, gallery)
+}
+
+// Authors can delete their annotations, editors of the gallery any of them.
+func (g Galleries) deleteAnnotation(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	id, err := strconv.Atoi(chi.URLParam(r, "annotationId"))
+	if err != nil {
+		http.Error(w, "annotation not found", http.StatusNotFound)
+		return
+	}
+	userId := currentUserId(r)
+	canEdit := g.GalleryService.Authorize(userId, gallery, models.GalleryActionEdit) == nil
+	err = g.AnnotationService.Delete(gallery, id, userId, canEdit)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, imagePagePath(gallery, chi.URLParam(r, "filename"))+"#annotations", http.StatusFound)
+}
+
+// Move an annotation of the gallery to another status, then go back to the
+// page of its image (the "filename" form value).
+func (g Galleries) SetAnnotationStatus(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "annotationId"))
+	if err != nil {
+		http.Error(w, "annotation not found", http.StatusNotFound)
+		return
+	}
+	err = g.AnnotationService.SetStatus(gallery, id, r.FormValue("status"))
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, imagePagePath(gallery, r.FormValue("filename"))+"#annotations", http.StatusFound)
+}
+
+// Download the annotations of the gallery that aren't done as a Markdown task
+// list.
+func (g Galleries) ExportAnnotations(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	annotations, err := g.AnnotationService.Open(gallery.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("gallery-%d-retouch-requests.md", gallery.ID)
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	err = models.WriteTaskList(w, gallery.Title, annotations)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+}
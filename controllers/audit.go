@@ -0,0 +1,306 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// How audit events are shown to users.
+var auditDescriptions = map[string]string{
+	models.AuditUserCreated:                   "Account created",
+	models.AuditSignInFailed:                  "Failed sign in",
+	models.AuditAccountLocked:                 "Account locked",
+	models.AuditPasswordChanged:               "Password changed",
+	models.AuditEmailChanged:                  "Email address changed",
+	models.AuditSessionCreated:                "Signed in",
+	models.AuditSessionDeleted:                "Signed out",
+	models.AuditSessionsRevoked:               "Signed out everywhere",
+	models.AuditSessionReauthenticated:        "Password confirmed",
+	models.AuditPasswordResetRequested:        "Password reset requested",
+	models.AuditPasswordResetCompleted:        "Password reset",
+	models.AuditGalleryCreated:                "Gallery created",
+	models.AuditGalleryUpdated:                "Gallery updated",
+	models.AuditGalleryDeleted:                "Gallery deleted",
+	models.AuditGalleryPublished:              "Scheduled gallery went live",
+	models.AuditGalleryExpired:                "Gallery expired",
+	models.AuditCollectionCreated:             "Collection created",
+	models.AuditCollectionUpdated:             "Collection updated",
+	models.AuditCollectionDeleted:             "Collection deleted",
+	models.AuditShareLinkCreated:              "Share link created",
+	models.AuditShareLinkRevoked:              "Share link revoked",
+	models.AuditSelectionSubmitted:            "Selection submitted",
+	models.AuditCommentModerated:              "Comment approved or hidden",
+	models.AuditCommentDeleted:                "Comment deleted",
+	models.AuditImageDeleted:                  "Image deleted",
+	models.AuditImageUploaded:                 "Image uploaded",
+	models.AuditInvitationCreated:             "Invitation created",
+	models.AuditInvitationRevoked:             "Invitation revoked",
+	models.AuditUserDisabled:                  "Account disabled",
+	models.AuditUserEnabled:                   "Account re-enabled",
+	models.AuditPasswordResetForced:           "Password reset required by an admin",
+	models.AuditRoleChanged:                   "Role changed",
+	models.AuditImpersonationStarted:          "Support started viewing the account",
+	models.AuditImpersonationEnded:            "Support stopped viewing the account",
+	models.AuditOrganizationCreated:           "Organization created",
+	models.AuditOrganizationDeleted:           "Organization deleted",
+	models.AuditOrganizationMemberInvited:     "Invited to an organization",
+	models.AuditOrganizationMemberAdded:       "Added to an organization",
+	models.AuditOrganizationMemberRemoved:     "Removed from an organization",
+	models.AuditOrganizationMemberRoleChanged: "Organization role changed",
+	models.AuditSCIMTokenCreated:              "Provisioning token created for an organization",
+	models.AuditSCIMTokenRevoked:              "Provisioning token revoked for an organization",
+	models.AuditSCIMUserProvisioned:           "Account provisioned by an organization",
+	models.AuditProfileUpdated:                "Profile updated",
+	models.AuditAvatarUpdated:                 "Profile picture changed",
+}
+
+const securityHistoryLimit = 100
+
+// Rows of the audit event tables.
+type auditEventRow struct {
+	Time        string
+	Action      string
+	Description string
+	UserID      uint
+	ActorID     uint
+	IP          string
+	UserAgent   string
+	Details     string
+}
+
+func newAuditEventRow(event models.AuditEvent) auditEventRow {
+	row := auditEventRow{
+		Time:        event.CreatedAt.UTC().Format("2006-01-02 15:04:05 MST"),
+		Action:      event.Action,
+		Description: auditDescriptions[event.Action],
+		UserID:      event.UserID,
+		ActorID:     event.Actor.UserID,
+		IP:          event.Actor.IP,
+		UserAgent:   event.Actor.UserAgent,
+	}
+	if row.Description == "" {
+		row.Description = event.Action
+	}
+	if len(event.Details) > 0 {
+		details, err := json.Marshal(event.Details)
+		if err == nil {
+			row.Details = string(details)
+		}
+	}
+	return row
+}
+
+// Render the security history of the current user.
+func (u Users) SecurityHistory(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var data struct {
+		Events []auditEventRow
+	}
+	events, err := u.AuditService.ByUserId(user.ID, securityHistoryLimit)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, event := range events {
+		data.Events = append(data.Events, newAuditEventRow(event))
+	}
+	u.Templates.SecurityHistory.Execute(w, r, data)
+}
+
+// Data for the admin audit log template.
+type auditData struct {
+	Filter    auditFilterForm
+	Events    []auditEventRow
+	ExportURL string // Same filters, without the format
+}
+
+// The filter form, as typed.
+type auditFilterForm struct {
+	UserID string
+	Email  string
+	Action string
+	IP     string
+	From   string // YYYY-MM-DD
+	To     string // YYYY-MM-DD, included
+}
+
+// Render the audit log, filtered by the query string.
+func (a Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	data := auditData{
+		Filter: readAuditFilterForm(r),
+	}
+	filter, err := data.Filter.parse()
+	if err != nil {
+		a.Templates.Audit.Execute(w, r, data, err)
+		return
+	}
+	events, err := a.AuditService.Search(filter)
+	if err != nil {
+		a.Templates.Audit.Execute(w, r, data, err)
+		return
+	}
+	for _, event := range events {
+		data.Events = append(data.Events, newAuditEventRow(event))
+	}
+	data.ExportURL = "/admin/audit/export?" + r.URL.Query().Encode()
+	a.Templates.Audit.Execute(w, r, data)
+}
+
+// Download the (filtered) audit log, as CSV or JSON (`format` query param).
+func (a Admin) ExportAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := readAuditFilterForm(r).parse()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.Limit = -1
+	events, err := a.AuditService.Search(filter)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405")
+	switch r.FormValue("format") {
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		err = writeAuditJSON(w, events)
+	case "csv", "":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		err = writeAuditCSV(w, events)
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Println(err) // The response has started, nothing else we can do.
+	}
+}
+
+func readAuditFilterForm(r *http.Request) auditFilterForm {
+	return auditFilterForm{
+		UserID: r.FormValue("user_id"),
+		Email:  r.FormValue("email"),
+		Action: r.FormValue("action"),
+		IP:     r.FormValue("ip"),
+		From:   r.FormValue("from"),
+		To:     r.FormValue("to"),
+	}
+}
+
+func (form auditFilterForm) parse() (models.AuditFilter, error) {
+	filter := models.AuditFilter{
+		Email:  form.Email,
+		Action: form.Action,
+		IP:     form.IP,
+	}
+	if form.UserID != "" {
+		userId, err := strconv.ParseUint(form.UserID, 10, 32)
+		if err != nil {
+			return filter, apperrors.Public(err, "The user ID must be a number")
+		}
+		filter.UserID = uint(userId)
+	}
+	if form.From != "" {
+		from, err := time.Parse(time.DateOnly, form.From)
+		if err != nil {
+			return filter, apperrors.Public(err, "Dates must look like 2006-01-02")
+		}
+		filter.From = from
+	}
+	if form.To != "" {
+		to, err := time.Parse(time.DateOnly, form.To)
+		if err != nil {
+			return filter, apperrors.Public(err, "Dates must look like 2006-01-02")
+		}
+		filter.To = to.AddDate(0, 0, 1)
+	}
+	return filter, nil
+}
+
+// What the JSON export looks like.
+type auditEventJSON struct {
+	ID        int64          `json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	ActorID   uint           `json:"actor_id,omitempty"`
+	UserID    uint           `json:"user_id,omitempty"`
+	Action    string         `json:"action"`
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	Details   map[string]any `json:"details"`
+}
+
+func writeAuditJSON(w http.ResponseWriter, events []models.AuditEvent) error {
+	rows := make([]auditEventJSON, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, auditEventJSON{
+			ID:        event.ID,
+			CreatedAt: event.CreatedAt,
+			ActorID:   event.Actor.UserID,
+			UserID:    event.UserID,
+			Action:    event.Action,
+			IP:        event.Actor.IP,
+			UserAgent: event.Actor.UserAgent,
+			Details:   event.Details,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rows)
+}
+
+func writeAuditCSV(w http.ResponseWriter, events []models.AuditEvent) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"id", "created_at", "actor_id", "user_id", "action", "ip", "user_agent", "details"})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		details, err := json.Marshal(event.Details)
+		if err != nil {
+			return err
+		}
+		err = cw.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			optionalId(event.Actor.UserID),
+			optionalId(event.UserID),
+			event.Action,
+			csvSafe(event.Actor.IP),
+			csvSafe(event.Actor.UserAgent),
+			csvSafe(string(details)),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func optionalId(id uint) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// User agents and emails are chosen by whoever sends the request: don't let
+// spreadsheets run them as formulas.
+func csvSafe(value string) string {
+	if value != "" && (value[0] == '=' || value[0] == '+' || value[0] == '-' || value[0] == '@') {
+		return "'" + value
+	}
+	return value
+}
@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+type Collections struct {
+	Templates struct {
+		Show Template
+	}
+	CollectionService *models.CollectionService
+}
+
+// Data for the collection template. The top of the workspace is shown like
+// a collection without ID.
+type collectionData struct {
+	ID           int
+	Title        string
+	Visibility   string
+	ParentID     int
+	Visibilities []string
+	CanEdit      bool
+	CanDelete    bool
+	Breadcrumbs  []models.Collection
+	Children     []collectionChild
+	Collections  []collectionOption // of the workspace, to move this one
+}
+
+// A collection in a select, indented by depth.
+type collectionOption struct {
+	ID    int
+	Label string
+}
+
+type collectionChild struct {
+	Title       string
+	Path        string
+	IsGallery   bool
+	Visibility  string
+	CoverPath   string // "" without cover
+	CoverAltTxt string
+}
+
+// Render the collections and galleries at the top of the workspace.
+func (c Collections) Index(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var organizationId uint
+	data := collectionData{
+		Title:     "Collections",
+		CanEdit:   true,
+		CanDelete: false,
+	}
+	if workspace := context.Workspace(r.Context()); workspace != nil {
+		organizationId = workspace.ID
+		data.Title = workspace.Name
+	}
+	children, err := c.CollectionService.Children(0, user.ID, organizationId, true)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Children = collectionChildren(children)
+	c.Templates.Show.Execute(w, r, data)
+}
+
+// Render a collection: its breadcrumbs, and what's in it.
+func (c Collections) Show(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionById(w, r, models.GalleryActionView)
+	if err != nil {
+		return
+	}
+	c.renderShow(w, r, collection)
+}
+
+func (c Collections) renderShow(w http.ResponseWriter, r *http.Request, collection *models.Collection, errs ...error) {
+	userId := currentUserId(r)
+	data := collectionData{
+		ID:           collection.ID,
+		Title:        collection.Title,
+		Visibility:   collection.Visibility,
+		ParentID:     collection.ParentID,
+		Visibilities: models.GalleryVisibilities,
+		CanEdit:      c.CollectionService.Authorize(userId, collection, models.GalleryActionEdit) == nil,
+		CanDelete:    c.CollectionService.Authorize(userId, collection, models.GalleryActionDelete) == nil,
+	}
+	path, err := c.CollectionService.Path(collection.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	// The collection itself is the title, not a breadcrumb.
+	data.Breadcrumbs = visibleBreadcrumbs(path[:len(path)-1], data.CanEdit)
+	children, err := c.CollectionService.Children(collection.ID, 0, 0, data.CanEdit)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Children = collectionChildren(children)
+	if data.CanEdit {
+		collections, err := c.CollectionService.Workspace(collection.UserID, collection.OrganizationID)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		data.Collections = collectionOptions(collections)
+	}
+	c.Templates.Show.Execute(w, r, data, errs...)
+}
+
+// Process form submission to create a collection, in the collection
+// parent_id (or at the top) of the current workspace.
+func (c Collections) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	var organizationId uint
+	if workspace := context.Workspace(r.Context()); workspace != nil {
+		organizationId = workspace.ID
+	}
+	parentId, _ := strconv.Atoi(r.FormValue("parent_id"))
+	collection, err := c.CollectionService.WithActor(actor(r)).Create(r.FormValue("title"), user.ID, organizationId, parentId)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrCollectionTitleRequired):
+			http.Error(w, "A collection needs a title", http.StatusBadRequest)
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "collection not found", http.StatusNotFound)
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", collection.ID), http.StatusFound)
+}
+
+// Process form submission to rename, move, or change the visibility of a
+// collection.
+func (c Collections) Update(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionById(w, r, models.GalleryActionEdit)
+	if err != nil {
+		return
+	}
+	collection.Title = r.FormValue("title")
+	collection.Visibility = r.FormValue("visibility")
+	collection.ParentID, _ = strconv.Atoi(r.FormValue("parent_id"))
+	err = c.CollectionService.WithActor(actor(r)).Update(collection)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrCollectionTitleRequired):
+			err = apperrors.Public(err, "A collection needs a title")
+		case errors.Is(err, models.ErrCollectionCycle):
+			err = apperrors.Public(err, "A collection can't be moved into itself, or into a collection it contains")
+		case errors.Is(err, models.ErrNotFound):
+			err = apperrors.Public(err, "That collection doesn't exist anymore")
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		c.renderShow(w, r, collection, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/collections/%d", collection.ID), http.StatusFound)
+}
+
+// Process form submission to delete a collection. What was in it moves to
+// its parent.
+func (c Collections) Delete(w http.ResponseWriter, r *http.Request) {
+	collection, err := c.collectionById(w, r, models.GalleryActionDelete)
+	if err != nil {
+		return
+	}
+	err = c.CollectionService.WithActor(actor(r)).Delete(collection)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	if collection.ParentID != 0 {
+		http.Redirect(w, r, fmt.Sprintf("/collections/%d", collection.ParentID), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/collections", http.StatusFound)
+}
+
+// Loads the collection referenced by the route param `id`, if the user may
+// perform the action on it. Otherwise, it handles the HTTP error response
+// and returns the error. Private collections are reported as missing to
+// those who can't see them.
+func (c Collections) collectionById(w http.ResponseWriter, r *http.Request, action models.GalleryAction) (*models.Collection, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusNotFound)
+		return nil, err
+	}
+	collection, err := c.CollectionService.ByID(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "collection not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	err = c.CollectionService.Authorize(currentUserId(r), collection, action)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrForbidden) && action == models.GalleryActionView:
+			http.Error(w, "collection not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrForbidden):
+			http.Error(w, "you can't change this collection", http.StatusForbidden)
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+	return collection, nil
+}
+
+func collectionChildren(children []models.CollectionChild) []collectionChild {
+	var data []collectionChild
+	for _, child := range children {
+		var item collectionChild
+		if child.Collection != nil {
+			item.Title = child.Collection.Title
+			item.Path = fmt.Sprintf("/collections/%d", child.Collection.ID)
+			item.Visibility = child.Collection.EffectiveVisibility
+		} else {
+			item.Title = child.Gallery.Title
+			item.Path = galleryPath(child.Gallery)
+			item.IsGallery = true
+			item.Visibility = child.Gallery.EffectiveVisibility
+		}
+		if child.CoverGallery != nil {
+			item.CoverPath = galleryPath(child.CoverGallery) + "/images/" + url.PathEscape(child.Cover.Filename)
+			item.CoverAltTxt = child.Cover.Caption
+		}
+		data = append(data, item)
+	}
+	return data
+}
+
+func collectionOptions(collections []models.Collection) []collectionOption {
+	var options []collectionOption
+	for _, collection := range collections {
+		options = append(options, collectionOption{
+			ID:    collection.ID,
+			Label: strings.Repeat("— ", collection.Depth) + collection.Title,
+		})
+	}
+	return options
+}
+
+// The breadcrumbs the user may follow: those who can't edit the collections
+// only get the ones below the last private collection.
+func visibleBreadcrumbs(path []models.Collection, canEdit bool) []models.Collection {
+	if canEdit {
+		return path
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].EffectiveVisibility == models.GalleryVisibilityPrivate {
+			return path[i+1:]
+		}
+	}
+	return path
+}
+
+// The ID of the signed in user, 0 for nobody.
+func currentUserId(r *http.Request) uint {
+	if user := context.User(r.Context()); user != nil {
+		return user.ID
+	}
+	return 0
+}
@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Data for the page of an image, with its comments.
+type imagePageData struct {
+	GalleryTitle string
+	GalleryPath  string
+	Filename     string
+	Src          string
+	Caption      string
+	Tags         []string
+	Comments     string // setting of the gallery
+	CanComment   bool
+	SignedIn     bool
+	Body         string // of the new comment, as typed
+	CommentPath  string // where comments are posted
+	Previous     string // page of the previous image, "" for the first one
+	Next         string
+	Threads      []*commentView
+	// Retouch requests, drawn over the image
+	Annotations        []annotationView
+	AnnotatePath       string // where annotations are posted, "" when signed out
+	AnnotationStatuses []string
+}
+
+// A comment, with what the viewer can do with it.
+type commentView struct {
+	ID          int
+	Author      string
+	Body        string
+	Pending     bool
+	Hidden      bool
+	CreatedAt   string
+	Filename    string
+	CommentPath string // to reply
+	CanReply    bool
+	// Where the moderation forms post, "" for those who can't moderate.
+	ModeratePath string
+	Replies      []*commentView
+}
+
+// A comment waiting for approval, on the edit page of the gallery.
+type pendingComment struct {
+	ID        int
+	Author    string
+	Body      string
+	Filename  string
+	ImagePath string // page of the image
+}
+
+// Render the page of an image of the gallery at /galleries/{id}, with its
+// comments and annotations.
+func (g Galleries) ImagePage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, reachableById(g.GalleryService), g.userCanViewGalleryPage())
+	if err != nil {
+		return
+	}
+	g.renderImagePage(w, r, gallery, "")
+}
+
+// Same as ImagePage, for the gallery at /u/{handle}/{slug}.
+func (g Galleries) ImagePageBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r, g.userCanViewGalleryPage())
+	if err != nil {
+		return
+	}
+	g.renderImagePage(w, r, gallery, "")
+}
+
+func (g Galleries) renderImagePage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, body string, errs ...error) {
+	// All of them, for the captions and the links to the previous and next.
+	images, err := g.GalleryService.Images(gallery.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	i := slices.IndexFunc(images, func(image models.Image) bool {
+		return image.Filename == chi.URLParam(r, "filename")
+	})
+	if i < 0 {
+		http.Error(w, "image not found", http.StatusNotFound)
+		return
+	}
+	image := images[i]
+	imagePath := galleryPath(gallery) + "/images/" + url.PathEscape(image.Filename)
+	userId := currentUserId(r)
+	canModerate := g.GalleryService.Authorize(userId, gallery, models.GalleryActionEdit) == nil
+	data := imagePageData{
+		GalleryTitle: gallery.Title,
+		GalleryPath:  galleryPath(gallery),
+		Filename:     image.Filename,
+		Src:          imagePath,
+		Caption:      image.Caption,
+		Tags:         image.Tags,
+		Comments:     gallery.Comments,
+		SignedIn:     userId != 0,
+		CanComment:   userId != 0 && gallery.Comments != models.GalleryCommentsDisabled,
+		Body:         body,
+		CommentPath:  imagePath + "/comments",
+	}
+	if i > 0 {
+		data.Previous = imagePagePath(gallery, images[i-1].Filename)
+	}
+	if i < len(images)-1 {
+		data.Next = imagePagePath(gallery, images[i+1].Filename)
+	}
+	if userId != 0 {
+		data.AnnotatePath = imagePath + "/annotations"
+		data.AnnotationStatuses = models.AnnotationStatuses
+		data.Annotations, err = g.annotationViews(gallery, image.Filename, userId, canModerate)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	threads, err := g.CommentService.Threads(gallery.ID, image.Filename, userId, canModerate)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var view func(comment *models.Comment) *commentView
+	view = func(comment *models.Comment) *commentView {
+		v := &commentView{
+			ID:          comment.ID,
+			Author:      comment.Author,
+			Body:        comment.Body,
+			Pending:     comment.Status == models.CommentPending,
+			Hidden:      comment.Status == models.CommentHidden,
+			CreatedAt:   formatScheduleTime(comment.CreatedAt),
+			Filename:    comment.Filename,
+			CommentPath: data.CommentPath,
+			CanReply:    data.CanComment && comment.Status == models.CommentVisible,
+		}
+		if v.Author == "" {
+			v.Author = "Someone"
+		}
+		if canModerate {
+			v.ModeratePath = fmt.Sprintf("/galleries/%d/comments/%d", gallery.ID, comment.ID)
+		}
+		for _, reply := range comment.Replies {
+			v.Replies = append(v.Replies, view(reply))
+		}
+		return v
+	}
+	for _, thread := range threads {
+		data.Threads = append(data.Threads, view(thread))
+	}
+	g.Templates.Image.Execute(w, r, data, errs...)
+}
+
+// Process the comment form of the page of an image of the gallery at
+// /galleries/{id}.
+func (g Galleries) Comment(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, reachableById(g.GalleryService), userCanViewGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.comment(w, r, gallery)
+}
+
+// Same as Comment, for the gallery at /u/{handle}/{slug}.
+func (g Galleries) CommentBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r, userCanViewGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.comment(w, r, gallery)
+}
+
+// Adds the comment, and tells the owner of the gallery about it unless they
+// wrote it.
+func (g Galleries) comment(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	user := context.User(r.Context())
+	filename := chi.URLParam(r, "filename")
+	body := r.FormValue("body")
+	parentId, _ := strconv.Atoi(r.FormValue("parent_id"))
+	comment, err := g.CommentService.Create(gallery, filename, user.ID, parentId, body)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "image or comment not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrCommentsDisabled):
+			http.Error(w, "comments are disabled in this gallery", http.StatusForbidden)
+		case errors.Is(err, models.ErrInvalidComment):
+			g.renderImagePage(w, r, gallery, body, apperrors.Public(err, "Comments can't be empty, nor longer than 2000 characters"))
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	notice := models.NewCommentNotice{
+		GalleryTitle: gallery.Title,
+		Filename:     filename,
+		Author:       user.Email,
+		Body:         comment.Body,
+		Pending:      comment.Status == models.CommentPending,
+		URL:          g.PublicURL + imagePagePath(gallery, filename),
+	}
+	sendInBackground(func() error {
+		to, err := g.GalleryService.OwnerEmail(gallery)
+		if err != nil || to == "" || to == user.Email {
+			return err
+		}
+		return g.EmailService.NewComment(to, notice)
+	})
+	http.Redirect(w, r, fmt.Sprintf("%s#comment-%d", imagePagePath(gallery, filename), comment.ID), http.StatusFound)
+}
+
+// Approve a pending comment of the gallery, or show a hidden one again.
+func (g Galleries) ShowComment(w http.ResponseWriter, r *http.Request) {
+	g.moderateComment(w, r, func(svc *models.CommentService, gallery *models.Gallery, id int) error {
+		return svc.SetStatus(gallery, id, models.CommentVisible)
+	})
+}
+
+// Hide a comment of the gallery (and its replies) from everybody but its
+// editors.
+func (g Galleries) HideComment(w http.ResponseWriter, r *http.Request) {
+	g.moderateComment(w, r, func(svc *models.CommentService, gallery *models.Gallery, id int) error {
+		return svc.SetStatus(gallery, id, models.CommentHidden)
+	})
+}
+
+// Delete a comment of the gallery, with its replies.
+func (g Galleries) DeleteComment(w http.ResponseWriter, r *http.Request) {
+	g.moderateComment(w, r, func(svc *models.CommentService, gallery *models.Gallery, id int) error {
+		return svc.Delete(gallery, id)
+	})
+}
+
+// Runs the moderation action on the comment at
+// /galleries/{id}/comments/{commentId}, for editors of the gallery, then
+// goes back to the page of the image (the "filename" form value), or to the
+// edit page of the gallery.
+func (g Galleries) moderateComment(
+	w http.ResponseWriter,
+	r *http.Request,
+	action func(*models.CommentService, *models.Gallery, int) error,
+) {
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	commentId, err := strconv.Atoi(chi.URLParam(r, "commentId"))
+	if err != nil {
+		http.Error(w, "comment not found", http.StatusNotFound)
+		return
+	}
+	err = action(g.CommentService.WithActor(actor(r)), gallery, commentId)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	back := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	if filename := r.FormValue("filename"); filename != "" {
+		back = imagePagePath(gallery, filename)
+	}
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// The path of the page of an image of the gallery.
+func imagePagePath(gallery *models.Gallery, filename string) string {
+	return galleryPath(gallery) + "/images/" + url.PathEscape(filename) + "/detail"
+}
@@ -25,7 +25,7 @@ func setCookie(w http.ResponseWriter, name, value string) {
 }
 
 func readCookie(r *http.Request, name string) (string, error) {
-	cookie, err := r.Cookie(CookieName)
+	cookie, err := r.Cookie(name)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", name, err)
 	}
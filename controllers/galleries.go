@@ -6,8 +6,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
 	"github.com/lifebalance/lenslocked/context"
 	"github.com/lifebalance/lenslocked/models"
 )
@@ -18,18 +21,32 @@ type Galleries struct {
 		Index Template
 		Show  Template
 		Edit  Template
+		// For galleries that aren't live (yet)
+		Unavailable Template
+		Image       Template // page of an image, with its comments
 	}
-	GalleryService *models.GalleryService
+	GalleryService    *models.GalleryService
+	CollectionService *models.CollectionService
+	ScheduleService   *models.GalleryScheduleService
+	CommentService    *models.CommentService
+	AnnotationService *models.AnnotationService
+	EmailService      *models.EmailService
+	PublicURL         string
 }
 
+// Bytes of multipart uploads kept in memory, the rest goes to temporary files.
+const uploadMemory = 32 << 20
+
 type galleryOpt func(http.ResponseWriter, *http.Request, *models.Gallery) error
 
 // Render form to create a new gallery
 func (g Galleries) New(w http.ResponseWriter, r *http.Request) {
 	var data struct {
-		Title string
+		Title        string
+		CollectionID int // to create the gallery in
 	}
-	data.Title = r.FormValue("title")   // parse query string
+	data.Title = r.FormValue("title") // parse query string
+	data.CollectionID, _ = strconv.Atoi(r.FormValue("collection"))
 	g.Templates.New.Execute(w, r, data) // render title in the template
 }
 
@@ -41,126 +58,323 @@ func (g Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	data.UserID = context.User(r.Context()).ID
 	data.Title = r.FormValue("title")
-	gallery, err := g.GalleryService.Create(data.Title, data.UserID)
+	// Galleries created in an organization's workspace belong to it.
+	var organizationId uint
+	if workspace := context.Workspace(r.Context()); workspace != nil {
+		organizationId = workspace.ID
+	}
+	gallery, err := g.GalleryService.WithActor(actor(r)).Create(data.Title, data.UserID, organizationId)
 	if err != nil {
 		g.Templates.New.Execute(w, r, gallery, err)
 		fmt.Println(err.Error()) // rudimentary logging
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
+	if collectionId, _ := strconv.Atoi(r.FormValue("collection")); collectionId != 0 {
+		// A collection of another workspace is ignored: the gallery stays at
+		// the top.
+		err = g.GalleryService.SetCollection(gallery.ID, collectionId)
+		if err != nil && !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
 	editGalleryPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editGalleryPath, http.StatusFound)
 }
 
 // Render form to edit a gallery
 func (g Galleries) Edit(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryById(w, r, userMustOwnGallery)
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
 	if err != nil {
 		return
 	}
+	g.renderEdit(w, r, gallery)
+}
 
+func (g Galleries) renderEdit(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, errs ...error) {
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Caption         string
+		Tags            string
 	}
 
 	data := struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID              int
+		Title           string
+		Description     string
+		Tags            string
+		Visibility      string
+		Visibilities    []string
+		Comments        string
+		CommentSettings []string
+		PendingComments []pendingComment
+		OpenAnnotations int // retouch requests that aren't done
+		CollectionID    int
+		Collections     []collectionOption // of the workspace, to move it
+		PublishAt       string             // datetime-local values, in UTC
+		ExpireAt        string
+		Slug            string
+		Handle          string // of the owner, "" if the gallery has no /u/ URL
+		Path            string
+		Images          []Image
 	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+		ID:              gallery.ID,
+		Title:           gallery.Title,
+		Description:     gallery.Description,
+		Tags:            strings.Join(gallery.Tags, ", "),
+		Visibility:      gallery.Visibility,
+		Visibilities:    models.GalleryVisibilities,
+		Comments:        gallery.Comments,
+		CommentSettings: models.GalleryCommentSettings,
+		CollectionID:    gallery.CollectionID,
+		PublishAt:       scheduleInputValue(gallery.PublishAt),
+		ExpireAt:        scheduleInputValue(gallery.ExpireAt),
+		Slug:            gallery.Slug,
+		Handle:          gallery.Handle,
+		Path:            galleryPath(gallery),
+	}
+	collections, err := g.CollectionService.Workspace(gallery.UserID, gallery.OrganizationID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.Collections = collectionOptions(collections)
+	pending, err := g.CommentService.Pending(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	open, err := g.AnnotationService.Open(gallery.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data.OpenAnnotations = len(open)
+	for _, comment := range pending {
+		if comment.Author == "" {
+			comment.Author = "Someone"
+		}
+		data.PendingComments = append(data.PendingComments, pendingComment{
+			ID:        comment.ID,
+			Author:    comment.Author,
+			Body:      comment.Body,
+			Filename:  comment.Filename,
+			ImagePath: imagePagePath(gallery, comment.Filename),
+		})
 	}
 	// Attach the images to the data
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
 	}
 	for _, img := range images {
 		data.Images = append(data.Images, Image{
 			GalleryID:       gallery.ID,
 			Filename:        img.Filename,
 			FilenameEscaped: url.PathEscape(img.Filename),
+			Caption:         img.Caption,
+			Tags:            strings.Join(img.Tags, ", "),
 		})
 	}
-	g.Templates.Edit.Execute(w, r, data) // render title in the template
+	g.Templates.Edit.Execute(w, r, data, errs...) // render title in the template
 }
 
 // Process form submission to edit a gallery
 func (g Galleries) Update(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryById(w, r, userMustOwnGallery)
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
 	if err != nil {
 		return
 	}
 
 	gallery.Title = r.FormValue("title")
-	err = g.GalleryService.UpdateGallery(gallery)
+	gallery.Description = strings.TrimSpace(r.FormValue("description"))
+	gallery.Tags = models.ParseTags(r.FormValue("tags"))
+	// "" is the visibility of the collection.
+	if _, ok := r.PostForm["visibility"]; ok {
+		gallery.Visibility = r.PostFormValue("visibility")
+	}
+	if slug := r.FormValue("slug"); slug != "" {
+		gallery.Slug = strings.ToLower(strings.TrimSpace(slug))
+	}
+	if _, ok := r.PostForm["publish_at"]; ok {
+		gallery.PublishAt, err = parseScheduleTime(r.PostFormValue("publish_at"), r.PostFormValue("tz"))
+		if err != nil {
+			g.renderEdit(w, r, gallery, apperrors.Public(err, "Invalid date for going live"))
+			return
+		}
+	}
+	if _, ok := r.PostForm["expire_at"]; ok {
+		gallery.ExpireAt, err = parseScheduleTime(r.PostFormValue("expire_at"), r.PostFormValue("tz"))
+		if err != nil {
+			g.renderEdit(w, r, gallery, apperrors.Public(err, "Invalid date for closing"))
+			return
+		}
+	}
+	err = g.GalleryService.WithActor(actor(r)).UpdateGallery(gallery)
 	if err != nil {
-		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		switch {
+		case errors.Is(err, models.ErrInvalidSlug):
+			err = apperrors.Public(err, "The URL can only have lowercase letters, digits and dashes (e.g. summer-2024)")
+		case errors.Is(err, models.ErrSlugTaken):
+			err = apperrors.Public(err, "You already have a gallery with that URL")
+		case errors.Is(err, models.ErrInvalidTags):
+			err = apperrors.Public(err, tagsErrorMessage)
+		case errors.Is(err, models.ErrInvalidSchedule):
+			err = apperrors.Public(err, "The gallery has to go live before it closes")
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		g.renderEdit(w, r, gallery, err)
 		return
 	}
+	if comments := r.PostFormValue("comments"); comments != "" && comments != gallery.Comments {
+		err = g.GalleryService.SetComments(gallery, comments)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+	}
+	if collectionId, err := strconv.Atoi(r.FormValue("collection")); err == nil && collectionId != gallery.CollectionID {
+		err = g.GalleryService.SetCollection(gallery.ID, collectionId)
+		if err != nil {
+			if !errors.Is(err, models.ErrNotFound) {
+				fmt.Println(err) // rudimentary logging
+				http.Error(w, "something went wrong", http.StatusInternalServerError)
+				return
+			}
+			g.renderEdit(w, r, gallery, apperrors.Public(err, "That collection doesn't exist anymore"))
+			return
+		}
+	}
 	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// Render the galleries of the current workspace: the user's own galleries, or
+// those of the organization they switched to.
 func (g Galleries) Index(w http.ResponseWriter, r *http.Request) {
 	type Gallery struct {
-		ID    int
-		Title string
+		ID       int
+		Title    string
+		Path     string
+		Schedule string // e.g. "Goes live on ...", "" when live for good
 	}
 	var data struct {
+		Workspace *models.Membership
+		CanDelete bool
 		Galleries []Gallery
 	}
 
 	user := context.User(r.Context())
-	galleries, err := g.GalleryService.GalleriesByUserId(user.ID)
+	data.Workspace = context.Workspace(r.Context())
+	var galleries []models.Gallery
+	var err error
+	if data.Workspace != nil {
+		data.CanDelete = data.Workspace.Role != models.OrgRoleMember
+		galleries, err = g.GalleryService.GalleriesByOrganizationId(data.Workspace.ID)
+	} else {
+		data.CanDelete = true
+		galleries, err = g.GalleryService.GalleriesByUserId(user.ID)
+	}
 	if err != nil {
 		fmt.Println("galleries controller: index: ", err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
 	}
 	for _, g := range galleries {
+		if data.Workspace == nil {
+			g.Handle = user.Handle
+		}
 		data.Galleries = append(data.Galleries, Gallery{
-			ID:    g.ID,
-			Title: g.Title,
+			ID:       g.ID,
+			Title:    g.Title,
+			Path:     galleryPath(&g),
+			Schedule: scheduleSummary(&g, time.Now()),
 		})
 	}
 	g.Templates.Index.Execute(w, r, data)
 }
 
+// Render the gallery at /galleries/{id}. Galleries at /u/{handle}/{slug}
+// are only reachable this way by their editors.
 func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryById(w, r)
+	gallery, err := g.galleryById(w, r, reachableById(g.GalleryService), g.userCanViewGalleryPage())
 	if err != nil {
 		return
 	}
+	g.renderShow(w, r, gallery)
+}
 
+// Render the gallery at /u/{handle}/{slug}, redirecting previous slugs.
+func (g Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r, g.userCanViewGalleryPage())
+	if err != nil {
+		return
+	}
+	g.renderShow(w, r, gallery)
+}
+
+func (g Galleries) renderShow(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
 	type Image struct {
 		GalleryID       int
 		Filename        string
 		FilenameEscaped string
+		Caption         string
+		Tags            []string
 	}
 	// data for the template
 	data := struct {
-		ID     int
-		Title  string
-		Images []Image
+		ID          int
+		Title       string
+		Description string
+		Tags        []string
+		Path        string
+		Breadcrumbs []models.Collection
+		Schedule    string
+		CanProof    bool
+		Images      []Image
 	}{
-		ID:    gallery.ID,
-		Title: gallery.Title,
+		ID:          gallery.ID,
+		Title:       gallery.Title,
+		Description: gallery.Description,
+		Tags:        gallery.Tags,
+		Path:        galleryPath(gallery),
+		Schedule:    scheduleSummary(gallery, time.Now()),
+		CanProof:    context.User(r.Context()) != nil,
+	}
+	if gallery.CollectionID != 0 {
+		path, err := g.CollectionService.Path(gallery.CollectionID)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		canEdit := g.GalleryService.Authorize(currentUserId(r), gallery, models.GalleryActionEdit) == nil
+		data.Breadcrumbs = visibleBreadcrumbs(path, canEdit)
 	}
 	images, err := g.GalleryService.Images(gallery.ID)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
 	}
 	for _, img := range images {
 		data.Images = append(data.Images, Image{
 			GalleryID:       gallery.ID,
 			Filename:        img.Filename,
 			FilenameEscaped: url.PathEscape(img.Filename),
+			Caption:         img.Caption,
+			Tags:            img.Tags,
 		})
 	}
 
@@ -168,11 +382,11 @@ func (g Galleries) Show(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
-	gallery, err := g.galleryById(w, r)
+	gallery, err := g.galleryById(w, r, userCanDeleteGallery(g.GalleryService))
 	if err != nil {
 		return
 	}
-	err = g.GalleryService.DeleteGallery(gallery.ID)
+	err = g.GalleryService.WithActor(actor(r)).DeleteGallery(gallery.ID)
 	if err != nil {
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
 		return
@@ -180,13 +394,44 @@ func (g Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
 
+// Process form submission to set the caption and tags of an image.
+func (g Galleries) UpdateImage(w http.ResponseWriter, r *http.Request) {
+	filename := chi.URLParam(r, "filename")
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	err = g.GalleryService.UpdateImage(gallery.ID, filename, r.FormValue("caption"), models.ParseTags(r.FormValue("tags")))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		case errors.Is(err, models.ErrInvalidTags):
+			err = apperrors.Public(err, tagsErrorMessage)
+		case errors.Is(err, models.ErrCaptionTooLong):
+			err = apperrors.Public(err, "Captions are at most 2000 characters")
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		g.renderEdit(w, r, gallery, err)
+		return
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
+const tagsErrorMessage = "Use at most 20 tags, separated by commas, of at most 30 characters each"
+
 func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	filename := chi.URLParam(r, "filename")
-	gallery, err := g.galleryById(w, r, userMustOwnGallery)
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
 	if err != nil {
 		return
 	}
-	err = g.GalleryService.DeleteImage(gallery.ID, filename)
+	err = g.GalleryService.WithActor(actor(r)).DeleteImage(gallery.ID, filename)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
@@ -195,14 +440,63 @@ func (g Galleries) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, editPath, http.StatusFound)
 }
 
+// Process the upload of images (multipart form, field "images") to a gallery.
+func (g Galleries) UploadImage(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, userCanEditGallery(g.GalleryService))
+	if err != nil {
+		return
+	}
+	err = r.ParseMultipartForm(uploadMemory)
+	if err != nil {
+		http.Error(w, "invalid upload", http.StatusBadRequest)
+		return
+	}
+	svc := g.GalleryService.WithActor(actor(r))
+	for _, fileHeader := range r.MultipartForm.File["images"] {
+		file, err := fileHeader.Open()
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		_, err = svc.UploadImage(gallery.ID, fileHeader.Filename, file)
+		file.Close()
+		if err != nil {
+			switch {
+			case errors.Is(err, models.ErrImageTooLarge):
+				http.Error(w, fmt.Sprintf("%s is too large", fileHeader.Filename), http.StatusRequestEntityTooLarge)
+			case errors.Is(err, models.ErrUnsupportedImage):
+				http.Error(w, fmt.Sprintf("%s is not a JPEG, PNG or GIF image", fileHeader.Filename), http.StatusUnsupportedMediaType)
+			default:
+				fmt.Println(err) // rudimentary logging
+				http.Error(w, "something went wrong", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+	editPath := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	http.Redirect(w, r, editPath, http.StatusFound)
+}
+
 func (g Galleries) Image(w http.ResponseWriter, r *http.Request) {
-	filename := chi.URLParam(r, "filename")
-	galleryId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	gallery, err := g.galleryById(w, r, userCanViewGallery(g.GalleryService), reachableById(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.serveImage(w, r, gallery)
+}
+
+func (g Galleries) ImageBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r, userCanViewGallery(g.GalleryService))
 	if err != nil {
-		http.Error(w, "invalid id", http.StatusNotFound)
 		return
 	}
-	image, err := g.GalleryService.Image(galleryId, filename)
+	g.serveImage(w, r, gallery)
+}
+
+func (g Galleries) serveImage(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	filename := chi.URLParam(r, "filename")
+	image, err := g.GalleryService.Image(gallery.ID, filename)
 	if err != nil {
 		if errors.Is(err, models.ErrNotFound) {
 			http.Error(w, "image not found", http.StatusNotFound)
@@ -241,7 +535,9 @@ func (g Galleries) galleryById(
 			return nil, err
 
 		}
+		fmt.Println(err)
 		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
 	}
 	// Run functional options.
 	for _, opt := range opts {
@@ -253,15 +549,128 @@ func (g Galleries) galleryById(
 	return gallery, nil
 }
 
-func userMustOwnGallery(
+// Loads and returns the gallery at /u/{handle}/{slug}, handling the HTTP
+// response in case of error like galleryById. When the slug is a previous
+// one, it redirects (301) to the current URL and returns errGalleryMoved.
+func (g Galleries) galleryBySlug(
 	w http.ResponseWriter,
 	r *http.Request,
-	gallery *models.Gallery,
-) error {
-	user := context.User(r.Context())
-	if gallery.UserID != user.ID {
-		http.Error(w, "you can't edit this gallery", http.StatusForbidden)
-		return fmt.Errorf("user does not have access to this gallery")
+	opts ...galleryOpt,
+) (*models.Gallery, error) {
+	slug := chi.URLParam(r, "slug")
+	gallery, err := g.GalleryService.GalleryBySlug(chi.URLParam(r, "handle"), slug)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	for _, opt := range opts {
+		err = opt(w, r, gallery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if gallery.Slug != slug {
+		// Same URL with the current slug: whatever comes after it (an image,
+		// ...) and the query string are kept.
+		segments := strings.SplitN(r.URL.EscapedPath(), "/", 5) // "", "u", handle, slug, rest
+		segments[3] = url.PathEscape(gallery.Slug)
+		target := strings.Join(segments, "/")
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return nil, errGalleryMoved
+	}
+	return gallery, nil
+}
+
+var errGalleryMoved = errors.New("gallery moved to a new slug")
+
+// The URL of the gallery (see Gallery.Path).
+func galleryPath(gallery *models.Gallery) string {
+	return gallery.Path()
+}
+
+// Galleries at /u/{handle}/{slug} are only reachable by their ID for their
+// editors (and admins, for the admin console), so that IDs can't be used to
+// go through everybody's galleries. Others get a 404.
+func reachableById(svc *models.GalleryService) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		if gallery.Handle == "" {
+			return nil
+		}
+		var userId uint
+		if user := context.User(r.Context()); user != nil {
+			if user.Role == models.RoleAdmin {
+				return nil
+			}
+			userId = user.ID
+		}
+		err := svc.Authorize(userId, gallery, models.GalleryActionEdit)
+		if err != nil {
+			if errors.Is(err, models.ErrForbidden) {
+				http.Error(w, "gallery not found", http.StatusNotFound)
+				return err
+			}
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		return nil
+	}
+}
+
+// Only lets through those who may see the gallery. Private galleries are
+// reported as missing to everybody else.
+func userCanViewGallery(svc *models.GalleryService) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		var userId uint
+		if user := context.User(r.Context()); user != nil {
+			userId = user.ID
+		}
+		err := svc.Authorize(userId, gallery, models.GalleryActionView)
+		if err != nil {
+			if errors.Is(err, models.ErrForbidden) {
+				http.Error(w, "gallery not found", http.StatusNotFound)
+				return err
+			}
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		return nil
+	}
+}
+
+// Only lets through users who may edit the gallery (see
+// GalleryService.Authorize).
+func userCanEditGallery(svc *models.GalleryService) galleryOpt {
+	return userCan(svc, models.GalleryActionEdit, "you can't edit this gallery")
+}
+
+// Only lets through users who may delete the gallery.
+func userCanDeleteGallery(svc *models.GalleryService) galleryOpt {
+	return userCan(svc, models.GalleryActionDelete, "you can't delete this gallery")
+}
+
+func userCan(svc *models.GalleryService, action models.GalleryAction, forbidden string) galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		user := context.User(r.Context())
+		err := svc.Authorize(user.ID, gallery, action)
+		if err != nil {
+			if errors.Is(err, models.ErrForbidden) {
+				http.Error(w, forbidden, http.StatusForbidden)
+				return err
+			}
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return err
+		}
+		return nil
 	}
-	return nil
 }
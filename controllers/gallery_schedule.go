@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// How dates of the schedule are sent by the datetime-local inputs.
+const scheduleInputLayout = "2006-01-02T15:04"
+
+// Only lets through those who may see the gallery, like userCanViewGallery.
+// Galleries that aren't live yet, or closed, get a page saying so (with a
+// form to be told when they go live) rather than a 404.
+func (g Galleries) userCanViewGalleryPage() galleryOpt {
+	return func(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) error {
+		err := g.GalleryService.Authorize(currentUserId(r), gallery, models.GalleryActionView)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, models.ErrGalleryNotPublished):
+			g.renderUnavailable(w, r, gallery, http.StatusForbidden, "")
+		case errors.Is(err, models.ErrGalleryExpired):
+			g.renderUnavailable(w, r, gallery, http.StatusGone, "")
+		case errors.Is(err, models.ErrForbidden):
+			http.Error(w, "gallery not found", http.StatusNotFound)
+		default:
+			fmt.Println(err)
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return err
+	}
+}
+
+// Data for the page of galleries that aren't live.
+type unavailableData struct {
+	Title        string
+	PublishAt    string // "" once published
+	ExpireAt     string // "" until expired
+	CanSubscribe bool
+	Path         string // of the gallery, to subscribe
+	Email        string
+	Notice       string
+}
+
+// Render the page of a gallery that isn't live with the HTTP status, and a
+// notice (e.g. after subscribing) if it isn't "".
+func (g Galleries) renderUnavailable(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, status int, notice string, errs ...error) {
+	var data unavailableData
+	data.Title = gallery.Title
+	data.Path = galleryPath(gallery)
+	data.Notice = notice
+	if time.Now().Before(gallery.PublishAt) {
+		data.PublishAt = formatScheduleTime(gallery.PublishAt)
+		data.CanSubscribe = true
+	} else if !gallery.ExpireAt.IsZero() {
+		data.ExpireAt = formatScheduleTime(gallery.ExpireAt)
+	}
+	if user := context.User(r.Context()); user != nil {
+		data.Email = user.Email
+	}
+	// Execute sets it too late once the status is written.
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	g.Templates.Unavailable.Execute(w, r, data, errs...)
+}
+
+// Process form submission to get an email when the gallery at /galleries/{id}
+// goes live, and when it closes.
+func (g Galleries) Subscribe(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryById(w, r, reachableById(g.GalleryService))
+	if err != nil {
+		return
+	}
+	g.subscribe(w, r, gallery)
+}
+
+// Same as Subscribe, for the gallery at /u/{handle}/{slug}.
+func (g Galleries) SubscribeBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+	g.subscribe(w, r, gallery)
+}
+
+func (g Galleries) subscribe(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) {
+	// Only galleries that aren't live yet take subscriptions, and only from
+	// those who could see them once they are.
+	err := g.GalleryService.Authorize(currentUserId(r), gallery, models.GalleryActionView)
+	switch {
+	case errors.Is(err, models.ErrGalleryNotPublished):
+	case err == nil:
+		// Live already: nothing to wait for.
+		http.Redirect(w, r, galleryPath(gallery), http.StatusFound)
+		return
+	case errors.Is(err, models.ErrForbidden):
+		http.Error(w, "gallery not found", http.StatusNotFound)
+		return
+	default:
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var userId uint
+	if user := context.User(r.Context()); user != nil {
+		userId = user.ID
+	}
+	err = g.ScheduleService.Subscribe(gallery.ID, r.FormValue("email"), userId)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidEmail) {
+			g.renderUnavailable(w, r, gallery, http.StatusBadRequest, "", apperrors.Public(err, "That doesn't look like an email address"))
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	g.renderUnavailable(w, r, gallery, http.StatusOK, "You're on the list: we'll email you when the gallery goes live.")
+}
+
+// Unsubscribe with the link of the emails sent to subscribers.
+func (g Galleries) Unsubscribe(w http.ResponseWriter, r *http.Request) {
+	galleryId, err := g.ScheduleService.Unsubscribe(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link was already used, or replaced by the one of a more recent email.", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	gallery, err := g.GalleryService.GalleryById(galleryId)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	data := unavailableData{
+		Title:  gallery.Title,
+		Notice: "You won't get emails about this gallery anymore.",
+	}
+	g.Templates.Unavailable.Execute(w, r, data)
+}
+
+// A line about when the gallery goes live or closes, "" if it's live with no
+// end.
+func scheduleSummary(gallery *models.Gallery, now time.Time) string {
+	switch {
+	case now.Before(gallery.PublishAt):
+		return "Goes live on " + formatScheduleTime(gallery.PublishAt)
+	case gallery.ExpireAt.IsZero():
+		return ""
+	case now.Before(gallery.ExpireAt):
+		return "Open until " + formatScheduleTime(gallery.ExpireAt)
+	}
+	return "Closed on " + formatScheduleTime(gallery.ExpireAt)
+}
+
+func formatScheduleTime(t time.Time) string {
+	return t.UTC().Format("January 2, 2006 at 15:04 MST")
+}
+
+// Parses a date of the schedule form: value is a datetime-local input, in
+// the time zone named tz (the browser's, UTC if unknown). "" is the zero
+// time.
+func parseScheduleTime(value, tz string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	location, err := time.LoadLocation(tz)
+	if err != nil || tz == "" {
+		location = time.UTC
+	}
+	t, err := time.ParseInLocation(scheduleInputLayout, value, location)
+	if err != nil {
+		// Some browsers add the seconds.
+		t, err = time.ParseInLocation(scheduleInputLayout+":05", value, location)
+	}
+	return t, err
+}
+
+// The value of a datetime-local input for t, in UTC (the edit page shows it
+// in the browser's time zone).
+func scheduleInputValue(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(scheduleInputLayout)
+}
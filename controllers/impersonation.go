@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+const (
+	// Holds the impersonation token, next to the session of the admin.
+	ImpersonationCookieName = "impersonation"
+)
+
+// Start seeing the app as the user of the URL. A reason is required.
+func (a Admin) StartImpersonation(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	if reason == "" {
+		a.renderUser(w, r, apperrors.Public(errors.New("impersonation without a reason"), "Give a reason for viewing the app as this user"))
+		return
+	}
+	admin := context.User(r.Context())
+	impersonation, err := a.ImpersonationService.WithActor(actor(r)).Start(admin.ID, uint(userId), reason)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		case errors.Is(err, models.ErrCannotImpersonate):
+			err = apperrors.Public(err, "Admins can't be impersonated")
+		}
+		a.renderUser(w, r, err)
+		return
+	}
+	setCookie(w, ImpersonationCookieName, impersonation.Token)
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// Stop impersonating, and go back to the admin page of the user.
+func (a Admin) StopImpersonation(w http.ResponseWriter, r *http.Request) {
+	impersonation := context.Impersonation(r.Context())
+	deleteCookie(w, ImpersonationCookieName)
+	if impersonation == nil {
+		http.Redirect(w, r, "/admin", http.StatusFound)
+		return
+	}
+	err := a.ImpersonationService.WithActor(actor(r)).End(impersonation.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", impersonation.UserID), http.StatusFound)
+}
+
+type impersonationRow struct {
+	AdminID    uint
+	AdminEmail string
+	UserID     uint
+	UserEmail  string
+	Reason     string
+	StartedAt  string
+	EndedAt    string // "" while it's going on
+}
+
+// Render the record of the impersonations.
+func (a Admin) Impersonations(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Impersonations []impersonationRow
+	}
+	impersonations, err := a.ImpersonationService.List(0)
+	if err != nil {
+		a.Templates.Impersonations.Execute(w, r, data, err)
+		return
+	}
+	for _, imp := range impersonations {
+		row := impersonationRow{
+			AdminID:    imp.AdminID,
+			AdminEmail: imp.AdminEmail,
+			UserID:     imp.UserID,
+			UserEmail:  imp.UserEmail,
+			Reason:     imp.Reason,
+			StartedAt:  imp.StartedAt.UTC().Format("2006-01-02 15:04:05 MST"),
+		}
+		if !imp.EndedAt.IsZero() {
+			row.EndedAt = imp.EndedAt.UTC().Format("2006-01-02 15:04:05 MST")
+		}
+		data.Impersonations = append(data.Impersonations, row)
+	}
+	a.Templates.Impersonations.Execute(w, r, data)
+}
@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+const (
+	defaultInvitationDays = 7
+	maxInvitationDays     = 365
+)
+
+// Data for the admin invitations template.
+type invitationsData struct {
+	Form        invitationForm
+	Created     *createdInvitation // Just created: the only time its code is known
+	Invitations []invitationRow
+}
+
+// The "New invitation" form, as typed.
+type invitationForm struct {
+	Email   string
+	MaxUses string
+	Days    string
+	Send    bool
+}
+
+type createdInvitation struct {
+	Link   string
+	SentTo string // "" if it wasn't emailed
+}
+
+type invitationRow struct {
+	ID        int
+	Email     string
+	Uses      int
+	MaxUses   int
+	ExpiresAt string
+	CreatedAt string
+	CreatedBy uint
+	Usable    bool
+}
+
+// Render the invitations, and the form to create one.
+func (a Admin) Invitations(w http.ResponseWriter, r *http.Request) {
+	data := invitationsData{
+		Form: invitationForm{
+			MaxUses: "1",
+			Days:    strconv.Itoa(defaultInvitationDays),
+		},
+	}
+	a.renderInvitations(w, r, data)
+}
+
+// Create an invitation, and email it if asked to. The signup link is shown
+// once, so that it can also be shared some other way.
+func (a Admin) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+	data := invitationsData{
+		Form: invitationForm{
+			Email:   strings.TrimSpace(r.FormValue("email")),
+			MaxUses: r.FormValue("max_uses"),
+			Days:    r.FormValue("days"),
+			Send:    r.FormValue("send") != "",
+		},
+	}
+	maxUses, duration, err := data.Form.parse()
+	if err != nil {
+		a.renderInvitations(w, r, data, err)
+		return
+	}
+	invitation, err := a.InvitationService.WithActor(actor(r)).Create(data.Form.Email, maxUses, duration)
+	if err != nil {
+		a.renderInvitations(w, r, data, err)
+		return
+	}
+	data.Created = &createdInvitation{
+		Link: a.PublicURL + "/signup?" + url.Values{"invite": {invitation.Code}}.Encode(),
+	}
+	if data.Form.Send {
+		data.Created.SentTo = invitation.Email
+		sendInBackground(func() error {
+			return a.EmailService.Invitation(invitation.Email, data.Created.Link, invitation.ExpiresAt)
+		})
+	}
+	data.Form = invitationForm{
+		MaxUses: "1",
+		Days:    strconv.Itoa(defaultInvitationDays),
+	}
+	a.renderInvitations(w, r, data)
+}
+
+// Revoke an invitation: its code can't be used anymore.
+func (a Admin) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusNotFound)
+		return
+	}
+	err = a.InvitationService.WithActor(actor(r)).Revoke(id)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/invitations", http.StatusFound)
+}
+
+func (a Admin) renderInvitations(w http.ResponseWriter, r *http.Request, data invitationsData, errs ...error) {
+	invitations, err := a.InvitationService.List()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, invitation := range invitations {
+		data.Invitations = append(data.Invitations, invitationRow{
+			ID:        invitation.ID,
+			Email:     invitation.Email,
+			Uses:      invitation.Uses,
+			MaxUses:   invitation.MaxUses,
+			ExpiresAt: invitation.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"),
+			CreatedAt: invitation.CreatedAt.UTC().Format("2006-01-02 15:04 MST"),
+			CreatedBy: invitation.CreatedBy,
+			Usable:    invitation.Usable(),
+		})
+	}
+	a.Templates.Invitations.Execute(w, r, data, errs...)
+}
+
+func (form invitationForm) parse() (int, time.Duration, error) {
+	maxUses, err := strconv.Atoi(form.MaxUses)
+	if err != nil || maxUses < 1 {
+		return 0, 0, apperrors.Public(fmt.Errorf("invalid max uses: %q", form.MaxUses), "The number of uses must be at least 1")
+	}
+	days, err := strconv.Atoi(form.Days)
+	if err != nil || days < 1 || days > maxInvitationDays {
+		return 0, 0, apperrors.Public(
+			fmt.Errorf("invalid invitation days: %q", form.Days),
+			fmt.Sprintf("Invitations must expire in 1 to %d days", maxInvitationDays),
+		)
+	}
+	if form.Send && form.Email == "" {
+		return 0, 0, apperrors.Public(errors.New("no email to send the invitation to"), "Enter the email address to send the invitation to")
+	}
+	return maxUses, time.Duration(days) * 24 * time.Hour, nil
+}
@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Process the "Email me a sign in link" button of the sign in form.
+//
+// The response is the same whether the email is registered or not, and the
+// email is sent in the background so the timing doesn't tell either.
+func (u Users) ProcessMagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Email string
+	}
+	data.Email = r.FormValue("email")
+	emailKey, ipKey := "magiclink:email:"+strings.ToLower(data.Email), "magiclink:ip:"+clientIP(r)
+
+	err := u.ThrottleService.Check(emailKey, ipKey)
+	if err != nil {
+		var throttledErr models.ThrottledError
+		if errors.As(err, &throttledErr) {
+			err = apperrors.Public(err, fmt.Sprintf(
+				"Too many sign in links requested. Please try again in %s.",
+				throttledErr.RetryAfter,
+			))
+		}
+		u.renderSignIn(w, r, data.Email, err)
+		return
+	}
+	for _, key := range []string{emailKey, ipKey} {
+		_, err = u.ThrottleService.Hit(key)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+
+	link, err := u.MagicLinkService.Create(data.Email)
+	switch {
+	case err == nil:
+		vals := url.Values{
+			"token": {link.Token},
+		}
+		signInUrl := u.PublicURL + "/signin/link?" + vals.Encode()
+		sendInBackground(func() error {
+			return u.EmailService.MagicLink(data.Email, signInUrl)
+		})
+	case errors.Is(err, models.ErrNotFound):
+		// Nothing to send, but don't tell.
+	default:
+		fmt.Println(err) // rudimentary logging
+	}
+	u.Templates.MagicLinkSent.Execute(w, r, data)
+}
+
+// The link sent by email. Consuming the token takes a POST (the button on
+// this page): some email scanners follow links, and would burn it otherwise.
+//
+// Links sent to confirm a sensitive action also carry the page to go back to.
+func (u Users) MagicLink(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+		Next  string
+	}
+	data.Token = r.FormValue("token")
+	if next := r.FormValue("next"); next != "" {
+		data.Next = safeRedirectPath(next)
+	}
+	u.Templates.MagicLink.Execute(w, r, data)
+}
+
+func (u Users) ProcessMagicLinkSignIn(w http.ResponseWriter, r *http.Request) {
+	user, err := u.MagicLinkService.Consume(r.FormValue("token"))
+	if err != nil {
+		if !errors.Is(err, models.ErrNotFound) {
+			fmt.Println(err) // rudimentary logging
+		}
+		u.renderSignIn(w, r, "", apperrors.Public(err, "That sign in link is invalid or has expired. Please ask for a new one."))
+		return
+	}
+	u.signIn(w, r, user)
+}
+
+// Sends an email without making the request wait for the SMTP server.
+func sendInBackground(send func() error) {
+	go func() {
+		err := send()
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}()
+}
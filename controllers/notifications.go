@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	// Long-lived random ID of the browser, to notice sign ins from new devices.
+	DeviceCookieName   = "device"
+	deviceCookieMaxAge = 2 * 365 * 24 * 60 * 60 // seconds
+)
+
+// Sends a security notice (unless the user turned that kind off), with a
+// "This wasn't me" link. The email is sent in the background.
+func (u Users) notify(r *http.Request, userId uint, to, kind, details string) {
+	if !u.NotificationService.Enabled(userId, kind) {
+		return
+	}
+	token, err := u.AccountRecoveryService.Create(userId)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		return
+	}
+	vals := url.Values{
+		"token": {token},
+	}
+	notice := models.SecurityNotice{
+		Kind:      kind,
+		Time:      time.Now(),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Details:   details,
+		NotMeURL:  u.PublicURL + "/users/not-me?" + vals.Encode(),
+	}
+	sendInBackground(func() error {
+		return u.EmailService.SecurityNotice(to, notice)
+	})
+}
+
+// Remembers the device the user is signing in from, and sends a notice if
+// it's a new one.
+func (u Users) checkDevice(w http.ResponseWriter, r *http.Request, user *models.User) {
+	deviceId, err := readCookie(r, DeviceCookieName)
+	if err != nil {
+		deviceId, err = rand.RandomBase64String(models.MinBytesPerToken)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			return
+		}
+		cookie := newCookie(DeviceCookieName, deviceId)
+		cookie.MaxAge = deviceCookieMaxAge
+		http.SetCookie(w, cookie)
+	}
+	isNew, err := u.DeviceService.SignedIn(user.ID, deviceId, r.UserAgent(), clientIP(r))
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		return
+	}
+	if isNew {
+		u.notify(r, user.ID, user.Email, models.NoticeNewDevice, "")
+	}
+}
+
+// The "This wasn't me" link of the notices. Like sign in links, using it
+// takes a POST (the button on this page), so email scanners can't.
+func (u Users) NotMe(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		Token string
+	}
+	data.Token = r.FormValue("token")
+	u.Templates.NotMe.Execute(w, r, data)
+}
+
+// Signs the account out everywhere, and sends the user to the password reset
+// form.
+func (u Users) ProcessNotMe(w http.ResponseWriter, r *http.Request) {
+	user, err := u.AccountRecoveryService.Consume(r.FormValue("token"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.SessionService.WithActor(actor(r)).DeleteForUser(user.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	err = u.MagicLinkService.DeleteForUser(user.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	deleteCookie(w, CookieName)
+	passwordReset, err := u.PasswordResetService.WithActor(actor(r)).Create(user.Email)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"token": {passwordReset.Token},
+	}
+	http.Redirect(w, r, "/reset-pwd?"+vals.Encode(), http.StatusFound)
+}
+
+// A notice kind, as shown in the settings.
+type noticePreference struct {
+	Kind    string
+	Label   string
+	Enabled bool
+}
+
+// Process form submission of the notification preferences (a checkbox named
+// "notices" per kind).
+func (u Users) ProcessNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	prefs := make(map[string]bool)
+	for _, kind := range r.PostForm["notices"] {
+		prefs[kind] = true
+	}
+	err = u.NotificationService.UpdatePreferences(user.ID, prefs)
+	if err != nil {
+		u.renderSettings(w, r, user, "", err)
+		return
+	}
+	u.renderSettings(w, r, user, "Your notification preferences have been saved.")
+}
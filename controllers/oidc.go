@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+const (
+	// Holds the state of the sign in with an identity provider, so that only
+	// the browser that began it can complete it.
+	OIDCStateCookieName = "oidc_state"
+)
+
+// Redirect the user to the identity provider in the `provider` URL param.
+func (u Users) OIDCSignIn(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	authURL, state, err := u.OIDCService.Begin(providerName, u.oidcRedirectURL(providerName))
+	if err != nil {
+		if errors.Is(err, models.ErrUnknownProvider) {
+			http.Error(w, "identity provider not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		u.renderSignIn(w, r, "", apperrors.Public(err, "We couldn't reach the identity provider, please try again later"))
+		return
+	}
+	cookie := newCookie(OIDCStateCookieName, state)
+	cookie.Path = "/oauth/"
+	cookie.MaxAge = int(models.DefaultOIDCLoginDuration.Seconds())
+	// The provider sends the user back with a top-level GET, which Lax
+	// cookies are sent with.
+	cookie.SameSite = http.SameSiteLaxMode
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// The identity provider sends the user back here, with a code (or an error).
+// Ends up in the same session path as signing in with a password.
+func (u Users) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	providerName := chi.URLParam(r, "provider")
+	stateCookie, _ := readCookie(r, OIDCStateCookieName)
+	cookie := newCookie(OIDCStateCookieName, "")
+	cookie.Path = "/oauth/"
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+	if providerError := r.FormValue("error"); providerError != "" {
+		err := fmt.Errorf("oidc callback: %s: %s", providerError, r.FormValue("error_description"))
+		u.renderSignIn(w, r, "", apperrors.Public(err, "Signing in with the identity provider was canceled or failed"))
+		return
+	}
+	// Login CSRF: the state must come from the browser that began the login.
+	state := r.FormValue("state")
+	if stateCookie == "" || subtle.ConstantTimeCompare([]byte(stateCookie), []byte(state)) != 1 {
+		err := fmt.Errorf("oidc callback: %w: state doesn't match the cookie", models.ErrInvalidOIDCState)
+		u.renderSignIn(w, r, "", apperrors.Public(err, "Your sign in request expired, please try again"))
+		return
+	}
+	user, err := u.OIDCService.Complete(
+		providerName,
+		state,
+		r.FormValue("code"),
+		u.oidcRedirectURL(providerName),
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrUnknownProvider):
+			http.Error(w, "identity provider not found", http.StatusNotFound)
+			return
+		case errors.Is(err, models.ErrUnverifiedEmail):
+			err = apperrors.Public(err, "The identity provider didn't confirm your email address")
+		case errors.Is(err, models.ErrSignupClosed):
+			err = apperrors.Public(err, "There's no account with this email address. You need an invitation to sign up.")
+		case errors.Is(err, models.ErrInvalidOIDCState):
+			err = apperrors.Public(err, "Your sign in request expired, please try again")
+		}
+		u.renderSignIn(w, r, "", err)
+		return
+	}
+	u.signIn(w, r, user)
+}
+
+// Must match one of the redirect URIs registered with the provider.
+func (u Users) oidcRedirectURL(providerName string) string {
+	return u.PublicURL + "/oauth/" + providerName + "/callback"
+}
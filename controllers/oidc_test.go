@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Records what would have been rendered.
+type stubTemplate struct {
+	executed bool
+	errs     []error
+}
+
+func (tpl *stubTemplate) Execute(w http.ResponseWriter, r *http.Request, data interface{}, errs ...error) {
+	tpl.executed = true
+	tpl.errs = errs
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie string // No cookie if empty
+		state  string
+	}{
+		{name: "no cookie", state: "the-state"},
+		{name: "other state", cookie: "another-state", state: "the-state"},
+		{name: "no state", cookie: "the-state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signIn := &stubTemplate{}
+			u := Users{
+				// No DB: Complete can't be called.
+				OIDCService: &models.OIDCService{
+					Providers: map[string]*models.OIDCProvider{"stub": {Name: "stub"}},
+				},
+			}
+			u.Templates.SignIn = signIn
+
+			r := httptest.NewRequest(http.MethodGet, "/oauth/stub/callback?code=the-code&state="+tt.state, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: OIDCStateCookieName, Value: tt.cookie})
+			}
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("provider", "stub")
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+			w := httptest.NewRecorder()
+			u.OIDCCallback(w, r)
+
+			if !signIn.executed || len(signIn.errs) != 1 || !errors.Is(signIn.errs[0], models.ErrInvalidOIDCState) {
+				t.Errorf("rendered the sign in page with %v, want %v", signIn.errs, models.ErrInvalidOIDCState)
+			}
+			// The cookie is single use.
+			cookies := w.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != OIDCStateCookieName || cookies[0].MaxAge >= 0 {
+				t.Errorf("cookies = %v, want %s deleted", cookies, OIDCStateCookieName)
+			}
+		})
+	}
+}
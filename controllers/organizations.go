@@ -0,0 +1,495 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+const (
+	// Holds the ID of the organization the user works in (no cookie: their
+	// personal galleries).
+	WorkspaceCookieName = "workspace"
+)
+
+type Organizations struct {
+	Templates struct {
+		Index      Template
+		Show       Template
+		Invitation Template
+	}
+	OrganizationService *models.OrganizationService
+	SCIMService         *models.SCIMService
+	EmailService        *models.EmailService
+	// Used to show the SCIM base URL and in invitation links, e.g.
+	// "https://lenslocked.com"
+	PublicURL string
+}
+
+// Render the organizations of the user, with a form to create one.
+func (o Organizations) Index(w http.ResponseWriter, r *http.Request) {
+	o.renderIndex(w, r, "")
+}
+
+func (o Organizations) renderIndex(w http.ResponseWriter, r *http.Request, name string, errs ...error) {
+	var data struct {
+		Name          string
+		Organizations []models.Membership
+	}
+	data.Name = name
+	data.Organizations = context.Memberships(r.Context())
+	o.Templates.Index.Execute(w, r, data, errs...)
+}
+
+// Create an organization, owned by the user, and switch to it.
+func (o Organizations) Create(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	name := r.FormValue("name")
+	org, err := o.OrganizationService.WithActor(actor(r)).Create(name, user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrOrganizationNameRequired) {
+			err = apperrors.Public(err, "Give the organization a name")
+		}
+		o.renderIndex(w, r, name, err)
+		return
+	}
+	setCookie(w, WorkspaceCookieName, strconv.FormatUint(uint64(org.ID), 10))
+	http.Redirect(w, r, fmt.Sprintf("/orgs/%d", org.ID), http.StatusFound)
+}
+
+type orgInvitationRow struct {
+	ID        int
+	Email     string
+	Role      string
+	ExpiresAt string
+	CanManage bool // whether the current user can revoke it
+}
+
+type memberRow struct {
+	models.Member
+	Self      bool
+	CanManage bool // whether the current user can change their role or remove them
+}
+
+// Render an organization: its members, and what the user can do with them.
+func (o Organizations) Show(w http.ResponseWriter, r *http.Request) {
+	membership, err := o.membership(w, r)
+	if err != nil {
+		return
+	}
+	o.renderShow(w, r, membership)
+}
+
+func (o Organizations) renderShow(w http.ResponseWriter, r *http.Request, membership *models.Membership, errs ...error) {
+	o.renderShowWithToken(w, r, membership, "", errs...)
+}
+
+// Renders the organization, with the SCIM token that was just created (if
+// any): it's the only time it's shown.
+func (o Organizations) renderShowWithToken(w http.ResponseWriter, r *http.Request, membership *models.Membership, scimToken string, errs ...error) {
+	var data struct {
+		Organization *models.Membership
+		Members      []memberRow
+		Invitations  []orgInvitationRow
+		Roles        []string // the roles the user can give
+		CanManage    bool
+		IsOwner      bool
+		SCIM         struct {
+			Enabled bool
+			URL     string
+			Token   string
+		}
+	}
+	data.Organization = membership
+	data.CanManage = membership.CanManage(models.OrgRoleMember)
+	data.IsOwner = membership.Role == models.OrgRoleOwner
+	for _, role := range models.OrgRoles {
+		if membership.CanManage(role) {
+			data.Roles = append(data.Roles, role)
+		}
+	}
+	user := context.User(r.Context())
+	members, err := o.OrganizationService.Members(membership.ID)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, member := range members {
+		data.Members = append(data.Members, memberRow{
+			Member:    member,
+			Self:      member.UserID == user.ID,
+			CanManage: membership.CanManage(member.Role),
+		})
+	}
+	if data.CanManage {
+		invitations, err := o.OrganizationService.Invitations(membership.ID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, invitation := range invitations {
+			data.Invitations = append(data.Invitations, orgInvitationRow{
+				ID:        invitation.ID,
+				Email:     invitation.Email,
+				Role:      invitation.Role,
+				ExpiresAt: invitation.ExpiresAt.Format("January 2, 2006"),
+				CanManage: membership.CanManage(invitation.Role),
+			})
+		}
+	}
+	if data.IsOwner {
+		data.SCIM.Enabled, err = o.SCIMService.Enabled(membership.ID)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		data.SCIM.URL = o.PublicURL + "/scim/v2"
+		data.SCIM.Token = scimToken
+	}
+	o.Templates.Show.Execute(w, r, data, errs...)
+}
+
+// Rename the organization (owners and admins).
+func (o Organizations) Rename(w http.ResponseWriter, r *http.Request) {
+	o.action(w, r, func(membership *models.Membership) error {
+		if !membership.CanManage(models.OrgRoleMember) {
+			return errOrgForbidden
+		}
+		err := o.OrganizationService.Rename(membership.ID, r.FormValue("name"))
+		if errors.Is(err, models.ErrOrganizationNameRequired) {
+			return apperrors.Public(err, "Give the organization a name")
+		}
+		return err
+	})
+}
+
+// Invite someone to the organization by email. They join once they accept.
+func (o Organizations) Invite(w http.ResponseWriter, r *http.Request) {
+	o.action(w, r, func(membership *models.Membership) error {
+		role := r.FormValue("role")
+		if !membership.CanManage(role) {
+			return errOrgForbidden
+		}
+		invitation, err := o.OrganizationService.WithActor(actor(r)).Invite(membership.ID, r.FormValue("email"), role)
+		switch {
+		case errors.Is(err, models.ErrInvalidEmail):
+			return apperrors.Public(err, "Enter a valid email address")
+		case errors.Is(err, models.ErrAlreadyMember):
+			return apperrors.Public(err, "They are already a member")
+		case err != nil:
+			return err
+		}
+		vals := url.Values{
+			"code": {invitation.Code},
+		}
+		notice := models.OrganizationInvitationNotice{
+			OrganizationName: membership.Name,
+			Role:             invitation.Role,
+			AcceptURL:        o.PublicURL + "/orgs/invitations/accept?" + vals.Encode(),
+			ExpiresAt:        invitation.ExpiresAt,
+		}
+		sendInBackground(func() error {
+			return o.EmailService.OrganizationInvitation(invitation.Email, notice)
+		})
+		return nil
+	})
+}
+
+// Revoke an invitation to the organization that wasn't accepted yet.
+func (o Organizations) RevokeInvitation(w http.ResponseWriter, r *http.Request) {
+	invitationId, err := strconv.Atoi(chi.URLParam(r, "invitationId"))
+	if err != nil {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	o.action(w, r, func(membership *models.Membership) error {
+		invitations, err := o.OrganizationService.Invitations(membership.ID)
+		if err != nil {
+			return err
+		}
+		i := slices.IndexFunc(invitations, func(invitation models.Invitation) bool {
+			return invitation.ID == invitationId
+		})
+		if i < 0 {
+			return apperrors.Public(models.ErrNotFound, "This invitation was already accepted, revoked, or has expired")
+		}
+		if !membership.CanManage(invitations[i].Role) {
+			return errOrgForbidden
+		}
+		return o.OrganizationService.RevokeInvitation(membership.ID, invitationId)
+	})
+}
+
+// Data for the invitation template.
+type orgInvitationData struct {
+	Code     string
+	SignedIn bool
+}
+
+// Render the page of the link sent with an invitation, where the invited user
+// accepts it. Signed out users are asked to sign in first.
+func (o Organizations) Invitation(w http.ResponseWriter, r *http.Request) {
+	data := orgInvitationData{
+		Code:     r.FormValue("code"),
+		SignedIn: context.User(r.Context()) != nil,
+	}
+	o.Templates.Invitation.Execute(w, r, data)
+}
+
+// Accept an invitation, and switch to the organization.
+func (o Organizations) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	data := orgInvitationData{
+		Code:     r.FormValue("code"),
+		SignedIn: true,
+	}
+	membership, err := o.OrganizationService.WithActor(actor(r)).AcceptInvitation(data.Code, user)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrInvalidInvitation):
+			err = apperrors.Public(err, fmt.Sprintf(
+				"This invitation is invalid, used up, expired, or for another email address than %s",
+				user.Email,
+			))
+		case errors.Is(err, models.ErrAlreadyMember):
+			err = apperrors.Public(err, "You are already a member of this organization")
+		default:
+			fmt.Println(err) // rudimentary logging
+		}
+		o.Templates.Invitation.Execute(w, r, data, err)
+		return
+	}
+	setCookie(w, WorkspaceCookieName, strconv.FormatUint(uint64(membership.ID), 10))
+	http.Redirect(w, r, fmt.Sprintf("/orgs/%d", membership.ID), http.StatusFound)
+}
+
+// Change the role of a member.
+func (o Organizations) SetRole(w http.ResponseWriter, r *http.Request) {
+	o.memberAction(w, r, func(membership *models.Membership, member *models.Member) error {
+		role := r.FormValue("role")
+		if !membership.CanManage(member.Role) || !membership.CanManage(role) {
+			return errOrgForbidden
+		}
+		return o.OrganizationService.WithActor(actor(r)).SetRole(membership.ID, member.UserID, role)
+	})
+}
+
+// Remove a member (to leave, see Leave).
+func (o Organizations) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	o.memberAction(w, r, func(membership *models.Membership, member *models.Member) error {
+		if !membership.CanManage(member.Role) || member.UserID == context.User(r.Context()).ID {
+			return errOrgForbidden
+		}
+		return o.OrganizationService.WithActor(actor(r)).RemoveMember(membership.ID, member.UserID)
+	})
+}
+
+// Leave the organization. Its galleries stay with it.
+func (o Organizations) Leave(w http.ResponseWriter, r *http.Request) {
+	membership, err := o.membership(w, r)
+	if err != nil {
+		return
+	}
+	user := context.User(r.Context())
+	err = o.OrganizationService.WithActor(actor(r)).RemoveMember(membership.ID, user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrLastOwner) {
+			err = apperrors.Public(err, "You are the last owner: make someone else owner, or delete the organization")
+		}
+		o.renderShow(w, r, membership, err)
+		return
+	}
+	leaveWorkspace(w, r, membership.ID)
+	http.Redirect(w, r, "/orgs", http.StatusFound)
+}
+
+// Delete the organization, with all its galleries (owners only).
+func (o Organizations) Delete(w http.ResponseWriter, r *http.Request) {
+	membership, err := o.membership(w, r)
+	if err != nil {
+		return
+	}
+	if membership.Role != models.OrgRoleOwner {
+		o.renderShow(w, r, membership, errOrgForbidden)
+		return
+	}
+	err = o.OrganizationService.WithActor(actor(r)).Delete(membership.ID)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	leaveWorkspace(w, r, membership.ID)
+	http.Redirect(w, r, "/orgs", http.StatusFound)
+}
+
+// Create the SCIM token of the organization (owners only), replacing the
+// previous one, so that its identity provider can provision users.
+func (o Organizations) CreateSCIMToken(w http.ResponseWriter, r *http.Request) {
+	membership, err := o.membership(w, r)
+	if err != nil {
+		return
+	}
+	if membership.Role != models.OrgRoleOwner {
+		o.renderShow(w, r, membership, errOrgForbidden)
+		return
+	}
+	token, err := o.SCIMService.WithActor(actor(r)).CreateToken(membership.ID)
+	if err != nil {
+		o.renderShow(w, r, membership, err)
+		return
+	}
+	o.renderShowWithToken(w, r, membership, token)
+}
+
+// Revoke the SCIM token of the organization (owners only). Provisioned
+// accounts stay as they are.
+func (o Organizations) RevokeSCIMToken(w http.ResponseWriter, r *http.Request) {
+	o.action(w, r, func(membership *models.Membership) error {
+		if membership.Role != models.OrgRoleOwner {
+			return errOrgForbidden
+		}
+		return o.SCIMService.WithActor(actor(r)).RevokeToken(membership.ID)
+	})
+}
+
+var errOrgForbidden = apperrors.Public(models.ErrForbidden, "Your role in the organization doesn't allow this")
+
+// Runs an action on the member of the URL (`userId`), then goes back to the
+// organization page (or shows it with the error).
+func (o Organizations) memberAction(w http.ResponseWriter, r *http.Request, action func(membership *models.Membership, member *models.Member) error) {
+	userId, err := strconv.ParseUint(chi.URLParam(r, "userId"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusNotFound)
+		return
+	}
+	o.action(w, r, func(membership *models.Membership) error {
+		member, err := o.OrganizationService.Membership(membership.ID, uint(userId))
+		if err != nil {
+			return err
+		}
+		return action(membership, &models.Member{UserID: uint(userId), Role: member.Role})
+	})
+}
+
+// Runs an action on the organization of the URL, then goes back to its page
+// (or shows it with the error).
+func (o Organizations) action(w http.ResponseWriter, r *http.Request, action func(*models.Membership) error) {
+	membership, err := o.membership(w, r)
+	if err != nil {
+		return
+	}
+	err = action(membership)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrLastOwner):
+			err = apperrors.Public(err, "The organization needs at least one owner")
+		case errors.Is(err, models.ErrNotFound):
+			err = apperrors.Public(err, "They aren't a member of the organization")
+		}
+		fmt.Println(err) // rudimentary logging
+		o.renderShow(w, r, membership, err)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/orgs/%d", membership.ID), http.StatusFound)
+}
+
+// Loads the membership of the user in the organization of the URL. Users
+// who aren't members get a 404, as if the organization didn't exist.
+func (o Organizations) membership(w http.ResponseWriter, r *http.Request) (*models.Membership, error) {
+	organizationId, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusNotFound)
+		return nil, err
+	}
+	user := context.User(r.Context())
+	membership, err := o.OrganizationService.Membership(uint(organizationId), user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	return membership, nil
+}
+
+// Switch to the workspace of an organization (or back to the personal one
+// with organization_id=0).
+func (o Organizations) SwitchWorkspace(w http.ResponseWriter, r *http.Request) {
+	organizationId, err := strconv.ParseUint(r.FormValue("organization_id"), 10, 32)
+	if err != nil || organizationId == 0 {
+		deleteCookie(w, WorkspaceCookieName)
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+	user := context.User(r.Context())
+	_, err = o.OrganizationService.Membership(uint(organizationId), user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	setCookie(w, WorkspaceCookieName, strconv.FormatUint(organizationId, 10))
+	http.Redirect(w, r, "/galleries", http.StatusFound)
+}
+
+// Loads the organizations of the current user, and the one they work in.
+// Must run after UserMiddleware.SetUser.
+type WorkspaceMiddleware struct {
+	OrganizationService *models.OrganizationService
+}
+
+func (wmw WorkspaceMiddleware) SetWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		memberships, err := wmw.OrganizationService.Memberships(user.ID)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.WithMemberships(r.Context(), memberships)
+		if workspaceCookie, err := readCookie(r, WorkspaceCookieName); err == nil {
+			workspace := findMembership(memberships, workspaceCookie)
+			if workspace != nil {
+				ctx = context.WithWorkspace(ctx, workspace)
+			} else {
+				deleteCookie(w, WorkspaceCookieName) // left, removed, deleted...
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Switches back to the personal workspace if the user was working in the
+// organization.
+func leaveWorkspace(w http.ResponseWriter, r *http.Request, organizationId uint) {
+	if workspace := context.Workspace(r.Context()); workspace != nil && workspace.ID == organizationId {
+		deleteCookie(w, WorkspaceCookieName)
+	}
+}
+
+func findMembership(memberships []models.Membership, organizationId string) *models.Membership {
+	for i, membership := range memberships {
+		if strconv.FormatUint(uint64(membership.ID), 10) == organizationId {
+			return &memberships[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Public profiles (/u/{handle}) and the avatars shown on them.
+type Profiles struct {
+	Templates struct {
+		Show Template
+	}
+	ProfileService *models.ProfileService
+	GalleryService *models.GalleryService
+}
+
+// Render the public profile of the handle, with the user's public galleries.
+func (p Profiles) Show(w http.ResponseWriter, r *http.Request) {
+	profile, err := p.ProfileService.ByHandle(chi.URLParam(r, "handle"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "profile not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	galleries, err := p.GalleryService.PublicGalleriesByUserId(profile.UserID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	var data struct {
+		Profile   *models.Profile
+		Galleries []models.Gallery
+	}
+	data.Profile = profile
+	data.Galleries = galleries
+	p.Templates.Show.Execute(w, r, data)
+}
+
+// Serve an avatar. Filenames change with every new avatar, so they can be
+// cached for a long time.
+func (p Profiles) Avatar(w http.ResponseWriter, r *http.Request) {
+	path, err := p.ProfileService.AvatarPath(chi.URLParam(r, "filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "avatar not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeFile(w, r, path)
+}
+
+// Process the profile form of the settings page (multipart: it may come with
+// a new avatar).
+func (u Users) ProcessProfile(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := r.ParseMultipartForm(uploadMemory)
+	if err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	svc := u.ProfileService.WithActor(actor(r))
+	profile := models.Profile{
+		UserID:      user.ID,
+		Handle:      r.FormValue("handle"),
+		DisplayName: r.FormValue("display_name"),
+		Bio:         r.FormValue("bio"),
+		Website:     r.FormValue("website"),
+	}
+	err = svc.Update(profile)
+	if err != nil {
+		u.renderSettings(w, r, user, "", profileError(err))
+		return
+	}
+	file, fileHeader, err := r.FormFile("avatar")
+	if err == nil {
+		defer file.Close()
+		if fileHeader.Size > 0 {
+			_, err = svc.SetAvatar(user.ID, file)
+			if err != nil {
+				u.renderSettings(w, r, user, "", profileError(err))
+				return
+			}
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) {
+		fmt.Println(err) // rudimentary logging
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+// Process form submission to remove the avatar.
+func (u Users) ProcessRemoveAvatar(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	err := u.ProfileService.WithActor(actor(r)).RemoveAvatar(user.ID)
+	if err != nil {
+		u.renderSettings(w, r, user, "", err)
+		return
+	}
+	http.Redirect(w, r, "/users/me", http.StatusFound)
+}
+
+func profileError(err error) error {
+	switch {
+	case errors.Is(err, models.ErrHandleTaken):
+		return apperrors.Public(err, "That handle is already taken")
+	case errors.Is(err, models.ErrInvalidProfile):
+		return apperrors.Public(err, "Check your profile: handles are 2 to 30 letters, digits, - or _, bios are at most 1000 characters and websites start with http:// or https://")
+	case errors.Is(err, models.ErrImageTooLarge):
+		return apperrors.Public(err, "That picture is too large")
+	case errors.Is(err, models.ErrUnsupportedImage):
+		return apperrors.Public(err, "Profile pictures must be JPEG, PNG or GIF images")
+	}
+	return err
+}
@@ -0,0 +1,558 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+/*
+Proofing is where clients pick images in a gallery: favorites, and named
+selections with a note for each image if they want. They submit selections to
+the photographer, who exports them from the selections page of the gallery.
+
+Clients are signed in users who can see the gallery, at
+/galleries/{id}/proofing or /u/{handle}/{slug}/proofing, or whoever has a
+share link of the gallery, at /s/{token}.
+*/
+type Proofing struct {
+	Templates struct {
+		Show       Template // for clients
+		Selections Template // for the photographer
+	}
+	ProofingService *models.ProofingService
+	GalleryService  *models.GalleryService
+	EmailService    *models.EmailService
+	PublicURL       string
+}
+
+// Where a client proofs a gallery, and as whom.
+type proofingScope struct {
+	Gallery     *models.Gallery
+	Proofer     models.Proofer
+	ProoferName string
+	Base        string // path of the proofing page
+	ImagesPath  string // path the images are served at, with a trailing "/"
+}
+
+// Loads the gallery and the client of the request, handling the HTTP
+// response in case of error like Galleries.galleryById.
+func (p Proofing) scope(w http.ResponseWriter, r *http.Request) (*proofingScope, error) {
+	if token := chi.URLParam(r, "token"); token != "" {
+		return p.shareLinkScope(w, r, token)
+	}
+	var gallery *models.Gallery
+	var err error
+	opts := []galleryOpt{userCanViewGallery(p.GalleryService)}
+	if handle := chi.URLParam(r, "handle"); handle != "" {
+		gallery, err = p.GalleryService.GalleryBySlug(handle, chi.URLParam(r, "slug"))
+	} else {
+		var id int
+		id, err = strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusNotFound)
+			return nil, err
+		}
+		gallery, err = p.GalleryService.GalleryById(id)
+		opts = append(opts, reachableById(p.GalleryService))
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	for _, opt := range opts {
+		err = opt(w, r, gallery)
+		if err != nil {
+			return nil, err
+		}
+	}
+	user := context.User(r.Context())
+	return &proofingScope{
+		Gallery:     gallery,
+		Proofer:     models.Proofer{UserID: user.ID},
+		ProoferName: user.Email,
+		Base:        galleryPath(gallery) + "/proofing",
+		ImagesPath:  galleryPath(gallery) + "/images/",
+	}, nil
+}
+
+// Share links work whatever the visibility of the gallery, but not before it
+// goes live, nor once it's closed.
+func (p Proofing) shareLinkScope(w http.ResponseWriter, r *http.Request, token string) (*proofingScope, error) {
+	link, err := p.ProofingService.ShareLinkByToken(token)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "This link doesn't work anymore. Ask the photographer for a new one.", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	gallery, err := p.GalleryService.GalleryById(link.GalleryID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	err = gallery.CheckSchedule(time.Now())
+	switch {
+	case errors.Is(err, models.ErrGalleryNotPublished):
+		http.Error(w, "This gallery isn't live yet. Come back on "+formatScheduleTime(gallery.PublishAt)+".", http.StatusForbidden)
+		return nil, err
+	case errors.Is(err, models.ErrGalleryExpired):
+		http.Error(w, "This gallery is closed. Ask the photographer if you need more time.", http.StatusGone)
+		return nil, err
+	}
+	base := "/s/" + url.PathEscape(token)
+	return &proofingScope{
+		Gallery:     gallery,
+		Proofer:     models.Proofer{ShareLinkID: link.ID},
+		ProoferName: link.Label,
+		Base:        base,
+		ImagesPath:  base + "/images/",
+	}, nil
+}
+
+// Data for the proofing page.
+type proofingData struct {
+	Title       string
+	Description string
+	ProoferName string
+	Base        string
+	Notice      string
+	Images      []proofingImage
+	Selections  []proofingSelection
+	NewName     string // of the new selection, as typed
+}
+
+type proofingImage struct {
+	Filename string
+	Src      string
+	Caption  string
+	Favorite bool
+}
+
+type proofingSelection struct {
+	ID        int
+	Name      string
+	Favorites bool
+	Submitted string // "" until submitted
+	Images    []proofingSelectionImage
+}
+
+type proofingSelectionImage struct {
+	Filename string
+	Src      string
+	Note     string
+}
+
+// Render the proofing page of the gallery.
+func (p Proofing) Show(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	p.renderShow(w, r, scope, proofingData{})
+}
+
+func (p Proofing) renderShow(w http.ResponseWriter, r *http.Request, scope *proofingScope, data proofingData, errs ...error) {
+	data.Title = scope.Gallery.Title
+	data.Description = scope.Gallery.Description
+	data.ProoferName = scope.ProoferName
+	data.Base = scope.Base
+	selections, err := p.ProofingService.Selections(scope.Gallery.ID, scope.Proofer)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	favorites := make(map[string]bool)
+	for _, selection := range selections {
+		row := proofingSelection{
+			ID:        selection.ID,
+			Name:      selection.Name,
+			Favorites: selection.Favorites,
+		}
+		if !selection.SubmittedAt.IsZero() {
+			row.Submitted = formatScheduleTime(selection.SubmittedAt)
+		}
+		for _, image := range selection.Images {
+			if selection.Favorites {
+				favorites[image.Filename] = true
+			}
+			row.Images = append(row.Images, proofingSelectionImage{
+				Filename: image.Filename,
+				Src:      scope.ImagesPath + url.PathEscape(image.Filename),
+				Note:     image.Note,
+			})
+		}
+		data.Selections = append(data.Selections, row)
+	}
+	images, err := p.GalleryService.Images(scope.Gallery.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, image := range images {
+		data.Images = append(data.Images, proofingImage{
+			Filename: image.Filename,
+			Src:      scope.ImagesPath + url.PathEscape(image.Filename),
+			Caption:  image.Caption,
+			Favorite: favorites[image.Filename],
+		})
+	}
+	p.Templates.Show.Execute(w, r, data, errs...)
+}
+
+// Serve the images of the gallery to the client of a share link.
+func (p Proofing) Image(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	image, err := p.GalleryService.Image(scope.Gallery.ID, chi.URLParam(r, "filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, image.Path)
+}
+
+// Add an image to the favorites of the client, or remove it.
+func (p Proofing) Favorite(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	favorite := r.FormValue("favorite") == "true"
+	err = p.ProofingService.Favorite(scope.Gallery.ID, scope.Proofer, r.FormValue("filename"), favorite)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "image not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, scope.Base, http.StatusFound)
+}
+
+// Create a selection for the client.
+func (p Proofing) CreateSelection(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	name := r.FormValue("name")
+	_, err = p.ProofingService.CreateSelection(scope.Gallery.ID, scope.Proofer, name)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrSelectionNameRequired):
+			err = apperrors.Public(err, "Give the selection a name, of at most 100 characters")
+		case errors.Is(err, models.ErrSelectionNameTaken):
+			err = apperrors.Public(err, "You already have a selection with that name")
+		default:
+			fmt.Println(err) // rudimentary logging
+		}
+		p.renderShow(w, r, scope, proofingData{NewName: name}, err)
+		return
+	}
+	http.Redirect(w, r, scope.Base, http.StatusFound)
+}
+
+// Add an image to a selection of the client, or update its note.
+func (p Proofing) SetImage(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	selectionId, err := strconv.Atoi(r.FormValue("selection_id"))
+	if err != nil {
+		http.Error(w, "selection not found", http.StatusNotFound)
+		return
+	}
+	err = p.ProofingService.SetSelectionImage(selectionId, scope.Proofer, r.FormValue("filename"), r.FormValue("note"))
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrNotFound):
+			http.Error(w, "selection or image not found", http.StatusNotFound)
+		case errors.Is(err, models.ErrNoteTooLong):
+			p.renderShow(w, r, scope, proofingData{}, apperrors.Public(err, "Notes can't be longer than 1000 characters"))
+		default:
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+		}
+		return
+	}
+	http.Redirect(w, r, scope.Base, http.StatusFound)
+}
+
+// Remove an image from a selection of the client.
+func (p Proofing) RemoveImage(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	selectionId, err := strconv.Atoi(r.FormValue("selection_id"))
+	if err != nil {
+		http.Error(w, "selection not found", http.StatusNotFound)
+		return
+	}
+	err = p.ProofingService.RemoveSelectionImage(selectionId, scope.Proofer, r.FormValue("filename"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "selection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, scope.Base, http.StatusFound)
+}
+
+// Submit a selection of the client to the photographer, who gets an email
+// about it.
+func (p Proofing) Submit(w http.ResponseWriter, r *http.Request) {
+	scope, err := p.scope(w, r)
+	if err != nil {
+		return
+	}
+	selectionId, err := strconv.Atoi(chi.URLParam(r, "selectionId"))
+	if err != nil {
+		http.Error(w, "selection not found", http.StatusNotFound)
+		return
+	}
+	selection, err := p.ProofingService.WithActor(actor(r)).SubmitSelection(selectionId, scope.Proofer)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "selection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	gallery := scope.Gallery
+	notice := models.SelectionSubmittedNotice{
+		GalleryTitle:  gallery.Title,
+		SelectionName: selection.Name,
+		ProoferName:   scope.ProoferName,
+		Images:        len(selection.Images),
+		URL:           fmt.Sprintf("%s/galleries/%d/selections", p.PublicURL, gallery.ID),
+	}
+	sendInBackground(func() error {
+		to, err := p.GalleryService.OwnerEmail(gallery)
+		if err != nil || to == "" {
+			return err
+		}
+		return p.EmailService.SelectionSubmitted(to, notice)
+	})
+	data := proofingData{
+		Notice: fmt.Sprintf("%q was sent to the photographer. You can still change it, and send it again.", selection.Name),
+	}
+	p.renderShow(w, r, scope, data)
+}
+
+// Data for the selections page of a gallery.
+type selectionsData struct {
+	ID         int
+	Title      string
+	Path       string
+	Label      string            // of the new share link, as typed
+	Created    *createdShareLink // Just created: the only time its link is known
+	ShareLinks []shareLinkRow
+	Selections []submittedSelection
+}
+
+type createdShareLink struct {
+	Label string
+	Link  string
+}
+
+type shareLinkRow struct {
+	ID        int
+	Label     string
+	CreatedAt string
+}
+
+type submittedSelection struct {
+	ID          int
+	Name        string
+	ProoferName string
+	SubmittedAt string
+	Images      []models.SelectionImage
+	ExportPath  string
+	Lightroom   string
+}
+
+// Render the share links of the gallery, and the selections its clients
+// submitted.
+func (p Proofing) Selections(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.editableGallery(w, r)
+	if err != nil {
+		return
+	}
+	p.renderSelections(w, r, gallery, selectionsData{})
+}
+
+func (p Proofing) renderSelections(w http.ResponseWriter, r *http.Request, gallery *models.Gallery, data selectionsData, errs ...error) {
+	data.ID = gallery.ID
+	data.Title = gallery.Title
+	data.Path = galleryPath(gallery)
+	links, err := p.ProofingService.ShareLinks(gallery.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, link := range links {
+		data.ShareLinks = append(data.ShareLinks, shareLinkRow{
+			ID:        link.ID,
+			Label:     link.Label,
+			CreatedAt: link.CreatedAt.UTC().Format("2006-01-02 15:04 MST"),
+		})
+	}
+	selections, err := p.ProofingService.SubmittedSelections(gallery.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	for _, selection := range selections {
+		data.Selections = append(data.Selections, submittedSelection{
+			ID:          selection.ID,
+			Name:        selection.Name,
+			ProoferName: selection.ProoferName,
+			SubmittedAt: formatScheduleTime(selection.SubmittedAt),
+			Images:      selection.Images,
+			ExportPath:  fmt.Sprintf("/galleries/%d/selections/%d/export.csv", gallery.ID, selection.ID),
+			Lightroom:   models.LightroomFilter(&selection),
+		})
+	}
+	p.Templates.Selections.Execute(w, r, data, errs...)
+}
+
+// Create a share link to the gallery. Its link is shown once.
+func (p Proofing) CreateShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.editableGallery(w, r)
+	if err != nil {
+		return
+	}
+	label := r.FormValue("label")
+	user := context.User(r.Context())
+	link, err := p.ProofingService.WithActor(actor(r)).CreateShareLink(gallery, label, user.ID)
+	if err != nil {
+		if errors.Is(err, models.ErrShareLinkLabelRequired) {
+			err = apperrors.Public(err, "Say who the link is for, in at most 100 characters")
+		} else {
+			fmt.Println(err) // rudimentary logging
+		}
+		p.renderSelections(w, r, gallery, selectionsData{Label: label}, err)
+		return
+	}
+	data := selectionsData{
+		Created: &createdShareLink{
+			Label: link.Label,
+			Link:  p.PublicURL + "/s/" + url.PathEscape(link.Token),
+		},
+	}
+	p.renderSelections(w, r, gallery, data)
+}
+
+// Revoke a share link of the gallery: it stops working, but what its client
+// submitted stays.
+func (p Proofing) RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.editableGallery(w, r)
+	if err != nil {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "shareId"))
+	if err != nil {
+		http.Error(w, "share link not found", http.StatusNotFound)
+		return
+	}
+	err = p.ProofingService.WithActor(actor(r)).RevokeShareLink(gallery, id)
+	if err != nil && !errors.Is(err, models.ErrNotFound) {
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/galleries/%d/selections", gallery.ID), http.StatusFound)
+}
+
+// Download a submitted selection as CSV: the filename and note of each image.
+func (p Proofing) ExportSelection(w http.ResponseWriter, r *http.Request) {
+	gallery, err := p.editableGallery(w, r)
+	if err != nil {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "selectionId"))
+	if err != nil {
+		http.Error(w, "selection not found", http.StatusNotFound)
+		return
+	}
+	selection, err := p.ProofingService.SubmittedSelection(gallery.ID, id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "selection not found", http.StatusNotFound)
+			return
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
+	}
+	filename := fmt.Sprintf("gallery-%d-selection-%d.csv", gallery.ID, selection.ID)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	err = models.WriteSelectionCSV(w, selection)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+}
+
+// Loads the gallery at /galleries/{id} for its editors, like
+// Galleries.galleryById with userCanEditGallery.
+func (p Proofing) editableGallery(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusNotFound)
+		return nil, err
+	}
+	gallery, err := p.GalleryService.GalleryById(id)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			http.Error(w, "gallery not found", http.StatusNotFound)
+			return nil, err
+		}
+		fmt.Println(err) // rudimentary logging
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return nil, err
+	}
+	err = userCanEditGallery(p.GalleryService)(w, r, gallery)
+	if err != nil {
+		return nil, err
+	}
+	return gallery, nil
+}
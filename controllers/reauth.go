@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lifebalance/lenslocked/apperrors"
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Data for the password confirmation template.
+type confirmPasswordData struct {
+	Email       string
+	Next        string
+	HasPassword bool // Otherwise only the confirmation link is offered
+}
+
+// Render the password confirmation page (see UserMiddleware.RequireRecentAuth).
+func (u Users) ConfirmPassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	data := confirmPasswordData{
+		Email:       user.Email,
+		Next:        safeRedirectPath(r.FormValue("next")),
+		HasPassword: u.hasPassword(user),
+	}
+	u.Templates.ConfirmPassword.Execute(w, r, data)
+}
+
+// Process form submission to confirm the password. Failures count against
+// the same throttle and lockout as signing in, so this page can't be used to
+// guess passwords either.
+func (u Users) ProcessConfirmPassword(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	data := confirmPasswordData{
+		Email:       user.Email,
+		Next:        safeRedirectPath(r.FormValue("next")),
+		HasPassword: u.hasPassword(user),
+	}
+	if !data.HasPassword {
+		// Not a failed attempt: there's no password to get right.
+		err := apperrors.Public(models.ErrInvalidCredentials, "Your account doesn't have a password. Confirm with a link by email instead.")
+		u.Templates.ConfirmPassword.Execute(w, r, data, err)
+		return
+	}
+	err := u.checkPassword(r, u.authenticator(), user.Email, r.FormValue("password"))
+	if err != nil {
+		u.Templates.ConfirmPassword.Execute(w, r, data, err)
+		return
+	}
+	sessionCookie, err := readCookie(r, CookieName)
+	if err != nil {
+		http.Redirect(w, r, "/signin", http.StatusFound)
+		return
+	}
+	err = u.SessionService.WithActor(actor(r)).Reauthenticate(sessionCookie)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, data.Next, http.StatusFound)
+}
+
+// Process the "Email me a link" button of the confirmation page, for users
+// without a password (or who forgot it). The link is a sign in link: signing
+// in again counts as a recent authentication, and it sends them on to Next.
+func (u Users) ProcessConfirmByLink(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	data := confirmPasswordData{
+		Email:       user.Email,
+		Next:        safeRedirectPath(r.FormValue("next")),
+		HasPassword: u.hasPassword(user),
+	}
+	emailKey, ipKey := "magiclink:email:"+strings.ToLower(user.Email), "magiclink:ip:"+clientIP(r)
+	err := u.ThrottleService.Check(emailKey, ipKey)
+	if err != nil {
+		var throttledErr models.ThrottledError
+		if errors.As(err, &throttledErr) {
+			err = apperrors.Public(err, fmt.Sprintf(
+				"Too many links requested. Please try again in %s.",
+				throttledErr.RetryAfter,
+			))
+		}
+		u.Templates.ConfirmPassword.Execute(w, r, data, err)
+		return
+	}
+	for _, key := range []string{emailKey, ipKey} {
+		_, err = u.ThrottleService.Hit(key)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+
+	link, err := u.MagicLinkService.Create(user.Email)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		return
+	}
+	vals := url.Values{
+		"token": {link.Token},
+		"next":  {data.Next},
+	}
+	signInUrl := u.PublicURL + "/signin/link?" + vals.Encode()
+	sendInBackground(func() error {
+		return u.EmailService.MagicLink(user.Email, signInUrl)
+	})
+	u.Templates.MagicLinkSent.Execute(w, r, data)
+}
+
+// Whether the user has a password to confirm: a local one, or (maybe) one in
+// the directory. Accounts created through OIDC or a sign in link don't.
+func (u Users) hasPassword(user *models.User) bool {
+	return user.PasswordHash != "" || u.authenticator() != models.Authenticator(u.UserService)
+}
+
+// Checks the password of a signed in user with auth, for the pages that ask
+// for it again. Failures count against the same throttle and lockout as
+// signing in. Returns the error to show to the user.
+func (u Users) checkPassword(r *http.Request, auth models.Authenticator, email, password string) error {
+	emailKey, ipKey := signInThrottleKeys(email, clientIP(r))
+	err := u.ThrottleService.Check(emailKey, ipKey)
+	if err != nil {
+		var throttledErr models.ThrottledError
+		if errors.As(err, &throttledErr) {
+			err = apperrors.Public(err, fmt.Sprintf(
+				"Too many attempts. Please try again in %s.",
+				throttledErr.RetryAfter,
+			))
+		}
+		return err
+	}
+	_, err = auth.Authenticate(email, password)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountLocked):
+			err = apperrors.Public(err, lockedAccountMessage)
+		case errors.Is(err, models.ErrInvalidCredentials), errors.Is(err, models.ErrEmailTaken):
+			// The directory password of an entry that isn't linked to this
+			// account is a wrong password all the same.
+			err = u.signInFailed(r, email, err)
+		}
+		return err
+	}
+	err = u.ThrottleService.Reset(emailKey)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// Returns the IP address of the client that sent the request.
+// Proxy headers (X-Forwarded-For...) are ignored, since they can be spoofed.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Who is making the request, for the audit log.
+func actor(r *http.Request) models.Actor {
+	actor := models.Actor{
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if user := context.User(r.Context()); user != nil {
+		actor.UserID = user.ID
+	}
+	// What admins do while impersonating someone is on them.
+	if impersonation := context.Impersonation(r.Context()); impersonation != nil {
+		actor.UserID = impersonation.AdminID
+	}
+	return actor
+}
+
+// Where to send the user back to after an interruption (e.g. confirming their
+// password). Form submissions can't be replayed, so for those it's the page
+// the form was on.
+func returnPath(r *http.Request) string {
+	if r.Method == http.MethodGet {
+		return r.URL.RequestURI()
+	}
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host {
+		return "/users/me"
+	}
+	return safeRedirectPath(referer.RequestURI())
+}
+
+// Only allows local paths, so that our redirects can't send users to another
+// site ("//evil.com", "https://evil.com"...).
+func safeRedirectPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return "/users/me"
+	}
+	return path
+}
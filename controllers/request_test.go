@@ -0,0 +1,26 @@
+package controllers
+
+import "testing"
+
+func TestSafeRedirectPath(t *testing.T) {
+	for _, path := range []string{"/", "/galleries/1", "/galleries?page=2#top"} {
+		if got := safeRedirectPath(path); got != path {
+			t.Errorf("safeRedirectPath(%q) = %q, want it unchanged", path, got)
+		}
+	}
+	// Anything that isn't a local path goes to the account settings.
+	offsite := []string{
+		"",
+		"galleries/1",
+		"//evil.com",
+		"//evil.com/users/me",
+		"/\\evil.com",
+		"https://evil.com",
+		"javascript:alert(1)",
+	}
+	for _, path := range offsite {
+		if got := safeRedirectPath(path); got != "/users/me" {
+			t.Errorf("safeRedirectPath(%q) = %q, want /users/me", path, got)
+		}
+	}
+}
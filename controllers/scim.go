@@ -0,0 +1,683 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+// SCIM 2.0 schemas (RFC 7643, RFC 7644).
+const (
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaSPConfig     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+)
+
+// The SCIM 2.0 API (/scim/v2), used by the identity providers of
+// organizations to provision their users. Requests are authenticated with the
+// bearer token of an organization, and only see the users it manages.
+//
+// Invalid tokens count against the IP address of the client, so that tokens
+// can't be guessed.
+type SCIM struct {
+	SCIMService     *models.SCIMService
+	ThrottleService *models.ThrottleService
+	// Used to build the location of the resources, e.g. "https://lenslocked.com"
+	PublicURL string
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created,omitempty"`
+	Location     string `json:"location"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type scimUserResource struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Emails     []scimEmail `json:"emails"`
+	Active     bool        `json:"active"`
+	Groups     []scimRef   `json:"groups"`
+	Meta       scimMeta    `json:"meta"`
+}
+
+type scimGroupResource struct {
+	Schemas     []string  `json:"schemas"`
+	ID          string    `json:"id"`
+	DisplayName string    `json:"displayName"`
+	Members     []scimRef `json:"members"`
+	Meta        scimMeta  `json:"meta"`
+}
+
+type scimListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+func (s SCIM) userResource(user models.SCIMUser) scimUserResource {
+	resource := scimUserResource{
+		Schemas:    []string{scimSchemaUser},
+		ID:         strconv.FormatUint(uint64(user.ID), 10),
+		ExternalID: user.ExternalID,
+		UserName:   user.Email,
+		Emails:     []scimEmail{{Value: user.Email, Primary: true}},
+		Active:     user.Active,
+		Groups:     []scimRef{},
+		Meta: scimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt.UTC().Format(time.RFC3339),
+			Location:     s.PublicURL + "/scim/v2/Users/" + strconv.FormatUint(uint64(user.ID), 10),
+		},
+	}
+	if user.Role != "" {
+		resource.Groups = append(resource.Groups, scimRef{
+			Value:   user.Role,
+			Display: user.Role,
+			Ref:     s.PublicURL + "/scim/v2/Groups/" + user.Role,
+		})
+	}
+	return resource
+}
+
+func (s SCIM) groupResource(group models.SCIMGroup) scimGroupResource {
+	resource := scimGroupResource{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          group.Role,
+		DisplayName: group.Role,
+		Members:     []scimRef{},
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Location:     s.PublicURL + "/scim/v2/Groups/" + group.Role,
+		},
+	}
+	for _, user := range group.Members {
+		userId := strconv.FormatUint(uint64(user.ID), 10)
+		resource.Members = append(resource.Members, scimRef{
+			Value:   userId,
+			Display: user.Email,
+			Ref:     s.PublicURL + "/scim/v2/Users/" + userId,
+		})
+	}
+	return resource
+}
+
+// What this implementation supports.
+func (s SCIM) ServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.organization(w, r); err != nil {
+		return
+	}
+	supported := func(supported bool) map[string]any {
+		return map[string]any{"supported": supported}
+	}
+	writeSCIM(w, http.StatusOK, map[string]any{
+		"schemas":        []string{scimSchemaSPConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": models.DefaultSCIMListLimit},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "The SCIM token of the organization",
+		}},
+		"meta": scimMeta{
+			ResourceType: "ServiceProviderConfig",
+			Location:     s.PublicURL + "/scim/v2/ServiceProviderConfig",
+		},
+	})
+}
+
+// List the users, e.g. ?filter=userName eq "bob@example.com"&startIndex=1&count=10
+func (s SCIM) ListUsers(w http.ResponseWriter, r *http.Request) {
+	org, err := s.organization(w, r)
+	if err != nil {
+		return
+	}
+	filter, err := parseSCIMFilter(r.FormValue("filter"))
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	startIndex, count := scimPage(r)
+	users, total, err := s.SCIMService.Users(org.ID, filter, startIndex-1, count)
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	list := scimListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(users),
+		Resources:    []any{},
+	}
+	for _, user := range users {
+		list.Resources = append(list.Resources, s.userResource(user))
+	}
+	writeSCIM(w, http.StatusOK, list)
+}
+
+func (s SCIM) GetUser(w http.ResponseWriter, r *http.Request) {
+	s.userAction(w, r, func(org *models.Organization, user *models.SCIMUser) (*models.SCIMUser, error) {
+		return user, nil
+	})
+}
+
+// scimUserInput is what identity providers send to create or replace users.
+// Attributes we don't store (name, displayName...) are ignored.
+type scimUserInput struct {
+	UserName   string      `json:"userName"`
+	ExternalID string      `json:"externalId"`
+	Active     *bool       `json:"active"`
+	Emails     []scimEmail `json:"emails"`
+}
+
+// The email of the user: the userName if it's one, the primary email
+// otherwise.
+func (input scimUserInput) email() string {
+	if strings.Contains(input.UserName, "@") || len(input.Emails) == 0 {
+		return input.UserName
+	}
+	for _, email := range input.Emails {
+		if email.Primary {
+			return email.Value
+		}
+	}
+	return input.Emails[0].Value
+}
+
+func (input scimUserInput) user(id uint) models.SCIMUser {
+	user := models.SCIMUser{
+		ID:         id,
+		Email:      input.email(),
+		ExternalID: input.ExternalID,
+		Active:     true,
+	}
+	if input.Active != nil {
+		user.Active = *input.Active
+	}
+	return user
+}
+
+// Provision a user.
+func (s SCIM) CreateUser(w http.ResponseWriter, r *http.Request) {
+	org, err := s.organization(w, r)
+	if err != nil {
+		return
+	}
+	var input scimUserInput
+	err = json.NewDecoder(r.Body).Decode(&input)
+	if err != nil {
+		scimError(w, fmt.Errorf("%w: %w", models.ErrInvalidSCIMUser, err))
+		return
+	}
+	user, err := s.SCIMService.WithActor(actor(r)).CreateUser(org.ID, input.user(0))
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	resource := s.userResource(*user)
+	w.Header().Set("Location", resource.Meta.Location)
+	writeSCIM(w, http.StatusCreated, resource)
+}
+
+// Replace a user (PUT).
+func (s SCIM) ReplaceUser(w http.ResponseWriter, r *http.Request) {
+	s.userAction(w, r, func(org *models.Organization, user *models.SCIMUser) (*models.SCIMUser, error) {
+		var input scimUserInput
+		err := json.NewDecoder(r.Body).Decode(&input)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", models.ErrInvalidSCIMUser, err)
+		}
+		return s.SCIMService.WithActor(actor(r)).UpdateUser(org.ID, input.user(user.ID))
+	})
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+// The path of emails, e.g. `emails[type eq "work"].value`
+var scimEmailsPath = regexp.MustCompile(`^emails(\[[^\]]*\])?(\.value)?$`)
+
+// Update some attributes of a user (PATCH), e.g. `active` to deprovision them.
+func (s SCIM) PatchUser(w http.ResponseWriter, r *http.Request) {
+	s.userAction(w, r, func(org *models.Organization, user *models.SCIMUser) (*models.SCIMUser, error) {
+		var patch scimPatchRequest
+		err := json.NewDecoder(r.Body).Decode(&patch)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", models.ErrInvalidSCIMUser, err)
+		}
+		updated := *user
+		for _, op := range patch.Operations {
+			switch strings.ToLower(op.Op) {
+			case "add", "replace":
+			default:
+				// Removing the userName, active... makes no sense here.
+				return nil, fmt.Errorf("%w: unsupported op %q", models.ErrInvalidSCIMUser, op.Op)
+			}
+			values := map[string]json.RawMessage{op.Path: op.Value}
+			if op.Path == "" {
+				// No path: the value holds the attributes.
+				values = nil
+				err := json.Unmarshal(op.Value, &values)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", models.ErrInvalidSCIMUser, err)
+				}
+			}
+			for path, value := range values {
+				err := patchSCIMUser(&updated, path, value)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return s.SCIMService.WithActor(actor(r)).UpdateUser(org.ID, updated)
+	})
+}
+
+func patchSCIMUser(user *models.SCIMUser, path string, value json.RawMessage) error {
+	var err error
+	switch path = strings.ToLower(path); {
+	case path == "active":
+		user.Active, err = scimBool(value)
+	case path == "username":
+		err = json.Unmarshal(value, &user.Email)
+	case path == "externalid":
+		err = json.Unmarshal(value, &user.ExternalID)
+	case scimEmailsPath.MatchString(path):
+		var emails []scimEmail
+		if json.Unmarshal(value, &emails) == nil {
+			for _, email := range emails {
+				if email.Primary || len(emails) == 1 {
+					user.Email = email.Value
+				}
+			}
+		} else {
+			err = json.Unmarshal(value, &user.Email)
+		}
+	}
+	// Other attributes (name, displayName...) aren't stored.
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", models.ErrInvalidSCIMUser, path, err)
+	}
+	return nil
+}
+
+// Some identity providers send booleans as strings ("False").
+func scimBool(value json.RawMessage) (bool, error) {
+	var b bool
+	err := json.Unmarshal(value, &b)
+	if err == nil {
+		return b, nil
+	}
+	var s string
+	err = json.Unmarshal(value, &s)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(s)
+}
+
+// Deprovision a user. The account is disabled, not deleted: it keeps its
+// galleries, and shows as inactive.
+func (s SCIM) DeleteUser(w http.ResponseWriter, r *http.Request) {
+	org, user, err := s.user(w, r)
+	if err != nil {
+		return
+	}
+	err = s.SCIMService.WithActor(actor(r)).Deprovision(org.ID, user.ID)
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Runs an action on the user of the URL, and responds with the user it
+// returns.
+func (s SCIM) userAction(w http.ResponseWriter, r *http.Request, action func(*models.Organization, *models.SCIMUser) (*models.SCIMUser, error)) {
+	org, user, err := s.user(w, r)
+	if err != nil {
+		return
+	}
+	user, err = action(org, user)
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, s.userResource(*user))
+}
+
+// Loads the organization of the request, and its user of the URL.
+func (s SCIM) user(w http.ResponseWriter, r *http.Request) (*models.Organization, *models.SCIMUser, error) {
+	org, err := s.organization(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	userId, err := strconv.ParseUint(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		scimError(w, models.ErrNotFound)
+		return nil, nil, err
+	}
+	user, err := s.SCIMService.User(org.ID, uint(userId))
+	if err != nil {
+		scimError(w, err)
+		return nil, nil, err
+	}
+	return org, user, nil
+}
+
+// List the groups (the roles of the organization), e.g.
+// ?filter=displayName eq "admin"
+func (s SCIM) ListGroups(w http.ResponseWriter, r *http.Request) {
+	org, err := s.organization(w, r)
+	if err != nil {
+		return
+	}
+	filter, err := parseSCIMFilter(r.FormValue("filter"))
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	if filter != nil {
+		attribute := strings.ToLower(filter.Attribute)
+		if (attribute != "displayname" && attribute != "id") || strings.ToLower(filter.Operator) != "eq" {
+			scimError(w, models.ErrInvalidSCIMFilter)
+			return
+		}
+	}
+	groups, err := s.SCIMService.Groups(org.ID)
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	list := scimListResponse{
+		Schemas:    []string{scimSchemaListResponse},
+		StartIndex: 1,
+		Resources:  []any{},
+	}
+	for _, group := range groups {
+		if filter != nil && !strings.EqualFold(group.Role, filter.Value) {
+			continue
+		}
+		list.Resources = append(list.Resources, s.groupResource(group))
+	}
+	list.TotalResults = len(list.Resources)
+	list.ItemsPerPage = len(list.Resources)
+	writeSCIM(w, http.StatusOK, list)
+}
+
+func (s SCIM) GetGroup(w http.ResponseWriter, r *http.Request) {
+	org, err := s.organization(w, r)
+	if err != nil {
+		return
+	}
+	group, err := s.group(org, chi.URLParam(r, "id"))
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, s.groupResource(*group))
+}
+
+func (s SCIM) group(org *models.Organization, role string) (*models.SCIMGroup, error) {
+	groups, err := s.SCIMService.Groups(org.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range groups {
+		if group.Role == role {
+			return &group, nil
+		}
+	}
+	return nil, models.ErrNotFound
+}
+
+// The members filter of group patches, e.g. `members[value eq "12"]`
+var scimMembersPath = regexp.MustCompile(`(?i)^members\[value eq "(\d+)"\]$`)
+
+// Add or remove members of a group (PATCH), i.e. change their role.
+func (s SCIM) PatchGroup(w http.ResponseWriter, r *http.Request) {
+	org, err := s.organization(w, r)
+	if err != nil {
+		return
+	}
+	group, err := s.group(org, chi.URLParam(r, "id"))
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	var patch scimPatchRequest
+	err = json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		scimError(w, fmt.Errorf("%w: %w", models.ErrInvalidSCIMUser, err))
+		return
+	}
+	svc := s.SCIMService.WithActor(actor(r))
+	for _, op := range patch.Operations {
+		// Members of the value, if any.
+		var members []scimRef
+		if len(op.Value) > 0 {
+			err = json.Unmarshal(op.Value, &members)
+			if err != nil {
+				scimError(w, fmt.Errorf("%w: members: %w", models.ErrInvalidSCIMUser, err))
+				return
+			}
+		}
+		if match := scimMembersPath.FindStringSubmatch(op.Path); match != nil {
+			members = []scimRef{{Value: match[1]}}
+		} else if !strings.EqualFold(op.Path, "members") {
+			// displayName and the like can't change.
+			scimError(w, fmt.Errorf("%w: unsupported path %q", models.ErrInvalidSCIMUser, op.Path))
+			return
+		}
+		change := svc.AddToGroup
+		switch strings.ToLower(op.Op) {
+		case "add":
+		case "remove":
+			change = svc.RemoveFromGroup
+		case "replace":
+			// Those who aren't in the new list leave the group.
+			for _, current := range group.Members {
+				if !scimRefsContain(members, current.ID) {
+					err = svc.RemoveFromGroup(org.ID, group.Role, current.ID)
+					if err != nil {
+						scimError(w, err)
+						return
+					}
+				}
+			}
+		default:
+			scimError(w, fmt.Errorf("%w: unsupported op %q", models.ErrInvalidSCIMUser, op.Op))
+			return
+		}
+		for _, member := range members {
+			userId, err := strconv.ParseUint(member.Value, 10, 32)
+			if err != nil {
+				scimError(w, fmt.Errorf("%w: member %q", models.ErrInvalidSCIMUser, member.Value))
+				return
+			}
+			err = change(org.ID, group.Role, uint(userId))
+			if err != nil {
+				scimError(w, err)
+				return
+			}
+		}
+	}
+	group, err = s.group(org, group.Role)
+	if err != nil {
+		scimError(w, err)
+		return
+	}
+	writeSCIM(w, http.StatusOK, s.groupResource(*group))
+}
+
+func scimRefsContain(refs []scimRef, userId uint) bool {
+	for _, ref := range refs {
+		if ref.Value == strconv.FormatUint(uint64(userId), 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// Groups are the roles of the organization: they can't be created, renamed
+// or deleted.
+func (s SCIM) GroupsReadOnly(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.organization(w, r); err != nil {
+		return
+	}
+	writeSCIMError(w, http.StatusForbidden, "mutability", "Groups are the roles of the organization (owner, admin, member) and can't be changed")
+}
+
+// Loads the organization of the bearer token. Responds with a 401 if there's
+// no valid token, and a 429 if the client sent too many invalid ones.
+func (s SCIM) organization(w http.ResponseWriter, r *http.Request) (*models.Organization, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		writeSCIMError(w, http.StatusUnauthorized, "", "A bearer token is required")
+		return nil, errors.New("scim: no bearer token")
+	}
+	ipKey := "scim:ip:" + clientIP(r)
+	err := s.ThrottleService.Check(ipKey)
+	if err != nil {
+		var throttledErr models.ThrottledError
+		if errors.As(err, &throttledErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(throttledErr.RetryAfter.Seconds()))))
+			writeSCIMError(w, http.StatusTooManyRequests, "", "Too many invalid tokens, please try again later")
+			return nil, err
+		}
+		scimError(w, err)
+		return nil, err
+	}
+	org, err := s.SCIMService.Organization(strings.TrimSpace(token))
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			_, hitErr := s.ThrottleService.Hit(ipKey)
+			if hitErr != nil {
+				fmt.Println(hitErr) // rudimentary logging
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim", error="invalid_token"`)
+			writeSCIMError(w, http.StatusUnauthorized, "", "Invalid bearer token")
+			return nil, err
+		}
+		scimError(w, err)
+		return nil, err
+	}
+	return org, nil
+}
+
+// Reads startIndex (1-based) and count from the query string.
+func scimPage(r *http.Request) (int, int) {
+	startIndex, err := strconv.Atoi(r.FormValue("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.FormValue("count"))
+	if err != nil || count < 1 || count > models.DefaultSCIMListLimit {
+		count = models.DefaultSCIMListLimit
+	}
+	return startIndex, count
+}
+
+var (
+	scimFilterCompare = regexp.MustCompile(`(?i)^\s*([a-z][\w.]*)\s+(eq|ne|co|sw|ew)\s+("(?:[^"\\]|\\.)*")\s*$`)
+	scimFilterPresent = regexp.MustCompile(`(?i)^\s*([a-z][\w.]*)\s+pr\s*$`)
+)
+
+// Parses simple SCIM filters: `attribute op "value"` and `attribute pr`.
+// Returns nil for an empty filter.
+func parseSCIMFilter(filter string) (*models.SCIMFilter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+	if match := scimFilterPresent.FindStringSubmatch(filter); match != nil {
+		return &models.SCIMFilter{Attribute: match[1], Operator: "pr"}, nil
+	}
+	match := scimFilterCompare.FindStringSubmatch(filter)
+	if match == nil {
+		return nil, fmt.Errorf("%w: %q", models.ErrInvalidSCIMFilter, filter)
+	}
+	value, err := strconv.Unquote(match[3])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", models.ErrInvalidSCIMFilter, filter)
+	}
+	return &models.SCIMFilter{Attribute: match[1], Operator: strings.ToLower(match[2]), Value: value}, nil
+}
+
+// Responds with the SCIM error matching err.
+func scimError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrNotFound):
+		writeSCIMError(w, http.StatusNotFound, "", "Resource not found")
+	case errors.Is(err, models.ErrEmailTaken):
+		writeSCIMError(w, http.StatusConflict, "uniqueness", "There's already an account with this email. Only accounts created through SCIM can be managed")
+	case errors.Is(err, models.ErrInvalidSCIMFilter):
+		writeSCIMError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+	case errors.Is(err, models.ErrInvalidSCIMUser):
+		writeSCIMError(w, http.StatusBadRequest, "invalidValue", err.Error())
+	case errors.Is(err, models.ErrLastOwner):
+		writeSCIMError(w, http.StatusBadRequest, "mutability", "The organization needs at least one owner")
+	default:
+		fmt.Println(err) // rudimentary logging
+		writeSCIMError(w, http.StatusInternalServerError, "", "Something went wrong")
+	}
+}
+
+func writeSCIMError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]any{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	writeSCIM(w, status, body)
+}
+
+func writeSCIM(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+}
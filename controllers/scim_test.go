@@ -0,0 +1,189 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lifebalance/lenslocked/migrations"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    *models.SCIMFilter
+		wantErr bool
+	}{
+		{filter: "", want: nil},
+		{filter: "   ", want: nil},
+		{
+			filter: `userName eq "bob@example.com"`,
+			want:   &models.SCIMFilter{Attribute: "userName", Operator: "eq", Value: "bob@example.com"},
+		},
+		{
+			filter: `  USERNAME EQ "Bob"  `,
+			want:   &models.SCIMFilter{Attribute: "USERNAME", Operator: "eq", Value: "Bob"},
+		},
+		{
+			filter: `emails.value co "example.com"`,
+			want:   &models.SCIMFilter{Attribute: "emails.value", Operator: "co", Value: "example.com"},
+		},
+		{
+			filter: `externalId sw "a\"b\\c"`,
+			want:   &models.SCIMFilter{Attribute: "externalId", Operator: "sw", Value: `a"b\c`},
+		},
+		{
+			filter: `userName ew ""`,
+			want:   &models.SCIMFilter{Attribute: "userName", Operator: "ew", Value: ""},
+		},
+		{
+			filter: "externalId pr",
+			want:   &models.SCIMFilter{Attribute: "externalId", Operator: "pr"},
+		},
+		{filter: "userName", wantErr: true},
+		{filter: "userName eq bob@example.com", wantErr: true},
+		{filter: `userName gt "bob"`, wantErr: true},
+		{filter: `userName eq "bob`, wantErr: true},
+		{filter: `userName eq "bob" and active eq true`, wantErr: true},
+		{filter: `1userName eq "bob"`, wantErr: true},
+		{filter: `userName eq "\q"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := parseSCIMFilter(tt.filter)
+			if tt.wantErr {
+				if !errors.Is(err, models.ErrInvalidSCIMFilter) {
+					t.Errorf("parseSCIMFilter() = %+v, %v, want %v", got, err, models.ErrInvalidSCIMFilter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSCIMFilter() err = %v", err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("parseSCIMFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchSCIMUser(t *testing.T) {
+	original := models.SCIMUser{
+		ID:         1,
+		Email:      "bob@example.com",
+		ExternalID: "ext-1",
+		Active:     true,
+		Role:       models.OrgRoleMember,
+	}
+	tests := []struct {
+		name    string
+		path    string
+		value   string
+		want    func(user *models.SCIMUser)
+		wantErr bool
+	}{
+		{name: "deactivate", path: "active", value: `false`, want: func(user *models.SCIMUser) { user.Active = false }},
+		{name: "case insensitive", path: "Active", value: `false`, want: func(user *models.SCIMUser) { user.Active = false }},
+		{name: "boolean as a string", path: "active", value: `"False"`, want: func(user *models.SCIMUser) { user.Active = false }},
+		{name: "not a boolean", path: "active", value: `"nope"`, wantErr: true},
+		{name: "userName", path: "userName", value: `"alice@example.com"`, want: func(user *models.SCIMUser) { user.Email = "alice@example.com" }},
+		{name: "userName not a string", path: "userName", value: `42`, wantErr: true},
+		{name: "externalId", path: "externalId", value: `"ext-2"`, want: func(user *models.SCIMUser) { user.ExternalID = "ext-2" }},
+		{
+			name:  "primary email",
+			path:  "emails",
+			value: `[{"value": "work@example.com"}, {"value": "alice@example.com", "primary": true}]`,
+			want:  func(user *models.SCIMUser) { user.Email = "alice@example.com" },
+		},
+		{
+			name:  "single email",
+			path:  "emails",
+			value: `[{"value": "alice@example.com"}]`,
+			want:  func(user *models.SCIMUser) { user.Email = "alice@example.com" },
+		},
+		{
+			name:  "several emails, none primary",
+			path:  "emails",
+			value: `[{"value": "work@example.com"}, {"value": "home@example.com"}]`,
+			want:  func(user *models.SCIMUser) {},
+		},
+		{
+			name:  "email value",
+			path:  `emails[type eq "work"].value`,
+			value: `"alice@example.com"`,
+			want:  func(user *models.SCIMUser) { user.Email = "alice@example.com" },
+		},
+		{name: "email not a string", path: "emails.value", value: `{}`, wantErr: true},
+		{name: "ignored attribute", path: "name.givenName", value: `"Alice"`, want: func(user *models.SCIMUser) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := original
+			err := patchSCIMUser(&user, tt.path, json.RawMessage(tt.value))
+			if tt.wantErr {
+				if !errors.Is(err, models.ErrInvalidSCIMUser) {
+					t.Errorf("patchSCIMUser() err = %v, want %v", err, models.ErrInvalidSCIMUser)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("patchSCIMUser() err = %v", err)
+			}
+			want := original
+			tt.want(&want)
+			if user != want {
+				t.Errorf("patchSCIMUser() = %+v, want %+v", user, want)
+			}
+		})
+	}
+}
+
+func TestSCIMThrottlesInvalidTokens(t *testing.T) {
+	dsn := os.Getenv("LENSLOCKED_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("LENSLOCKED_TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	defer db.Close()
+	err = models.MigrateFS(db, migrations.FS, ".")
+	if err != nil {
+		t.Fatalf("migrate test db: %v", err)
+	}
+	s := SCIM{
+		SCIMService:     &models.SCIMService{DB: db},
+		ThrottleService: &models.ThrottleService{DB: db, FreeHits: 2, BaseDelay: time.Minute},
+	}
+	// A client of its own, as the counters are kept in the database.
+	remoteAddr := fmt.Sprintf("scim-test-%d:1234", time.Now().UnixNano())
+	request := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/scim/v2/ServiceProviderConfig", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.ServiceProviderConfig(w, r)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := request("invalid"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("invalid token #%d: status = %d, want %d", i+1, w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := request("invalid")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header")
+	}
+}
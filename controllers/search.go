@@ -0,0 +1,128 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/lifebalance/lenslocked/context"
+	"github.com/lifebalance/lenslocked/models"
+)
+
+const popularTagsLimit = 20
+
+type Search struct {
+	Templates struct {
+		Index Template
+	}
+	SearchService *models.SearchService
+}
+
+// Render the search page, with the results of the query in the query string:
+// q (the text), tag (any number of them) and page.
+func (s Search) Index(w http.ResponseWriter, r *http.Request) {
+	type Result struct {
+		Path      string // of the gallery
+		ImagePath string // of the image, for image results
+		Filename  string
+		Title     []models.SnippetPart
+		Snippet   []models.SnippetPart
+		Tags      []string
+	}
+	type Tag struct {
+		Tag      string
+		Count    int
+		Selected bool
+		Toggle   string // search URL with the tag added, or removed
+	}
+	var data struct {
+		Query       string
+		Tags        []string
+		PopularTags []Tag
+		Results     []Result
+		Searched    bool
+		Page        int
+		PrevPage    string // URL of the previous page, "" for none
+		NextPage    string
+	}
+	var userId uint
+	if user := context.User(r.Context()); user != nil {
+		userId = user.ID
+	}
+	data.Query = r.FormValue("q")
+	data.Tags = models.ParseTags(strings.Join(r.URL.Query()["tag"], ","))
+	data.Page, _ = strconv.Atoi(r.FormValue("page"))
+	data.Page = max(data.Page, 1)
+
+	popularTags, err := s.SearchService.PopularTags(userId, popularTagsLimit)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	for _, tag := range popularTags {
+		selected := slices.Contains(data.Tags, tag.Tag)
+		toggled := append(slices.Clone(data.Tags), tag.Tag)
+		if selected {
+			toggled = slices.DeleteFunc(slices.Clone(data.Tags), func(t string) bool { return t == tag.Tag })
+		}
+		data.PopularTags = append(data.PopularTags, Tag{
+			Tag:      tag.Tag,
+			Count:    tag.Count,
+			Selected: selected,
+			Toggle:   searchPath(data.Query, toggled, 1),
+		})
+	}
+	data.Searched = data.Query != "" || len(data.Tags) > 0
+	if data.Searched {
+		// One more than shown, to know whether there's a next page.
+		results, err := s.SearchService.Search(models.SearchQuery{
+			Text:   data.Query,
+			Tags:   data.Tags,
+			UserID: userId,
+			Limit:  models.DefaultSearchLimit + 1,
+			Offset: (data.Page - 1) * models.DefaultSearchLimit,
+		})
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			http.Error(w, "something went wrong", http.StatusInternalServerError)
+			return
+		}
+		if len(results) > models.DefaultSearchLimit {
+			results = results[:models.DefaultSearchLimit]
+			data.NextPage = searchPath(data.Query, data.Tags, data.Page+1)
+		}
+		if data.Page > 1 {
+			data.PrevPage = searchPath(data.Query, data.Tags, data.Page-1)
+		}
+		for _, result := range results {
+			path := galleryPath(&result.Gallery)
+			var imagePath string
+			if result.Filename != "" {
+				imagePath = path + "/images/" + url.PathEscape(result.Filename)
+			}
+			data.Results = append(data.Results, Result{
+				Path:      path,
+				ImagePath: imagePath,
+				Filename:  result.Filename,
+				Title:     result.Title,
+				Snippet:   result.Snippet,
+				Tags:      result.Tags,
+			})
+		}
+	}
+	s.Templates.Index.Execute(w, r, data)
+}
+
+func searchPath(query string, tags []string, page int) string {
+	values := url.Values{}
+	if query != "" {
+		values.Set("q", query)
+	}
+	for _, tag := range tags {
+		values.Add("tag", tag)
+	}
+	values.Set("page", strconv.Itoa(page))
+	return "/search?" + values.Encode()
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/lifebalance/lenslocked/apperrors"
 	"github.com/lifebalance/lenslocked/context"
@@ -13,60 +15,132 @@ import (
 
 type Users struct {
 	Templates struct {
-		New            Template
-		SignIn         Template
-		ForgotPassword Template
-		CheckYourEmail Template
-		ResetPassword  Template
+		New             Template
+		SignIn          Template
+		ForgotPassword  Template
+		CheckYourEmail  Template
+		ResetPassword   Template
+		Settings        Template
+		MagicLinkSent   Template
+		MagicLink       Template
+		ConfirmPassword Template
+		SecurityHistory Template
+		NotMe           Template
 	}
-	UserService          *models.UserService
-	SessionService       *models.SessionService
-	PasswordResetService *models.PasswordResetService
-	EmailService         *models.EmailService
+	UserService            *models.UserService
+	SessionService         *models.SessionService
+	PasswordResetService   *models.PasswordResetService
+	EmailService           *models.EmailService
+	ThrottleService        *models.ThrottleService
+	AuditService           *models.AuditService
+	NotificationService    *models.NotificationService
+	AccountRecoveryService *models.AccountRecoveryService
+	DeviceService          *models.DeviceService
+	EmailChangeService     *models.EmailChangeService
+	AccountDeletionService *models.AccountDeletionService
+	ExportService          *models.ExportService
+	OIDCService            *models.OIDCService
+	MagicLinkService       *models.MagicLinkService
+	InvitationService      *models.InvitationService
+	ImpersonationService   *models.ImpersonationService
+	OrganizationService    *models.OrganizationService
+	ProfileService         *models.ProfileService
+	// Signing up requires an invitation code.
+	InviteOnly bool
+	// Checks emails and passwords (e.g. our DB, then LDAP). Defaults to the
+	// UserService.
+	Authenticator models.Authenticator
+	// Used to build the links sent by email, e.g. "https://lenslocked.com"
+	PublicURL string
+}
+
+// Data for the signup template.
+type signUpData struct {
+	Email      string
+	Invite     string // invitation code
+	EmailFixed bool   // the invitation is bound to Email
+	InviteOnly bool
 }
 
 func (u Users) New(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
+	data := signUpData{
+		Email:      r.FormValue("email"), // parse query string
+		Invite:     r.FormValue("invite"),
+		InviteOnly: u.InviteOnly,
+	}
+	// Invitation links only carry the code: fill in the rest from it.
+	if data.Invite != "" && u.InvitationService != nil {
+		invitation, err := u.InvitationService.Lookup(data.Invite)
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidInvitation) {
+				err = apperrors.Public(err, "This invitation is invalid, used up or expired")
+			}
+			u.Templates.New.Execute(w, r, data, err)
+			return
+		}
+		if invitation.Email != "" {
+			data.Email = invitation.Email
+			data.EmailFixed = true
+		}
 	}
-	data.Email = r.FormValue("email")   // parse query string
 	u.Templates.New.Execute(w, r, data) // render email in the template
 }
 
 func (u Users) Create(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email    string
-		Password string
+	data := signUpData{
+		Email:      r.FormValue("email"),
+		Invite:     strings.TrimSpace(r.FormValue("invite")),
+		InviteOnly: u.InviteOnly,
 	}
-	data.Email = r.FormValue("email")
-	data.Password = r.FormValue("password")
-	user, err := u.UserService.Create(data.Email, data.Password)
+	password := r.FormValue("password")
+	var invitation *models.Invitation
+	if u.InviteOnly {
+		var err error
+		invitation, err = u.InvitationService.Redeem(data.Invite, data.Email)
+		if err != nil {
+			if errors.Is(err, models.ErrInvalidInvitation) {
+				err = apperrors.Public(err, "This invitation code is invalid, used up, expired, or for another email address")
+			}
+			u.Templates.New.Execute(w, r, data, err)
+			return
+		}
+		data.EmailFixed = invitation.Email != ""
+	}
+	user, err := u.UserService.WithActor(actor(r)).Create(data.Email, password)
 	if err != nil {
+		if invitation != nil {
+			if err := u.InvitationService.Release(invitation.ID); err != nil {
+				fmt.Println(err) // rudimentary logging
+			}
+		}
 		if errors.Is(err, models.ErrEmailTaken) {
 			err = apperrors.Public(err, "That email is already taken")
 		}
+		err = u.passwordPolicyError(err)
 		u.Templates.New.Execute(w, r, data, err)
-		fmt.Println(err.Error()) // rudimentary logging
-		http.Error(w, "something went wrong", http.StatusInternalServerError)
-		return
-	}
-	session, err := u.SessionService.Upsert(uint(user.ID))
-	if err != nil {
-		fmt.Println(err.Error()) // rudimentary logging
-		// TODO: show a warning about the issue
-		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	setCookie(w, CookieName, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	u.signIn(w, r, user)
+}
+
+// Data for the sign in template.
+type signInData struct {
+	Email     string
+	Providers []*models.OIDCProvider // "Sign in with..." buttons
 }
 
 func (u Users) SignIn(w http.ResponseWriter, r *http.Request) {
-	var data struct {
-		Email string
+	u.renderSignIn(w, r, r.FormValue("email"))
+}
+
+func (u Users) renderSignIn(w http.ResponseWriter, r *http.Request, email string, errs ...error) {
+	data := signInData{
+		Email: email,
 	}
-	data.Email = r.FormValue("email")
-	u.Templates.SignIn.Execute(w, r, data)
+	if u.OIDCService != nil {
+		data.Providers = u.OIDCService.ProviderList()
+	}
+	u.Templates.SignIn.Execute(w, r, data, errs...)
 }
 
 func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
@@ -76,26 +150,103 @@ func (u Users) ProcessSignIn(w http.ResponseWriter, r *http.Request) {
 	}
 	data.Email = r.FormValue("email")
 	data.Password = r.FormValue("password")
-	user, err := u.UserService.Authenticate(data.Email, data.Password)
+	ip := clientIP(r)
+	emailKey, ipKey := signInThrottleKeys(data.Email, ip)
+
+	err := u.ThrottleService.Check(emailKey, ipKey)
 	if err != nil {
-		fmt.Println(err.Error()) // rudimentary logging
-		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		var throttledErr models.ThrottledError
+		if errors.As(err, &throttledErr) {
+			err = apperrors.Public(err, fmt.Sprintf(
+				"Too many sign in attempts. Please try again in %s.",
+				throttledErr.RetryAfter,
+			))
+		}
+		u.renderSignIn(w, r, data.Email, err)
+		return
+	}
+
+	user, err := u.authenticator().Authenticate(data.Email, data.Password)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrAccountLocked):
+			err = apperrors.Public(err, lockedAccountMessage)
+		case errors.Is(err, models.ErrInvalidCredentials):
+			err = u.signInFailed(r, data.Email, err)
+		case errors.Is(err, models.ErrEmailTaken):
+			// The directory knows the email, but the account with this email
+			// isn't linked to it.
+			err = apperrors.Public(err, "There's already an account with this email, which isn't linked to the directory. Sign in with its password, or ask an administrator.")
+		}
+		u.renderSignIn(w, r, data.Email, err)
 		return
 	}
-	session, err := u.SessionService.Upsert(uint(user.ID))
+	err = u.ThrottleService.Reset(emailKey)
 	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	u.signIn(w, r, user)
+}
+
+func (u Users) authenticator() models.Authenticator {
+	if u.Authenticator == nil {
+		return u.UserService
+	}
+	return u.Authenticator
+}
+
+// Starts a session for a user that has been authenticated (by any means), and
+// sends them to their account, or back to the "next" page of the form.
+func (u Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) {
+	session, err := u.SessionService.WithActor(actor(r)).Upsert(uint(user.ID))
+	if err != nil {
+		if errors.Is(err, models.ErrAccountDisabled) {
+			u.renderSignIn(w, r, user.Email, apperrors.Public(err, "This account has been disabled. Contact us if you think this is a mistake."))
+			return
+		}
 		fmt.Println(err.Error()) // rudimentary logging
 		// TODO: show a warning about the issue
+		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
 	setCookie(w, CookieName, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	u.checkDevice(w, r, user)
+	http.Redirect(w, r, safeRedirectPath(r.FormValue("next")), http.StatusFound)
+}
+
+const lockedAccountMessage = "Your account has been temporarily locked after too many failed sign in attempts. Reset your password to unlock it."
+
+// Counts a failed sign in against the email and the IP, locking the account
+// when there were too many of them. Returns the error to show to the user.
+func (u Users) signInFailed(r *http.Request, email string, authErr error) error {
+	userService := u.UserService.WithActor(actor(r))
+	userService.SignInFailed(email)
+	emailKey, ipKey := signInThrottleKeys(email, clientIP(r))
+	_, err := u.ThrottleService.Hit(ipKey)
+	if err != nil {
+		return err
+	}
+	failures, err := u.ThrottleService.Hit(emailKey)
+	if err != nil {
+		return err
+	}
+	if !userService.ShouldLock(failures) {
+		return apperrors.Public(authErr, "Invalid email or password")
+	}
+	user, err := userService.Lock(email)
+	if err != nil {
+		if errors.Is(err, models.ErrNotFound) {
+			// Don't reveal that the account doesn't exist.
+			return apperrors.Public(authErr, lockedAccountMessage)
+		}
+		return err
+	}
+	u.notify(r, user.ID, user.Email, models.NoticeAccountLocked, "")
+	return apperrors.Public(models.ErrAccountLocked, lockedAccountMessage)
 }
 
-func (u Users) CurrentUser(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := context.User(ctx)
-	fmt.Fprintf(w, "Current user: %s\n", user.Email)
+func signInThrottleKeys(email, ip string) (emailKey, ipKey string) {
+	return "signin:email:" + strings.ToLower(email), "signin:ip:" + ip
 }
 
 func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
@@ -105,7 +256,16 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/signin", http.StatusFound)
 		return
 	}
-	err = u.SessionService.DeleteSession(sessionToken)
+	// Signing out while impersonating signs the admin out, ending the
+	// impersonation first.
+	if impersonation := context.Impersonation(r.Context()); impersonation != nil {
+		err = u.ImpersonationService.WithActor(actor(r)).End(impersonation.ID)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+		deleteCookie(w, ImpersonationCookieName)
+	}
+	err = u.SessionService.WithActor(actor(r)).DeleteSession(sessionToken)
 	if err != nil {
 		fmt.Println(err)
 		http.Error(w, "Something went wrong", http.StatusInternalServerError)
@@ -114,8 +274,22 @@ func (u Users) ProcessSignOut(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/signin", http.StatusFound)
 }
 
+const (
+	DefaultRecentAuthWindow = 15 * time.Minute
+)
+
+/*
+RecentAuthWindow is how long after signing in (or confirming their password)
+users can perform sensitive actions without being asked for their password
+again. See RequireRecentAuth.
+
+ImpersonationService is optional: without it, impersonation cookies are
+ignored.
+*/
 type UserMiddleware struct {
-	SessionService *models.SessionService
+	SessionService       *models.SessionService
+	ImpersonationService *models.ImpersonationService
+	RecentAuthWindow     time.Duration // Defaults to DefaultRecentAuthWindow
 }
 
 func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
@@ -133,11 +307,28 @@ func (umw UserMiddleware) SetUser(next http.Handler) http.Handler {
 		}
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		// Admins impersonating someone see the app as that user.
+		if impersonationCookie, err := readCookie(r, ImpersonationCookieName); err == nil {
+			impersonation, impersonated, err := umw.impersonation(impersonationCookie, user)
+			if err == nil {
+				ctx = context.WithUser(ctx, impersonated)
+				ctx = context.WithImpersonation(ctx, impersonation)
+			} else {
+				deleteCookie(w, ImpersonationCookieName) // ended, expired...
+			}
+		}
 		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
 	})
 }
 
+func (umw UserMiddleware) impersonation(token string, admin *models.User) (*models.Impersonation, *models.User, error) {
+	if umw.ImpersonationService == nil || admin.Role != models.RoleAdmin {
+		return nil, nil, models.ErrNotFound
+	}
+	return umw.ImpersonationService.Active(token, admin.ID)
+}
+
 func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := context.User(r.Context())
@@ -149,6 +340,70 @@ func (umw UserMiddleware) RequireUser(next http.Handler) http.Handler {
 	})
 }
 
+// Only lets admins through. Everybody else gets a 404, so the admin pages
+// don't advertise themselves.
+func (umw UserMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		if user.Role != models.RoleAdmin {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Blocks destructive actions (deletes, credential changes...) while an admin
+// impersonates the user: impersonation is for looking, not for changing
+// things on the user's behalf.
+func (umw UserMiddleware) BlockImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if context.Impersonation(r.Context()) != nil {
+			http.Error(w, "This action is disabled while impersonating a user", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Protects sensitive actions (deletes, credential changes...) from stolen or
+// forgotten sessions: users who didn't authenticate within RecentAuthWindow
+// are sent to the password confirmation page first, and then back to where
+// they were.
+//
+// Must run after RequireUser.
+func (umw UserMiddleware) RequireRecentAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionCookie, err := readCookie(r, CookieName)
+		if err != nil {
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		authenticatedAt, err := umw.SessionService.AuthenticatedAt(sessionCookie)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+			http.Redirect(w, r, "/signin", http.StatusFound)
+			return
+		}
+		window := umw.RecentAuthWindow
+		if window == 0 {
+			window = DefaultRecentAuthWindow
+		}
+		if time.Since(authenticatedAt) <= window {
+			next.ServeHTTP(w, r)
+			return
+		}
+		vals := url.Values{
+			"next": {returnPath(r)},
+		}
+		http.Redirect(w, r, "/users/confirm?"+vals.Encode(), http.StatusFound)
+	})
+}
+
 func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string
@@ -157,36 +412,53 @@ func (u Users) ForgotPassword(w http.ResponseWriter, r *http.Request) {
 	u.Templates.ForgotPassword.Execute(w, r, data)
 }
 
+// Sends a password reset link.
+//
+// The response is the same whether the email is registered or not, and the
+// email is sent in the background so the timing doesn't tell either.
 func (u Users) ProcessForgotPassword(w http.ResponseWriter, r *http.Request) {
 	var data struct {
 		Email string
 	}
 	data.Email = r.FormValue("email")
-	// Generate pwd reset token
-	passwordReset, err := u.PasswordResetService.Create(data.Email)
+	emailKey, ipKey := "forgotpwd:email:"+strings.ToLower(data.Email), "forgotpwd:ip:"+clientIP(r)
+
+	err := u.ThrottleService.Check(emailKey, ipKey)
 	if err != nil {
-		// TODO: Handle non-existing/wrong email addresses
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		var throttledErr models.ThrottledError
+		if errors.As(err, &throttledErr) {
+			err = apperrors.Public(err, fmt.Sprintf(
+				"Too many password reset requests. Please try again in %s.",
+				throttledErr.RetryAfter,
+			))
+		}
+		u.Templates.ForgotPassword.Execute(w, r, data, err)
 		return
 	}
-	// Send token to user's email
-	vals := url.Values{
-		"token": {passwordReset.Token},
+	for _, key := range []string{emailKey, ipKey} {
+		_, err = u.ThrottleService.Hit(key)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
 	}
-	// TODO: add URLs for prod/dev
-	resetUrl := "http://localhost:3000/reset-pwd?" + vals.Encode()
-	err = u.EmailService.ForgotPassword(data.Email, resetUrl)
-	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
-		return
+
+	passwordReset, err := u.PasswordResetService.WithActor(actor(r)).Create(data.Email)
+	switch {
+	case err == nil:
+		vals := url.Values{
+			"token": {passwordReset.Token},
+		}
+		resetUrl := u.PublicURL + "/reset-pwd?" + vals.Encode()
+		sendInBackground(func() error {
+			return u.EmailService.ForgotPassword(data.Email, resetUrl)
+		})
+	case errors.Is(err, models.ErrNotFound):
+		// Nothing to send, but don't tell.
+	default:
+		fmt.Println(err) // rudimentary logging
 	}
-	// Don't show the reset token in the template, just a friendly message!
-	// Otherwise any baddy could ask for a pwd reset and steal the token!
-	// 2 options:
-	// A. Don't wait - >"IF your email exists in our DB, you'd have received a pwd reset email!"
-	// B. Wait till sent - >"We have sent a pwd reset to the email: some-email@test.com"
+	// Never show the token here, only a message that doesn't tell whether
+	// the account exists.
 	u.Templates.CheckYourEmail.Execute(w, r, data)
 }
 
@@ -208,26 +480,81 @@ func (u Users) ProcessResetPassword(w http.ResponseWriter, r *http.Request) {
 	data.Token = r.FormValue("token")
 	data.Password = r.FormValue("password")
 
-	user, err := u.PasswordResetService.Consume(data.Token)
+	// Check the new password before consuming the token, so the user can try
+	// again with a different one.
+	user, err := u.PasswordResetService.Lookup(data.Token)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+		u.Templates.ResetPassword.Execute(w, r, data, apperrors.Public(err, "That reset link is invalid or has expired. Please ask for a new one."))
 		return
 	}
-	// Update the user's password in db
-	err = u.UserService.UpdatePassword(user.ID, data.Password)
+	err = u.UserService.ValidatePassword(user.Email, data.Password)
+	if err != nil {
+		u.Templates.ResetPassword.Execute(w, r, data, u.passwordPolicyError(err))
+		return
+	}
+	user, err = u.PasswordResetService.WithActor(actor(r)).Consume(data.Token)
 	if err != nil {
 		fmt.Println(err)
-		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		u.Templates.ResetPassword.Execute(w, r, data, apperrors.Public(err, "That reset link is invalid or has expired. Please ask for a new one."))
 		return
 	}
-	// Sign the user in (set the session).
-	session, err := u.SessionService.Upsert(user.ID)
-	// In case of error, redirect to signin page.
+	// Update the user's password in db (also unlocks the account)
+	err = u.UserService.WithActor(actor(r)).UpdatePassword(user.ID, data.Password)
 	if err != nil {
 		fmt.Println(err)
-		http.Redirect(w, r, "/signin", http.StatusFound)
+		http.Error(w, "something went wrong", http.StatusInternalServerError)
+		return
 	}
-	setCookie(w, CookieName, session.Token)
-	http.Redirect(w, r, "/users/me", http.StatusFound)
+	u.passwordChanged(r, user)
+	// Sign the user in (a new session, on this device only).
+	u.signIn(w, r, user)
+}
+
+// Whoever knew the old password (or had a link sent by email) must not keep
+// access: revokes every session and pending token of the user, and lets them
+// know by email (if they want to).
+func (u Users) passwordChanged(r *http.Request, user *models.User) {
+	err := u.SessionService.WithActor(actor(r)).DeleteForUser(user.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	err = u.PasswordResetService.DeleteForUser(user.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	if u.MagicLinkService != nil {
+		err = u.MagicLinkService.DeleteForUser(user.ID)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	emailKey, _ := signInThrottleKeys(user.Email, "")
+	err = u.ThrottleService.Reset(emailKey)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	u.notify(r, user.ID, user.Email, models.NoticePasswordChanged, "")
+}
+
+// Turns password policy violations into public errors. Other errors are
+// returned untouched.
+func (u Users) passwordPolicyError(err error) error {
+	policy := u.UserService.PasswordPolicy
+	if policy == nil {
+		policy = &models.PasswordPolicy{}
+	}
+	switch {
+	case errors.Is(err, models.ErrPasswordTooShort):
+		return apperrors.Public(err, fmt.Sprintf("Your password must be at least %d characters long", policy.MinLen()))
+	case errors.Is(err, models.ErrPasswordTooLong):
+		return apperrors.Public(err, fmt.Sprintf("Your password can't be longer than %d characters (fewer with accents or emoji)", policy.MaxLen()))
+	case errors.Is(err, models.ErrPasswordBanned):
+		return apperrors.Public(err, "That password is too common, please choose a different one")
+	case errors.Is(err, models.ErrPasswordLikeEmail):
+		return apperrors.Public(err, "Your password is too similar to your email address")
+	case errors.Is(err, models.ErrPasswordBreached):
+		return apperrors.Public(err, "That password has appeared in a data breach, please choose a different one")
+	}
+	return err
 }
@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // the schedule of galleries is in the browser's time zone
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/csrf"
@@ -25,8 +28,26 @@ type config struct {
 		Secure bool
 	}
 	Server struct {
-		Address string
+		Address   string
+		PublicURL string
 	}
+	AccountDeletion struct {
+		GracePeriod time.Duration
+	}
+	RecentAuth struct {
+		Window time.Duration
+	}
+	Signup struct {
+		InviteOnly bool
+	}
+	Lockout struct {
+		Threshold int
+		Duration  time.Duration
+	}
+	PasswordPolicy models.PasswordPolicy
+	PasswordHasher models.PasswordHasher
+	OIDCProviders  map[string]*models.OIDCProvider
+	LDAP           *models.LDAPAuthenticator // nil if not configured
 }
 
 func main() {
@@ -48,14 +69,66 @@ func main() {
 		panic(err)
 	}
 
+	// Audit log, written by most services
+	auditService := &models.AuditService{
+		DB: conn,
+	}
+	auditor := models.Auditor{
+		Audit: auditService,
+	}
+
 	// User services
 	userService := &models.UserService{
-		DB: conn,
+		DB:               conn,
+		LockoutThreshold: cfg.Lockout.Threshold,
+		LockoutDuration:  cfg.Lockout.Duration,
+		PasswordPolicy:   &cfg.PasswordPolicy,
+		Hasher:           &cfg.PasswordHasher,
+		Auditor:          auditor,
 	}
 	sessionService := &models.SessionService{
-		DB: conn,
+		DB:      conn,
+		Auditor: auditor,
 	}
 	passwordResetService := &models.PasswordResetService{
+		DB:      conn,
+		Auditor: auditor,
+	}
+	magicLinkService := &models.MagicLinkService{
+		DB: conn,
+	}
+	emailChangeService := &models.EmailChangeService{
+		DB: conn,
+	}
+	oidcService := &models.OIDCService{
+		DB:         conn,
+		Providers:  cfg.OIDCProviders,
+		InviteOnly: cfg.Signup.InviteOnly,
+	}
+	impersonationService := &models.ImpersonationService{
+		DB:      conn,
+		Auditor: auditor,
+	}
+	invitationService := &models.InvitationService{
+		DB:      conn,
+		Auditor: auditor,
+	}
+	// Local passwords first, so directory outages don't lock out local users.
+	var authenticator models.Authenticator = userService
+	if cfg.LDAP != nil {
+		cfg.LDAP.DB = conn
+		authenticator = models.Authenticators{userService, cfg.LDAP}
+	}
+	notificationService := &models.NotificationService{
+		DB: conn,
+	}
+	accountRecoveryService := &models.AccountRecoveryService{
+		DB: conn,
+	}
+	deviceService := &models.DeviceService{
+		DB: conn,
+	}
+	throttleService := &models.ThrottleService{
 		DB: conn,
 	}
 	emailService, err := models.NewEmailService(cfg.SMTP)
@@ -63,13 +136,89 @@ func main() {
 		panic(err)
 	}
 	// Gallery services
+	imageProcessor := &models.ImageProcessor{}
 	galleryService := &models.GalleryService{
+		DB:             conn,
+		ImageProcessor: imageProcessor,
+		Auditor:        auditor,
+	}
+	collectionService := &models.CollectionService{
+		DB:             conn,
+		GalleryService: galleryService,
+		Auditor:        auditor,
+	}
+	scheduleService := &models.GalleryScheduleService{
+		DB:             conn,
+		GalleryService: galleryService,
+		EmailService:   emailService,
+		PublicURL:      cfg.Server.PublicURL,
+		Auditor:        auditor,
+	}
+	commentService := &models.CommentService{
+		DB:             conn,
+		GalleryService: galleryService,
+		Auditor:        auditor,
+	}
+	annotationService := &models.AnnotationService{
+		DB:             conn,
+		GalleryService: galleryService,
+	}
+	proofingService := &models.ProofingService{
+		DB:             conn,
+		GalleryService: galleryService,
+		Auditor:        auditor,
+	}
+	searchService := &models.SearchService{
 		DB: conn,
 	}
+	profileService := &models.ProfileService{
+		DB:             conn,
+		ImageProcessor: imageProcessor,
+		Auditor:        auditor,
+	}
+	organizationService := &models.OrganizationService{
+		DB:                conn,
+		GalleryService:    galleryService,
+		InvitationService: invitationService,
+		Auditor:           auditor,
+	}
+	scimService := &models.SCIMService{
+		DB:                  conn,
+		UserService:         userService,
+		SessionService:      sessionService,
+		OrganizationService: organizationService,
+		Auditor:             auditor,
+	}
+
+	// Account services
+	accountDeletionService := &models.AccountDeletionService{
+		DB:             conn,
+		GalleryService: galleryService,
+		ProfileService: profileService,
+		EmailService:   emailService,
+		GracePeriod:    cfg.AccountDeletion.GracePeriod,
+	}
+	statsService := &models.StatsService{
+		DB: conn,
+	}
+	exportService := &models.ExportService{
+		DB:             conn,
+		GalleryService: galleryService,
+		AuditService:   auditService,
+	}
+
+	// Background jobs
+	go accountDeletionService.Run(time.Hour)
+	go scheduleService.Run(time.Minute)
 
 	// Set up the middleware
 	umw := controllers.UserMiddleware{
-		SessionService: sessionService,
+		SessionService:       sessionService,
+		ImpersonationService: impersonationService,
+		RecentAuthWindow:     cfg.RecentAuth.Window,
+	}
+	wmw := controllers.WorkspaceMiddleware{
+		OrganizationService: organizationService,
 	}
 
 	csrfMw := csrf.Protect(
@@ -103,10 +252,27 @@ func main() {
 
 	// Users controllers
 	usersController := controllers.Users{
-		UserService:          userService,
-		SessionService:       sessionService,
-		PasswordResetService: passwordResetService,
-		EmailService:         emailService,
+		UserService:            userService,
+		SessionService:         sessionService,
+		PasswordResetService:   passwordResetService,
+		EmailService:           emailService,
+		ThrottleService:        throttleService,
+		AuditService:           auditService,
+		NotificationService:    notificationService,
+		AccountRecoveryService: accountRecoveryService,
+		DeviceService:          deviceService,
+		EmailChangeService:     emailChangeService,
+		AccountDeletionService: accountDeletionService,
+		ExportService:          exportService,
+		OIDCService:            oidcService,
+		MagicLinkService:       magicLinkService,
+		InvitationService:      invitationService,
+		ImpersonationService:   impersonationService,
+		OrganizationService:    organizationService,
+		ProfileService:         profileService,
+		InviteOnly:             cfg.Signup.InviteOnly,
+		Authenticator:          authenticator,
+		PublicURL:              cfg.Server.PublicURL,
 	}
 	usersController.Templates.New = views.MustParse(
 		views.ParseFS(templates.FS, "signup.gohtml", "tailwind.gohtml"),
@@ -123,9 +289,68 @@ func main() {
 	usersController.Templates.ResetPassword = views.MustParse(
 		views.ParseFS(templates.FS, "reset-pwd.gohtml", "tailwind.gohtml"),
 	)
+	usersController.Templates.Settings = views.MustParse(
+		views.ParseFS(templates.FS, "settings.gohtml", "tailwind.gohtml"),
+	)
+	usersController.Templates.MagicLinkSent = views.MustParse(
+		views.ParseFS(templates.FS, "magic-link-sent.gohtml", "tailwind.gohtml"),
+	)
+	usersController.Templates.MagicLink = views.MustParse(
+		views.ParseFS(templates.FS, "magic-link.gohtml", "tailwind.gohtml"),
+	)
+	usersController.Templates.ConfirmPassword = views.MustParse(
+		views.ParseFS(templates.FS, "confirm-password.gohtml", "tailwind.gohtml"),
+	)
+	usersController.Templates.SecurityHistory = views.MustParse(
+		views.ParseFS(templates.FS, "security.gohtml", "tailwind.gohtml"),
+	)
+	usersController.Templates.NotMe = views.MustParse(
+		views.ParseFS(templates.FS, "not-me.gohtml", "tailwind.gohtml"),
+	)
+	// Admin controllers
+	adminController := controllers.Admin{
+		UserService:          userService,
+		SessionService:       sessionService,
+		PasswordResetService: passwordResetService,
+		MagicLinkService:     magicLinkService,
+		GalleryService:       galleryService,
+		StatsService:         statsService,
+		AuditService:         auditService,
+		InvitationService:    invitationService,
+		ImpersonationService: impersonationService,
+		EmailService:         emailService,
+		PublicURL:            cfg.Server.PublicURL,
+	}
+	adminController.Templates.Dashboard = views.MustParse(
+		views.ParseFS(templates.FS, "admin/dashboard.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
+	adminController.Templates.Users = views.MustParse(
+		views.ParseFS(templates.FS, "admin/users.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
+	adminController.Templates.User = views.MustParse(
+		views.ParseFS(templates.FS, "admin/user.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
+	adminController.Templates.Impersonations = views.MustParse(
+		views.ParseFS(templates.FS, "admin/impersonations.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
+	adminController.Templates.Galleries = views.MustParse(
+		views.ParseFS(templates.FS, "admin/galleries.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
+	adminController.Templates.Audit = views.MustParse(
+		views.ParseFS(templates.FS, "admin/audit.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
+	adminController.Templates.Invitations = views.MustParse(
+		views.ParseFS(templates.FS, "admin/invitations.gohtml", "admin/nav.gohtml", "tailwind.gohtml"),
+	)
 	// Galleries controllers
 	galleriesController := controllers.Galleries{
-		GalleryService: galleryService,
+		GalleryService:    galleryService,
+		CollectionService: collectionService,
+		ScheduleService:   scheduleService,
+		CommentService:    commentService,
+		AnnotationService: annotationService,
+		EmailService:      emailService,
+		PublicURL:         cfg.Server.PublicURL,
 	}
 	galleriesController.Templates.New = views.MustParse(
 		views.ParseFS(
@@ -155,11 +380,93 @@ func main() {
 			"tailwind.gohtml",
 		),
 	)
+	galleriesController.Templates.Unavailable = views.MustParse(
+		views.ParseFS(
+			templates.FS,
+			"galleries/unavailable.gohtml",
+			"tailwind.gohtml",
+		),
+	)
+	galleriesController.Templates.Image = views.MustParse(
+		views.ParseFS(
+			templates.FS,
+			"galleries/image.gohtml",
+			"tailwind.gohtml",
+		),
+	)
+	// Proofing controllers
+	proofingController := controllers.Proofing{
+		ProofingService: proofingService,
+		GalleryService:  galleryService,
+		EmailService:    emailService,
+		PublicURL:       cfg.Server.PublicURL,
+	}
+	proofingController.Templates.Show = views.MustParse(
+		views.ParseFS(templates.FS, "proofing/show.gohtml", "tailwind.gohtml"),
+	)
+	proofingController.Templates.Selections = views.MustParse(
+		views.ParseFS(templates.FS, "galleries/selections.gohtml", "tailwind.gohtml"),
+	)
+	// Collections controllers
+	collectionsController := controllers.Collections{
+		CollectionService: collectionService,
+	}
+	collectionsController.Templates.Show = views.MustParse(
+		views.ParseFS(templates.FS, "collections/show.gohtml", "tailwind.gohtml"),
+	)
+	// Search controllers
+	searchController := controllers.Search{
+		SearchService: searchService,
+	}
+	searchController.Templates.Index = views.MustParse(
+		views.ParseFS(templates.FS, "search.gohtml", "tailwind.gohtml"),
+	)
+	// Profiles controllers
+	profilesController := controllers.Profiles{
+		ProfileService: profileService,
+		GalleryService: galleryService,
+	}
+	profilesController.Templates.Show = views.MustParse(
+		views.ParseFS(templates.FS, "profiles/show.gohtml", "tailwind.gohtml"),
+	)
+	// Organizations controllers
+	organizationsController := controllers.Organizations{
+		OrganizationService: organizationService,
+		SCIMService:         scimService,
+		EmailService:        emailService,
+		PublicURL:           cfg.Server.PublicURL,
+	}
+	organizationsController.Templates.Index = views.MustParse(
+		views.ParseFS(templates.FS, "orgs/index.gohtml", "tailwind.gohtml"),
+	)
+	organizationsController.Templates.Show = views.MustParse(
+		views.ParseFS(templates.FS, "orgs/show.gohtml", "tailwind.gohtml"),
+	)
+	organizationsController.Templates.Invitation = views.MustParse(
+		views.ParseFS(templates.FS, "orgs/invitation.gohtml", "tailwind.gohtml"),
+	)
+	// SCIM API
+	scimController := controllers.SCIM{
+		SCIMService:     scimService,
+		ThrottleService: throttleService,
+		PublicURL:       cfg.Server.PublicURL,
+	}
 
 	// Set up router and routes
 	r := chi.NewRouter()
+	// The SCIM API authenticates with bearer tokens, not cookies: it isn't
+	// exposed to CSRF (and its clients have no CSRF token).
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/scim/") {
+				r = csrf.UnsafeSkipCheck(r)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
 	r.Use(csrfMw)
 	r.Use(umw.SetUser)
+	r.Use(wmw.SetWorkspace)
 	tpl := views.MustParse(views.ParseFS(templates.FS, "home.gohtml", "tailwind.gohtml"))
 	r.Get("/", controllers.StaticHandler(tpl))
 
@@ -173,30 +480,172 @@ func main() {
 	r.Post("/users", usersController.Create)         // process the form
 	r.Get("/signin", usersController.SignIn)         // send the form
 	r.Post("/signin", usersController.ProcessSignIn) // process the form
+	r.Post("/signin/magic-link", usersController.ProcessMagicLink)
+	r.Get("/signin/link", usersController.MagicLink)
+	r.Post("/signin/link", usersController.ProcessMagicLinkSignIn)
 	r.Post("/signout", usersController.ProcessSignOut)
+	r.Get("/oauth/{provider}", usersController.OIDCSignIn)
+	r.Get("/oauth/{provider}/callback", usersController.OIDCCallback)
 	r.Get("/forgot-pwd", usersController.ForgotPassword)
 	r.Post("/forgot-pwd", usersController.ProcessForgotPassword)
 	r.Get("/reset-pwd", usersController.ResetPassword)
 	r.Post("/reset-pwd", usersController.ProcessResetPassword)
+	r.Get("/users/email/confirm", usersController.ConfirmEmailChange)
+	r.Get("/users/delete/cancel", usersController.CancelDeletion)
+	r.Get("/users/not-me", usersController.NotMe)
+	r.Post("/users/not-me", usersController.ProcessNotMe)
+	r.With(umw.RequireUser).Get("/users/confirm", usersController.ConfirmPassword)
+	r.With(umw.RequireUser, umw.BlockImpersonation).Post("/users/confirm", usersController.ProcessConfirmPassword)
+	r.With(umw.RequireUser, umw.BlockImpersonation).Post("/users/confirm/link", usersController.ProcessConfirmByLink)
+	r.With(umw.RequireUser).Post("/impersonation/stop", adminController.StopImpersonation)
 	r.Route("/users/me", func(r chi.Router) {
 		r.Use(umw.RequireUser)
-		r.Get("/", usersController.CurrentUser)
+		r.Get("/", usersController.CurrentUser) // account settings
+		r.With(umw.BlockImpersonation).Get("/export", usersController.ExportData)
+		r.Get("/security", usersController.SecurityHistory)
+		r.With(umw.BlockImpersonation).Post("/notifications", usersController.ProcessNotificationPreferences)
+		r.With(umw.BlockImpersonation).Post("/delete/cancel", usersController.ProcessCancelDeletion)
+		r.With(umw.BlockImpersonation).Post("/profile", usersController.ProcessProfile)
+		r.With(umw.BlockImpersonation).Post("/avatar/delete", usersController.ProcessRemoveAvatar)
+		// Sensitive actions: the password must have been entered recently.
+		r.Group(func(r chi.Router) {
+			r.Use(umw.BlockImpersonation)
+			r.Use(umw.RequireRecentAuth)
+			r.Post("/password", usersController.ProcessChangePassword)
+			r.Post("/email", usersController.ProcessChangeEmail)
+			r.Post("/delete", usersController.ProcessDeleteAccount)
+		})
 	})
+	r.Get("/search", searchController.Index)
+	// Where clients pick images, with a share link or signed in.
+	proofingRoutes := func(r chi.Router) {
+		r.Get("/", proofingController.Show)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.BlockImpersonation)
+			r.Post("/favorites", proofingController.Favorite)
+			r.Post("/selections", proofingController.CreateSelection)
+			r.Post("/selections/images", proofingController.SetImage)
+			r.Post("/selections/images/remove", proofingController.RemoveImage)
+			r.Post("/selections/{selectionId}/submit", proofingController.Submit)
+		})
+	}
+	r.Route("/s/{token}", func(r chi.Router) {
+		proofingRoutes(r)
+		r.Get("/images/{filename}", proofingController.Image)
+	})
+	r.With(umw.RequireUser).Route("/u/{handle}/{slug}/proofing", proofingRoutes)
+	r.Get("/u/{handle}", profilesController.Show)
+	r.Get("/u/{handle}/{slug}", galleriesController.ShowBySlug)
+	r.Get("/u/{handle}/{slug}/images/{filename}", galleriesController.ImageBySlug)
+	r.Get("/u/{handle}/{slug}/images/{filename}/detail", galleriesController.ImagePageBySlug)
+	r.With(umw.RequireUser, umw.BlockImpersonation).Post("/u/{handle}/{slug}/images/{filename}/comments", galleriesController.CommentBySlug)
+	r.With(umw.RequireUser, umw.BlockImpersonation).Post("/u/{handle}/{slug}/images/{filename}/annotations", galleriesController.AnnotateBySlug)
+	r.With(umw.RequireUser, umw.BlockImpersonation, umw.RequireRecentAuth).Post("/u/{handle}/{slug}/images/{filename}/annotations/{annotationId}/delete", galleriesController.DeleteAnnotationBySlug)
+	r.With(umw.BlockImpersonation).Post("/u/{handle}/{slug}/subscribe", galleriesController.SubscribeBySlug)
+	r.Get("/avatars/{filename}", profilesController.Avatar)
 	r.Route("/galleries", func(r chi.Router) {
 		r.Get("/{id}", galleriesController.Show) // anybody can see galleries
 		r.Get("/{id}/images/{filename}", galleriesController.Image)
+		r.Get("/{id}/images/{filename}/detail", galleriesController.ImagePage)
+		r.With(umw.BlockImpersonation).Post("/{id}/subscribe", galleriesController.Subscribe)
+		r.Get("/unsubscribe", galleriesController.Unsubscribe)
 		// Group is needed so that only CREATING galleries require an authenticated user
 		r.Group(func(r chi.Router) {
 			r.Use(umw.RequireUser)
-			r.Get("/{id}/edit", galleriesController.Edit)    // send the form
-			r.Post("/{id}/edit", galleriesController.Update) // process the form
+			r.Get("/{id}/edit", galleriesController.Edit)                                 // send the form
+			r.With(umw.BlockImpersonation).Post("/{id}/edit", galleriesController.Update) // process the form
+			r.With(umw.BlockImpersonation).Post("/{id}/images", galleriesController.UploadImage)
+			r.With(umw.BlockImpersonation).Post("/{id}/images/{filename}/edit", galleriesController.UpdateImage)
+			r.With(umw.BlockImpersonation).Post("/{id}/images/{filename}/comments", galleriesController.Comment)
+			r.With(umw.BlockImpersonation).Post("/{id}/comments/{commentId}/show", galleriesController.ShowComment)
+			r.With(umw.BlockImpersonation).Post("/{id}/comments/{commentId}/hide", galleriesController.HideComment)
+			r.With(umw.BlockImpersonation, umw.RequireRecentAuth).Post("/{id}/comments/{commentId}/delete", galleriesController.DeleteComment)
+			r.With(umw.BlockImpersonation).Post("/{id}/images/{filename}/annotations", galleriesController.Annotate)
+			r.With(umw.BlockImpersonation, umw.RequireRecentAuth).Post("/{id}/images/{filename}/annotations/{annotationId}/delete", galleriesController.DeleteAnnotation)
+			r.With(umw.BlockImpersonation).Post("/{id}/annotations/{annotationId}/status", galleriesController.SetAnnotationStatus)
+			r.With(umw.BlockImpersonation).Get("/{id}/annotations/export.md", galleriesController.ExportAnnotations)
+			r.Route("/{id}/proofing", proofingRoutes)
+			r.Get("/{id}/selections", proofingController.Selections)
+			r.With(umw.BlockImpersonation).Get("/{id}/selections/{selectionId}/export.csv", proofingController.ExportSelection)
+			r.With(umw.BlockImpersonation, umw.RequireRecentAuth).Post("/{id}/shares", proofingController.CreateShareLink)
+			r.With(umw.BlockImpersonation).Post("/{id}/shares/{shareId}/revoke", proofingController.RevokeShareLink)
 			r.Get("/new", galleriesController.New)
-			r.Post("/", galleriesController.Create)
+			r.With(umw.BlockImpersonation).Post("/", galleriesController.Create)
 			r.Get("/", galleriesController.Index)
-			r.Post("/{id}/delete", galleriesController.Delete)
-			r.Post("/{id}/images/{filename}/delete", galleriesController.DeleteImage)
+			r.With(umw.BlockImpersonation, umw.RequireRecentAuth).Post("/{id}/delete", galleriesController.Delete)
+			r.With(umw.BlockImpersonation, umw.RequireRecentAuth).Post("/{id}/images/{filename}/delete", galleriesController.DeleteImage)
+		})
+	})
+	r.Route("/collections", func(r chi.Router) {
+		r.Get("/{id}", collectionsController.Show) // like galleries, per visibility
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/", collectionsController.Index)
+			r.With(umw.BlockImpersonation).Post("/", collectionsController.Create)
+			r.With(umw.BlockImpersonation).Post("/{id}/edit", collectionsController.Update)
+			r.With(umw.BlockImpersonation, umw.RequireRecentAuth).Post("/{id}/delete", collectionsController.Delete)
+		})
+	})
+	r.With(umw.RequireUser).Post("/workspace", organizationsController.SwitchWorkspace)
+	r.Route("/orgs", func(r chi.Router) {
+		// Signed out users are asked to sign in first.
+		r.Get("/invitations/accept", organizationsController.Invitation)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireUser)
+			r.Get("/", organizationsController.Index)
+			r.Get("/{id}", organizationsController.Show)
+			r.Group(func(r chi.Router) {
+				r.Use(umw.BlockImpersonation)
+				r.Post("/", organizationsController.Create)
+				r.Post("/invitations/accept", organizationsController.AcceptInvitation)
+				r.Post("/{id}", organizationsController.Rename)
+				r.Post("/{id}/invitations", organizationsController.Invite)
+				r.Post("/{id}/invitations/{invitationId}/revoke", organizationsController.RevokeInvitation)
+				r.Post("/{id}/members/{userId}/role", organizationsController.SetRole)
+				r.Post("/{id}/members/{userId}/remove", organizationsController.RemoveMember)
+				r.Post("/{id}/leave", organizationsController.Leave)
+				r.With(umw.RequireRecentAuth).Post("/{id}/delete", organizationsController.Delete)
+				r.With(umw.RequireRecentAuth).Post("/{id}/scim/token", organizationsController.CreateSCIMToken)
+				r.Post("/{id}/scim/token/revoke", organizationsController.RevokeSCIMToken)
+			})
 		})
 	})
+	r.Route("/scim/v2", func(r chi.Router) {
+		r.Get("/ServiceProviderConfig", scimController.ServiceProviderConfig)
+		r.Get("/Users", scimController.ListUsers)
+		r.Post("/Users", scimController.CreateUser)
+		r.Get("/Users/{id}", scimController.GetUser)
+		r.Put("/Users/{id}", scimController.ReplaceUser)
+		r.Patch("/Users/{id}", scimController.PatchUser)
+		r.Delete("/Users/{id}", scimController.DeleteUser)
+		r.Get("/Groups", scimController.ListGroups)
+		r.Post("/Groups", scimController.GroupsReadOnly)
+		r.Get("/Groups/{id}", scimController.GetGroup)
+		r.Patch("/Groups/{id}", scimController.PatchGroup)
+		r.Put("/Groups/{id}", scimController.GroupsReadOnly)
+		r.Delete("/Groups/{id}", scimController.GroupsReadOnly)
+	})
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(umw.RequireAdmin)
+		r.Get("/", adminController.Dashboard)
+		r.Get("/users", adminController.Users)
+		r.Get("/users/{id}", adminController.User)
+		r.Get("/galleries", adminController.Galleries)
+		r.Group(func(r chi.Router) {
+			r.Use(umw.RequireRecentAuth)
+			r.Post("/users/{id}/disable", adminController.DisableUser)
+			r.Post("/users/{id}/enable", adminController.EnableUser)
+			r.Post("/users/{id}/reset-password", adminController.ForcePasswordReset)
+			r.Post("/users/{id}/sessions/revoke", adminController.RevokeSessions)
+			r.Post("/users/{id}/impersonate", adminController.StartImpersonation)
+		})
+		r.Get("/audit", adminController.Audit)
+		r.Get("/audit/export", adminController.ExportAudit)
+		r.Get("/impersonations", adminController.Impersonations)
+		r.Get("/invitations", adminController.Invitations)
+		r.Post("/invitations", adminController.CreateInvitation)
+		r.Post("/invitations/{id}/revoke", adminController.RevokeInvitation)
+	})
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	})
@@ -236,6 +685,185 @@ func loadSMTPConfig() (models.SMTPConfig, error) {
 	return cfg, nil
 }
 
+// All the PASSWORD_* envs are optional. The breached passwords list is loaded
+// in memory once, at startup.
+func loadPasswordPolicy() (models.PasswordPolicy, error) {
+	var policy models.PasswordPolicy
+	var err error
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		policy.MinLength, err = strconv.Atoi(minLength)
+		if err != nil {
+			return policy, fmt.Errorf("invalid PASSWORD_MIN_LENGTH: %w", err)
+		}
+	}
+	if maxLength := os.Getenv("PASSWORD_MAX_LENGTH"); maxLength != "" {
+		policy.MaxLength, err = strconv.Atoi(maxLength)
+		if err != nil {
+			return policy, fmt.Errorf("invalid PASSWORD_MAX_LENGTH: %w", err)
+		}
+	}
+	if allow := os.Getenv("PASSWORD_ALLOW_EMAIL_SIMILARITY"); allow != "" {
+		policy.AllowEmailSimilarity, err = strconv.ParseBool(allow)
+		if err != nil {
+			return policy, fmt.Errorf("invalid PASSWORD_ALLOW_EMAIL_SIMILARITY: %w", err)
+		}
+	}
+	if bannedFile := os.Getenv("PASSWORD_BANNED_FILE"); bannedFile != "" {
+		policy.Banned, err = models.LoadBannedPasswords(bannedFile)
+		if err != nil {
+			return policy, err
+		}
+	}
+	if breachedFile := os.Getenv("PASSWORD_BREACHED_FILE"); breachedFile != "" {
+		policy.Breached, err = models.LoadBreachedPasswords(breachedFile)
+		if err != nil {
+			return policy, err
+		}
+		log.Printf("loaded %d breached passwords", policy.Breached.Len())
+	}
+	return policy, nil
+}
+
+// All the envs are optional; by default passwords are hashed with bcrypt.
+// Use `go run ./cmd/bcrypt tune` to find values that suit the server.
+func loadPasswordHasher() (models.PasswordHasher, error) {
+	hasher := models.PasswordHasher{
+		Algorithm: os.Getenv("PASSWORD_HASH_ALGORITHM"),
+	}
+	switch hasher.Algorithm {
+	case "", models.HashAlgorithmBcrypt, models.HashAlgorithmArgon2id:
+	default:
+		return hasher, fmt.Errorf("invalid PASSWORD_HASH_ALGORITHM: %s", hasher.Algorithm)
+	}
+	var err error
+	if cost := os.Getenv("BCRYPT_COST"); cost != "" {
+		hasher.BcryptCost, err = strconv.Atoi(cost)
+		if err != nil {
+			return hasher, fmt.Errorf("invalid BCRYPT_COST: %w", err)
+		}
+	}
+	uint32Envs := map[string]*uint32{
+		"ARGON2_TIME":   &hasher.Argon2.Time,
+		"ARGON2_MEMORY": &hasher.Argon2.Memory,
+	}
+	for name, dst := range uint32Envs {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return hasher, fmt.Errorf("invalid %s: %w", name, err)
+			}
+			*dst = uint32(parsed)
+		}
+	}
+	if threads := os.Getenv("ARGON2_THREADS"); threads != "" {
+		parsed, err := strconv.ParseUint(threads, 10, 8)
+		if err != nil {
+			return hasher, fmt.Errorf("invalid ARGON2_THREADS: %w", err)
+		}
+		hasher.Argon2.Threads = uint8(parsed)
+	}
+	return hasher, nil
+}
+
+/*
+OIDC_PROVIDERS is a comma separated list of names (used in the URLs), e.g.
+"google,okta". Each of them is configured with its own envs:
+
+	OIDC_GOOGLE_ISSUER=https://accounts.google.com
+	OIDC_GOOGLE_CLIENT_ID=...
+	OIDC_GOOGLE_CLIENT_SECRET=...
+	OIDC_GOOGLE_DISPLAY_NAME=Google  (optional)
+	OIDC_GOOGLE_SCOPES=openid email  (optional)
+
+The redirect URI to register with the provider is <PUBLIC_URL>/oauth/<name>/callback
+*/
+func loadOIDCProviders() (map[string]*models.OIDCProvider, error) {
+	providers := make(map[string]*models.OIDCProvider)
+	names := os.Getenv("OIDC_PROVIDERS")
+	if names == "" {
+		return providers, nil
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := models.OIDCProvider{
+			Name:         name,
+			DisplayName:  os.Getenv(prefix + "DISPLAY_NAME"),
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("missing %sISSUER or %sCLIENT_ID", prefix, prefix)
+		}
+		if provider.DisplayName == "" {
+			provider.DisplayName = name
+		}
+		providers[name] = &provider
+	}
+	return providers, nil
+}
+
+/*
+LDAP authentication is enabled by setting LDAP_URL:
+
+	LDAP_URL=ldaps://ldap.example.com
+	LDAP_START_TLS=false  (optional, for ldap:// URLs)
+	LDAP_BIND_DN=cn=lenslocked,ou=services,dc=example,dc=com
+	LDAP_BIND_PASSWORD=...
+	LDAP_BASE_DN=ou=people,dc=example,dc=com
+	LDAP_USER_FILTER=(mail=%s)  (optional)
+	LDAP_EMAIL_ATTRIBUTE=mail  (optional)
+	LDAP_GROUP_ATTRIBUTE=memberOf  (optional)
+	LDAP_GROUP_ROLES=cn=admins,ou=groups,dc=example,dc=com=>admin  (optional)
+
+LDAP_GROUP_ROLES maps group DNs to roles, separated by ";".
+*/
+func loadLDAP() (*models.LDAPAuthenticator, error) {
+	ldapURL := os.Getenv("LDAP_URL")
+	if ldapURL == "" {
+		return nil, nil
+	}
+	ldapAuth := models.LDAPAuthenticator{
+		URL:            ldapURL,
+		BindDN:         os.Getenv("LDAP_BIND_DN"),
+		BindPassword:   os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:         os.Getenv("LDAP_BASE_DN"),
+		UserFilter:     os.Getenv("LDAP_USER_FILTER"),
+		EmailAttribute: os.Getenv("LDAP_EMAIL_ATTRIBUTE"),
+		GroupAttribute: os.Getenv("LDAP_GROUP_ATTRIBUTE"),
+	}
+	if ldapAuth.BaseDN == "" {
+		return nil, fmt.Errorf("missing LDAP_BASE_DN")
+	}
+	if ldapAuth.UserFilter != "" && strings.Count(ldapAuth.UserFilter, "%s") != 1 {
+		return nil, fmt.Errorf("LDAP_USER_FILTER must contain %%s once")
+	}
+	if startTLS := os.Getenv("LDAP_START_TLS"); startTLS != "" {
+		var err error
+		ldapAuth.StartTLS, err = strconv.ParseBool(startTLS)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP_START_TLS: %w", err)
+		}
+	}
+	if groupRoles := os.Getenv("LDAP_GROUP_ROLES"); groupRoles != "" {
+		ldapAuth.GroupRoles = make(map[string]string)
+		for _, mapping := range strings.Split(groupRoles, ";") {
+			groupDN, role, ok := strings.Cut(mapping, "=>")
+			groupDN, role = strings.TrimSpace(groupDN), strings.TrimSpace(role)
+			if !ok || groupDN == "" || (role != models.RoleUser && role != models.RoleAdmin) {
+				return nil, fmt.Errorf("invalid LDAP_GROUP_ROLES entry: %q", mapping)
+			}
+			ldapAuth.GroupRoles[groupDN] = role
+		}
+	}
+	return &ldapAuth, nil
+}
+
 func loadEnvConfig() (config, error) {
 	var cfg config
 
@@ -271,6 +899,77 @@ func loadEnvConfig() (config, error) {
 
 	// Server
 	cfg.Server.Address = ":3000" //  TODO: Load from env
+	// Base URL for the links we send by email
+	cfg.Server.PublicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if cfg.Server.PublicURL == "" {
+		cfg.Server.PublicURL = "http://localhost:3000"
+	}
+
+	// Account deletion (optional)
+	if gracePeriod := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); gracePeriod != "" {
+		cfg.AccountDeletion.GracePeriod, err = time.ParseDuration(gracePeriod)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ACCOUNT_DELETION_GRACE_PERIOD: %w", err)
+		}
+	}
+
+	// How long after signing in sensitive actions are allowed without
+	// confirming the password again (optional)
+	if window := os.Getenv("RECENT_AUTH_WINDOW"); window != "" {
+		cfg.RecentAuth.Window, err = time.ParseDuration(window)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid RECENT_AUTH_WINDOW: %w", err)
+		}
+	}
+
+	// Signup (optional, open by default)
+	if inviteOnly := os.Getenv("INVITE_ONLY"); inviteOnly != "" {
+		cfg.Signup.InviteOnly, err = strconv.ParseBool(inviteOnly)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid INVITE_ONLY: %w", err)
+		}
+	}
+
+	// Lockout (optional, the UserService has sensible defaults)
+	if threshold := os.Getenv("LOCKOUT_THRESHOLD"); threshold != "" {
+		cfg.Lockout.Threshold, err = strconv.Atoi(threshold)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid LOCKOUT_THRESHOLD: %w", err)
+		}
+	}
+	if duration := os.Getenv("LOCKOUT_DURATION"); duration != "" {
+		cfg.Lockout.Duration, err = time.ParseDuration(duration)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid LOCKOUT_DURATION: %w", err)
+		}
+	}
+
+	// Password policy
+	passwordPolicy, err := loadPasswordPolicy()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load password policy: %w", err)
+	}
+	cfg.PasswordPolicy = passwordPolicy
+
+	// Password hashing
+	passwordHasher, err := loadPasswordHasher()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load password hasher config: %w", err)
+	}
+	cfg.PasswordHasher = passwordHasher
+
+	// OpenID Connect providers
+	oidcProviders, err := loadOIDCProviders()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load OIDC providers: %w", err)
+	}
+	cfg.OIDCProviders = oidcProviders
+
+	// LDAP directory (optional)
+	cfg.LDAP, err = loadLDAP()
+	if err != nil {
+		return cfg, fmt.Errorf("failed to load LDAP config: %w", err)
+	}
 
 	return cfg, nil
 }
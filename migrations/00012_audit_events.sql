@@ -0,0 +1,64 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- No foreign keys: the log must outlive deleted accounts.
+    actor_id INT,
+    user_id INT,
+    action TEXT NOT NULL,
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS audit_events_user_id_idx ON audit_events (user_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx ON audit_events (created_at DESC);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER audit_events_append_only
+BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_events
+FOR EACH STATEMENT EXECUTE FUNCTION audit_events_append_only();
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- The audit log replaces security_events.
+INSERT INTO audit_events (created_at, user_id, action, ip)
+SELECT created_at, user_id,
+    CASE kind
+        WHEN 'account_locked' THEN 'account.locked'
+        WHEN 'password_changed' THEN 'password.changed'
+        WHEN 'email_changed' THEN 'email.changed'
+        ELSE kind
+    END,
+    COALESCE(ip, '')
+FROM security_events;
+DROP TABLE security_events;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS security_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    ip TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+INSERT INTO security_events (user_id, kind, ip, created_at)
+SELECT user_id, replace(action, '.', '_'), ip, created_at
+FROM audit_events
+WHERE action IN ('account.locked', 'password.changed', 'email.changed')
+    AND user_id IN (SELECT id FROM users);
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE audit_events;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP FUNCTION audit_events_append_only;
+-- +goose StatementEnd
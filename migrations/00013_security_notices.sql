@@ -0,0 +1,39 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Notices are on by default: only the ones a user turned off are stored.
+CREATE TABLE IF NOT EXISTS notification_opt_outs (
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    PRIMARY KEY (user_id, kind)
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS known_devices (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    device_hash TEXT NOT NULL,
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, device_hash)
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS account_recoveries (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE account_recoveries;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE known_devices;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE notification_opt_outs;
+-- +goose StatementEnd
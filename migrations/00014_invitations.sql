@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Invitation codes, for invite-only signup. Only the hash of the code is
+-- stored. A NULL email means anybody with the code can sign up with it.
+CREATE TABLE IF NOT EXISTS invitations (
+    id SERIAL PRIMARY KEY,
+    code_hash TEXT UNIQUE NOT NULL,
+    email TEXT,
+    max_uses INT NOT NULL CHECK (max_uses > 0),
+    uses INT NOT NULL DEFAULT 0 CHECK (uses >= 0),
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE invitations;
+-- +goose StatementEnd
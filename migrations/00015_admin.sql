@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Disabled accounts can't sign in, and their sessions stop working.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ;
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Existing accounts get the time of the migration.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN created_at;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN disabled_at;
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Admins viewing the app as another user. Rows are kept once ended: they are
+-- the record of who looked at which account, when, and why.
+CREATE TABLE IF NOT EXISTS impersonations (
+    id SERIAL PRIMARY KEY,
+    admin_id INT REFERENCES users (id) ON DELETE SET NULL,
+    user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    reason TEXT NOT NULL CHECK (reason <> ''),
+    token_hash TEXT UNIQUE NOT NULL,
+    started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    ended_at TIMESTAMPTZ
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS impersonations_started_at_idx ON impersonations (started_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE impersonations;
+-- +goose StatementEnd
@@ -0,0 +1,52 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS organizations (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL CHECK (name <> ''),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS organization_members (
+    organization_id INT REFERENCES organizations (id) ON DELETE CASCADE,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id)
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS organization_members_user_id_idx ON organization_members (user_id);
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- A gallery is owned by a user (user_id) or by an organization
+-- (organization_id), never both. created_by keeps track of who made it, and
+-- doesn't take the gallery down with it when they leave.
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS organization_id INT REFERENCES organizations (id) ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    ADD CONSTRAINT galleries_one_owner CHECK (user_id IS NULL OR organization_id IS NULL);
+-- +goose StatementEnd
+-- +goose StatementBegin
+UPDATE galleries SET created_by = user_id;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS galleries_organization_id_idx ON galleries (organization_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM galleries WHERE organization_id IS NOT NULL;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP CONSTRAINT galleries_one_owner,
+    DROP COLUMN created_by,
+    DROP COLUMN organization_id;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE organization_members;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE organizations;
+-- +goose StatementEnd
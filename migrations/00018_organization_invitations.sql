@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Invitations to join an organization, with the role to give. They are bound
+-- to an email address, and don't let anybody sign up.
+ALTER TABLE invitations
+    ADD COLUMN IF NOT EXISTS organization_id INT REFERENCES organizations (id) ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS role TEXT CHECK (role IN ('owner', 'admin', 'member')),
+    ADD CONSTRAINT invitations_organization CHECK (
+        organization_id IS NULL OR (email IS NOT NULL AND role IS NOT NULL)
+    );
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS invitations_organization_id_idx ON invitations (organization_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM invitations WHERE organization_id IS NOT NULL;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE invitations
+    DROP CONSTRAINT invitations_organization,
+    DROP COLUMN role,
+    DROP COLUMN organization_id;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Bearer token of the organization's SCIM API (identity provider
+-- provisioning). NULL when provisioning isn't set up.
+ALTER TABLE organizations
+    ADD COLUMN IF NOT EXISTS scim_token_hash TEXT UNIQUE;
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Accounts managed by an organization's identity provider, with the ID the
+-- provider knows them by.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS scim_organization_id INT REFERENCES organizations (id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS scim_external_id TEXT,
+    ADD CONSTRAINT users_scim_external_id_key UNIQUE (scim_organization_id, scim_external_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP CONSTRAINT users_scim_external_id_key,
+    DROP COLUMN scim_external_id,
+    DROP COLUMN scim_organization_id;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE organizations
+    DROP COLUMN scim_token_hash;
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Public profiles, at /u/{handle}. Handles are stored in lowercase. avatar is
+-- the filename of the avatar in the avatars folder ('' for none).
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS handle TEXT UNIQUE,
+    ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS website TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS avatar TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Public galleries are listed on the profile of their owner, unlisted ones
+-- can only be seen by those who have the link, private ones by their owners.
+-- Galleries were all public so far.
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS visibility TEXT NOT NULL DEFAULT 'public'
+        CHECK (visibility IN ('public', 'unlisted', 'private'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN visibility;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE users
+    DROP COLUMN avatar,
+    DROP COLUMN website,
+    DROP COLUMN bio,
+    DROP COLUMN display_name,
+    DROP COLUMN handle;
+-- +goose StatementEnd
@@ -0,0 +1,53 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries of a user are at /u/{handle}/{slug}. Slugs are unique per owner
+-- (user or organization).
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS slug TEXT;
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Existing galleries get a slug made from their title, with a number added
+-- when the owner has several galleries with the same one.
+WITH slugs AS (
+    SELECT id, COALESCE(user_id::TEXT, 'org-' || organization_id) AS owner,
+        COALESCE(NULLIF(LEFT(TRIM(BOTH '-' FROM
+            regexp_replace(lower(title), '[^a-z0-9]+', '-', 'g')), 80), ''),
+            'gallery') AS base
+    FROM galleries
+), numbered AS (
+    SELECT id, base,
+        row_number() OVER (PARTITION BY owner, base ORDER BY id) AS n
+    FROM slugs
+)
+UPDATE galleries
+SET slug = CASE WHEN numbered.n = 1 THEN numbered.base
+    ELSE numbered.base || '-' || numbered.n END
+FROM numbered
+WHERE galleries.id = numbered.id;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE galleries
+    ALTER COLUMN slug SET NOT NULL,
+    ADD CONSTRAINT galleries_user_slug UNIQUE (user_id, slug),
+    ADD CONSTRAINT galleries_organization_slug UNIQUE (organization_id, slug);
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Previous slugs of galleries, so that old links redirect to the new ones.
+CREATE TABLE IF NOT EXISTS gallery_slug_history (
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    slug TEXT NOT NULL,
+    replaced_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (gallery_id, slug)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS gallery_slug_history;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP CONSTRAINT galleries_organization_slug,
+    DROP CONSTRAINT galleries_user_slug,
+    DROP COLUMN slug;
+-- +goose StatementEnd
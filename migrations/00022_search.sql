@@ -0,0 +1,79 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Tags are lowercase, without commas (see models.NormalizeTags).
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS search_vector TSVECTOR;
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Images are files in the gallery folder: rows only exist for images that
+-- have a caption or tags.
+CREATE TABLE IF NOT EXISTS images (
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    caption TEXT NOT NULL DEFAULT '',
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    search_vector TSVECTOR,
+    PRIMARY KEY (gallery_id, filename)
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Titles and tags weigh more than descriptions and captions in the ranking.
+-- (Triggers rather than generated columns: array_to_string isn't immutable.)
+CREATE OR REPLACE FUNCTION galleries_search_vector() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', NEW.title), 'A') ||
+        setweight(to_tsvector('english', array_to_string(NEW.tags, ' ')), 'A') ||
+        setweight(to_tsvector('english', NEW.description), 'B');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER galleries_search_vector
+    BEFORE INSERT OR UPDATE OF title, description, tags ON galleries
+    FOR EACH ROW EXECUTE FUNCTION galleries_search_vector();
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION images_search_vector() RETURNS trigger AS $$
+BEGIN
+    NEW.search_vector :=
+        setweight(to_tsvector('english', array_to_string(NEW.tags, ' ')), 'A') ||
+        setweight(to_tsvector('english', NEW.caption), 'B');
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TRIGGER images_search_vector
+    BEFORE INSERT OR UPDATE OF caption, tags ON images
+    FOR EACH ROW EXECUTE FUNCTION images_search_vector();
+-- +goose StatementEnd
+-- +goose StatementBegin
+UPDATE galleries
+SET title = title;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS galleries_search_vector_idx ON galleries USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS galleries_tags_idx ON galleries USING GIN (tags);
+CREATE INDEX IF NOT EXISTS images_search_vector_idx ON images USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS images_tags_idx ON images USING GIN (tags);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS images;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS galleries_search_vector ON galleries;
+DROP FUNCTION IF EXISTS galleries_search_vector();
+DROP FUNCTION IF EXISTS images_search_vector();
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN search_vector,
+    DROP COLUMN tags,
+    DROP COLUMN description;
+-- +goose StatementEnd
@@ -0,0 +1,82 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Collections hold galleries and other collections. Like galleries, they
+-- belong to a user or to an organization, and so does everything in them. A
+-- NULL visibility means the visibility of the parent collection (public at
+-- the top).
+CREATE TABLE IF NOT EXISTS collections (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    organization_id INT REFERENCES organizations (id) ON DELETE CASCADE,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    parent_id INT REFERENCES collections (id) ON DELETE SET NULL,
+    title TEXT NOT NULL CHECK (title <> ''),
+    visibility TEXT CHECK (visibility IN ('public', 'unlisted', 'private')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT collections_one_owner CHECK (num_nonnulls(user_id, organization_id) = 1)
+);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS collections_user_id_idx ON collections (user_id);
+CREATE INDEX IF NOT EXISTS collections_organization_id_idx ON collections (organization_id);
+CREATE INDEX IF NOT EXISTS collections_parent_id_idx ON collections (parent_id);
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Galleries with a NULL visibility get the one of their collection. Galleries
+-- were all at the top so far, where that is public.
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS collection_id INT REFERENCES collections (id) ON DELETE SET NULL,
+    ALTER COLUMN visibility DROP NOT NULL,
+    ALTER COLUMN visibility DROP DEFAULT;
+-- +goose StatementEnd
+-- +goose StatementBegin
+UPDATE galleries
+SET visibility = NULL
+WHERE visibility = 'public';
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS galleries_collection_id_idx ON galleries (collection_id);
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- The visibility of the collection: its own, or the one of its closest
+-- ancestor that has one, or public.
+CREATE OR REPLACE FUNCTION collection_visibility(collection INT) RETURNS TEXT AS $$
+    WITH RECURSIVE ancestors AS (
+        SELECT id, parent_id, visibility, 0 AS depth
+        FROM collections
+        WHERE id = collection
+        UNION ALL
+        SELECT collections.id, collections.parent_id, collections.visibility,
+            ancestors.depth + 1
+        FROM collections
+            JOIN ancestors ON collections.id = ancestors.parent_id
+        WHERE ancestors.visibility IS NULL AND ancestors.depth < 100
+    )
+    SELECT COALESCE((
+        SELECT visibility
+        FROM ancestors
+        WHERE visibility IS NOT NULL
+        ORDER BY depth
+        LIMIT 1
+    ), 'public');
+$$ LANGUAGE sql STABLE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP FUNCTION IF EXISTS collection_visibility(INT);
+-- +goose StatementEnd
+-- +goose StatementBegin
+UPDATE galleries
+SET visibility = 'public'
+WHERE visibility IS NULL;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP COLUMN collection_id,
+    ALTER COLUMN visibility SET DEFAULT 'public',
+    ALTER COLUMN visibility SET NOT NULL;
+-- +goose StatementEnd
+-- +goose StatementBegin
+DROP TABLE IF EXISTS collections;
+-- +goose StatementEnd
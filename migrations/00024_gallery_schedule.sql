@@ -0,0 +1,44 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Galleries can go live at publish_at, and close at expire_at (NULL: no
+-- limit). Access follows the times; schedule_state is what the owner and the
+-- subscribers were last told, and is moved forward by the scheduler.
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS publish_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS expire_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS schedule_state TEXT NOT NULL DEFAULT 'published'
+        CHECK (schedule_state IN ('scheduled', 'published', 'expired')),
+    ADD CONSTRAINT galleries_schedule_order
+        CHECK (publish_at IS NULL OR expire_at IS NULL OR publish_at < expire_at);
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE INDEX IF NOT EXISTS galleries_publish_at_idx ON galleries (publish_at)
+WHERE schedule_state = 'scheduled';
+CREATE INDEX IF NOT EXISTS galleries_expire_at_idx ON galleries (expire_at)
+WHERE schedule_state <> 'expired';
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Clients who want an email when the gallery goes live, and when it closes.
+-- The token (hashed) is the unsubscribe link of the last email.
+CREATE TABLE IF NOT EXISTS gallery_subscriptions (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (gallery_id, email)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS gallery_subscriptions;
+-- +goose StatementEnd
+-- +goose StatementBegin
+ALTER TABLE galleries
+    DROP CONSTRAINT IF EXISTS galleries_schedule_order,
+    DROP COLUMN IF EXISTS schedule_state,
+    DROP COLUMN IF EXISTS expire_at,
+    DROP COLUMN IF EXISTS publish_at;
+-- +goose StatementEnd
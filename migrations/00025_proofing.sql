@@ -0,0 +1,51 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Links to a gallery for one client, who can see it (whatever its
+-- visibility) and proof it without an account.
+CREATE TABLE IF NOT EXISTS share_links (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    label TEXT NOT NULL CHECK (label <> ''),
+    token_hash TEXT UNIQUE NOT NULL,
+    created_by INT REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS share_links_gallery_id_idx ON share_links (gallery_id);
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- The images a client picked in a gallery: their favorites, and named lists.
+-- The client is a user, or the client of a share link.
+CREATE TABLE IF NOT EXISTS selections (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    user_id INT REFERENCES users (id) ON DELETE CASCADE,
+    share_link_id INT REFERENCES share_links (id) ON DELETE CASCADE,
+    name TEXT NOT NULL CHECK (name <> ''),
+    favorites BOOLEAN NOT NULL DEFAULT FALSE,
+    submitted_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    CONSTRAINT selections_one_client CHECK (num_nonnulls(user_id, share_link_id) = 1)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS selections_name_idx
+ON selections (gallery_id, COALESCE(user_id, 0), COALESCE(share_link_id, 0), lower(name));
+CREATE UNIQUE INDEX IF NOT EXISTS selections_favorites_idx
+ON selections (gallery_id, COALESCE(user_id, 0), COALESCE(share_link_id, 0))
+WHERE favorites;
+-- +goose StatementEnd
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS selection_images (
+    selection_id INT NOT NULL REFERENCES selections (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    note TEXT NOT NULL DEFAULT '',
+    added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (selection_id, filename)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS selection_images;
+DROP TABLE IF EXISTS selections;
+DROP TABLE IF EXISTS share_links;
+-- +goose StatementEnd
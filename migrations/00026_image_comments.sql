@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Whether those who can see a gallery can comment on its images: allow,
+-- moderate (the owner approves comments first) or disabled.
+ALTER TABLE galleries
+    ADD COLUMN IF NOT EXISTS comments TEXT NOT NULL DEFAULT 'allow'
+        CHECK (comments IN ('allow', 'moderate', 'disabled'));
+-- +goose StatementEnd
+-- +goose StatementBegin
+-- Comments on an image, replying to parent_id (NULL: a new thread). Pending
+-- comments wait for the owner's approval; hidden ones were hidden by the
+-- owner. Both are only shown to the owner (and pending ones to their author).
+CREATE TABLE IF NOT EXISTS image_comments (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    parent_id INT REFERENCES image_comments (id) ON DELETE CASCADE,
+    user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    body TEXT NOT NULL CHECK (body <> ''),
+    status TEXT NOT NULL DEFAULT 'visible'
+        CHECK (status IN ('visible', 'pending', 'hidden')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS image_comments_image_idx
+ON image_comments (gallery_id, filename, created_at);
+CREATE INDEX IF NOT EXISTS image_comments_pending_idx
+ON image_comments (gallery_id)
+WHERE status = 'pending';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS image_comments;
+ALTER TABLE galleries DROP COLUMN IF EXISTS comments;
+-- +goose StatementEnd
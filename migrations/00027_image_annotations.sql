@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+-- Retouch requests anchored to a region of an image, in coordinates
+-- normalized to its size (0 to 1, from the top left). Points have no width
+-- nor height. That regions fit in the image is checked by the app, with some
+-- leeway for rounding.
+CREATE TABLE IF NOT EXISTS image_annotations (
+    id SERIAL PRIMARY KEY,
+    gallery_id INT NOT NULL REFERENCES galleries (id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    user_id INT REFERENCES users (id) ON DELETE SET NULL,
+    x DOUBLE PRECISION NOT NULL CHECK (x >= 0 AND x <= 1),
+    y DOUBLE PRECISION NOT NULL CHECK (y >= 0 AND y <= 1),
+    width DOUBLE PRECISION NOT NULL DEFAULT 0 CHECK (width >= 0 AND width <= 1),
+    height DOUBLE PRECISION NOT NULL DEFAULT 0 CHECK (height >= 0 AND height <= 1),
+    body TEXT NOT NULL CHECK (body <> ''),
+    status TEXT NOT NULL DEFAULT 'open'
+        CHECK (status IN ('open', 'in_progress', 'done')),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS image_annotations_image_idx
+ON image_annotations (gallery_id, filename, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS image_annotations;
+-- +goose StatementEnd
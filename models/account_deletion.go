@@ -0,0 +1,293 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	DefaultDeletionGracePeriod = 7 * 24 * time.Hour
+)
+
+type AccountDeletion struct {
+	ID           int
+	UserID       uint
+	Token        string // Only set when scheduling (not stored in db)
+	TokenHash    string
+	ScheduledFor time.Time
+}
+
+/*
+AccountDeletionService schedules the deletion of accounts. Nothing is deleted
+right away: the user has GracePeriod to change their mind, using the cancel
+token (sent by email) or from the account settings.
+
+RunDue deletes the accounts whose grace period is over. Since ON DELETE CASCADE
+only takes care of the DB rows, it also removes the images of the user's
+galleries through the GalleryService, and their avatar through the
+ProfileService. Users who became the only owner of an organization in the
+meantime are kept, and told by email (if EmailService is set) that their
+deletion was canceled.
+*/
+type AccountDeletionService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	ProfileService *ProfileService
+	EmailService   *EmailService
+	GracePeriod    time.Duration // Defaults to DefaultDeletionGracePeriod
+	BytesPerToken  int
+}
+
+func (svc *AccountDeletionService) Schedule(userId uint) (*AccountDeletion, error) {
+	bytesPerToken := max(MinBytesPerToken, svc.BytesPerToken)
+	token, err := rand.RandomBase64String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("schedule deletion: %w", err)
+	}
+	gracePeriod := svc.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultDeletionGracePeriod
+	}
+	deletion := AccountDeletion{
+		UserID:       userId,
+		Token:        token,
+		TokenHash:    svc.hashToken(token),
+		ScheduledFor: time.Now().Add(gracePeriod),
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO account_deletions (user_id, token_hash, scheduled_for)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, scheduled_for = $3
+		RETURNING id;
+	`, deletion.UserID, deletion.TokenHash, deletion.ScheduledFor)
+	err = row.Scan(&deletion.ID)
+	if err != nil {
+		return nil, fmt.Errorf("schedule deletion: %w", err)
+	}
+	return &deletion, nil
+}
+
+// Returns the scheduled deletion of a user, or ErrNotFound.
+func (svc *AccountDeletionService) Pending(userId uint) (*AccountDeletion, error) {
+	deletion := AccountDeletion{
+		UserID: userId,
+	}
+	row := svc.DB.QueryRow(`
+		SELECT id, scheduled_for
+		FROM account_deletions
+		WHERE user_id = $1;
+	`, userId)
+	err := row.Scan(&deletion.ID, &deletion.ScheduledFor)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("pending deletion: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("pending deletion: %w", err)
+	}
+	return &deletion, nil
+}
+
+// Cancels a deletion using the token sent by email.
+func (svc *AccountDeletionService) Cancel(token string) (*AccountDeletion, error) {
+	deletion := AccountDeletion{
+		TokenHash: svc.hashToken(token),
+	}
+	row := svc.DB.QueryRow(`
+		DELETE FROM account_deletions
+		WHERE token_hash = $1
+		RETURNING id, user_id, scheduled_for;
+	`, deletion.TokenHash)
+	err := row.Scan(&deletion.ID, &deletion.UserID, &deletion.ScheduledFor)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("cancel deletion: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("cancel deletion: %w", err)
+	}
+	return &deletion, nil
+}
+
+// Cancels the deletion of a (signed in) user.
+func (svc *AccountDeletionService) CancelForUser(userId uint) error {
+	_, err := svc.DB.Exec(`
+		DELETE FROM account_deletions
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	return nil
+}
+
+// Deletes the accounts whose grace period is over, and returns how many.
+// Deletions canceled because of an organization (see deleteAccount) don't
+// count.
+func (svc *AccountDeletionService) RunDue() (int, error) {
+	rows, err := svc.DB.Query(`
+		SELECT user_id
+		FROM account_deletions
+		WHERE scheduled_for <= NOW();
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("run due deletions: %w", err)
+	}
+	var userIds []uint
+	for rows.Next() {
+		var userId uint
+		err := rows.Scan(&userId)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("run due deletions: %w", err)
+		}
+		userIds = append(userIds, userId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("run due deletions: %w", err)
+	}
+
+	deleted := 0
+	for _, userId := range userIds {
+		err := svc.deleteAccount(userId)
+		if errors.Is(err, ErrLastOwner) {
+			continue
+		}
+		if err != nil {
+			return deleted, fmt.Errorf("run due deletions: %w", err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Runs RunDue every interval. Blocks forever, so call it in a goroutine.
+func (svc *AccountDeletionService) Run(interval time.Duration) {
+	for {
+		deleted, err := svc.RunDue()
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+		if deleted > 0 {
+			fmt.Printf("deleted %d accounts\n", deleted)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Deletes the account, unless the user is the only owner of an organization,
+// which can't be left without one: the deletion is canceled instead, and
+// ErrLastOwner returned. Deleting the account was possible when it was
+// scheduled, but other owners may have left since.
+func (svc *AccountDeletionService) deleteAccount(userId uint) error {
+	galleries, err := svc.GalleryService.GalleriesByUserId(userId)
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	profile, err := svc.ProfileService.ByUserId(userId)
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	defer tx.Rollback()
+	// Locked like OrganizationService.changeMember does, so that no owner
+	// leaves while we check.
+	_, err = tx.Exec(`
+		SELECT organizations.id
+		FROM organizations
+			JOIN organization_members ON organization_members.organization_id = organizations.id
+		WHERE organization_members.user_id = $1
+		FOR UPDATE OF organizations;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	var soleOwnership sql.NullString // name of the organization
+	row := tx.QueryRow(`
+		SELECT organizations.name
+		FROM organizations
+			JOIN organization_members ON organization_members.organization_id = organizations.id
+		WHERE organization_members.role = $2
+		GROUP BY organizations.id
+		HAVING COUNT(*) = 1 AND BOOL_OR(organization_members.user_id = $1)
+		ORDER BY organizations.name
+		LIMIT 1;
+	`, userId, OrgRoleOwner)
+	err = row.Scan(&soleOwnership)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	if soleOwnership.Valid {
+		return svc.cancelForSoleOwner(tx, userId, soleOwnership.String)
+	}
+	// Sessions, galleries, tokens... are removed by ON DELETE CASCADE.
+	_, err = tx.Exec(`
+		DELETE FROM users
+		WHERE id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	// The files aren't, so remove them once the rows are gone.
+	for _, gallery := range galleries {
+		err = svc.GalleryService.DeleteImages(gallery.ID)
+		if err != nil {
+			return fmt.Errorf("delete account: %w", err)
+		}
+	}
+	err = svc.ProfileService.deleteAvatarFile(profile.Avatar)
+	if err != nil {
+		return fmt.Errorf("delete account: %w", err)
+	}
+	return nil
+}
+
+// Cancels the deletion of a user who is the only owner of organizationName,
+// and tells them. Returns ErrLastOwner.
+func (svc *AccountDeletionService) cancelForSoleOwner(tx *sql.Tx, userId uint, organizationName string) error {
+	var email string
+	row := tx.QueryRow(`
+		DELETE FROM account_deletions
+			USING users
+		WHERE account_deletions.user_id = $1 AND users.id = account_deletions.user_id
+		RETURNING users.email;
+	`, userId)
+	err := row.Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The user canceled it in the meantime.
+		return fmt.Errorf("cancel deletion: %w", ErrLastOwner)
+	}
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("cancel deletion: %w", err)
+	}
+	if svc.EmailService != nil {
+		err = svc.EmailService.AccountDeletionCanceled(email, organizationName)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	return fmt.Errorf("cancel deletion: %w", ErrLastOwner)
+}
+
+func (svc *AccountDeletionService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
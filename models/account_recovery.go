@@ -0,0 +1,95 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	// Notices may be read days later, so the links last a while.
+	DefaultAccountRecoveryDuration = 7 * 24 * time.Hour
+)
+
+/*
+AccountRecoveryService issues the tokens of the "This wasn't me" links in
+security notices. Using one proves access to the mailbox the notice was sent
+to, so it's enough to sign the account out everywhere and start a password
+reset.
+
+Unlike password resets, a user can have many of them (one per notice). Using
+one deletes them all.
+*/
+type AccountRecoveryService struct {
+	DB            *sql.DB
+	BytesPerToken int           // Defaults to MinBytesPerToken
+	Duration      time.Duration // Defaults to DefaultAccountRecoveryDuration
+}
+
+// Returns a new token for the user.
+func (svc *AccountRecoveryService) Create(userId uint) (string, error) {
+	token, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerToken))
+	if err != nil {
+		return "", fmt.Errorf("create account recovery: %w", err)
+	}
+	duration := svc.Duration
+	if duration == 0 {
+		duration = DefaultAccountRecoveryDuration
+	}
+	_, err = svc.DB.Exec(`
+		INSERT INTO account_recoveries (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3);
+	`, userId, svc.hashToken(token), time.Now().Add(duration))
+	if err != nil {
+		return "", fmt.Errorf("create account recovery: %w", err)
+	}
+	return token, nil
+}
+
+// Returns the user the (non-expired) token belongs to, and deletes all their
+// tokens. Unknown and expired tokens return ErrNotFound.
+func (svc *AccountRecoveryService) Consume(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	// Deleting and reading in one statement: two requests racing with the
+	// same token can't both get the user.
+	row := svc.DB.QueryRow(`
+		WITH recovery AS (
+			DELETE FROM account_recoveries
+			WHERE token_hash = $1
+			RETURNING user_id, expires_at
+		)
+		SELECT users.id, users.email, users.password_hash, users.role, recovery.expires_at
+		FROM recovery
+			JOIN users ON users.id = recovery.user_id;
+	`, svc.hashToken(token))
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume account recovery: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("consume account recovery: %w", err)
+	}
+	// The other links of the user (and expired ones) are useless now.
+	_, err = svc.DB.Exec(`
+		DELETE FROM account_recoveries
+		WHERE user_id = $1 OR expires_at < NOW();
+	`, user.ID)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	if time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("consume account recovery: %w", ErrNotFound)
+	}
+	return &user, nil
+}
+
+func (svc *AccountRecoveryService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,277 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Statuses of annotations.
+const (
+	AnnotationOpen       = "open"
+	AnnotationInProgress = "in_progress"
+	AnnotationDone       = "done"
+)
+
+var AnnotationStatuses = []string{AnnotationOpen, AnnotationInProgress, AnnotationDone}
+
+const annotationBodyMaxLength = 1000
+
+// A region of an image, in coordinates normalized to its size: from 0 to 1,
+// from the top left corner. Points have no width nor height.
+type Region struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+}
+
+func (region Region) IsPoint() bool {
+	return region.Width == 0 && region.Height == 0
+}
+
+func (region Region) valid() bool {
+	for _, v := range []float64{region.X, region.Y, region.Width, region.Height} {
+		if math.IsNaN(v) || v < 0 || v > 1 {
+			return false
+		}
+	}
+	// A little leeway for rounding in browsers.
+	return region.X+region.Width <= 1+1e-9 && region.Y+region.Height <= 1+1e-9
+}
+
+/*
+An annotation is a retouch request on a region of an image: a clone stamp
+here, a crop there. Clients add them; editors of the gallery move them from
+open to in progress to done.
+
+Editors see all the annotations of a gallery, others only their own.
+*/
+type Annotation struct {
+	ID        int
+	GalleryID int
+	Filename  string
+	UserID    uint   // 0 once the author deleted their account
+	Author    string // display name or handle of the author, "" if none
+	Region    Region
+	Body      string
+	Status    string
+	CreatedAt time.Time
+}
+
+// AnnotationService manages the annotations on the images of galleries.
+type AnnotationService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+}
+
+const annotationColumns = `
+	image_annotations.id, image_annotations.gallery_id, image_annotations.filename,
+	COALESCE(image_annotations.user_id, 0),
+	COALESCE(NULLIF(users.display_name, ''), users.handle, ''),
+	image_annotations.x, image_annotations.y, image_annotations.width,
+	image_annotations.height, image_annotations.body, image_annotations.status,
+	image_annotations.created_at`
+
+// The annotations on the image that viewerId may see, oldest first: all of
+// them for editors (all being true), their own for the others.
+func (svc *AnnotationService) ForImage(galleryId int, filename string, viewerId uint, all bool) ([]Annotation, error) {
+	annotations, err := svc.query(`
+		SELECT `+annotationColumns+`
+		FROM image_annotations
+			LEFT JOIN users ON users.id = image_annotations.user_id
+		WHERE image_annotations.gallery_id = $1 AND image_annotations.filename = $2
+			AND ($4 OR image_annotations.user_id = $3)
+		ORDER BY image_annotations.created_at, image_annotations.id;
+	`, galleryId, filename, nullableId(viewerId), all)
+	if err != nil {
+		return nil, fmt.Errorf("annotations for image: %w", err)
+	}
+	return annotations, nil
+}
+
+// The annotations of the gallery that aren't done, by image, oldest first.
+func (svc *AnnotationService) Open(galleryId int) ([]Annotation, error) {
+	annotations, err := svc.query(`
+		SELECT `+annotationColumns+`
+		FROM image_annotations
+			LEFT JOIN users ON users.id = image_annotations.user_id
+		WHERE image_annotations.gallery_id = $1 AND image_annotations.status <> 'done'
+		ORDER BY image_annotations.filename, image_annotations.created_at, image_annotations.id;
+	`, galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("open annotations: %w", err)
+	}
+	return annotations, nil
+}
+
+func (svc *AnnotationService) query(query string, args ...any) ([]Annotation, error) {
+	rows, err := svc.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var annotations []Annotation
+	for rows.Next() {
+		var annotation Annotation
+		err := rows.Scan(
+			&annotation.ID,
+			&annotation.GalleryID,
+			&annotation.Filename,
+			&annotation.UserID,
+			&annotation.Author,
+			&annotation.Region.X,
+			&annotation.Region.Y,
+			&annotation.Region.Width,
+			&annotation.Region.Height,
+			&annotation.Body,
+			&annotation.Status,
+			&annotation.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, annotation)
+	}
+	return annotations, rows.Err()
+}
+
+// Adds an open annotation by authorId on the region of the image. Whether the
+// author may see the gallery is up to the caller.
+//
+// Returns ErrInvalidRegion for regions out of the image, ErrInvalidAnnotation
+// for empty or long bodies, and ErrNotFound if the image doesn't exist.
+func (svc *AnnotationService) Create(gallery *Gallery, filename string, authorId uint, region Region, body string) (*Annotation, error) {
+	if !region.valid() {
+		return nil, fmt.Errorf("create annotation: %w", ErrInvalidRegion)
+	}
+	if region.X+region.Width > 1 {
+		region.Width = 1 - region.X
+	}
+	if region.Y+region.Height > 1 {
+		region.Height = 1 - region.Y
+	}
+	body = strings.TrimSpace(body)
+	if body == "" || utf8.RuneCountInString(body) > annotationBodyMaxLength {
+		return nil, fmt.Errorf("create annotation: %w", ErrInvalidAnnotation)
+	}
+	_, err := svc.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		return nil, fmt.Errorf("create annotation: %w", err)
+	}
+	annotation := Annotation{
+		GalleryID: gallery.ID,
+		Filename:  filename,
+		UserID:    authorId,
+		Region:    region,
+		Body:      body,
+		Status:    AnnotationOpen,
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO image_annotations (gallery_id, filename, user_id, x, y, width, height, body)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at;
+	`, annotation.GalleryID, annotation.Filename, nullableId(annotation.UserID),
+		region.X, region.Y, region.Width, region.Height, annotation.Body)
+	err = row.Scan(&annotation.ID, &annotation.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create annotation: %w", err)
+	}
+	return &annotation, nil
+}
+
+// Sets the status of the annotation of the gallery (one of
+// AnnotationStatuses). Returns ErrNotFound if there's no such annotation.
+func (svc *AnnotationService) SetStatus(gallery *Gallery, id int, status string) error {
+	if !slices.Contains(AnnotationStatuses, status) {
+		return fmt.Errorf("set annotation status: unknown status %q", status)
+	}
+	result, err := svc.DB.Exec(`
+		UPDATE image_annotations
+		SET status = $3, updated_at = NOW()
+		WHERE id = $1 AND gallery_id = $2;
+	`, id, gallery.ID, status)
+	if err != nil {
+		return fmt.Errorf("set annotation status: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("set annotation status: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("set annotation status: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// Deletes the annotation of the gallery, for its author, or for anybody when
+// moderator is true (editors of the gallery). Returns ErrNotFound if there's
+// no such annotation, or if userId can't delete it.
+func (svc *AnnotationService) Delete(gallery *Gallery, id int, userId uint, moderator bool) error {
+	result, err := svc.DB.Exec(`
+		DELETE FROM image_annotations
+		WHERE id = $1 AND gallery_id = $2 AND ($4 OR user_id = $3);
+	`, id, gallery.ID, nullableId(userId), moderator)
+	if err != nil {
+		return fmt.Errorf("delete annotation: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete annotation: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("delete annotation: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// Writes the annotations as a Markdown task list, one section per image, for
+// the gallery titled title. Those in progress are marked so.
+func WriteTaskList(w io.Writer, title string, annotations []Annotation) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Retouch requests: %s\n", title)
+	if len(annotations) == 0 {
+		b.WriteString("\nNothing to do.\n")
+	}
+	filename := ""
+	for i, annotation := range annotations {
+		if i == 0 || annotation.Filename != filename {
+			filename = annotation.Filename
+			fmt.Fprintf(&b, "\n## %s\n\n", filename)
+		}
+		b.WriteString("- [ ] ")
+		if annotation.Status == AnnotationInProgress {
+			b.WriteString("(in progress) ")
+		}
+		// One line per task.
+		b.WriteString(strings.Join(strings.Fields(annotation.Body), " "))
+		fmt.Fprintf(&b, " (%s", annotation.Region.describe())
+		if annotation.Author != "" {
+			fmt.Fprintf(&b, ", by %s", annotation.Author)
+		}
+		b.WriteString(")\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	if err != nil {
+		return fmt.Errorf("task list: %w", err)
+	}
+	return nil
+}
+
+// The region in percents of the image, e.g. "point at 12%, 40%" or "area at
+// 10%, 20%, 30% × 5%".
+func (region Region) describe() string {
+	percent := func(v float64) string {
+		return fmt.Sprintf("%.0f%%", v*100)
+	}
+	if region.IsPoint() {
+		return "point at " + percent(region.X) + ", " + percent(region.Y)
+	}
+	return "area at " + percent(region.X) + ", " + percent(region.Y) + ", " +
+		percent(region.Width) + " × " + percent(region.Height)
+}
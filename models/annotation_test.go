@@ -0,0 +1,37 @@
+package models
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRegionValid(t *testing.T) {
+	valid := []Region{
+		{},                    // top left corner
+		{X: 0.5, Y: 0.5},      // a point
+		{X: 1, Y: 1},          // bottom right corner
+		{Width: 1, Height: 1}, // the whole image
+		{X: 0.25, Y: 0.5, Width: 0.5, Height: 0.25},
+		{X: 0.3, Y: 0.1, Width: 0.7000000001, Height: 0.9}, // rounding
+	}
+	for _, region := range valid {
+		if !region.valid() {
+			t.Errorf("%+v.valid() = false, want true", region)
+		}
+	}
+
+	invalid := []Region{
+		{X: -0.1, Y: 0.5},
+		{X: 0.5, Y: 0.5, Width: -0.1, Height: 0.1},
+		{X: 0.6, Y: 0, Width: 0.6, Height: 0.1}, // past the right edge
+		{X: 0, Y: 0.6, Width: 0.1, Height: 0.6}, // past the bottom edge
+		{X: 1.5, Y: 0.5},
+		{X: math.NaN(), Y: 0.5},
+		{X: 0.5, Y: 0.5, Width: math.Inf(1), Height: 0.1},
+	}
+	for _, region := range invalid {
+		if region.valid() {
+			t.Errorf("%+v.valid() = true, want false", region)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditUserCreated                   = "user.created"
+	AuditSignInFailed                  = "signin.failed"
+	AuditAccountLocked                 = "account.locked"
+	AuditPasswordChanged               = "password.changed"
+	AuditEmailChanged                  = "email.changed"
+	AuditSessionCreated                = "session.created"
+	AuditSessionDeleted                = "session.deleted"
+	AuditSessionsRevoked               = "sessions.revoked"
+	AuditSessionReauthenticated        = "session.reauthenticated"
+	AuditPasswordResetRequested        = "password_reset.requested"
+	AuditPasswordResetCompleted        = "password_reset.completed"
+	AuditGalleryCreated                = "gallery.created"
+	AuditGalleryUpdated                = "gallery.updated"
+	AuditGalleryDeleted                = "gallery.deleted"
+	AuditGalleryPublished              = "gallery.published"
+	AuditGalleryExpired                = "gallery.expired"
+	AuditCollectionCreated             = "collection.created"
+	AuditCollectionUpdated             = "collection.updated"
+	AuditCollectionDeleted             = "collection.deleted"
+	AuditShareLinkCreated              = "share_link.created"
+	AuditShareLinkRevoked              = "share_link.revoked"
+	AuditSelectionSubmitted            = "selection.submitted"
+	AuditCommentModerated              = "comment.moderated"
+	AuditCommentDeleted                = "comment.deleted"
+	AuditImageDeleted                  = "image.deleted"
+	AuditImageUploaded                 = "image.uploaded"
+	AuditInvitationCreated             = "invitation.created"
+	AuditInvitationRevoked             = "invitation.revoked"
+	AuditUserDisabled                  = "user.disabled"
+	AuditUserEnabled                   = "user.enabled"
+	AuditPasswordResetForced           = "password_reset.forced"
+	AuditRoleChanged                   = "user.role_changed"
+	AuditImpersonationStarted          = "impersonation.started"
+	AuditImpersonationEnded            = "impersonation.ended"
+	AuditOrganizationCreated           = "organization.created"
+	AuditOrganizationDeleted           = "organization.deleted"
+	AuditOrganizationMemberInvited     = "organization.member_invited"
+	AuditOrganizationMemberAdded       = "organization.member_added"
+	AuditOrganizationMemberRemoved     = "organization.member_removed"
+	AuditOrganizationMemberRoleChanged = "organization.member_role_changed"
+	AuditSCIMTokenCreated              = "scim.token_created"
+	AuditSCIMTokenRevoked              = "scim.token_revoked"
+	AuditSCIMUserProvisioned           = "scim.user_provisioned"
+	AuditProfileUpdated                = "profile.updated"
+	AuditAvatarUpdated                 = "avatar.updated"
+)
+
+const (
+	DefaultAuditSearchLimit = 200
+	auditActionMaxLength    = 64
+	auditUserAgentMaxLength = 512
+)
+
+// Who did something: the signed in user (if any), and where the request came
+// from.
+type Actor struct {
+	UserID    uint // 0 if nobody is signed in (e.g. signing in, resetting a password)
+	IP        string
+	UserAgent string
+}
+
+type AuditEvent struct {
+	ID        int64
+	CreatedAt time.Time
+	Actor     Actor
+	UserID    uint // The account the event is about, 0 if unknown
+	Action    string
+	Details   map[string]any
+}
+
+// Filters for AuditService.Search. Zero values don't filter.
+type AuditFilter struct {
+	UserID uint
+	Email  string // of the account the event is about
+	Action string // exact match, or a prefix ending in "." (e.g. "session.")
+	IP     string
+	From   time.Time
+	To     time.Time
+	Limit  int // Defaults to DefaultAuditSearchLimit, -1 for no limit
+}
+
+/*
+AuditService writes to and reads from the audit log (audit_events).
+
+The table is append-only (the DB rejects updates and deletes), and has no
+foreign keys: the history of an account outlives the account.
+*/
+type AuditService struct {
+	DB *sql.DB
+}
+
+func (svc *AuditService) Record(actor Actor, userId uint, action string, details map[string]any) error {
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("record audit event: %w", err)
+	}
+	if details == nil {
+		detailsJSON = []byte("{}")
+	}
+	_, err = svc.DB.Exec(`
+		INSERT INTO audit_events (actor_id, user_id, action, ip, user_agent, details)
+		VALUES ($1, $2, $3, $4, $5, $6);
+	`,
+		nullableId(actor.UserID),
+		nullableId(userId),
+		truncate(action, auditActionMaxLength),
+		actor.IP,
+		truncate(actor.UserAgent, auditUserAgentMaxLength),
+		detailsJSON,
+	)
+	if err != nil {
+		return fmt.Errorf("record audit event: %w", err)
+	}
+	return nil
+}
+
+// The events about a user, most recent first. A limit <= 0 means no limit.
+func (svc *AuditService) ByUserId(userId uint, limit int) ([]AuditEvent, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	events, err := svc.Search(AuditFilter{
+		UserID: userId,
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("query audit events by user ID: %w", err)
+	}
+	return events, nil
+}
+
+// Returns the events matching the filter, most recent first.
+func (svc *AuditService) Search(filter AuditFilter) ([]AuditEvent, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.UserID != 0 {
+		where("audit_events.user_id = $%d", filter.UserID)
+	}
+	if filter.Email != "" {
+		// Accounts can be deleted or change their email, so look at the
+		// emails recorded in the events too.
+		where(`(users.email = $%[1]d OR audit_events.details->>'email' = $%[1]d)`, strings.ToLower(filter.Email))
+	}
+	if strings.HasSuffix(filter.Action, ".") {
+		where("audit_events.action LIKE $%d", escapeLike(filter.Action)+"%")
+	} else if filter.Action != "" {
+		where("audit_events.action = $%d", filter.Action)
+	}
+	if filter.IP != "" {
+		where("audit_events.ip = $%d", filter.IP)
+	}
+	if !filter.From.IsZero() {
+		where("audit_events.created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("audit_events.created_at < $%d", filter.To)
+	}
+	query := `
+		SELECT audit_events.id, audit_events.created_at, audit_events.actor_id,
+			audit_events.user_id, audit_events.action, audit_events.ip,
+			audit_events.user_agent, audit_events.details
+		FROM audit_events
+			LEFT JOIN users ON users.id = audit_events.user_id`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	query += "\n\t\tORDER BY audit_events.created_at DESC, audit_events.id DESC"
+	limit := filter.Limit
+	if limit == 0 {
+		limit = DefaultAuditSearchLimit
+	}
+	if limit > 0 {
+		args = append(args, limit)
+		query += fmt.Sprintf("\n\t\tLIMIT $%d", len(args))
+	}
+
+	rows, err := svc.DB.Query(query+";", args...)
+	if err != nil {
+		return nil, fmt.Errorf("search audit events: %w", err)
+	}
+	defer rows.Close()
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var actorId, userId sql.NullInt64
+		var detailsJSON []byte
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&actorId,
+			&userId,
+			&event.Action,
+			&event.Actor.IP,
+			&event.Actor.UserAgent,
+			&detailsJSON,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("search audit events: %w", err)
+		}
+		event.Actor.UserID = uint(actorId.Int64)
+		event.UserID = uint(userId.Int64)
+		err = json.Unmarshal(detailsJSON, &event.Details)
+		if err != nil {
+			return nil, fmt.Errorf("search audit events: %w", err)
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search audit events: %w", err)
+	}
+	return events, nil
+}
+
+/*
+Auditor is embedded in the services that write to the audit log. Actor is
+left empty in the shared services: use their WithActor method to get a copy
+that records who is making the request, e.g.
+
+	userService.WithActor(actor).UpdatePassword(userId, password)
+
+A nil Audit disables the audit log. Failing to record an event doesn't fail
+the operation; it is only logged.
+*/
+type Auditor struct {
+	Audit *AuditService
+	Actor Actor
+}
+
+func (a Auditor) record(userId uint, action string, details map[string]any) {
+	if a.Audit == nil {
+		return
+	}
+	err := a.Audit.Record(a.Actor, userId, action, details)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+}
+
+func nullableId(id uint) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(id), Valid: id != 0}
+}
+
+func nullableTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+func truncate(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	return s[:maxLength]
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Anything that can tell who a user is from their email and password, e.g.
+// the UserService (passwords stored in our DB) or an LDAP directory.
+//
+// Implementations return ErrInvalidCredentials when the email/password pair
+// isn't valid for them.
+type Authenticator interface {
+	Authenticate(email, password string) (*User, error)
+}
+
+// Tries each Authenticator in order, until one of them accepts the
+// credentials. Only ErrInvalidCredentials moves on to the next one; any other
+// error (e.g. ErrAccountLocked) is returned right away.
+type Authenticators []Authenticator
+
+func (auths Authenticators) Authenticate(email, password string) (*User, error) {
+	for _, auth := range auths {
+		user, err := auth.Authenticate(email, password)
+		if err == nil {
+			return user, nil
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("authenticate: %w", ErrInvalidCredentials)
+}
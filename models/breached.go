@@ -0,0 +1,77 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+/*
+BreachedPasswords is an offline list of breached passwords, kept in memory as
+a sorted slice of SHA-1 hashes (20 bytes per password, no per-entry overhead),
+so lookups are a binary search.
+
+The file uses the "Pwned Passwords" format: one uppercase/lowercase hex SHA-1
+hash per line, optionally followed by ":<count>", which is ignored:
+
+	5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:10434004
+	7C4A8D09CA3762AF61E59520943DC26494F8941B
+
+Lines don't need to be sorted; they are sorted once when loading.
+*/
+type BreachedPasswords struct {
+	hashes [][sha1.Size]byte // sorted
+}
+
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load breached passwords: %w", err)
+	}
+	defer f.Close()
+
+	var hashes [][sha1.Size]byte
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		hexHash, _, _ := strings.Cut(line, ":")
+		var hash [sha1.Size]byte
+		n, err := hex.Decode(hash[:], []byte(hexHash))
+		if err != nil || n != sha1.Size {
+			return nil, fmt.Errorf("load breached passwords: invalid hash on line %d", lineNumber)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("load breached passwords: %w", err)
+	}
+
+	// Sorted in place: the list can be large, so it isn't copied.
+	slices.SortFunc(hashes, func(a, b [sha1.Size]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return &BreachedPasswords{hashes: hashes}, nil
+}
+
+// Number of passwords in the list.
+func (bp *BreachedPasswords) Len() int {
+	return len(bp.hashes)
+}
+
+func (bp *BreachedPasswords) Contains(password string) bool {
+	hash := sha1.Sum([]byte(password))
+	_, found := slices.BinarySearchFunc(bp.hashes, hash, func(a, b [sha1.Size]byte) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return found
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns a list with the given passwords, loaded from a file like the
+// real one.
+func newTestBreachedPasswords(t *testing.T, passwords ...string) *BreachedPasswords {
+	t.Helper()
+	var lines []string
+	for i, password := range passwords {
+		hash := sha1.Sum([]byte(password))
+		line := hex.EncodeToString(hash[:])
+		if i%2 == 0 {
+			line = strings.ToUpper(line) + ":42"
+		}
+		lines = append(lines, line, "")
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatalf("LoadBreachedPasswords() err = %v", err)
+	}
+	return bp
+}
+
+func TestBreachedPasswordsContains(t *testing.T) {
+	bp := newTestBreachedPasswords(t, "password", "hunter2", "123456", "correct horse battery staple", "letmein")
+	if bp.Len() != 5 {
+		t.Errorf("Len() = %d, want 5", bp.Len())
+	}
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"hunter2", true},
+		{"123456", true},
+		{"correct horse battery staple", true},
+		{"letmein", true},
+		{"Password", false},
+		{"hunter3", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := bp.Contains(tt.password); got != tt.want {
+				t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("empty list", func(t *testing.T) {
+		empty := newTestBreachedPasswords(t)
+		if empty.Contains("password") {
+			t.Error("Contains() = true, want false")
+		}
+	})
+}
+
+func TestLoadBreachedPasswordsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"not hex":   "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FDZ\n",
+		"too short": "5BAA61E4C9B93F3F0682250B6CF8331B7EE68F\n",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "breached.txt")
+			err := os.WriteFile(path, []byte(content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = LoadBreachedPasswords(path)
+			if err == nil {
+				t.Error("LoadBreachedPasswords() err = nil, want an error")
+			}
+		})
+	}
+}
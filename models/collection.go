@@ -0,0 +1,526 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// How many galleries are looked at to find the cover of a collection.
+const collectionCoverCandidates = 20
+
+/*
+A collection holds galleries and other collections, e.g. "2026 Weddings" >
+"Smith Wedding" > "Ceremony". Like galleries, it belongs to a user (UserID) or
+to an organization (OrganizationID), and so does everything in it.
+*/
+type Collection struct {
+	ID             int
+	UserID         uint
+	OrganizationID uint
+	CreatedBy      uint
+	ParentID       int // 0 when it's at the top
+	Title          string
+	// Visibility of the collection, "" for the visibility of its parent
+	// (public at the top). Galleries and collections in it that have no
+	// visibility of their own get EffectiveVisibility.
+	Visibility          string
+	EffectiveVisibility string
+	Depth               int // Only set by Workspace: 0 at the top
+}
+
+func (collection Collection) historyUserId() uint {
+	if collection.UserID != 0 {
+		return collection.UserID
+	}
+	return collection.CreatedBy
+}
+
+// A gallery, or a collection, in a collection.
+type CollectionChild struct {
+	Collection *Collection // nil for galleries
+	Gallery    *Gallery    // nil for collections
+	// The gallery with the cover image (the first image of the gallery, or
+	// of a gallery in the collection), nil if there are no images.
+	CoverGallery *Gallery
+	Cover        Image
+}
+
+/*
+CollectionService manages collections and what's in them. Galleries are
+moved in and out of collections with GalleryService.SetCollection.
+
+Who may see and edit collections follows the rules of galleries (see
+GalleryService.Authorize).
+*/
+type CollectionService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *CollectionService) WithActor(actor Actor) *CollectionService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+const collectionColumns = `
+	collections.id, COALESCE(collections.user_id, 0),
+	COALESCE(collections.organization_id, 0), COALESCE(collections.created_by, 0),
+	COALESCE(collections.parent_id, 0), collections.title,
+	COALESCE(collections.visibility, ''), collection_visibility(collections.id)`
+
+func scanCollection(row scanner) (*Collection, error) {
+	var collection Collection
+	err := row.Scan(
+		&collection.ID,
+		&collection.UserID,
+		&collection.OrganizationID,
+		&collection.CreatedBy,
+		&collection.ParentID,
+		&collection.Title,
+		&collection.Visibility,
+		&collection.EffectiveVisibility,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("collection %w", ErrNotFound)
+		}
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// Creates a collection for userId, or, when organizationId isn't 0, for that
+// organization (userId being who created it), in the parent collection (0
+// for the top). Returns ErrNotFound if the parent has another owner.
+func (svc *CollectionService) Create(title string, userId, organizationId uint, parentId int) (*Collection, error) {
+	collection := Collection{
+		Title:          strings.TrimSpace(title),
+		UserID:         userId,
+		OrganizationID: organizationId,
+		CreatedBy:      userId,
+		ParentID:       parentId,
+	}
+	if organizationId != 0 {
+		collection.UserID = 0
+	}
+	if collection.Title == "" {
+		return nil, fmt.Errorf("create collection: %w", ErrCollectionTitleRequired)
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO collections (title, user_id, organization_id, created_by, parent_id)
+		SELECT $1, $2, $3, $4, NULLIF($5, 0)
+		WHERE $5 = 0 OR EXISTS (
+			SELECT 1
+			FROM collections
+			WHERE id = $5
+				AND user_id IS NOT DISTINCT FROM $2
+				AND organization_id IS NOT DISTINCT FROM $3
+		)
+		RETURNING id, collection_visibility(id);
+	`, collection.Title, nullableId(collection.UserID), nullableId(collection.OrganizationID),
+		nullableId(collection.CreatedBy), parentId)
+	err := row.Scan(&collection.ID, &collection.EffectiveVisibility)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create collection: parent %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+	svc.record(collection.historyUserId(), AuditCollectionCreated, map[string]any{
+		"collection_id": collection.ID,
+		"title":         collection.Title,
+	})
+	return &collection, nil
+}
+
+func (svc *CollectionService) ByID(id int) (*Collection, error) {
+	collection, err := scanCollection(svc.DB.QueryRow(`
+		SELECT `+collectionColumns+`
+		FROM collections
+		WHERE id = $1;
+	`, id))
+	if err != nil {
+		return nil, fmt.Errorf("collection by ID: %w", err)
+	}
+	return collection, nil
+}
+
+// The collections from the top down to the collection (included), for
+// breadcrumbs.
+func (svc *CollectionService) Path(id int) ([]Collection, error) {
+	rows, err := svc.DB.Query(`
+		WITH RECURSIVE ancestors AS (
+			SELECT id, parent_id, 0 AS depth
+			FROM collections
+			WHERE id = $1
+			UNION ALL
+			SELECT collections.id, collections.parent_id, ancestors.depth + 1
+			FROM collections
+				JOIN ancestors ON collections.id = ancestors.parent_id
+			WHERE ancestors.depth < 100
+		)
+		SELECT `+collectionColumns+`
+		FROM ancestors
+			JOIN collections ON collections.id = ancestors.id
+		ORDER BY ancestors.depth DESC;
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("collection path: %w", err)
+	}
+	defer rows.Close()
+	var path []Collection
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, fmt.Errorf("collection path: %w", err)
+		}
+		path = append(path, *collection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("collection path: %w", err)
+	}
+	return path, nil
+}
+
+// All the collections of the user (organizationId 0) or of the organization,
+// as a tree: each collection is followed by the ones in it, with their
+// Depth set.
+func (svc *CollectionService) Workspace(userId, organizationId uint) ([]Collection, error) {
+	owner := "user_id = $1"
+	ownerId := userId
+	if organizationId != 0 {
+		owner = "organization_id = $1"
+		ownerId = organizationId
+	}
+	rows, err := svc.DB.Query(`
+		SELECT `+collectionColumns+`
+		FROM collections
+		WHERE `+owner+`
+		ORDER BY lower(title), id;
+	`, ownerId)
+	if err != nil {
+		return nil, fmt.Errorf("workspace collections: %w", err)
+	}
+	defer rows.Close()
+	children := make(map[int][]Collection)
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, fmt.Errorf("workspace collections: %w", err)
+		}
+		children[collection.ParentID] = append(children[collection.ParentID], *collection)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("workspace collections: %w", err)
+	}
+	var tree []Collection
+	var walk func(parentId, depth int)
+	walk = func(parentId, depth int) {
+		for _, collection := range children[parentId] {
+			collection.Depth = depth
+			tree = append(tree, collection)
+			walk(collection.ID, depth+1)
+		}
+	}
+	walk(0, 0)
+	return tree, nil
+}
+
+// The collections and galleries in the collection (0 for the top of the
+// workspace of userId or organizationId), collections first, with their
+// covers. Unless all is true, only those that can be listed for anybody are
+// returned: public ones, and unlisted ones that get it from the collection
+// (galleries only while they are live).
+func (svc *CollectionService) Children(id int, userId, organizationId uint, all bool) ([]CollectionChild, error) {
+	var children []CollectionChild
+	collections, err := svc.childCollections(id, userId, organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("collection children: %w", err)
+	}
+	for _, collection := range collections {
+		if !all && !listable(collection.Visibility, collection.EffectiveVisibility) {
+			continue
+		}
+		child := CollectionChild{Collection: &collection}
+		child.CoverGallery, child.Cover, err = svc.cover(collection.ID, all)
+		if err != nil {
+			return nil, fmt.Errorf("collection children: %w", err)
+		}
+		children = append(children, child)
+	}
+	galleries, err := svc.childGalleries(id, userId, organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("collection children: %w", err)
+	}
+	now := time.Now()
+	for _, gallery := range galleries {
+		if !all && (!listable(gallery.Visibility, gallery.EffectiveVisibility) || gallery.CheckSchedule(now) != nil) {
+			continue
+		}
+		child := CollectionChild{Gallery: &gallery}
+		cover, err := svc.GalleryService.Cover(gallery.ID)
+		if err == nil {
+			child.CoverGallery = &gallery
+			child.Cover = cover
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, fmt.Errorf("collection children: %w", err)
+		}
+		children = append(children, child)
+	}
+	return children, nil
+}
+
+// Whether something with that visibility can be listed in its collection for
+// anybody: unlisted ones can't, unless they get it from the collection (then
+// only those who have the link to the collection see the list).
+func listable(visibility, effectiveVisibility string) bool {
+	switch effectiveVisibility {
+	case GalleryVisibilityPublic:
+		return true
+	case GalleryVisibilityUnlisted:
+		return visibility == ""
+	}
+	return false
+}
+
+// Collections in the collection, or at the top of the workspace when id is 0.
+func (svc *CollectionService) childCollections(id int, userId, organizationId uint) ([]Collection, error) {
+	where, args := childrenWhere("collections", id, userId, organizationId)
+	rows, err := svc.DB.Query(`
+		SELECT `+collectionColumns+`
+		FROM collections
+		WHERE `+where+`
+		ORDER BY lower(collections.title), collections.id;
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var collections []Collection
+	for rows.Next() {
+		collection, err := scanCollection(rows)
+		if err != nil {
+			return nil, err
+		}
+		collections = append(collections, *collection)
+	}
+	return collections, rows.Err()
+}
+
+// Galleries in the collection, or at the top of the workspace when id is 0.
+func (svc *CollectionService) childGalleries(id int, userId, organizationId uint) ([]Gallery, error) {
+	where, args := childrenWhere("galleries", id, userId, organizationId)
+	rows, err := svc.DB.Query(`
+		SELECT `+galleryColumns+`
+		FROM galleries
+			LEFT JOIN users ON users.id = galleries.user_id
+		WHERE `+where+`
+		ORDER BY lower(galleries.title), galleries.id;
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery, err := scanGallery(rows)
+		if err != nil {
+			return nil, err
+		}
+		galleries = append(galleries, *gallery)
+	}
+	return galleries, rows.Err()
+}
+
+func childrenWhere(table string, id int, userId, organizationId uint) (string, []any) {
+	parent := "parent_id"
+	if table == "galleries" {
+		parent = "collection_id"
+	}
+	if id != 0 {
+		return table + "." + parent + " = $1", []any{id}
+	}
+	if organizationId != 0 {
+		return table + "." + parent + " IS NULL AND " + table + ".organization_id = $1", []any{organizationId}
+	}
+	return table + "." + parent + " IS NULL AND " + table + ".user_id = $1", []any{userId}
+}
+
+// The cover of a collection: the first image of the first gallery that has
+// one, looking at the galleries closest to the top first. Unless all is
+// true, only public galleries that are live are looked at.
+func (svc *CollectionService) cover(id int, all bool) (*Gallery, Image, error) {
+	rows, err := svc.DB.Query(`
+		WITH RECURSIVE descendants AS (
+			SELECT id, 0 AS depth
+			FROM collections
+			WHERE id = $1
+			UNION ALL
+			SELECT collections.id, descendants.depth + 1
+			FROM collections
+				JOIN descendants ON collections.parent_id = descendants.id
+			WHERE descendants.depth < 100
+		)
+		SELECT `+galleryColumns+`
+		FROM descendants
+			JOIN galleries ON galleries.collection_id = descendants.id
+			LEFT JOIN users ON users.id = galleries.user_id
+		ORDER BY descendants.depth, lower(galleries.title), galleries.id
+		LIMIT $2;
+	`, id, collectionCoverCandidates)
+	if err != nil {
+		return nil, Image{}, err
+	}
+	var candidates []Gallery
+	for rows.Next() {
+		gallery, err := scanGallery(rows)
+		if err != nil {
+			rows.Close()
+			return nil, Image{}, err
+		}
+		candidates = append(candidates, *gallery)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, Image{}, err
+	}
+	for _, gallery := range candidates {
+		if !all && (gallery.EffectiveVisibility != GalleryVisibilityPublic || gallery.CheckSchedule(time.Now()) != nil) {
+			continue
+		}
+		cover, err := svc.GalleryService.Cover(gallery.ID)
+		if err == nil {
+			return &gallery, cover, nil
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return nil, Image{}, err
+		}
+	}
+	return nil, Image{}, nil
+}
+
+// Updates the title, visibility and parent of the collection. Returns
+// ErrCollectionTitleRequired without a title, ErrNotFound if the parent has
+// another owner, and ErrCollectionCycle if the parent is in the collection.
+func (svc *CollectionService) Update(collection *Collection) error {
+	collection.Title = strings.TrimSpace(collection.Title)
+	if collection.Title == "" {
+		return fmt.Errorf("update collection: %w", ErrCollectionTitleRequired)
+	}
+	if collection.Visibility != "" && !validGalleryVisibility(collection.Visibility) {
+		return fmt.Errorf("update collection: unknown visibility %q", collection.Visibility)
+	}
+	if collection.ParentID != 0 {
+		var inside bool
+		err := svc.DB.QueryRow(`
+			WITH RECURSIVE descendants AS (
+				SELECT id, 0 AS depth
+				FROM collections
+				WHERE id = $1
+				UNION ALL
+				SELECT collections.id, descendants.depth + 1
+				FROM collections
+					JOIN descendants ON collections.parent_id = descendants.id
+				WHERE descendants.depth < 100
+			)
+			SELECT EXISTS (SELECT 1 FROM descendants WHERE id = $2);
+		`, collection.ID, collection.ParentID).Scan(&inside)
+		if err != nil {
+			return fmt.Errorf("update collection: %w", err)
+		}
+		if inside {
+			return fmt.Errorf("update collection: %w", ErrCollectionCycle)
+		}
+	}
+	result, err := svc.DB.Exec(`
+		UPDATE collections
+		SET title = $2, visibility = NULLIF($3, ''), parent_id = NULLIF($4, 0)
+		WHERE id = $1 AND ($4 = 0 OR EXISTS (
+			SELECT 1
+			FROM collections parent
+			WHERE parent.id = $4
+				AND parent.user_id IS NOT DISTINCT FROM collections.user_id
+				AND parent.organization_id IS NOT DISTINCT FROM collections.organization_id
+		));
+	`, collection.ID, collection.Title, collection.Visibility, collection.ParentID)
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("update collection: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("update collection: %w", ErrNotFound)
+	}
+	svc.record(collection.historyUserId(), AuditCollectionUpdated, map[string]any{
+		"collection_id": collection.ID,
+		"title":         collection.Title,
+		"visibility":    collection.Visibility,
+		"parent_id":     collection.ParentID,
+	})
+	return nil
+}
+
+// Deletes the collection. What was in it moves to its parent: galleries are
+// never deleted with their collection.
+func (svc *CollectionService) Delete(collection *Collection) error {
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE galleries
+		SET collection_id = NULLIF($2, 0)
+		WHERE collection_id = $1;
+	`, collection.ID, collection.ParentID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	_, err = tx.Exec(`
+		UPDATE collections
+		SET parent_id = NULLIF($2, 0)
+		WHERE parent_id = $1;
+	`, collection.ID, collection.ParentID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	_, err = tx.Exec(`
+		DELETE FROM collections
+		WHERE id = $1;
+	`, collection.ID)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	svc.record(collection.historyUserId(), AuditCollectionDeleted, map[string]any{
+		"collection_id": collection.ID,
+		"title":         collection.Title,
+	})
+	return nil
+}
+
+// Returns ErrForbidden unless the user may perform the action on the
+// collection: the same rules as for a gallery with the same owner and
+// visibility (see GalleryService.Authorize).
+func (svc *CollectionService) Authorize(userId uint, collection *Collection, action GalleryAction) error {
+	err := svc.GalleryService.Authorize(userId, &Gallery{
+		UserID:              collection.UserID,
+		OrganizationID:      collection.OrganizationID,
+		EffectiveVisibility: collection.EffectiveVisibility,
+	}, action)
+	if err != nil {
+		return fmt.Errorf("authorize collection: %w", err)
+	}
+	return nil
+}
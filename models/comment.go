@@ -0,0 +1,296 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// Statuses of comments.
+const (
+	CommentVisible = "visible"
+	CommentPending = "pending" // waiting for the owner's approval
+	CommentHidden  = "hidden"  // by the owner
+)
+
+const commentBodyMaxLength = 2000
+
+/*
+A comment on an image, replying to ParentID (0 for a new thread).
+
+Only visible comments are shown to those who can see the gallery. Its editors
+see them all, and authors see their own pending comments.
+*/
+type Comment struct {
+	ID        int
+	GalleryID int
+	Filename  string
+	ParentID  int
+	UserID    uint   // 0 once the author deleted their account
+	Author    string // display name or handle of the author, "" if none
+	Body      string
+	Status    string
+	CreatedAt time.Time
+	Replies   []*Comment
+}
+
+// CommentService manages the comments on the images of galleries.
+type CommentService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *CommentService) WithActor(actor Actor) *CommentService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+// The threads of comments on the image that viewerId (0 when signed out) may
+// see, oldest first, with their replies. Moderators (editors of the gallery)
+// see all comments. Replies to comments one may not see aren't shown either.
+func (svc *CommentService) Threads(galleryId int, filename string, viewerId uint, moderator bool) ([]*Comment, error) {
+	rows, err := svc.DB.Query(`
+		SELECT image_comments.id, COALESCE(image_comments.parent_id, 0),
+			COALESCE(image_comments.user_id, 0),
+			COALESCE(NULLIF(users.display_name, ''), users.handle, ''),
+			image_comments.body, image_comments.status, image_comments.created_at
+		FROM image_comments
+			LEFT JOIN users ON users.id = image_comments.user_id
+		WHERE image_comments.gallery_id = $1 AND image_comments.filename = $2
+			AND ($4 OR image_comments.status = 'visible'
+				OR (image_comments.status = 'pending' AND image_comments.user_id = $3))
+		ORDER BY image_comments.created_at, image_comments.id;
+	`, galleryId, filename, nullableId(viewerId), moderator)
+	if err != nil {
+		return nil, fmt.Errorf("comment threads: %w", err)
+	}
+	defer rows.Close()
+	var threads []*Comment
+	byId := make(map[int]*Comment)
+	for rows.Next() {
+		comment := Comment{
+			GalleryID: galleryId,
+			Filename:  filename,
+		}
+		err := rows.Scan(&comment.ID, &comment.ParentID, &comment.UserID, &comment.Author,
+			&comment.Body, &comment.Status, &comment.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("comment threads: %w", err)
+		}
+		// Parents come first, being older.
+		if comment.ParentID == 0 {
+			threads = append(threads, &comment)
+		} else if parent, ok := byId[comment.ParentID]; ok {
+			parent.Replies = append(parent.Replies, &comment)
+		} else {
+			continue
+		}
+		byId[comment.ID] = &comment
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("comment threads: %w", err)
+	}
+	return threads, nil
+}
+
+// The comments of the gallery waiting for approval, oldest first (without
+// their replies).
+func (svc *CommentService) Pending(galleryId int) ([]Comment, error) {
+	rows, err := svc.DB.Query(`
+		SELECT image_comments.id, image_comments.filename,
+			COALESCE(image_comments.parent_id, 0), COALESCE(image_comments.user_id, 0),
+			COALESCE(NULLIF(users.display_name, ''), users.handle, ''),
+			image_comments.body, image_comments.created_at
+		FROM image_comments
+			LEFT JOIN users ON users.id = image_comments.user_id
+		WHERE image_comments.gallery_id = $1 AND image_comments.status = 'pending'
+		ORDER BY image_comments.created_at, image_comments.id;
+	`, galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("pending comments: %w", err)
+	}
+	defer rows.Close()
+	var comments []Comment
+	for rows.Next() {
+		comment := Comment{
+			GalleryID: galleryId,
+			Status:    CommentPending,
+		}
+		err := rows.Scan(&comment.ID, &comment.Filename, &comment.ParentID, &comment.UserID,
+			&comment.Author, &comment.Body, &comment.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("pending comments: %w", err)
+		}
+		comments = append(comments, comment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pending comments: %w", err)
+	}
+	return comments, nil
+}
+
+// Adds a comment by authorId on the image, replying to parentId (0 for a new
+// thread). Whether the author may see the gallery is up to the caller.
+//
+// In moderated galleries, comments are pending until approved, unless their
+// author can edit the gallery. Returns ErrCommentsDisabled if the gallery
+// doesn't take comments, ErrInvalidComment for empty or long bodies, and
+// ErrNotFound if the image or the parent comment doesn't exist.
+func (svc *CommentService) Create(gallery *Gallery, filename string, authorId uint, parentId int, body string) (*Comment, error) {
+	if gallery.Comments == GalleryCommentsDisabled {
+		return nil, fmt.Errorf("create comment: %w", ErrCommentsDisabled)
+	}
+	body = strings.TrimSpace(body)
+	if body == "" || utf8.RuneCountInString(body) > commentBodyMaxLength {
+		return nil, fmt.Errorf("create comment: %w", ErrInvalidComment)
+	}
+	_, err := svc.GalleryService.Image(gallery.ID, filename)
+	if err != nil {
+		return nil, fmt.Errorf("create comment: %w", err)
+	}
+	comment := Comment{
+		GalleryID: gallery.ID,
+		Filename:  filename,
+		ParentID:  parentId,
+		UserID:    authorId,
+		Body:      body,
+		Status:    CommentVisible,
+	}
+	if gallery.Comments == GalleryCommentsModerate {
+		err := svc.GalleryService.Authorize(authorId, gallery, GalleryActionEdit)
+		if errors.Is(err, ErrForbidden) {
+			comment.Status = CommentPending
+		} else if err != nil {
+			return nil, fmt.Errorf("create comment: %w", err)
+		}
+	}
+	// The parent has to be on the same image.
+	row := svc.DB.QueryRow(`
+		INSERT INTO image_comments (gallery_id, filename, parent_id, user_id, body, status)
+		SELECT $1, $2, NULLIF($3, 0), $4, $5, $6
+		WHERE $3 = 0 OR EXISTS (
+			SELECT 1
+			FROM image_comments
+			WHERE id = $3 AND gallery_id = $1 AND filename = $2
+		)
+		RETURNING id, created_at;
+	`, comment.GalleryID, comment.Filename, comment.ParentID, nullableId(comment.UserID),
+		comment.Body, comment.Status)
+	err = row.Scan(&comment.ID, &comment.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create comment: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("create comment: %w", err)
+	}
+	return &comment, nil
+}
+
+// Shows (approving it if it was pending) or hides the comment of the gallery,
+// and its replies with it. Returns ErrNotFound if there's no such comment.
+func (svc *CommentService) SetStatus(gallery *Gallery, id int, status string) error {
+	if status != CommentVisible && status != CommentHidden {
+		return fmt.Errorf("set comment status: unknown status %q", status)
+	}
+	var filename string
+	row := svc.DB.QueryRow(`
+		UPDATE image_comments
+		SET status = $3
+		WHERE id = $1 AND gallery_id = $2
+		RETURNING filename;
+	`, id, gallery.ID, status)
+	err := row.Scan(&filename)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("set comment status: %w", ErrNotFound)
+		}
+		return fmt.Errorf("set comment status: %w", err)
+	}
+	svc.record(gallery.historyUserId(), AuditCommentModerated, map[string]any{
+		"gallery_id": gallery.ID,
+		"filename":   filename,
+		"comment_id": id,
+		"status":     status,
+	})
+	return nil
+}
+
+// Deletes the comment of the gallery, with its replies. Returns ErrNotFound
+// if there's no such comment.
+func (svc *CommentService) Delete(gallery *Gallery, id int) error {
+	var filename string
+	row := svc.DB.QueryRow(`
+		DELETE FROM image_comments
+		WHERE id = $1 AND gallery_id = $2
+		RETURNING filename;
+	`, id, gallery.ID)
+	err := row.Scan(&filename)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("delete comment: %w", ErrNotFound)
+		}
+		return fmt.Errorf("delete comment: %w", err)
+	}
+	svc.record(gallery.historyUserId(), AuditCommentDeleted, map[string]any{
+		"gallery_id": gallery.ID,
+		"filename":   filename,
+		"comment_id": id,
+	})
+	return nil
+}
+
+// An email to the owner of a gallery about a new comment, sent by
+// EmailService.NewComment.
+type NewCommentNotice struct {
+	GalleryTitle string
+	Filename     string
+	Author       string
+	Body         string
+	Pending      bool   // waiting for approval
+	URL          string // of the image page
+}
+
+var newCommentTextTemplate = texttemplate.Must(texttemplate.New("comment").Parse(`{{.Author}} commented on {{.Filename}} in your gallery "{{.GalleryTitle}}":
+
+{{.Body}}
+
+{{if .Pending}}The comment waits for your approval: {{else}}Reply: {{end}}{{.URL}}
+`))
+
+var newCommentHTMLTemplate = htmltemplate.Must(htmltemplate.New("comment").Parse(`<p>{{.Author}} commented on {{.Filename}} in your gallery "{{.GalleryTitle}}":</p>
+<blockquote style="white-space: pre-line">{{.Body}}</blockquote>
+<p>{{if .Pending}}The comment waits for your <a href="{{.URL}}">approval</a>.{{else}}<a href="{{.URL}}">Reply</a>{{end}}</p>
+`))
+
+func (es *EmailService) NewComment(to string, notice NewCommentNotice) error {
+	var plainText, html bytes.Buffer
+	err := newCommentTextTemplate.Execute(&plainText, notice)
+	if err != nil {
+		return fmt.Errorf("new comment email: %w", err)
+	}
+	err = newCommentHTMLTemplate.Execute(&html, notice)
+	if err != nil {
+		return fmt.Errorf("new comment email: %w", err)
+	}
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   fmt.Sprintf("New comment in %s", notice.GalleryTitle),
+		PlainText: strings.TrimSpace(plainText.String()),
+		HTML:      html.String(),
+	}
+	err = es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
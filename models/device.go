@@ -0,0 +1,52 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+)
+
+// DeviceService remembers the devices (browsers) each user signed in from,
+// identified by a random ID kept in a long-lived cookie. Only hashes of the
+// IDs are stored.
+type DeviceService struct {
+	DB *sql.DB
+}
+
+// Records a sign in from the device. Returns true if it's a new device for a
+// user that signed in from other devices before (the very first device isn't
+// news).
+func (svc *DeviceService) SignedIn(userId uint, deviceId, userAgent, ip string) (bool, error) {
+	var hadDevices, inserted bool
+	row := svc.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM known_devices
+			WHERE user_id = $1
+		);
+	`, userId)
+	err := row.Scan(&hadDevices)
+	if err != nil {
+		return false, fmt.Errorf("device signed in: %w", err)
+	}
+	// xmax is 0 for rows that were just inserted (not updated).
+	row = svc.DB.QueryRow(`
+		INSERT INTO known_devices (user_id, device_hash, user_agent, ip)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, device_hash) DO
+		UPDATE
+		SET user_agent = $3, ip = $4, last_seen_at = NOW()
+		RETURNING xmax = 0;
+	`, userId, svc.hashDeviceId(deviceId), truncate(userAgent, auditUserAgentMaxLength), ip)
+	err = row.Scan(&inserted)
+	if err != nil {
+		return false, fmt.Errorf("device signed in: %w", err)
+	}
+	return hadDevices && inserted, nil
+}
+
+func (svc *DeviceService) hashDeviceId(deviceId string) string {
+	hash := sha256.Sum256([]byte(deviceId))
+	return base64.URLEncoding.EncodeToString(hash[:])
+}
@@ -2,7 +2,9 @@ package models
 
 import (
 	"fmt"
+	"html"
 	"log"
+	"time"
 
 	"github.com/wneessen/go-mail"
 )
@@ -83,7 +85,7 @@ func (es *EmailService) ForgotPassword(to string, resetUrl string) error {
 	msg := Email{
 		From:      DefaultSender,
 		To:        to,
-		Subject:   "testing",
+		Subject:   "Reset your password",
 		PlainText: "Reset your password: " + resetUrl,
 		HTML: fmt.Sprintf(
 			`<h1>Reset your password: </h1><p><a href="%s">Here</a></p>`, resetUrl,
@@ -97,6 +99,103 @@ func (es *EmailService) ForgotPassword(to string, resetUrl string) error {
 	return nil
 }
 
+func (es *EmailService) MagicLink(to string, signInUrl string) error {
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   "Your sign in link",
+		PlainText: "Sign in to LensLocked (the link can only be used once, and expires soon): " + signInUrl,
+		HTML: fmt.Sprintf(
+			`<h1>Sign in to LensLocked</h1><p><a href="%s">Sign in</a></p><p>The link can only be used once, and expires soon. If you didn't ask for it, you can ignore this email.</p>`, signInUrl,
+		),
+	}
+	err := es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) Invitation(to string, signUpUrl string, expiresAt time.Time) error {
+	expires := expiresAt.UTC().Format("January 2, 2006")
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   "You're invited to LensLocked",
+		PlainText: "You're invited to join LensLocked. Sign up before " + expires + ": " + signUpUrl,
+		HTML: fmt.Sprintf(
+			`<h1>You're invited to join LensLocked</h1><p><a href="%s">Sign up</a> before %s.</p>`, signUpUrl, expires,
+		),
+	}
+	err := es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) ConfirmEmailChange(to string, confirmUrl string) error {
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   "Confirm your new email address",
+		PlainText: "Confirm your new email address: " + confirmUrl,
+		HTML: fmt.Sprintf(
+			`<h1>Confirm your new email address: </h1><p><a href="%s">Here</a></p>`, confirmUrl,
+		),
+	}
+	err := es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
+
+func (es *EmailService) AccountDeletionScheduled(to string, cancelUrl string, scheduledFor time.Time) error {
+	when := scheduledFor.Format("January 2, 2006")
+	msg := Email{
+		From:    DefaultSender,
+		To:      to,
+		Subject: "Your account will be deleted",
+		PlainText: fmt.Sprintf(
+			"Your account and all your galleries will be deleted on %s. Changed your mind? Cancel the deletion: %s",
+			when, cancelUrl,
+		),
+		HTML: fmt.Sprintf(
+			`<h1>Your account will be deleted on %s</h1><p>All your galleries and images will be deleted too. Changed your mind? <a href="%s">Cancel the deletion</a></p>`,
+			when, cancelUrl,
+		),
+	}
+	err := es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
+
+// Tells a user their account wasn't deleted after all, because they are the
+// only owner of organizationName.
+func (es *EmailService) AccountDeletionCanceled(to string, organizationName string) error {
+	msg := Email{
+		From:    DefaultSender,
+		To:      to,
+		Subject: "Your account wasn't deleted",
+		PlainText: fmt.Sprintf(
+			"You are now the only owner of %s, so your account wasn't deleted: the organization would be left without an owner. Make someone else owner, or delete it, then delete your account again.",
+			organizationName,
+		),
+		HTML: fmt.Sprintf(
+			`<h1>Your account wasn't deleted</h1><p>You are now the only owner of %s, and the organization would be left without an owner. Make someone else owner, or delete it, then delete your account again.</p>`,
+			html.EscapeString(organizationName),
+		),
+	}
+	err := es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
+
 func (es *EmailService) setFrom(msg *mail.Msg, email Email) {
 	var from string
 	switch {
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	DefaultEmailChangeDuration = 24 * time.Hour
+)
+
+type EmailChange struct {
+	ID        int
+	UserID    uint
+	NewEmail  string
+	Token     string // Only set when creating an email change (not stored in db)
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+/*
+EmailChangeService keeps track of requests to change the email of an account.
+The new address is only stored in the users table once the token sent to it is
+consumed, which proves the user owns it. A user can only have one pending
+request; a new one replaces the previous.
+
+BytesPerToken defaults to MinBytesPerToken (session.go).
+*/
+type EmailChangeService struct {
+	DB            *sql.DB
+	BytesPerToken int
+	Duration      time.Duration // Defaults to DefaultEmailChangeDuration
+}
+
+// Creates the request to change the address of the user to newEmail. Returns
+// ErrInvalidEmail if newEmail isn't an email address, and ErrEmailTaken if
+// another account uses it.
+func (svc *EmailChangeService) Create(userId uint, newEmail string) (*EmailChange, error) {
+	newEmail = strings.ToLower(strings.TrimSpace(newEmail))
+	address, err := mail.ParseAddress(newEmail)
+	if err != nil || address.Address != newEmail {
+		return nil, fmt.Errorf("create email change: %w", ErrInvalidEmail)
+	}
+	// Fail early if the address is already in use.
+	var taken bool
+	row := svc.DB.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM users WHERE email = $1);
+	`, newEmail)
+	err = row.Scan(&taken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+
+	bytesPerToken := max(MinBytesPerToken, svc.BytesPerToken)
+	token, err := rand.RandomBase64String(bytesPerToken)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	duration := svc.Duration
+	if duration <= 0 {
+		duration = DefaultEmailChangeDuration
+	}
+	emailChange := EmailChange{
+		UserID:    userId,
+		NewEmail:  newEmail,
+		Token:     token,
+		TokenHash: svc.hashToken(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row = svc.DB.QueryRow(`
+		INSERT INTO email_changes (user_id, new_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO
+		UPDATE
+		SET new_email = $2, token_hash = $3, expires_at = $4
+		RETURNING id;
+	`, emailChange.UserID, emailChange.NewEmail, emailChange.TokenHash, emailChange.ExpiresAt)
+	err = row.Scan(&emailChange.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create email change: %w", err)
+	}
+	return &emailChange, nil
+}
+
+// Returns the pending (non-expired) email change of a user, or ErrNotFound.
+func (svc *EmailChangeService) Pending(userId uint) (*EmailChange, error) {
+	emailChange := EmailChange{
+		UserID: userId,
+	}
+	row := svc.DB.QueryRow(`
+		SELECT id, new_email, expires_at
+		FROM email_changes
+		WHERE user_id = $1 AND expires_at > NOW();
+	`, userId)
+	err := row.Scan(&emailChange.ID, &emailChange.NewEmail, &emailChange.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("pending email change: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("pending email change: %w", err)
+	}
+	return &emailChange, nil
+}
+
+// Deletes the token and returns the email change it belonged to. Use
+// UserService.UpdateEmail to apply it.
+func (svc *EmailChangeService) Consume(token string) (*EmailChange, error) {
+	emailChange := EmailChange{
+		TokenHash: svc.hashToken(token),
+	}
+	row := svc.DB.QueryRow(`
+		DELETE FROM email_changes
+		WHERE token_hash = $1
+		RETURNING id, user_id, new_email, expires_at;
+	`, emailChange.TokenHash)
+	err := row.Scan(
+		&emailChange.ID,
+		&emailChange.UserID,
+		&emailChange.NewEmail,
+		&emailChange.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume email change: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("consume email change: %w", err)
+	}
+	if time.Now().After(emailChange.ExpiresAt) {
+		return nil, fmt.Errorf("consume email change: token expired")
+	}
+	return &emailChange, nil
+}
+
+func (svc *EmailChangeService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -1,8 +1,75 @@
 package models
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
-	ErrEmailTaken = errors.New("email address already taken")
-	ErrNotFound   = errors.New("not found")
+	ErrEmailTaken         = errors.New("email address already taken")
+	ErrNotFound           = errors.New("not found")
+	ErrForbidden          = errors.New("forbidden")
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrAccountLocked      = errors.New("account temporarily locked")
+	ErrAccountDisabled    = errors.New("account disabled")
+	ErrThrottled          = errors.New("too many attempts")
+	ErrInvalidInvitation  = errors.New("invalid, used up or expired invitation")
+	ErrSignupClosed       = errors.New("signup requires an invitation")
+	ErrCannotImpersonate  = errors.New("this account can't be impersonated")
+	ErrInvalidEmail       = errors.New("invalid email address")
+
+	// Organizations
+	ErrOrganizationNameRequired = errors.New("organization name required")
+	ErrAlreadyMember            = errors.New("already a member of the organization")
+	ErrLastOwner                = errors.New("an organization needs at least one owner")
+
+	// Images
+	ErrImageTooLarge    = errors.New("image too large")
+	ErrUnsupportedImage = errors.New("unsupported image format")
+
+	// Profiles
+	ErrInvalidProfile = errors.New("invalid profile")
+	ErrHandleTaken    = errors.New("handle already taken")
+
+	// Gallery slugs
+	ErrInvalidSlug = errors.New("invalid slug")
+	ErrSlugTaken   = errors.New("slug already taken")
+
+	// Tags and captions
+	ErrInvalidTags    = errors.New("invalid tags")
+	ErrCaptionTooLong = errors.New("caption too long")
+
+	// Scheduled galleries: they are forbidden to those who can't edit them.
+	ErrGalleryNotPublished = fmt.Errorf("gallery not published yet: %w", ErrForbidden)
+	ErrGalleryExpired      = fmt.Errorf("gallery expired: %w", ErrForbidden)
+	ErrInvalidSchedule     = errors.New("gallery must be published before it expires")
+
+	// Collections
+	ErrCollectionTitleRequired = errors.New("collection title required")
+	ErrCollectionCycle         = errors.New("collection can't be moved into itself")
+
+	// Proofing
+	ErrShareLinkLabelRequired = errors.New("share link label required")
+	ErrSelectionNameRequired  = errors.New("selection name required")
+	ErrSelectionNameTaken     = errors.New("selection name already taken")
+	ErrNoteTooLong            = errors.New("note too long")
+
+	// Comments
+	ErrCommentsDisabled = errors.New("comments disabled")
+	ErrInvalidComment   = errors.New("invalid comment")
+
+	// Annotations
+	ErrInvalidRegion     = errors.New("region out of the image")
+	ErrInvalidAnnotation = errors.New("invalid annotation")
+
+	// SCIM
+	ErrInvalidSCIMFilter = errors.New("invalid scim filter")
+	ErrInvalidSCIMUser   = errors.New("invalid scim user")
+
+	// Password policy violations
+	ErrPasswordTooShort  = errors.New("password too short")
+	ErrPasswordTooLong   = errors.New("password too long")
+	ErrPasswordBanned    = errors.New("password is banned")
+	ErrPasswordLikeEmail = errors.New("password too similar to email")
+	ErrPasswordBreached  = errors.New("password found in breached passwords list")
 )
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+)
+
+// What goes in the data.json file of an export.
+type exportData struct {
+	ExportedAt     time.Time             `json:"exported_at"`
+	User           exportUser            `json:"user"`
+	Galleries      []exportGallery       `json:"galleries"`
+	Sessions       []exportSession       `json:"sessions"`
+	SecurityEvents []exportSecurityEvent `json:"security_events"`
+}
+
+type exportUser struct {
+	ID    uint   `json:"id"`
+	Email string `json:"email"`
+}
+
+type exportGallery struct {
+	ID          int           `json:"id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Tags        []string      `json:"tags"`
+	Images      []exportImage `json:"images"`
+}
+
+type exportImage struct {
+	Filename   string    `json:"filename"`
+	Caption    string    `json:"caption"`
+	Tags       []string  `json:"tags"`
+	Size       int64     `json:"size"`
+	ModifiedAt time.Time `json:"modified_at"`
+	Path       string    `json:"path"` // path inside the ZIP file
+}
+
+type exportSession struct {
+	ID uint `json:"id"`
+}
+
+type exportSecurityEvent struct {
+	Action    string         `json:"action"`
+	IP        string         `json:"ip"`
+	UserAgent string         `json:"user_agent"`
+	Details   map[string]any `json:"details"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+/*
+ExportService builds a ZIP file with all the data we keep about a user:
+
+	data.json                    user, galleries, image metadata, sessions...
+	images/gallery-1/photo.jpg   the original images
+	images/gallery-1/...
+*/
+type ExportService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	AuditService   *AuditService
+}
+
+func (svc *ExportService) Write(w io.Writer, user *User) error {
+	data := exportData{
+		ExportedAt: time.Now(),
+		User: exportUser{
+			ID:    user.ID,
+			Email: user.Email,
+		},
+	}
+	var images []Image
+	galleries, err := svc.GalleryService.GalleriesByUserId(user.ID)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	for _, gallery := range galleries {
+		exportedGallery := exportGallery{
+			ID:          gallery.ID,
+			Title:       gallery.Title,
+			Description: gallery.Description,
+			Tags:        gallery.Tags,
+		}
+		galleryImages, err := svc.GalleryService.Images(gallery.ID)
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		for _, img := range galleryImages {
+			info, err := os.Stat(img.Path)
+			if err != nil {
+				return fmt.Errorf("export: %w", err)
+			}
+			exportedGallery.Images = append(exportedGallery.Images, exportImage{
+				Filename:   img.Filename,
+				Caption:    img.Caption,
+				Tags:       img.Tags,
+				Size:       info.Size(),
+				ModifiedAt: info.ModTime(),
+				Path:       exportImagePath(img),
+			})
+			images = append(images, img)
+		}
+		data.Galleries = append(data.Galleries, exportedGallery)
+	}
+	data.Sessions, err = svc.sessions(user.ID)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	events, err := svc.AuditService.ByUserId(user.ID, 0)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	for _, event := range events {
+		data.SecurityEvents = append(data.SecurityEvents, exportSecurityEvent{
+			Action:    event.Action,
+			IP:        event.Actor.IP,
+			UserAgent: event.Actor.UserAgent,
+			Details:   event.Details,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+
+	zw := zip.NewWriter(w)
+	jsonFile, err := zw.Create("data.json")
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	enc := json.NewEncoder(jsonFile)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(data)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	for _, img := range images {
+		err = addFileToZip(zw, img.Path, exportImagePath(img))
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+	}
+	return zw.Close()
+}
+
+func (svc *ExportService) sessions(userId uint) ([]exportSession, error) {
+	rows, err := svc.DB.Query(`
+		SELECT id
+		FROM sessions
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("query sessions: %w", err)
+	}
+	defer rows.Close()
+	var sessions []exportSession
+	for rows.Next() {
+		var session exportSession
+		err := rows.Scan(&session.ID)
+		if err != nil {
+			return nil, fmt.Errorf("query sessions: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func exportImagePath(img Image) string {
+	return path.Join("images", fmt.Sprintf("gallery-%d", img.GalleryID), img.Filename)
+}
+
+func addFileToZip(zw *zip.Writer, filePath, zipPath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Images are already compressed, so just store them.
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:   zipPath,
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, f)
+	return err
+}
@@ -1,117 +1,767 @@
 package models
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/text/unicode/norm"
 )
 
 type Image struct {
 	GalleryID int
 	Path      string
 	Filename  string
+	Caption   string
+	Tags      []string
 }
 
+/*
+A gallery is owned either by a user (UserID), or by an organization
+(OrganizationID), the other one being 0. CreatedBy is the user who created it,
+which for organization galleries may not be a member anymore.
+*/
 type Gallery struct {
-	ID     int
-	UserID uint
-	Title  string
+	ID             int
+	UserID         uint
+	OrganizationID uint
+	CreatedBy      uint
+	Title          string
+	Description    string
+	Tags           []string
+	// Visibility of the gallery, "" for the visibility of its collection.
+	// EffectiveVisibility is the resulting one.
+	Visibility          string
+	EffectiveVisibility string
+	CollectionID        int    // 0 when it's at the top, in no collection
+	Slug                string // unique among the galleries of the owner
+	// Only those who can edit the gallery see it before PublishAt, and from
+	// ExpireAt on. Zero for no limit.
+	PublishAt time.Time
+	ExpireAt  time.Time
+	// Whether its images take comments (GalleryComments...). Not set by
+	// GalleriesByUserId and the like.
+	Comments string
+	// Handle of the user owning the gallery, "" if it's not at
+	// /u/{handle}/{slug} (organization galleries, users without a handle).
+	// Not set by GalleriesByUserId and the like.
+	Handle string
+}
+
+// Who can see a gallery.
+const (
+	GalleryVisibilityPublic   = "public"   // anybody, and it's listed on the owner's profile
+	GalleryVisibilityUnlisted = "unlisted" // anybody with the link
+	GalleryVisibilityPrivate  = "private"  // those who can edit it
+)
+
+var GalleryVisibilities = []string{GalleryVisibilityPublic, GalleryVisibilityUnlisted, GalleryVisibilityPrivate}
+
+// Whether those who can see a gallery can comment on its images.
+const (
+	GalleryCommentsAllow    = "allow"    // comments show right away
+	GalleryCommentsModerate = "moderate" // the owner approves them first
+	GalleryCommentsDisabled = "disabled"
+)
+
+var GalleryCommentSettings = []string{GalleryCommentsAllow, GalleryCommentsModerate, GalleryCommentsDisabled}
+
+// The visibility of the gallery in SQL queries: its own, or the one of its
+// collection (see collection_visibility in the migrations).
+const galleryVisibilitySQL = `COALESCE(galleries.visibility, collection_visibility(galleries.collection_id))`
+
+// The URL path of the gallery: /u/{handle}/{slug} when its owner has a
+// handle, /galleries/{id} otherwise.
+func (gallery Gallery) Path() string {
+	if gallery.Handle == "" {
+		return fmt.Sprintf("/galleries/%d", gallery.ID)
+	}
+	return "/u/" + url.PathEscape(gallery.Handle) + "/" + url.PathEscape(gallery.Slug)
+}
+
+// Galleries that are live in SQL queries: published and not expired yet.
+const galleryLiveSQL = `(galleries.publish_at IS NULL OR galleries.publish_at <= NOW())
+	AND (galleries.expire_at IS NULL OR galleries.expire_at > NOW())`
+
+// Returns ErrGalleryNotPublished before PublishAt, ErrGalleryExpired from
+// ExpireAt on.
+func (gallery Gallery) CheckSchedule(now time.Time) error {
+	if !gallery.PublishAt.IsZero() && now.Before(gallery.PublishAt) {
+		return ErrGalleryNotPublished
+	}
+	if !gallery.ExpireAt.IsZero() && !now.Before(gallery.ExpireAt) {
+		return ErrGalleryExpired
+	}
+	return nil
 }
 
+// The email address of the owner of the gallery: the user owning it, or, for
+// organization galleries, who created it. "" if there's nobody (anymore).
+func (svc *GalleryService) OwnerEmail(gallery *Gallery) (string, error) {
+	var email string
+	row := svc.DB.QueryRow(`
+		SELECT email
+		FROM users
+		WHERE id = $1;
+	`, gallery.historyUserId())
+	err := row.Scan(&email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("gallery owner email: %w", err)
+	}
+	return email, nil
+}
+
+// The user whose history (audit log) the changes to the gallery go to.
+func (gallery Gallery) historyUserId() uint {
+	if gallery.UserID != 0 {
+		return gallery.UserID
+	}
+	return gallery.CreatedBy
+}
+
+// What users can do with a gallery (see GalleryService.Authorize).
+type GalleryAction int
+
+const (
+	GalleryActionEdit   GalleryAction = iota // edit the title, add/delete images...
+	GalleryActionDelete                      // delete the whole gallery
+	GalleryActionView                        // see it and its images
+)
+
+const (
+	gallerySlugMaxLength  = 80
+	imageCaptionMaxLength = 2000
+)
+
+// Slugs are lowercase letters and digits, in words separated by "-".
+var gallerySlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// The largest gallery images are resized to fit in (pixels).
+const DefaultGalleryImageSize = 2560
+
 type GalleryService struct {
 	DB *sql.DB
 	// Folder to store images. If not set, defaults to "images".
 	ImagesDir string
+	// Uploaded images go through it. If not set, uses the default limits.
+	ImageProcessor *ImageProcessor
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *GalleryService) WithActor(actor Actor) *GalleryService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
 }
 
-func (svc *GalleryService) Create(title string, userId uint) (*Gallery, error) {
+// Creates a gallery for userId, or, when organizationId isn't 0, for that
+// organization (userId being who created it). Whether the user may create
+// galleries in the organization is up to the caller.
+//
+// The slug is made from the title, with a number added if the owner already
+// has a gallery with that slug.
+func (svc *GalleryService) Create(title string, userId, organizationId uint) (*Gallery, error) {
 	gallery := Gallery{
-		Title:  title,
-		UserID: userId,
+		Title:          title,
+		UserID:         userId,
+		OrganizationID: organizationId,
+		CreatedBy:      userId,
+		// At the top, where galleries are public unless they say otherwise.
+		EffectiveVisibility: GalleryVisibilityPublic,
+		Comments:            GalleryCommentsAllow,
 	}
-	row := svc.DB.QueryRow(`
-		INSERT INTO galleries (title, user_id)
-		VALUES ($1, $2)
-		RETURNING id;
-	`, gallery.Title, gallery.UserID)
-	err := row.Scan(&gallery.ID)
-	if err != nil {
-		return nil, fmt.Errorf("create gallery: %w", err)
+	if organizationId != 0 {
+		gallery.UserID = 0
+	}
+	base := Slugify(title)
+	for n := 1; ; n++ {
+		gallery.Slug = base
+		if n > 1 {
+			gallery.Slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		// Conflicts can only be on the slug: try the next one.
+		row := svc.DB.QueryRow(`
+			INSERT INTO galleries (title, user_id, organization_id, created_by, slug)
+			VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING
+			RETURNING id;
+		`, gallery.Title, nullableId(gallery.UserID), nullableId(gallery.OrganizationID),
+			nullableId(gallery.CreatedBy), gallery.Slug)
+		err := row.Scan(&gallery.ID)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, sql.ErrNoRows) || n == 100 {
+			return nil, fmt.Errorf("create gallery: %w", err)
+		}
 	}
+	details := map[string]any{
+		"gallery_id": gallery.ID,
+		"title":      gallery.Title,
+	}
+	if organizationId != 0 {
+		details["organization_id"] = organizationId
+	}
+	svc.record(gallery.historyUserId(), AuditGalleryCreated, details)
 	return &gallery, nil
 }
 
-func (svc *GalleryService) GalleryById(id int) (*Gallery, error) {
-	gallery := Gallery{
-		ID: id,
-	}
-	row := svc.DB.QueryRow(`
-		SELECT title, user_id
-		FROM galleries
-		WHERE id = $1;
-	`, gallery.ID)
-	err := row.Scan(&gallery.Title, &gallery.UserID)
+const galleryColumns = `
+	galleries.id, galleries.title, COALESCE(galleries.user_id, 0),
+	COALESCE(galleries.organization_id, 0), COALESCE(galleries.created_by, 0),
+	COALESCE(galleries.visibility, ''), ` + galleryVisibilitySQL + `,
+	COALESCE(galleries.collection_id, 0), galleries.slug, COALESCE(users.handle, ''),
+	galleries.description, array_to_string(galleries.tags, ','),
+	galleries.publish_at, galleries.expire_at, galleries.comments`
+
+func scanGallery(row scanner) (*Gallery, error) {
+	var gallery Gallery
+	var tags string
+	var publishAt, expireAt sql.NullTime
+	err := row.Scan(
+		&gallery.ID,
+		&gallery.Title,
+		&gallery.UserID,
+		&gallery.OrganizationID,
+		&gallery.CreatedBy,
+		&gallery.Visibility,
+		&gallery.EffectiveVisibility,
+		&gallery.CollectionID,
+		&gallery.Slug,
+		&gallery.Handle,
+		&gallery.Description,
+		&tags,
+		&publishAt,
+		&expireAt,
+		&gallery.Comments,
+	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, fmt.Errorf("gallery %w", ErrNotFound)
 		}
-		return nil, fmt.Errorf("query gallery by ID: %w", err)
+		return nil, err
 	}
+	gallery.Tags = ParseTags(tags)
+	gallery.PublishAt = publishAt.Time
+	gallery.ExpireAt = expireAt.Time
 	return &gallery, nil
 }
 
+func (svc *GalleryService) GalleryById(id int) (*Gallery, error) {
+	gallery, err := scanGallery(svc.DB.QueryRow(`
+		SELECT `+galleryColumns+`
+		FROM galleries
+			LEFT JOIN users ON users.id = galleries.user_id
+		WHERE galleries.id = $1;
+	`, id))
+	if err != nil {
+		return nil, fmt.Errorf("query gallery by ID: %w", err)
+	}
+	return gallery, nil
+}
+
+// The gallery at /u/{handle}/{slug}. Galleries keep answering to their
+// previous slugs: the returned gallery's Slug is then different from slug,
+// and links to it should be redirected.
+func (svc *GalleryService) GalleryBySlug(handle, slug string) (*Gallery, error) {
+	gallery, err := scanGallery(svc.DB.QueryRow(`
+		SELECT `+galleryColumns+`
+		FROM galleries
+			JOIN users ON users.id = galleries.user_id
+		WHERE users.handle = $1 AND users.disabled_at IS NULL
+			AND galleries.slug = $2;
+	`, strings.ToLower(handle), slug))
+	if err == nil {
+		return gallery, nil
+	}
+	if !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
+	}
+	gallery, err = scanGallery(svc.DB.QueryRow(`
+		SELECT `+galleryColumns+`
+		FROM gallery_slug_history history
+			JOIN galleries ON galleries.id = history.gallery_id
+			JOIN users ON users.id = galleries.user_id
+		WHERE users.handle = $1 AND users.disabled_at IS NULL
+			AND history.slug = $2
+		ORDER BY history.replaced_at DESC
+		LIMIT 1;
+	`, strings.ToLower(handle), slug))
+	if err != nil {
+		return nil, fmt.Errorf("query gallery by slug: %w", err)
+	}
+	return gallery, nil
+}
+
 func (svc *GalleryService) GalleriesByUserId(userId uint) ([]Gallery, error) {
 	rows, err := svc.DB.Query(`
-		SELECT id, title
+		SELECT id, title, COALESCE(created_by, 0), COALESCE(visibility, ''),
+			`+galleryVisibilitySQL+`, COALESCE(collection_id, 0), slug,
+			description, array_to_string(tags, ','), publish_at, expire_at
 		FROM galleries
 		WHERE user_id = $1;
 	`, userId)
 	if err != nil {
 		return nil, fmt.Errorf("query galleries by user ID: %w", err)
 	}
+	defer rows.Close()
 	var galleries []Gallery
 	for rows.Next() {
 		gallery := Gallery{
 			UserID: userId,
 		}
-		err := rows.Scan(&gallery.ID, &gallery.Title)
+		var tags string
+		var publishAt, expireAt sql.NullTime
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.CreatedBy, &gallery.Visibility,
+			&gallery.EffectiveVisibility, &gallery.CollectionID, &gallery.Slug, &gallery.Description, &tags,
+			&publishAt, &expireAt)
 		if err != nil {
 			return nil, fmt.Errorf("query galleries by user ID: %w", err)
 		}
+		gallery.Tags = ParseTags(tags)
+		gallery.PublishAt = publishAt.Time
+		gallery.ExpireAt = expireAt.Time
 		galleries = append(galleries, gallery)
 	}
-	if rows.Err() != nil {
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("query galleries by user ID: %w", err)
 	}
 	return galleries, nil
 }
 
+const DefaultGallerySearchLimit = 50
+
+// A gallery, with the name of its owner (for the admin console).
+type GallerySummary struct {
+	Gallery
+	OwnerEmail       string // of the user owning it
+	OrganizationName string // of the organization owning it
+}
+
+// Filters for GalleryService.Search. Zero values don't filter.
+type GallerySearch struct {
+	Query  string // part of the title, or of the owner's email or name
+	UserID uint
+	Limit  int // Defaults to DefaultGallerySearchLimit
+	Offset int
+}
+
+// Returns the galleries matching the search, most recent first.
+func (svc *GalleryService) Search(search GallerySearch) ([]GallerySummary, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if search.UserID != 0 {
+		where("galleries.user_id = $%d", search.UserID)
+	}
+	if query := strings.TrimSpace(search.Query); query != "" {
+		where(`(galleries.title ILIKE $%[1]d OR users.email LIKE LOWER($%[1]d) OR organizations.name ILIKE $%[1]d)`, "%"+escapeLike(query)+"%")
+	}
+	query := `
+		SELECT galleries.id, galleries.title, COALESCE(galleries.user_id, 0),
+			COALESCE(users.email, ''), COALESCE(galleries.organization_id, 0),
+			COALESCE(organizations.name, '')
+		FROM galleries
+			LEFT JOIN users ON users.id = galleries.user_id
+			LEFT JOIN organizations ON organizations.id = galleries.organization_id`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := search.Limit
+	if limit <= 0 {
+		limit = DefaultGallerySearchLimit
+	}
+	args = append(args, limit, max(search.Offset, 0))
+	query += fmt.Sprintf("\n\t\tORDER BY galleries.id DESC\n\t\tLIMIT $%d OFFSET $%d;", len(args)-1, len(args))
+
+	rows, err := svc.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []GallerySummary
+	for rows.Next() {
+		var summary GallerySummary
+		var title sql.NullString
+		err := rows.Scan(
+			&summary.ID,
+			&title,
+			&summary.UserID,
+			&summary.OwnerEmail,
+			&summary.OrganizationID,
+			&summary.OrganizationName,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("search galleries: %w", err)
+		}
+		summary.Title = title.String
+		galleries = append(galleries, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search galleries: %w", err)
+	}
+	return galleries, nil
+}
+
+// The public galleries of the user that are live, for their profile.
+func (svc *GalleryService) PublicGalleriesByUserId(userId uint) ([]Gallery, error) {
+	rows, err := svc.DB.Query(`
+		SELECT id, title, slug
+		FROM galleries
+		WHERE user_id = $1 AND `+galleryVisibilitySQL+` = $2
+			AND `+galleryLiveSQL+`
+		ORDER BY id DESC;
+	`, userId, GalleryVisibilityPublic)
+	if err != nil {
+		return nil, fmt.Errorf("query public galleries: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			UserID:              userId,
+			EffectiveVisibility: GalleryVisibilityPublic,
+		}
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.Slug)
+		if err != nil {
+			return nil, fmt.Errorf("query public galleries: %w", err)
+		}
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query public galleries: %w", err)
+	}
+	return galleries, nil
+}
+
+func (svc *GalleryService) GalleriesByOrganizationId(organizationId uint) ([]Gallery, error) {
+	rows, err := svc.DB.Query(`
+		SELECT id, title, COALESCE(created_by, 0), COALESCE(visibility, ''),
+			`+galleryVisibilitySQL+`, COALESCE(collection_id, 0), slug,
+			description, array_to_string(tags, ','), publish_at, expire_at
+		FROM galleries
+		WHERE organization_id = $1
+		ORDER BY id;
+	`, organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("query galleries by organization ID: %w", err)
+	}
+	defer rows.Close()
+	var galleries []Gallery
+	for rows.Next() {
+		gallery := Gallery{
+			OrganizationID: organizationId,
+		}
+		var tags string
+		var publishAt, expireAt sql.NullTime
+		err := rows.Scan(&gallery.ID, &gallery.Title, &gallery.CreatedBy, &gallery.Visibility,
+			&gallery.EffectiveVisibility, &gallery.CollectionID, &gallery.Slug, &gallery.Description, &tags,
+			&publishAt, &expireAt)
+		if err != nil {
+			return nil, fmt.Errorf("query galleries by organization ID: %w", err)
+		}
+		gallery.Tags = ParseTags(tags)
+		gallery.PublishAt = publishAt.Time
+		gallery.ExpireAt = expireAt.Time
+		galleries = append(galleries, gallery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("query galleries by organization ID: %w", err)
+	}
+	return galleries, nil
+}
+
+/*
+Returns ErrForbidden unless the user (0 if nobody is signed in) may perform
+the action on the gallery:
+
+  - anybody can view public and unlisted galleries (their EffectiveVisibility),
+    private ones are viewed by those who can edit them. Before PublishAt and
+    from ExpireAt on, galleries are also only viewed by those who can edit
+    them: others get ErrGalleryNotPublished or ErrGalleryExpired (which are
+    ErrForbidden too).
+  - personal galleries: only their owner can edit or delete them.
+  - organization galleries: every member can edit them, only owners and
+    admins of the organization can delete them.
+*/
+func (svc *GalleryService) Authorize(userId uint, gallery *Gallery, action GalleryAction) error {
+	if action == GalleryActionView && gallery.EffectiveVisibility != GalleryVisibilityPrivate {
+		scheduleErr := gallery.CheckSchedule(time.Now())
+		if scheduleErr == nil {
+			return nil
+		}
+		err := svc.Authorize(userId, gallery, GalleryActionEdit)
+		if errors.Is(err, ErrForbidden) {
+			return fmt.Errorf("authorize gallery: %w", scheduleErr)
+		}
+		return err
+	}
+	if userId == 0 {
+		return fmt.Errorf("authorize gallery: %w", ErrForbidden)
+	}
+	if gallery.OrganizationID == 0 {
+		if gallery.UserID == 0 || gallery.UserID != userId {
+			return fmt.Errorf("authorize gallery: %w", ErrForbidden)
+		}
+		return nil
+	}
+	var role string
+	row := svc.DB.QueryRow(`
+		SELECT role
+		FROM organization_members
+		WHERE organization_id = $1 AND user_id = $2;
+	`, gallery.OrganizationID, userId)
+	err := row.Scan(&role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("authorize gallery: %w", ErrForbidden)
+		}
+		return fmt.Errorf("authorize gallery: %w", err)
+	}
+	if action == GalleryActionDelete && role != OrgRoleOwner && role != OrgRoleAdmin {
+		return fmt.Errorf("authorize gallery: %w", ErrForbidden)
+	}
+	return nil
+}
+
+// Updates the title, description, tags, visibility, slug and schedule of the
+// gallery. The previous slug keeps leading to the gallery (see
+// GalleryBySlug), until another gallery of the owner takes it. Returns
+// ErrInvalidSlug or ErrSlugTaken when the slug can't be used, ErrInvalidTags
+// when the tags can't, and ErrInvalidSchedule when it would expire before
+// being published.
+//
+// Moving PublishAt to the future makes the gallery scheduled again: its
+// subscribers will be told when it goes live. Reopening an expired gallery
+// doesn't tell anybody.
 func (svc *GalleryService) UpdateGallery(gallery *Gallery) error {
-	_, err := svc.DB.Exec(`
+	if gallery.Visibility != "" && !validGalleryVisibility(gallery.Visibility) {
+		return fmt.Errorf("update gallery: unknown visibility %q", gallery.Visibility)
+	}
+	if len(gallery.Slug) > gallerySlugMaxLength || !gallerySlugPattern.MatchString(gallery.Slug) {
+		return fmt.Errorf("update gallery: %w", ErrInvalidSlug)
+	}
+	tags, err := normalizeTags(gallery.Tags)
+	if err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	gallery.Tags = tags
+	if !gallery.PublishAt.IsZero() && !gallery.ExpireAt.IsZero() && !gallery.PublishAt.Before(gallery.ExpireAt) {
+		return fmt.Errorf("update gallery: %w", ErrInvalidSchedule)
+	}
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	defer tx.Rollback()
+	var previousSlug string
+	err = tx.QueryRow(`
+		SELECT slug
+		FROM galleries
+		WHERE id = $1
+		FOR UPDATE;
+	`, gallery.ID).Scan(&previousSlug)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("update gallery: %w", ErrNotFound)
+		}
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	_, err = tx.Exec(`
 		UPDATE galleries
-		SET title = $2
+		SET title = $2, visibility = NULLIF($3, ''), slug = $4, description = $5,
+			tags = string_to_array($6, ','), publish_at = $7, expire_at = $8,
+			schedule_state = CASE
+				WHEN $7 > NOW() THEN 'scheduled'
+				WHEN schedule_state = 'expired' AND ($8 IS NULL OR $8 > NOW()) THEN 'published'
+				ELSE schedule_state
+			END
 		WHERE id = $1;
-	`, gallery.ID, gallery.Title)
+	`, gallery.ID, gallery.Title, gallery.Visibility, gallery.Slug, gallery.Description,
+		strings.Join(gallery.Tags, ","), nullableTime(gallery.PublishAt), nullableTime(gallery.ExpireAt))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return fmt.Errorf("update gallery: %w", ErrSlugTaken)
+		}
+		return fmt.Errorf("update gallery: %w", err)
+	}
+	if previousSlug != gallery.Slug {
+		// The new slug is the owner's now: it no longer redirects to the
+		// galleries that had it before.
+		_, err = tx.Exec(`
+			DELETE FROM gallery_slug_history
+			WHERE slug = $1 AND gallery_id IN (
+				SELECT id
+				FROM galleries
+				WHERE user_id = $2 OR organization_id = $3
+			);
+		`, gallery.Slug, nullableId(gallery.UserID), nullableId(gallery.OrganizationID))
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO gallery_slug_history (gallery_id, slug)
+			VALUES ($1, $2)
+			ON CONFLICT (gallery_id, slug) DO UPDATE
+			SET replaced_at = now();
+		`, gallery.ID, previousSlug)
+		if err != nil {
+			return fmt.Errorf("update gallery: %w", err)
+		}
+	}
+	err = tx.Commit()
 	if err != nil {
 		return fmt.Errorf("update gallery: %w", err)
 	}
+	details := map[string]any{
+		"gallery_id": gallery.ID,
+		"title":      gallery.Title,
+		"visibility": gallery.Visibility,
+	}
+	if !gallery.PublishAt.IsZero() {
+		details["publish_at"] = gallery.PublishAt
+	}
+	if !gallery.ExpireAt.IsZero() {
+		details["expire_at"] = gallery.ExpireAt
+	}
+	if previousSlug != gallery.Slug {
+		details["slug"] = gallery.Slug
+		details["previous_slug"] = previousSlug
+	}
+	svc.record(gallery.historyUserId(), AuditGalleryUpdated, details)
 	return nil
 }
 
-func (svc *GalleryService) DeleteGallery(galleryId int) error {
+// Sets whether the images of the gallery take comments (one of
+// GalleryCommentSettings). Comments waiting for approval stay so when
+// moderation is turned off.
+func (svc *GalleryService) SetComments(gallery *Gallery, setting string) error {
+	if !slices.Contains(GalleryCommentSettings, setting) {
+		return fmt.Errorf("set comments: unknown setting %q", setting)
+	}
 	_, err := svc.DB.Exec(`
-		DELETE FROM galleries
+		UPDATE galleries
+		SET comments = $2
 		WHERE id = $1;
+	`, gallery.ID, setting)
+	if err != nil {
+		return fmt.Errorf("set comments: %w", err)
+	}
+	gallery.Comments = setting
+	return nil
+}
+
+// Moves the gallery to the collection (0 for the top). Returns ErrNotFound if
+// the collection doesn't belong to the owner of the gallery.
+func (svc *GalleryService) SetCollection(galleryId, collectionId int) error {
+	result, err := svc.DB.Exec(`
+		UPDATE galleries
+		SET collection_id = NULLIF($2, 0)
+		WHERE id = $1 AND ($2 = 0 OR EXISTS (
+			SELECT 1
+			FROM collections
+			WHERE collections.id = $2
+				AND collections.user_id IS NOT DISTINCT FROM galleries.user_id
+				AND collections.organization_id IS NOT DISTINCT FROM galleries.organization_id
+		));
+	`, galleryId, collectionId)
+	if err != nil {
+		return fmt.Errorf("set collection: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("set collection: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("set collection: %w", ErrNotFound)
+	}
+	return nil
+}
+
+// Makes a gallery slug out of the text (e.g. a title): "Été à Paris!" gives
+// "ete-a-paris". Returns "gallery" when nothing is left.
+func Slugify(text string) string {
+	var slug strings.Builder
+	dash := false
+	// NFKD splits accented letters into the letter and the accent, which
+	// is then dropped with the other characters.
+	for _, r := range norm.NFKD.String(strings.ToLower(text)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			dash = false
+			slug.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+		default:
+			dash = true
+		}
+		if slug.Len() >= gallerySlugMaxLength {
+			break
+		}
+	}
+	if slug.Len() == 0 {
+		return "gallery"
+	}
+	return strings.TrimSuffix(slug.String()[:min(slug.Len(), gallerySlugMaxLength)], "-")
+}
+
+func (svc *GalleryService) DeleteGallery(galleryId int) error {
+	var userId uint
+	var title string
+	row := svc.DB.QueryRow(`
+		DELETE FROM galleries
+		WHERE id = $1
+		RETURNING COALESCE(user_id, created_by, 0), title;
 	`, galleryId)
+	err := row.Scan(&userId, &title)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("delete gallery: %w", ErrNotFound)
+		}
+		return fmt.Errorf("delete gallery: %w", err)
+	}
+	svc.record(userId, AuditGalleryDeleted, map[string]any{
+		"gallery_id": galleryId,
+		"title":      title,
+	})
+	err = svc.DeleteImages(galleryId)
 	if err != nil {
 		return fmt.Errorf("delete gallery: %w", err)
 	}
 	return nil
 }
 
+// Removes the folder with all the images of a gallery. Deleting rows from the
+// galleries table (directly or through ON DELETE CASCADE) leaves the files
+// behind, so call this afterwards.
+func (svc *GalleryService) DeleteImages(galleryId int) error {
+	err := os.RemoveAll(svc.galleryDir(galleryId))
+	if err != nil {
+		return fmt.Errorf("delete images: %w", err)
+	}
+	return nil
+}
+
 func (svc *GalleryService) Images(galleryId int) ([]Image, error) {
 	globPattern := filepath.Join(svc.galleryDir(galleryId), "*") // "images/gallery-2/*"
 	allFiles, err := filepath.Glob(globPattern)
@@ -129,9 +779,86 @@ func (svc *GalleryService) Images(galleryId int) ([]Image, error) {
 			})
 		}
 	}
+	if len(images) == 0 {
+		return images, nil
+	}
+	// Captions and tags, for the images that have some.
+	rows, err := svc.DB.Query(`
+		SELECT filename, caption, array_to_string(tags, ',')
+		FROM images
+		WHERE gallery_id = $1;
+	`, galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	defer rows.Close()
+	details := make(map[string]Image)
+	for rows.Next() {
+		var img Image
+		var tags string
+		err := rows.Scan(&img.Filename, &img.Caption, &tags)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving gallery images: %w", err)
+		}
+		img.Tags = ParseTags(tags)
+		details[img.Filename] = img
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("retrieving gallery images: %w", err)
+	}
+	for i, img := range images {
+		images[i].Caption = details[img.Filename].Caption
+		images[i].Tags = details[img.Filename].Tags
+	}
 	return images, nil
 }
 
+// The first image of the gallery, to show in lists of galleries. Returns
+// ErrNotFound when the gallery has no images.
+func (svc *GalleryService) Cover(galleryId int) (Image, error) {
+	allFiles, err := filepath.Glob(filepath.Join(svc.galleryDir(galleryId), "*"))
+	if err != nil {
+		return Image{}, fmt.Errorf("gallery cover: %w", err)
+	}
+	for _, filename := range allFiles {
+		if hasExtension(filename, svc.supportedExtensions()) {
+			return Image{
+				GalleryID: galleryId,
+				Path:      filename,
+				Filename:  filepath.Base(filename),
+			}, nil
+		}
+	}
+	return Image{}, fmt.Errorf("gallery cover: %w", ErrNotFound)
+}
+
+// Sets the caption and tags of an image of the gallery. Returns
+// ErrInvalidTags when the tags can't be used.
+func (svc *GalleryService) UpdateImage(galleryId int, filename, caption string, tags []string) error {
+	_, err := svc.Image(galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	tags, err = normalizeTags(tags)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	caption = strings.TrimSpace(caption)
+	if utf8.RuneCountInString(caption) > imageCaptionMaxLength {
+		return fmt.Errorf("update image: %w", ErrCaptionTooLong)
+	}
+	_, err = svc.DB.Exec(`
+		INSERT INTO images (gallery_id, filename, caption, tags)
+		VALUES ($1, $2, $3, string_to_array($4, ','))
+		ON CONFLICT (gallery_id, filename) DO UPDATE
+		SET caption = EXCLUDED.caption, tags = EXCLUDED.tags;
+	`, galleryId, filename, caption, strings.Join(tags, ","))
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+	return nil
+}
+
 func (svc *GalleryService) Image(galleryId int, filename string) (Image, error) {
 	imgPath := filepath.Join(svc.galleryDir(galleryId), filename)
 	_, err := os.Stat(imgPath)
@@ -149,6 +876,67 @@ func (svc *GalleryService) Image(galleryId int, filename string) (Image, error)
 	}, nil
 }
 
+// Processes the uploaded image (see ImageProcessor) and adds it to the
+// gallery, replacing any image with the same name. Returns the stored image,
+// whose extension may differ from the uploaded one.
+func (svc *GalleryService) UploadImage(galleryId int, filename string, r io.Reader) (Image, error) {
+	processed, err := svc.imageProcessor().Process(r, DefaultGalleryImageSize, DefaultGalleryImageSize, false)
+	if err != nil {
+		return Image{}, fmt.Errorf("upload image: %w", err)
+	}
+	filename = imageFilename(filename, processed.Ext)
+	dir := svc.galleryDir(galleryId)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return Image{}, fmt.Errorf("upload image: %w", err)
+	}
+	imgPath := filepath.Join(dir, filename)
+	err = writeFile(imgPath, bytes.NewReader(processed.Data))
+	if err != nil {
+		return Image{}, fmt.Errorf("upload image: %w", err)
+	}
+	if svc.Audit != nil {
+		gallery, err := svc.GalleryById(galleryId)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		} else {
+			svc.record(gallery.historyUserId(), AuditImageUploaded, map[string]any{
+				"gallery_id": galleryId,
+				"filename":   filename,
+			})
+		}
+	}
+	return Image{
+		GalleryID: galleryId,
+		Path:      imgPath,
+		Filename:  filename,
+	}, nil
+}
+
+// A safe filename for the uploaded image: its base name without any path,
+// keeping letters, digits, "-" and "_", with the extension it's stored as.
+func imageFilename(uploaded, ext string) string {
+	base := filepath.Base(strings.ReplaceAll(uploaded, `\`, "/"))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	base = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ' || r == '.':
+			return '-'
+		}
+		return -1
+	}, base)
+	base = strings.Trim(base, "-")
+	if len(base) > 100 {
+		base = base[:100]
+	}
+	if base == "" {
+		base = "image"
+	}
+	return base + ext
+}
+
 func (svc *GalleryService) DeleteImage(galleryId int, filename string) error {
 	img, err := svc.Image(galleryId, filename)
 	if err != nil {
@@ -159,6 +947,49 @@ func (svc *GalleryService) DeleteImage(galleryId int, filename string) error {
 	if err != nil {
 		return fmt.Errorf("delete image: %w", err)
 	}
+	_, err = svc.DB.Exec(`
+		DELETE FROM images
+		WHERE gallery_id = $1 AND filename = $2;
+	`, galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+	// Selections of clients, comments and annotations refer to images by
+	// name, without a foreign key.
+	_, err = svc.DB.Exec(`
+		DELETE FROM selection_images
+		WHERE filename = $2 AND selection_id IN (
+			SELECT id FROM selections WHERE gallery_id = $1
+		);
+	`, galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		DELETE FROM image_comments
+		WHERE gallery_id = $1 AND filename = $2;
+	`, galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		DELETE FROM image_annotations
+		WHERE gallery_id = $1 AND filename = $2;
+	`, galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("delete image: %w", err)
+	}
+	if svc.Audit != nil {
+		gallery, err := svc.GalleryById(galleryId)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		} else {
+			svc.record(gallery.historyUserId(), AuditImageDeleted, map[string]any{
+				"gallery_id": galleryId,
+				"filename":   filename,
+			})
+		}
+	}
 	return nil
 }
 
@@ -178,6 +1009,22 @@ func hasExtension(filename string, extensions []string) bool {
 	return false
 }
 
+func (svc *GalleryService) imageProcessor() *ImageProcessor {
+	if svc.ImageProcessor == nil {
+		return &ImageProcessor{}
+	}
+	return svc.ImageProcessor
+}
+
+func validGalleryVisibility(visibility string) bool {
+	for _, v := range GalleryVisibilities {
+		if visibility == v {
+			return true
+		}
+	}
+	return false
+}
+
 func (svc *GalleryService) galleryDir(galleryId int) string {
 	imagesDir := svc.ImagesDir
 	if imagesDir == "" {
@@ -0,0 +1,332 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/mail"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+// States of the schedule of a gallery: what its owner and subscribers were
+// last told.
+const (
+	GalleryScheduled = "scheduled"
+	GalleryPublished = "published"
+	GalleryExpired   = "expired"
+)
+
+/*
+GalleryScheduleService tells the owner of galleries, and the clients who
+subscribed to them, when galleries go live (at PublishAt) and when they close
+(at ExpireAt).
+
+Access to galleries follows PublishAt and ExpireAt (see
+GalleryService.Authorize), whether RunDue ran or not. RunDue moves the
+schedule_state of the galleries forward and sends the emails. The state is
+moved before the emails are sent: if they fail, nobody is told twice.
+*/
+type GalleryScheduleService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	EmailService   *EmailService
+	PublicURL      string // to link galleries in the emails
+	BytesPerToken  int
+	Auditor
+}
+
+// Subscribes the email address to the gallery: it will get an email when the
+// gallery goes live, and when it closes. userId is the signed in user, 0 for
+// nobody. Subscribing twice does nothing. Returns ErrInvalidEmail if email
+// isn't an email address.
+func (svc *GalleryScheduleService) Subscribe(galleryId int, email string, userId uint) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return fmt.Errorf("subscribe: %w", ErrInvalidEmail)
+	}
+	// Replaced when the first email is sent.
+	token, err := svc.newToken()
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		INSERT INTO gallery_subscriptions (gallery_id, user_id, email, token_hash)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (gallery_id, email) DO NOTHING;
+	`, galleryId, nullableId(userId), email, svc.hashToken(token))
+	if err != nil {
+		return fmt.Errorf("subscribe: %w", err)
+	}
+	return nil
+}
+
+// Removes the subscription with the token of its unsubscribe link, and
+// returns the ID of its gallery. Returns ErrNotFound for unknown tokens.
+func (svc *GalleryScheduleService) Unsubscribe(token string) (int, error) {
+	var galleryId int
+	row := svc.DB.QueryRow(`
+		DELETE FROM gallery_subscriptions
+		WHERE token_hash = $1
+		RETURNING gallery_id;
+	`, svc.hashToken(token))
+	err := row.Scan(&galleryId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("unsubscribe: %w", ErrNotFound)
+		}
+		return 0, fmt.Errorf("unsubscribe: %w", err)
+	}
+	return galleryId, nil
+}
+
+// Moves the galleries that went live or closed to their new state, and tells
+// their owner and subscribers. Returns the number of galleries moved.
+func (svc *GalleryScheduleService) RunDue() (int, error) {
+	// Galleries that were scheduled and are already closed go straight to
+	// expired: a "now live" email would be of no use.
+	published, err := svc.advance(`
+		UPDATE galleries
+		SET schedule_state = 'published'
+		WHERE schedule_state = 'scheduled'
+			AND (publish_at IS NULL OR publish_at <= NOW())
+			AND (expire_at IS NULL OR expire_at > NOW())
+		RETURNING id;
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("run due schedules: %w", err)
+	}
+	expired, err := svc.advance(`
+		UPDATE galleries
+		SET schedule_state = 'expired'
+		WHERE schedule_state <> 'expired' AND expire_at <= NOW()
+		RETURNING id;
+	`)
+	if err != nil {
+		return len(published), fmt.Errorf("run due schedules: %w", err)
+	}
+	for _, galleryId := range published {
+		err = svc.notify(galleryId, GalleryPublished)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	for _, galleryId := range expired {
+		err = svc.notify(galleryId, GalleryExpired)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	return len(published) + len(expired), nil
+}
+
+// Runs RunDue every interval. Blocks forever, so call it in a goroutine.
+func (svc *GalleryScheduleService) Run(interval time.Duration) {
+	for {
+		n, err := svc.RunDue()
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+		if n > 0 {
+			fmt.Printf("published or expired %d galleries\n", n)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Runs the UPDATE ... RETURNING id query, and returns the IDs.
+func (svc *GalleryScheduleService) advance(query string) ([]int, error) {
+	rows, err := svc.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Tells the owner of the gallery (its creator, for organization galleries),
+// and its subscribers unless it's private, that it went to state.
+func (svc *GalleryScheduleService) notify(galleryId int, state string) error {
+	gallery, err := svc.GalleryService.GalleryById(galleryId)
+	if err != nil {
+		return fmt.Errorf("notify schedule: %w", err)
+	}
+	action := AuditGalleryPublished
+	if state == GalleryExpired {
+		action = AuditGalleryExpired
+	}
+	svc.record(gallery.historyUserId(), action, map[string]any{
+		"gallery_id": gallery.ID,
+		"title":      gallery.Title,
+	})
+	galleryURL := svc.PublicURL + gallery.Path()
+
+	ownerEmail, err := svc.GalleryService.OwnerEmail(gallery)
+	if err != nil {
+		return fmt.Errorf("notify schedule: %w", err)
+	}
+	if ownerEmail != "" {
+		err = svc.EmailService.GallerySchedule(ownerEmail, GalleryScheduleNotice{
+			State:      state,
+			Title:      gallery.Title,
+			GalleryURL: svc.PublicURL + fmt.Sprintf("/galleries/%d/edit", gallery.ID),
+			Owner:      true,
+		})
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	if gallery.EffectiveVisibility == GalleryVisibilityPrivate {
+		return nil
+	}
+
+	rows, err := svc.DB.Query(`
+		SELECT id, email
+		FROM gallery_subscriptions
+		WHERE gallery_id = $1;
+	`, gallery.ID)
+	if err != nil {
+		return fmt.Errorf("notify schedule: %w", err)
+	}
+	type subscription struct {
+		id    int
+		email string
+	}
+	var subscriptions []subscription
+	for rows.Next() {
+		var sub subscription
+		err := rows.Scan(&sub.id, &sub.email)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("notify schedule: %w", err)
+		}
+		subscriptions = append(subscriptions, sub)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("notify schedule: %w", err)
+	}
+	for _, sub := range subscriptions {
+		// Tokens are only stored hashed: each email gets a new one.
+		token, err := svc.newToken()
+		if err != nil {
+			return fmt.Errorf("notify schedule: %w", err)
+		}
+		_, err = svc.DB.Exec(`
+			UPDATE gallery_subscriptions
+			SET token_hash = $2
+			WHERE id = $1;
+		`, sub.id, svc.hashToken(token))
+		if err != nil {
+			return fmt.Errorf("notify schedule: %w", err)
+		}
+		err = svc.EmailService.GallerySchedule(sub.email, GalleryScheduleNotice{
+			State:          state,
+			Title:          gallery.Title,
+			GalleryURL:     galleryURL,
+			UnsubscribeURL: svc.PublicURL + "/galleries/unsubscribe?" + url.Values{"token": {token}}.Encode(),
+		})
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	return nil
+}
+
+func (svc *GalleryScheduleService) newToken() (string, error) {
+	return rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerToken))
+}
+
+func (svc *GalleryScheduleService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// An email about a gallery going live or closing, sent by
+// EmailService.GallerySchedule.
+type GalleryScheduleNotice struct {
+	State          string // GalleryPublished or GalleryExpired
+	Title          string // of the gallery
+	GalleryURL     string
+	Owner          bool   // whether it's for the owner, rather than a subscriber
+	UnsubscribeURL string // for subscribers
+}
+
+var galleryScheduleTextTemplate = texttemplate.Must(texttemplate.New("schedule").Parse(`{{.Summary}}
+
+{{if .Owner}}Edit the gallery{{else}}See the gallery{{end}}: {{.GalleryURL}}
+{{- if .UnsubscribeURL}}
+
+You get this email because you asked to be told about this gallery. Unsubscribe: {{.UnsubscribeURL}}{{end}}
+`))
+
+var galleryScheduleHTMLTemplate = htmltemplate.Must(htmltemplate.New("schedule").Parse(`<h1>{{.Subject}}</h1>
+<p>{{.Summary}}</p>
+<p><a href="{{.GalleryURL}}">{{if .Owner}}Edit the gallery{{else}}See the gallery{{end}}</a></p>
+{{if .UnsubscribeURL}}<p><small>You get this email because you asked to be told about this gallery. <a href="{{.UnsubscribeURL}}">Unsubscribe</a></small></p>{{end}}
+`))
+
+func (es *EmailService) GallerySchedule(to string, notice GalleryScheduleNotice) error {
+	data := struct {
+		GalleryScheduleNotice
+		Subject string
+		Summary string
+	}{
+		GalleryScheduleNotice: notice,
+	}
+	switch {
+	case notice.State == GalleryPublished && notice.Owner:
+		data.Subject = "Your gallery is live"
+		data.Summary = fmt.Sprintf("Your gallery %q went live as scheduled.", notice.Title)
+	case notice.State == GalleryPublished:
+		data.Subject = notice.Title + " is live"
+		data.Summary = fmt.Sprintf("The gallery %q is ready for you.", notice.Title)
+	case notice.State == GalleryExpired && notice.Owner:
+		data.Subject = "Your gallery closed"
+		data.Summary = fmt.Sprintf("Your gallery %q closed as scheduled. You can still see it, and reopen it by changing its dates.", notice.Title)
+	case notice.State == GalleryExpired:
+		data.Subject = notice.Title + " closed"
+		data.Summary = fmt.Sprintf("The gallery %q is closed. Ask the photographer if you need more time.", notice.Title)
+	default:
+		return fmt.Errorf("gallery schedule email: unknown state %q", notice.State)
+	}
+	var plainText, html bytes.Buffer
+	err := galleryScheduleTextTemplate.Execute(&plainText, data)
+	if err != nil {
+		return fmt.Errorf("gallery schedule email: %w", err)
+	}
+	err = galleryScheduleHTMLTemplate.Execute(&html, data)
+	if err != nil {
+		return fmt.Errorf("gallery schedule email: %w", err)
+	}
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   data.Subject,
+		PlainText: strings.TrimSpace(plainText.String()),
+		HTML:      html.String(),
+	}
+	err = es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
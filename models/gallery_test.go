@@ -0,0 +1,32 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	slugs := map[string]string{
+		"Summer":                 "summer",
+		"Été à Paris!":           "ete-a-paris",
+		"  Hello,   World  ":     "hello-world",
+		"Photos 2024":            "photos-2024",
+		"rock'n'roll":            "rock-n-roll",
+		"ﬁne art":                "fine-art",
+		"":                       "gallery",
+		"!!!":                    "gallery",
+		"日本":                     "gallery",
+		strings.Repeat("a", 100): strings.Repeat("a", gallerySlugMaxLength),
+		// Cut right after a dash, which is dropped.
+		strings.Repeat("a", gallerySlugMaxLength-1) + " b": strings.Repeat("a", gallerySlugMaxLength-1),
+	}
+	for text, want := range slugs {
+		got := Slugify(text)
+		if got != want {
+			t.Errorf("Slugify(%q) = %q, want %q", text, got, want)
+		}
+		if !gallerySlugPattern.MatchString(got) {
+			t.Errorf("Slugify(%q) = %q, which isn't a valid slug", text, got)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+const (
+	DefaultMaxUploadBytes  = 20 << 20   // 20 MB
+	DefaultMaxUploadPixels = 60_000_000 // e.g. 9500x6300
+	DefaultJPEGQuality     = 85
+)
+
+// An image ready to be stored: re-encoded, resized, without metadata.
+type ProcessedImage struct {
+	Data   []byte
+	Ext    string // ".jpg" or ".png"
+	Width  int
+	Height int
+}
+
+/*
+ImageProcessor is the pipeline uploaded images (gallery images, avatars...) go
+through before they are stored: the size of the upload and of the image are
+checked before decoding it all (no decompression bombs), then the image is
+resized and re-encoded, which also drops any metadata (e.g. GPS coordinates).
+
+JPEGs stay JPEGs, PNGs and GIFs (their first frame) become PNGs.
+*/
+type ImageProcessor struct {
+	MaxBytes    int64 // Defaults to DefaultMaxUploadBytes
+	MaxPixels   int   // Defaults to DefaultMaxUploadPixels
+	JPEGQuality int   // Defaults to DefaultJPEGQuality
+}
+
+// Processes the image so that it fits in maxWidth x maxHeight (images are
+// never enlarged). With crop, the image is cropped to the aspect ratio of
+// maxWidth x maxHeight first (e.g. square avatars).
+func (p *ImageProcessor) Process(r io.Reader, maxWidth, maxHeight int, crop bool) (*ProcessedImage, error) {
+	maxBytes := p.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultMaxUploadBytes
+	}
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("process image: %w", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("process image: %w", ErrImageTooLarge)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("process image: %w: %w", ErrUnsupportedImage, err)
+	}
+	maxPixels := p.MaxPixels
+	if maxPixels == 0 {
+		maxPixels = DefaultMaxUploadPixels
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxPixels {
+		return nil, fmt.Errorf("process image: %w", ErrImageTooLarge)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("process image: %w: %w", ErrUnsupportedImage, err)
+	}
+	if crop {
+		img = cropToRatio(img, maxWidth, maxHeight)
+	}
+	img = resizeToFit(img, maxWidth, maxHeight)
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	processed := ProcessedImage{
+		Width:  img.Bounds().Dx(),
+		Height: img.Bounds().Dy(),
+	}
+	switch format {
+	case "jpeg":
+		quality := p.JPEGQuality
+		if quality == 0 {
+			quality = DefaultJPEGQuality
+		}
+		processed.Ext = ".jpg"
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	default:
+		processed.Ext = ".png"
+		err = png.Encode(w, img)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("process image: %w", err)
+	}
+	processed.Data = buf.Bytes()
+	return &processed, nil
+}
+
+// Crops the center of the image to the aspect ratio of width x height.
+func cropToRatio(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	cropped := bounds
+	// Compare bounds.Dx()/bounds.Dy() with width/height without floats.
+	if bounds.Dx()*height > bounds.Dy()*width {
+		cropWidth := bounds.Dy() * width / height
+		cropped.Min.X += (bounds.Dx() - cropWidth) / 2
+		cropped.Max.X = cropped.Min.X + cropWidth
+	} else {
+		cropHeight := bounds.Dx() * height / width
+		cropped.Min.Y += (bounds.Dy() - cropHeight) / 2
+		cropped.Max.Y = cropped.Min.Y + cropHeight
+	}
+	if cropped.Empty() {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, cropped.Dx(), cropped.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, cropped.Min, draw.Src)
+	return dst
+}
+
+// Shrinks the image to fit in maxWidth x maxHeight, keeping its aspect
+// ratio. Each pixel is the average of the pixels it covers (box filter),
+// which is good enough to shrink photos.
+func resizeToFit(img image.Image, maxWidth, maxHeight int) image.Image {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	if srcWidth <= maxWidth && srcHeight <= maxHeight {
+		return img
+	}
+	width, height := maxWidth, srcHeight*maxWidth/srcWidth
+	if height > maxHeight {
+		width, height = srcWidth*maxHeight/srcHeight, maxHeight
+	}
+	width, height = max(width, 1), max(height, 1)
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*srcHeight/height
+		y1 := max(bounds.Min.Y+(y+1)*srcHeight/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*srcWidth/width
+			x1 := max(bounds.Min.X+(x+1)*srcWidth/width, x0+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(b / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,263 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	// Impersonations end on their own after this long.
+	DefaultImpersonationDuration = 1 * time.Hour
+	DefaultImpersonationLimit    = 200
+)
+
+type Impersonation struct {
+	ID         int
+	AdminID    uint // 0 if the admin was deleted
+	AdminEmail string
+	UserID     uint // 0 if the user was deleted
+	UserEmail  string
+	Reason     string
+	Token      string // Only set when starting an impersonation (not stored in db)
+	StartedAt  time.Time
+	ExpiresAt  time.Time
+	EndedAt    time.Time // Zero while it's going on
+}
+
+func (imp Impersonation) Active() bool {
+	return imp.EndedAt.IsZero() && time.Now().Before(imp.ExpiresAt)
+}
+
+/*
+ImpersonationService lets admins see the app as another user (e.g. to
+understand a support request). An impersonation is tied to the session of the
+admin who started it, through a token of its own: the UserMiddleware swaps the
+admin for the user when both are present.
+
+Every impersonation is kept with its reason, start and end time, and is also
+recorded in the audit log of the user. Admins can't be impersonated.
+*/
+type ImpersonationService struct {
+	DB            *sql.DB
+	BytesPerToken int           // Defaults to MinBytesPerToken
+	Duration      time.Duration // Defaults to DefaultImpersonationDuration
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *ImpersonationService) WithActor(actor Actor) *ImpersonationService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+// Starts impersonating userId, ending the other impersonations of the admin.
+// Returns ErrCannotImpersonate if the user is an admin (or the admin
+// themselves), and ErrNotFound if there's no such user.
+func (svc *ImpersonationService) Start(adminId, userId uint, reason string) (*Impersonation, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return nil, fmt.Errorf("start impersonation: a reason is required")
+	}
+	token, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerToken))
+	if err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+	duration := svc.Duration
+	if duration == 0 {
+		duration = DefaultImpersonationDuration
+	}
+	imp := Impersonation{
+		AdminID:   adminId,
+		UserID:    userId,
+		Reason:    reason,
+		Token:     token,
+		ExpiresAt: time.Now().Add(duration),
+	}
+
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE impersonations
+		SET ended_at = LEAST(NOW(), expires_at)
+		WHERE admin_id = $1 AND ended_at IS NULL;
+	`, adminId)
+	if err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+	var role string
+	row := tx.QueryRow(`
+		SELECT email, role
+		FROM users
+		WHERE id = $1;
+	`, userId)
+	err = row.Scan(&imp.UserEmail, &role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("start impersonation: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+	if role == RoleAdmin || userId == adminId {
+		return nil, fmt.Errorf("start impersonation: %w", ErrCannotImpersonate)
+	}
+	row = tx.QueryRow(`
+		INSERT INTO impersonations (admin_id, user_id, reason, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, started_at;
+	`, adminId, userId, reason, svc.hashToken(token), imp.ExpiresAt)
+	err = row.Scan(&imp.ID, &imp.StartedAt)
+	if err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("start impersonation: %w", err)
+	}
+	svc.record(userId, AuditImpersonationStarted, map[string]any{
+		"impersonation_id": imp.ID,
+		"reason":           reason,
+	})
+	return &imp, nil
+}
+
+// Returns the ongoing impersonation of the token, if it was started by
+// adminId, and the user being impersonated. Otherwise returns ErrNotFound.
+func (svc *ImpersonationService) Active(token string, adminId uint) (*Impersonation, *User, error) {
+	var imp Impersonation
+	var user User
+	row := svc.DB.QueryRow(`
+		SELECT impersonations.id, impersonations.reason,
+			impersonations.started_at, impersonations.expires_at,
+			admins.id, admins.email,
+			users.id, users.email, users.password_hash, users.role,
+			COALESCE(users.handle, ''), users.display_name, users.avatar
+		FROM impersonations
+			JOIN users admins ON admins.id = impersonations.admin_id
+			JOIN users ON users.id = impersonations.user_id
+		WHERE impersonations.token_hash = $1
+			AND impersonations.admin_id = $2
+			AND impersonations.ended_at IS NULL
+			AND impersonations.expires_at > NOW();
+	`, svc.hashToken(token), adminId)
+	err := row.Scan(
+		&imp.ID,
+		&imp.Reason,
+		&imp.StartedAt,
+		&imp.ExpiresAt,
+		&imp.AdminID,
+		&imp.AdminEmail,
+		&user.ID,
+		&user.Email,
+		&user.PasswordHash,
+		&user.Role,
+		&user.Handle,
+		&user.DisplayName,
+		&user.Avatar,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, fmt.Errorf("active impersonation: %w", ErrNotFound)
+		}
+		return nil, nil, fmt.Errorf("active impersonation: %w", err)
+	}
+	imp.UserID = user.ID
+	imp.UserEmail = user.Email
+	return &imp, &user, nil
+}
+
+// Ends the impersonation. Ending it twice does nothing.
+func (svc *ImpersonationService) End(id int) error {
+	var userId sql.NullInt64
+	row := svc.DB.QueryRow(`
+		UPDATE impersonations
+		SET ended_at = LEAST(NOW(), expires_at)
+		WHERE id = $1 AND ended_at IS NULL
+		RETURNING user_id;
+	`, id)
+	err := row.Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("end impersonation: %w", err)
+	}
+	svc.record(uint(userId.Int64), AuditImpersonationEnded, map[string]any{
+		"impersonation_id": id,
+	})
+	return nil
+}
+
+// The impersonations, most recent first. A limit <= 0 means
+// DefaultImpersonationLimit.
+func (svc *ImpersonationService) List(limit int) ([]Impersonation, error) {
+	if limit <= 0 {
+		limit = DefaultImpersonationLimit
+	}
+	// Impersonations that expired without being stopped ended when they
+	// expired.
+	_, err := svc.DB.Exec(`
+		UPDATE impersonations
+		SET ended_at = expires_at
+		WHERE ended_at IS NULL AND expires_at <= NOW();
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list impersonations: %w", err)
+	}
+	rows, err := svc.DB.Query(`
+		SELECT impersonations.id,
+			COALESCE(impersonations.admin_id, 0), COALESCE(admins.email, ''),
+			COALESCE(impersonations.user_id, 0), COALESCE(users.email, ''),
+			impersonations.reason, impersonations.started_at,
+			impersonations.expires_at, impersonations.ended_at
+		FROM impersonations
+			LEFT JOIN users admins ON admins.id = impersonations.admin_id
+			LEFT JOIN users ON users.id = impersonations.user_id
+		ORDER BY impersonations.started_at DESC, impersonations.id DESC
+		LIMIT $1;
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list impersonations: %w", err)
+	}
+	defer rows.Close()
+	var impersonations []Impersonation
+	for rows.Next() {
+		var imp Impersonation
+		var endedAt sql.NullTime
+		err := rows.Scan(
+			&imp.ID,
+			&imp.AdminID,
+			&imp.AdminEmail,
+			&imp.UserID,
+			&imp.UserEmail,
+			&imp.Reason,
+			&imp.StartedAt,
+			&imp.ExpiresAt,
+			&endedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("list impersonations: %w", err)
+		}
+		imp.EndedAt = endedAt.Time
+		impersonations = append(impersonations, imp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list impersonations: %w", err)
+	}
+	return impersonations, nil
+}
+
+func (svc *ImpersonationService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
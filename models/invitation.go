@@ -0,0 +1,374 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	DefaultInvitationDuration = 7 * 24 * time.Hour
+)
+
+type Invitation struct {
+	ID        int
+	Code      string // Only set when creating an invitation (not stored in db)
+	CodeHash  string
+	Email     string // "" if anybody with the code can use it
+	MaxUses   int
+	Uses      int
+	ExpiresAt time.Time
+	CreatedBy uint // 0 if the admin was deleted
+	CreatedAt time.Time
+	// Set for invitations to join an organization, with the role to give.
+	OrganizationID uint
+	Role           string
+}
+
+// Whether the invitation can still be used to sign up.
+func (inv Invitation) Usable() bool {
+	return inv.Uses < inv.MaxUses && time.Now().Before(inv.ExpiresAt)
+}
+
+/*
+InvitationService manages the codes needed to sign up when signup is
+invite-only. Codes are handled like the other tokens: only their hash is
+stored, so the code itself is only known when the invitation is created.
+
+An invitation can be used MaxUses times before it expires, and can be bound to
+an email address (only that address can sign up with it).
+
+Invitations to join an organization (see OrganizationService.Invite) are
+stored alongside, but can't be used to sign up: they are for accounts that
+already exist, and are always bound to an email address.
+*/
+type InvitationService struct {
+	DB           *sql.DB
+	BytesPerCode int           // Defaults to MinBytesPerToken
+	Duration     time.Duration // Defaults to DefaultInvitationDuration
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *InvitationService) WithActor(actor Actor) *InvitationService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+// Creates an invitation on behalf of the actor. An empty email means anybody
+// can use it; a zero duration means the default one.
+func (svc *InvitationService) Create(email string, maxUses int, duration time.Duration) (*Invitation, error) {
+	if maxUses < 1 {
+		return nil, fmt.Errorf("create invitation: max uses must be positive, got %d", maxUses)
+	}
+	code, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerCode))
+	if err != nil {
+		return nil, fmt.Errorf("create invitation: %w", err)
+	}
+	if duration == 0 {
+		duration = svc.Duration
+	}
+	if duration == 0 {
+		duration = DefaultInvitationDuration
+	}
+	invitation := Invitation{
+		Code:      code,
+		CodeHash:  svc.hashCode(code),
+		Email:     strings.ToLower(strings.TrimSpace(email)),
+		MaxUses:   maxUses,
+		ExpiresAt: time.Now().Add(duration),
+		CreatedBy: svc.Actor.UserID,
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO invitations (code_hash, email, max_uses, expires_at, created_by)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5)
+		RETURNING id, created_at;
+	`, invitation.CodeHash, invitation.Email, invitation.MaxUses, invitation.ExpiresAt, nullableId(invitation.CreatedBy))
+	err = row.Scan(&invitation.ID, &invitation.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create invitation: %w", err)
+	}
+	svc.record(0, AuditInvitationCreated, map[string]any{
+		"invitation_id": invitation.ID,
+		"email":         invitation.Email,
+		"max_uses":      invitation.MaxUses,
+	})
+	return &invitation, nil
+}
+
+// All the invitations, most recent first.
+func (svc *InvitationService) List() ([]Invitation, error) {
+	rows, err := svc.DB.Query(`
+		SELECT id, code_hash, COALESCE(email, ''), max_uses, uses, expires_at,
+			created_by, created_at
+		FROM invitations
+		WHERE organization_id IS NULL
+		ORDER BY created_at DESC, id DESC;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("list invitations: %w", err)
+	}
+	defer rows.Close()
+	var invitations []Invitation
+	for rows.Next() {
+		var invitation Invitation
+		var createdBy sql.NullInt64
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.CodeHash,
+			&invitation.Email,
+			&invitation.MaxUses,
+			&invitation.Uses,
+			&invitation.ExpiresAt,
+			&createdBy,
+			&invitation.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("list invitations: %w", err)
+		}
+		invitation.CreatedBy = uint(createdBy.Int64)
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+// Returns the invitation of a code without using it (e.g. to fill in the
+// signup form). Unknown, used up and expired codes return ErrInvalidInvitation.
+func (svc *InvitationService) Lookup(code string) (*Invitation, error) {
+	invitation := Invitation{
+		CodeHash: svc.hashCode(code),
+	}
+	row := svc.DB.QueryRow(`
+		SELECT id, COALESCE(email, ''), max_uses, uses, expires_at
+		FROM invitations
+		WHERE code_hash = $1 AND organization_id IS NULL;
+	`, invitation.CodeHash)
+	err := row.Scan(&invitation.ID, &invitation.Email, &invitation.MaxUses, &invitation.Uses, &invitation.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("lookup invitation: %w", ErrInvalidInvitation)
+		}
+		return nil, fmt.Errorf("lookup invitation: %w", err)
+	}
+	if !invitation.Usable() {
+		return nil, fmt.Errorf("lookup invitation: %w", ErrInvalidInvitation)
+	}
+	return &invitation, nil
+}
+
+// Uses the invitation to sign up with email. Returns ErrInvalidInvitation if
+// the code is unknown, used up, expired, or bound to another email.
+//
+// Use Release if the account couldn't be created after all.
+func (svc *InvitationService) Redeem(code, email string) (*Invitation, error) {
+	invitation := Invitation{
+		CodeHash: svc.hashCode(code),
+	}
+	// Checking and counting in one statement: two signups racing for the
+	// last use can't both get it.
+	row := svc.DB.QueryRow(`
+		UPDATE invitations
+		SET uses = uses + 1
+		WHERE code_hash = $1
+			AND organization_id IS NULL
+			AND uses < max_uses
+			AND expires_at > NOW()
+			AND (email IS NULL OR email = $2)
+		RETURNING id, COALESCE(email, ''), max_uses, uses, expires_at;
+	`, invitation.CodeHash, strings.ToLower(strings.TrimSpace(email)))
+	err := row.Scan(&invitation.ID, &invitation.Email, &invitation.MaxUses, &invitation.Uses, &invitation.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("redeem invitation: %w", ErrInvalidInvitation)
+		}
+		return nil, fmt.Errorf("redeem invitation: %w", err)
+	}
+	return &invitation, nil
+}
+
+// Gives back a use of the invitation (the signup it was redeemed for failed).
+func (svc *InvitationService) Release(id int) error {
+	_, err := svc.DB.Exec(`
+		UPDATE invitations
+		SET uses = uses - 1
+		WHERE id = $1 AND uses > 0;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("release invitation: %w", err)
+	}
+	return nil
+}
+
+// Deletes the invitation, so its code can't be used anymore.
+func (svc *InvitationService) Revoke(id int) error {
+	result, err := svc.DB.Exec(`
+		DELETE FROM invitations
+		WHERE id = $1;
+	`, id)
+	if err != nil {
+		return fmt.Errorf("revoke invitation: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revoke invitation: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("revoke invitation: %w", ErrNotFound)
+	}
+	svc.record(0, AuditInvitationRevoked, map[string]any{"invitation_id": id})
+	return nil
+}
+
+// Creates a single-use invitation for email to join the organization with
+// the role, on behalf of the actor. A new invitation for the same address
+// replaces the previous one.
+func (svc *InvitationService) CreateForOrganization(organizationId uint, email, role string) (*Invitation, error) {
+	code, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerCode))
+	if err != nil {
+		return nil, fmt.Errorf("create organization invitation: %w", err)
+	}
+	duration := svc.Duration
+	if duration == 0 {
+		duration = DefaultInvitationDuration
+	}
+	invitation := Invitation{
+		Code:           code,
+		CodeHash:       svc.hashCode(code),
+		Email:          strings.ToLower(strings.TrimSpace(email)),
+		MaxUses:        1,
+		ExpiresAt:      time.Now().Add(duration),
+		CreatedBy:      svc.Actor.UserID,
+		OrganizationID: organizationId,
+		Role:           role,
+	}
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create organization invitation: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		DELETE FROM invitations
+		WHERE organization_id = $1 AND email = $2;
+	`, invitation.OrganizationID, invitation.Email)
+	if err != nil {
+		return nil, fmt.Errorf("create organization invitation: %w", err)
+	}
+	row := tx.QueryRow(`
+		INSERT INTO invitations (code_hash, email, max_uses, expires_at, created_by,
+			organization_id, role)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at;
+	`, invitation.CodeHash, invitation.Email, invitation.MaxUses, invitation.ExpiresAt,
+		nullableId(invitation.CreatedBy), invitation.OrganizationID, invitation.Role)
+	err = row.Scan(&invitation.ID, &invitation.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create organization invitation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create organization invitation: %w", err)
+	}
+	return &invitation, nil
+}
+
+// The invitations to join the organization that can still be accepted, most
+// recent first.
+func (svc *InvitationService) ForOrganization(organizationId uint) ([]Invitation, error) {
+	rows, err := svc.DB.Query(`
+		SELECT id, email, max_uses, uses, expires_at, created_by, created_at, role
+		FROM invitations
+		WHERE organization_id = $1 AND uses < max_uses AND expires_at > NOW()
+		ORDER BY created_at DESC, id DESC;
+	`, organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("organization invitations: %w", err)
+	}
+	defer rows.Close()
+	var invitations []Invitation
+	for rows.Next() {
+		invitation := Invitation{
+			OrganizationID: organizationId,
+		}
+		var createdBy sql.NullInt64
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.Email,
+			&invitation.MaxUses,
+			&invitation.Uses,
+			&invitation.ExpiresAt,
+			&createdBy,
+			&invitation.CreatedAt,
+			&invitation.Role,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("organization invitations: %w", err)
+		}
+		invitation.CreatedBy = uint(createdBy.Int64)
+		invitations = append(invitations, invitation)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("organization invitations: %w", err)
+	}
+	return invitations, nil
+}
+
+// Returns the invitation to join an organization of a code, for email,
+// without using it. Unknown, used up and expired codes, and codes for
+// another address, return ErrInvalidInvitation.
+func (svc *InvitationService) LookupForOrganization(code, email string) (*Invitation, error) {
+	invitation := Invitation{
+		CodeHash: svc.hashCode(code),
+	}
+	row := svc.DB.QueryRow(`
+		SELECT id, email, max_uses, uses, expires_at, organization_id, role
+		FROM invitations
+		WHERE code_hash = $1 AND organization_id IS NOT NULL AND email = $2;
+	`, invitation.CodeHash, strings.ToLower(strings.TrimSpace(email)))
+	err := row.Scan(&invitation.ID, &invitation.Email, &invitation.MaxUses, &invitation.Uses,
+		&invitation.ExpiresAt, &invitation.OrganizationID, &invitation.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("lookup organization invitation: %w", ErrInvalidInvitation)
+		}
+		return nil, fmt.Errorf("lookup organization invitation: %w", err)
+	}
+	if !invitation.Usable() {
+		return nil, fmt.Errorf("lookup organization invitation: %w", ErrInvalidInvitation)
+	}
+	return &invitation, nil
+}
+
+// Deletes the invitation to join the organization. Returns ErrNotFound if
+// the organization has no such invitation.
+func (svc *InvitationService) RevokeForOrganization(organizationId uint, id int) error {
+	result, err := svc.DB.Exec(`
+		DELETE FROM invitations
+		WHERE id = $1 AND organization_id = $2;
+	`, id, organizationId)
+	if err != nil {
+		return fmt.Errorf("revoke organization invitation: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revoke organization invitation: %w", err)
+	}
+	if deleted == 0 {
+		return fmt.Errorf("revoke organization invitation: %w", ErrNotFound)
+	}
+	return nil
+}
+
+func (svc *InvitationService) hashCode(code string) string {
+	codeHash := sha256.Sum256([]byte(code))
+	return base64.URLEncoding.EncodeToString(codeHash[:])
+}
@@ -0,0 +1,260 @@
+package models
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	DefaultLDAPUserFilter     = "(mail=%s)"
+	DefaultLDAPEmailAttribute = "mail"
+	DefaultLDAPGroupAttribute = "memberOf"
+	DefaultLDAPTimeout        = 10 * time.Second
+	// Provider name of LDAP identities in user_identities.
+	LDAPIdentityProvider = "ldap"
+)
+
+/*
+LDAPAuthenticator checks credentials against an LDAP directory (bind and
+search):
+
+ 1. Bind with the service account (BindDN/BindPassword), or anonymously if
+    BindDN is empty.
+ 2. Search BaseDN for exactly one entry matching UserFilter, where %s is the
+    (escaped) email the user typed.
+ 3. Bind as that entry with the password the user typed.
+
+Users are provisioned just in time: the first successful sign in creates the
+users row (without a password, so they can only sign in through the
+directory), linked to the entry by its DN. Existing accounts with the same
+email are never linked: signing in fails with ErrEmailTaken. When GroupRoles is set, the role is synced from the groups of the
+entry (GroupAttribute, e.g. memberOf) on every sign in; users in none of the
+listed groups get RoleUser.
+*/
+type LDAPAuthenticator struct {
+	DB             *sql.DB
+	URL            string // e.g. "ldaps://ldap.example.com:636"
+	StartTLS       bool   // Upgrade ldap:// connections with StartTLS
+	TLSConfig      *tls.Config
+	BindDN         string
+	BindPassword   string
+	BaseDN         string
+	UserFilter     string            // Defaults to DefaultLDAPUserFilter
+	EmailAttribute string            // Defaults to DefaultLDAPEmailAttribute
+	GroupAttribute string            // Defaults to DefaultLDAPGroupAttribute
+	GroupRoles     map[string]string // group DN -> role
+	Timeout        time.Duration     // Defaults to DefaultLDAPTimeout
+}
+
+func (la *LDAPAuthenticator) Authenticate(email, password string) (*User, error) {
+	email = strings.ToLower(email)
+	// An empty password would be an "unauthenticated bind", which many
+	// servers accept for any DN.
+	if email == "" || password == "" {
+		return nil, fmt.Errorf("ldap authenticate: %w", ErrInvalidCredentials)
+	}
+	conn, err := la.dial()
+	if err != nil {
+		return nil, fmt.Errorf("ldap authenticate: %w", err)
+	}
+	defer conn.Close()
+
+	if la.BindDN != "" {
+		err = conn.Bind(la.BindDN, la.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap authenticate: service bind: %w", err)
+	}
+	entry, err := la.findEntry(conn, email)
+	if err != nil {
+		return nil, fmt.Errorf("ldap authenticate: %w", err)
+	}
+	err = conn.Bind(entry.DN, password)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, fmt.Errorf("ldap authenticate: %w", ErrInvalidCredentials)
+		}
+		return nil, fmt.Errorf("ldap authenticate: user bind: %w", err)
+	}
+
+	// Prefer the address stored in the directory, in case the filter matched
+	// something else (e.g. an alias).
+	if dirEmail := entry.GetAttributeValue(la.emailAttribute()); dirEmail != "" {
+		email = strings.ToLower(dirEmail)
+	}
+	user, err := la.provision(entry.DN, email, la.role(entry))
+	if err != nil {
+		return nil, fmt.Errorf("ldap authenticate: %w", err)
+	}
+	return user, nil
+}
+
+func (la *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	timeout := la.Timeout
+	if timeout == 0 {
+		timeout = DefaultLDAPTimeout
+	}
+	conn, err := ldap.DialURL(la.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(la.TLSConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	conn.SetTimeout(timeout)
+	if la.StartTLS {
+		tlsConfig := la.TLSConfig
+		if tlsConfig == nil {
+			ldapURL, err := url.Parse(la.URL)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("start tls: %w", err)
+			}
+			tlsConfig = &tls.Config{ServerName: ldapURL.Hostname()}
+		}
+		err = conn.StartTLS(tlsConfig)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("start tls: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+// Finds the directory entry of the user. Unknown (or ambiguous) users are
+// reported as invalid credentials, like a wrong password.
+func (la *LDAPAuthenticator) findEntry(conn *ldap.Conn, email string) (*ldap.Entry, error) {
+	userFilter := la.UserFilter
+	if userFilter == "" {
+		userFilter = DefaultLDAPUserFilter
+	}
+	req := ldap.NewSearchRequest(
+		la.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2, // we only need to know whether there's more than one
+		0,
+		false,
+		fmt.Sprintf(userFilter, ldap.EscapeFilter(email)),
+		[]string{"dn", la.emailAttribute(), la.groupAttribute()},
+		nil,
+	)
+	result, err := conn.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// Maps the groups of the entry to a role. Admin wins over anything else.
+// Returns "" when roles aren't managed by the directory.
+func (la *LDAPAuthenticator) role(entry *ldap.Entry) string {
+	if len(la.GroupRoles) == 0 {
+		return ""
+	}
+	role := RoleUser
+	for _, group := range entry.GetAttributeValues(la.groupAttribute()) {
+		for groupDN, groupRole := range la.GroupRoles {
+			if !strings.EqualFold(group, groupDN) {
+				continue
+			}
+			if groupRole == RoleAdmin {
+				return RoleAdmin
+			}
+			role = groupRole
+		}
+	}
+	return role
+}
+
+// Returns the users row linked to the entry, creating it the first time. An
+// empty role leaves the current one untouched.
+//
+// Accounts are only ever created here, never taken over: if an account that
+// isn't linked to the entry already has the address, ErrEmailTaken is
+// returned, and an admin has to sort it out. Otherwise whoever controls the
+// directory entry (or its mail attribute) would get the local account, and
+// the directory groups would overwrite its role.
+func (la *LDAPAuthenticator) provision(dn, email, role string) (*User, error) {
+	subject := strings.ToLower(dn)
+	tx, err := la.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("provision: %w", err)
+	}
+	defer tx.Rollback()
+
+	var user User
+	// 1. Known entry
+	row := tx.QueryRow(`
+		UPDATE users
+		SET role = COALESCE(NULLIF($3, ''), users.role)
+		FROM user_identities
+		WHERE user_identities.user_id = users.id
+			AND user_identities.provider = $1 AND user_identities.subject = $2
+		RETURNING users.id, users.email, users.password_hash, users.role;
+	`, LDAPIdentityProvider, subject, role)
+	err = row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role)
+	switch {
+	case err == nil:
+		_, err = tx.Exec(`
+			UPDATE user_identities
+			SET email = $3
+			WHERE provider = $1 AND subject = $2;
+		`, LDAPIdentityProvider, subject, email)
+	case errors.Is(err, sql.ErrNoRows):
+		// 2. A new account (no password), if the address is free.
+		user.Email = email
+		row = tx.QueryRow(`
+			INSERT INTO users (email, password_hash, role)
+			VALUES ($1, '', COALESCE(NULLIF($2, ''), 'user'))
+			ON CONFLICT (email) DO NOTHING
+			RETURNING id, password_hash, role;
+		`, email, role)
+		err = row.Scan(&user.ID, &user.PasswordHash, &user.Role)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("provision: %w", ErrEmailTaken)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("provision: %w", err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO user_identities (user_id, provider, subject, email)
+			VALUES ($1, $2, $3, $4);
+		`, user.ID, LDAPIdentityProvider, subject, email)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("provision: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("provision: %w", err)
+	}
+	return &user, nil
+}
+
+func (la *LDAPAuthenticator) emailAttribute() string {
+	if la.EmailAttribute == "" {
+		return DefaultLDAPEmailAttribute
+	}
+	return la.EmailAttribute
+}
+
+func (la *LDAPAuthenticator) groupAttribute() string {
+	if la.GroupAttribute == "" {
+		return DefaultLDAPGroupAttribute
+	}
+	return la.GroupAttribute
+}
@@ -0,0 +1,351 @@
+package models
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	stubLDAPBaseDN      = "dc=example,dc=com"
+	stubLDAPBindDN      = "cn=service,dc=example,dc=com"
+	stubLDAPAdminsGroup = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+// An LDAP server with just enough of the protocol for LDAPAuthenticator:
+// simple binds, searches with an equality filter, and unbinds.
+type stubLDAPServer struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries []*stubLDAPEntry
+}
+
+type stubLDAPEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+func newStubLDAPServer(t *testing.T, entries ...*stubLDAPEntry) *stubLDAPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &stubLDAPServer{
+		listener: listener,
+		entries: append([]*stubLDAPEntry{
+			{dn: stubLDAPBindDN, password: "service-password"},
+		}, entries...),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *stubLDAPServer) URL() string {
+	return "ldap://" + server.listener.Addr().String()
+}
+
+// Replaces the attributes of the entry with the given DN.
+func (server *stubLDAPServer) setAttrs(dn string, attrs map[string][]string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, entry := range server.entries {
+		if strings.EqualFold(entry.dn, dn) {
+			entry.attrs = attrs
+		}
+	}
+}
+
+func (server *stubLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		msgID, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			name, _ := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := ldap.LDAPResultInvalidCredentials
+			if server.bind(name, password) {
+				code = ldap.LDAPResultSuccess
+			}
+			conn.Write(ldapMessage(msgID, ldapResult(ldap.ApplicationBindResponse, code)))
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				conn.Write(ldapMessage(msgID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)))
+				continue
+			}
+			for _, entry := range server.search(filter) {
+				conn.Write(ldapMessage(msgID, entry))
+			}
+			conn.Write(ldapMessage(msgID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)))
+		default: // Unbind, or anything we don't support
+			return
+		}
+	}
+}
+
+func (server *stubLDAPServer) bind(dn, password string) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, entry := range server.entries {
+		if strings.EqualFold(entry.dn, dn) && password != "" && entry.password == password {
+			return true
+		}
+	}
+	return false
+}
+
+// Only supports filters like (attr=value).
+func (server *stubLDAPServer) search(filter string) []*ber.Packet {
+	attr, value, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(filter, "("), ")"), "=")
+	if !ok {
+		return nil
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var results []*ber.Packet
+	for _, entry := range server.entries {
+		matches := false
+		for _, v := range entry.attrs[attr] {
+			matches = matches || strings.EqualFold(v, value)
+		}
+		if !matches {
+			continue
+		}
+		result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "entry")
+		result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "dn"))
+		attrs := ber.NewSequence("attributes")
+		for name, values := range entry.attrs {
+			attr := ber.NewSequence("attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "type"))
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "values")
+			for _, v := range values {
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "value"))
+			}
+			attr.AppendChild(vals)
+			attrs.AppendChild(attr)
+		}
+		result.AppendChild(attrs)
+		results = append(results, result)
+	}
+	return results
+}
+
+func ldapMessage(msgID int64, op *ber.Packet) []byte {
+	packet := ber.NewSequence("message")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, msgID, "id"))
+	packet.AppendChild(op)
+	return packet.Bytes()
+}
+
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matched dn"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "message"))
+	return result
+}
+
+func newStubLDAPAuthenticator(server *stubLDAPServer) *LDAPAuthenticator {
+	return &LDAPAuthenticator{
+		URL:          server.URL(),
+		BindDN:       stubLDAPBindDN,
+		BindPassword: "service-password",
+		BaseDN:       stubLDAPBaseDN,
+		GroupRoles:   map[string]string{stubLDAPAdminsGroup: RoleAdmin},
+	}
+}
+
+func TestLDAPAuthenticatorCredentials(t *testing.T) {
+	server := newStubLDAPServer(t,
+		&stubLDAPEntry{
+			dn:       "uid=jon,ou=people,dc=example,dc=com",
+			password: "jon-password",
+			attrs:    map[string][]string{"mail": {"jon@example.com"}},
+		},
+		// Two entries with the same address: nobody can sign in with it.
+		&stubLDAPEntry{
+			dn:       "uid=shared1,ou=people,dc=example,dc=com",
+			password: "shared-password",
+			attrs:    map[string][]string{"mail": {"shared@example.com"}},
+		},
+		&stubLDAPEntry{
+			dn:       "uid=shared2,ou=people,dc=example,dc=com",
+			password: "shared-password",
+			attrs:    map[string][]string{"mail": {"shared@example.com"}},
+		},
+	)
+	// No DB: none of these get as far as provisioning.
+	la := newStubLDAPAuthenticator(server)
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+	}{
+		{"wrong password", "jon@example.com", "wrong"},
+		{"empty password", "jon@example.com", ""},
+		{"unknown email", "arya@example.com", "jon-password"},
+		{"ambiguous email", "shared@example.com", "shared-password"},
+		{"filter injection", "*", "jon-password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := la.Authenticate(tt.email, tt.password)
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Authenticate(%q, %q) err = %v, want %v", tt.email, tt.password, err, ErrInvalidCredentials)
+			}
+		})
+	}
+
+	t.Run("service bind fails", func(t *testing.T) {
+		la := newStubLDAPAuthenticator(server)
+		la.BindPassword = "wrong"
+		_, err := la.Authenticate("jon@example.com", "jon-password")
+		if err == nil || errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Authenticate() err = %v, want a configuration error", err)
+		}
+	})
+}
+
+func TestLDAPAuthenticatorRole(t *testing.T) {
+	la := &LDAPAuthenticator{
+		GroupRoles: map[string]string{
+			stubLDAPAdminsGroup:                      RoleAdmin,
+			"cn=users,ou=groups,dc=example,dc=com":   RoleUser,
+			"cn=editors,ou=groups,dc=example,dc=com": "editor",
+		},
+	}
+	tests := []struct {
+		name   string
+		groups []string
+		want   string
+	}{
+		{"no groups", nil, RoleUser},
+		{"unlisted group", []string{"cn=other,ou=groups,dc=example,dc=com"}, RoleUser},
+		{"listed group", []string{"cn=editors,ou=groups,dc=example,dc=com"}, "editor"},
+		{"case insensitive", []string{"CN=Admins,OU=Groups,DC=example,DC=com"}, RoleAdmin},
+		{"admin wins", []string{"cn=editors,ou=groups,dc=example,dc=com", stubLDAPAdminsGroup}, RoleAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := ldap.NewEntry("uid=jon,ou=people,dc=example,dc=com", map[string][]string{
+				DefaultLDAPGroupAttribute: tt.groups,
+			})
+			if got := la.role(entry); got != tt.want {
+				t.Errorf("role() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("roles not managed by the directory", func(t *testing.T) {
+		entry := ldap.NewEntry("uid=jon,ou=people,dc=example,dc=com", map[string][]string{
+			DefaultLDAPGroupAttribute: {stubLDAPAdminsGroup},
+		})
+		if got := (&LDAPAuthenticator{}).role(entry); got != "" {
+			t.Errorf("role() = %q, want none", got)
+		}
+	})
+}
+
+func TestLDAPAuthenticatorProvision(t *testing.T) {
+	db := testDB(t)
+
+	t.Run("creates the account, and syncs its role", func(t *testing.T) {
+		email := testEmail("ldap-new")
+		dn := "uid=" + strings.TrimSuffix(email, "@example.com") + ",ou=people,dc=example,dc=com"
+		server := newStubLDAPServer(t, &stubLDAPEntry{
+			dn:       dn,
+			password: "password",
+			attrs: map[string][]string{
+				"mail":     {email},
+				"memberOf": {stubLDAPAdminsGroup},
+			},
+		})
+		la := newStubLDAPAuthenticator(server)
+		la.DB = db
+
+		user, err := la.Authenticate(email, "password")
+		if err != nil {
+			t.Fatalf("Authenticate() err = %v", err)
+		}
+		if user.Email != email || user.Role != RoleAdmin || user.PasswordHash != "" {
+			t.Errorf("Authenticate() = %+v, want an admin account for %s without password", user, email)
+		}
+
+		// Out of the group, and with a new address in the directory: still
+		// the same account, linked by DN.
+		newEmail := testEmail("ldap-renamed")
+		server.setAttrs(dn, map[string][]string{"mail": {newEmail}})
+		again, err := la.Authenticate(newEmail, "password")
+		if err != nil {
+			t.Fatalf("Authenticate() again err = %v", err)
+		}
+		if again.ID != user.ID || again.Role != RoleUser {
+			t.Errorf("Authenticate() again = %+v, want account %d with role %q", again, user.ID, RoleUser)
+		}
+	})
+
+	t.Run("doesn't take over local accounts", func(t *testing.T) {
+		email := testEmail("ldap-local")
+		var userID uint
+		err := db.QueryRow(`
+			INSERT INTO users (email, password_hash)
+			VALUES ($1, 'local-hash')
+			RETURNING id;
+		`, email).Scan(&userID)
+		if err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		server := newStubLDAPServer(t, &stubLDAPEntry{
+			dn:       "uid=intruder,ou=people,dc=example,dc=com",
+			password: "password",
+			attrs: map[string][]string{
+				"mail":     {email},
+				"memberOf": {stubLDAPAdminsGroup},
+			},
+		})
+		la := newStubLDAPAuthenticator(server)
+		la.DB = db
+
+		_, err = la.Authenticate(email, "password")
+		if !errors.Is(err, ErrEmailTaken) {
+			t.Fatalf("Authenticate() err = %v, want %v", err, ErrEmailTaken)
+		}
+		var role string
+		var identities int
+		err = db.QueryRow(`
+			SELECT role, (SELECT COUNT(*) FROM user_identities WHERE user_id = users.id)
+			FROM users
+			WHERE id = $1;
+		`, userID).Scan(&role, &identities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if role != RoleUser || identities != 0 {
+			t.Errorf("role = %q with %d identities, want %q and none", role, identities, RoleUser)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	// Sign in links are as good as a password, so keep them short-lived.
+	DefaultMagicLinkDuration = 15 * time.Minute
+)
+
+type MagicLink struct {
+	ID        int
+	UserID    uint
+	Token     string // Only set when creating a link (not stored in db)
+	TokenHash string
+	ExpiresAt time.Time
+}
+
+/*
+MagicLinkService issues single-use tokens to sign in without a password (sent
+by email). It works like the PasswordResetService: only the hash of the token
+is stored, and a user has at most one link at a time (asking for a new one
+invalidates the previous one).
+*/
+type MagicLinkService struct {
+	DB            *sql.DB
+	BytesPerToken int           // Defaults to MinBytesPerToken
+	Duration      time.Duration // Defaults to DefaultMagicLinkDuration
+}
+
+// Returns ErrNotFound if there's no user with that email.
+func (svc *MagicLinkService) Create(email string) (*MagicLink, error) {
+	email = strings.ToLower(email)
+	var userId uint
+	row := svc.DB.QueryRow(`
+		SELECT id
+		FROM users
+		WHERE email = $1;
+	`, email)
+	err := row.Scan(&userId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create magic link: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	token, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerToken))
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	duration := svc.Duration
+	if duration == 0 {
+		duration = DefaultMagicLinkDuration
+	}
+	link := MagicLink{
+		UserID:    userId,
+		Token:     token,
+		TokenHash: svc.hashToken(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	row = svc.DB.QueryRow(`
+		INSERT INTO magic_links (user_id, token_hash, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO
+		UPDATE
+		SET token_hash = $2, expires_at = $3
+		RETURNING id;
+	`, link.UserID, link.TokenHash, link.ExpiresAt)
+	err = row.Scan(&link.ID)
+	if err != nil {
+		return nil, fmt.Errorf("create magic link: %w", err)
+	}
+	return &link, nil
+}
+
+// Returns the user the link belongs to, and deletes it so it can't be used
+// again. Unknown and expired tokens return ErrNotFound.
+func (svc *MagicLinkService) Consume(token string) (*User, error) {
+	var user User
+	var expiresAt time.Time
+	// Deleting and reading in one statement: two requests racing with the
+	// same token can't both get the user.
+	row := svc.DB.QueryRow(`
+		WITH link AS (
+			DELETE FROM magic_links
+			WHERE token_hash = $1
+			RETURNING user_id, expires_at
+		)
+		SELECT users.id, users.email, users.password_hash, users.role, link.expires_at
+		FROM link
+			JOIN users ON users.id = link.user_id;
+	`, svc.hashToken(token))
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("consume magic link: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("consume magic link: %w", err)
+	}
+	if time.Now().After(expiresAt) {
+		return nil, fmt.Errorf("consume magic link: %w", ErrNotFound)
+	}
+	return &user, nil
+}
+
+// Deletes the pending link of the user, if any.
+func (svc *MagicLinkService) DeleteForUser(userId uint) error {
+	_, err := svc.DB.Exec(`
+		DELETE FROM magic_links
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("delete magic link: %w", err)
+	}
+	return nil
+}
+
+func (svc *MagicLinkService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// NotificationService keeps track of the security notices each user wants to
+// get. Every notice is on until the user turns it off.
+type NotificationService struct {
+	DB *sql.DB
+}
+
+// Returns whether the user wants notices of that kind. Errors count as "yes":
+// better an email too many than a missed warning.
+func (svc *NotificationService) Enabled(userId uint, kind string) bool {
+	var optedOut bool
+	row := svc.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM notification_opt_outs
+			WHERE user_id = $1 AND kind = $2
+		);
+	`, userId, kind)
+	err := row.Scan(&optedOut)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+		return true
+	}
+	return !optedOut
+}
+
+// Returns, for each kind in NoticeKinds, whether the user wants it.
+func (svc *NotificationService) Preferences(userId uint) (map[string]bool, error) {
+	prefs := make(map[string]bool)
+	for _, kind := range NoticeKinds {
+		prefs[kind] = true
+	}
+	rows, err := svc.DB.Query(`
+		SELECT kind
+		FROM notification_opt_outs
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("notification preferences: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var kind string
+		err := rows.Scan(&kind)
+		if err != nil {
+			return nil, fmt.Errorf("notification preferences: %w", err)
+		}
+		prefs[kind] = false
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("notification preferences: %w", err)
+	}
+	return prefs, nil
+}
+
+// Replaces the preferences of the user. Kinds missing from prefs are turned
+// off.
+func (svc *NotificationService) UpdatePreferences(userId uint, prefs map[string]bool) error {
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("update notification preferences: %w", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		DELETE FROM notification_opt_outs
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("update notification preferences: %w", err)
+	}
+	for _, kind := range NoticeKinds {
+		if prefs[kind] {
+			continue
+		}
+		_, err = tx.Exec(`
+			INSERT INTO notification_opt_outs (user_id, kind)
+			VALUES ($1, $2);
+		`, userId, kind)
+		if err != nil {
+			return fmt.Errorf("update notification preferences: %w", err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("update notification preferences: %w", err)
+	}
+	return nil
+}
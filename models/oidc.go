@@ -0,0 +1,236 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	// How long the user has to complete the sign in at the provider.
+	DefaultOIDCLoginDuration = 10 * time.Minute
+)
+
+var (
+	ErrUnknownProvider  = errors.New("unknown identity provider")
+	ErrUnverifiedEmail  = errors.New("email not verified by the identity provider")
+	ErrInvalidOIDCState = errors.New("invalid or expired sign in request")
+)
+
+// A pending sign in with a provider, waiting for the user to come back.
+type OIDCLogin struct {
+	ID           int
+	State        string // Only set when creating it (not stored in db)
+	StateHash    string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+/*
+OIDCService signs users in through OpenID Connect providers.
+
+  - Begin stores a pending login (state, nonce and PKCE verifier) and returns
+    the URL of the provider to redirect the user to, and the state. The caller
+    must bind the state to the browser (e.g. in a cookie), so that nobody can
+    have a victim complete a login they started themselves.
+  - Complete consumes the pending login, exchanges the code for an ID token and
+    returns the matching user. The caller checks that the state comes from the
+    browser that began the login.
+
+Users are matched by provider and subject (user_identities). The first time
+someone signs in with a provider, the identity is linked to the account with
+the same email (only if the provider verified it), or a new account without
+password is created. When InviteOnly is set, only existing accounts can be
+linked: new ones need an invitation, like any other signup.
+*/
+type OIDCService struct {
+	DB         *sql.DB
+	Providers  map[string]*OIDCProvider // by Name
+	InviteOnly bool
+}
+
+// Configured providers, sorted by name (for the sign in page).
+func (svc *OIDCService) ProviderList() []*OIDCProvider {
+	var providers []*OIDCProvider
+	for _, provider := range svc.Providers {
+		providers = append(providers, provider)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	return providers
+}
+
+// Returns the URL of the provider, and the state of the login.
+func (svc *OIDCService) Begin(providerName, redirectURL string) (authURL, state string, err error) {
+	provider, ok := svc.Providers[providerName]
+	if !ok {
+		return "", "", fmt.Errorf("begin oidc login: %w", ErrUnknownProvider)
+	}
+	login := OIDCLogin{
+		Provider:  providerName,
+		ExpiresAt: time.Now().Add(DefaultOIDCLoginDuration),
+	}
+	login.State, err = rand.RandomBase64String(MinBytesPerToken)
+	if err != nil {
+		return "", "", fmt.Errorf("begin oidc login: %w", err)
+	}
+	login.Nonce, err = rand.RandomBase64String(MinBytesPerToken)
+	if err != nil {
+		return "", "", fmt.Errorf("begin oidc login: %w", err)
+	}
+	// RFC 7636 only allows [A-Za-z0-9-._~] (no padding).
+	login.CodeVerifier, err = rand.RandomBase64String(MinBytesPerToken)
+	if err != nil {
+		return "", "", fmt.Errorf("begin oidc login: %w", err)
+	}
+	login.CodeVerifier = strings.TrimRight(login.CodeVerifier, "=")
+	login.StateHash = svc.hashToken(login.State)
+
+	authURL, err = provider.AuthCodeURL(redirectURL, login.State, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		return "", "", fmt.Errorf("begin oidc login: %w", err)
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO oidc_logins (state_hash, provider, nonce, code_verifier, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id;
+	`, login.StateHash, login.Provider, login.Nonce, login.CodeVerifier, login.ExpiresAt)
+	err = row.Scan(&login.ID)
+	if err != nil {
+		return "", "", fmt.Errorf("begin oidc login: %w", err)
+	}
+	return authURL, login.State, nil
+}
+
+func (svc *OIDCService) Complete(providerName, state, code, redirectURL string) (*User, error) {
+	provider, ok := svc.Providers[providerName]
+	if !ok {
+		return nil, fmt.Errorf("complete oidc login: %w", ErrUnknownProvider)
+	}
+	login, err := svc.consumeLogin(providerName, state)
+	if err != nil {
+		return nil, fmt.Errorf("complete oidc login: %w", err)
+	}
+	claims, err := provider.Exchange(code, redirectURL, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("complete oidc login: %w", err)
+	}
+	user, err := svc.userForClaims(providerName, claims)
+	if err != nil {
+		return nil, fmt.Errorf("complete oidc login: %w", err)
+	}
+	return user, nil
+}
+
+func (svc *OIDCService) consumeLogin(providerName, state string) (*OIDCLogin, error) {
+	login := OIDCLogin{
+		StateHash: svc.hashToken(state),
+	}
+	// Single use: delete it whatever happens next.
+	row := svc.DB.QueryRow(`
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1
+		RETURNING id, provider, nonce, code_verifier, expires_at;
+	`, login.StateHash)
+	err := row.Scan(&login.ID, &login.Provider, &login.Nonce, &login.CodeVerifier, &login.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidOIDCState
+		}
+		return nil, err
+	}
+	if login.Provider != providerName || time.Now().After(login.ExpiresAt) {
+		return nil, ErrInvalidOIDCState
+	}
+	// Housekeeping: drop logins that were never completed.
+	_, err = svc.DB.Exec(`
+		DELETE FROM oidc_logins
+		WHERE expires_at < NOW();
+	`)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	return &login, nil
+}
+
+func (svc *OIDCService) userForClaims(providerName string, claims *IDTokenClaims) (*User, error) {
+	var user User
+	// 1. Known identity
+	row := svc.DB.QueryRow(`
+		SELECT users.id, users.email, users.password_hash, users.role
+		FROM user_identities
+			JOIN users ON users.id = user_identities.user_id
+		WHERE user_identities.provider = $1 AND user_identities.subject = $2;
+	`, providerName, claims.Subject)
+	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role)
+	if err == nil {
+		return &user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// Linking by email is only safe if the provider verified it.
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, ErrUnverifiedEmail
+	}
+	email := strings.ToLower(claims.Email)
+
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// 2. Existing account with the same email, or 3. a new one (no password).
+	if svc.InviteOnly {
+		row = tx.QueryRow(`
+			SELECT id, password_hash, role
+			FROM users
+			WHERE email = $1;
+		`, email)
+	} else {
+		row = tx.QueryRow(`
+			INSERT INTO users (email, password_hash)
+			VALUES ($1, '')
+			ON CONFLICT (email) DO
+			UPDATE
+			SET email = EXCLUDED.email
+			RETURNING id, password_hash, role;
+		`, email)
+	}
+	user.Email = email
+	err = row.Scan(&user.ID, &user.PasswordHash, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSignupClosed
+		}
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4);
+	`, user.ID, providerName, claims.Subject, email)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (svc *OIDCService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
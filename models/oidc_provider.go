@@ -0,0 +1,428 @@
+package models
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long discovery documents and signing keys are cached.
+	oidcCacheDuration = 1 * time.Hour
+	// Allowed clock difference with the provider when checking exp/iat.
+	oidcClockSkew = 1 * time.Minute
+)
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// Claims of an ID token we care about.
+type IDTokenClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	AuthorizedBy  string       `json:"azp"`
+	ExpiresAt     int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified oidcBool     `json:"email_verified"`
+}
+
+/*
+OIDCProvider is an OpenID Connect identity provider we are a relying party of.
+Endpoints and signing keys are discovered from the Issuer
+(<Issuer>/.well-known/openid-configuration) the first time they are needed,
+and cached for a while.
+
+Name is used in URLs (/oauth/<Name>), DisplayName on the sign in page.
+*/
+type OIDCProvider struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string     // Defaults to "openid email"
+	HTTPClient   *http.Client // Defaults to a client with a 10 seconds timeout
+
+	mu           sync.Mutex
+	discovery    *oidcDiscovery
+	keys         map[string]crypto.PublicKey // by key ID
+	discoveredAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Returns the URL to send the user to, to sign in with the provider. Uses the
+// authorization code flow with PKCE (S256).
+func (p *OIDCProvider) AuthCodeURL(redirectURL, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return "", fmt.Errorf("auth code url: %w", err)
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	vals := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {redirectURL},
+		"scope":                 {strings.Join(p.scopes(), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + vals.Encode(), nil
+}
+
+// Exchanges the authorization code for tokens, and returns the claims of the
+// ID token once it has been validated (signature, issuer, audience, expiry
+// and nonce).
+func (p *OIDCProvider) Exchange(code, redirectURL, codeVerifier, nonce string) (*IDTokenClaims, error) {
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	vals := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+		"code_verifier": {codeVerifier},
+	}
+	resp, err := p.httpClient().PostForm(discovery.TokenEndpoint, vals)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: decoding token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("exchange: %s: %s %s", resp.Status, tokens.Error, tokens.ErrorDescription)
+	}
+	claims, err := p.verifyIDToken(tokens.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("exchange: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("exchange: %w: nonce mismatch", ErrInvalidIDToken)
+	}
+	return claims, nil
+}
+
+func (p *OIDCProvider) verifyIDToken(rawToken string) (*IDTokenClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidIDToken)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidIDToken, err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidIDToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidIDToken, err)
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidIDToken, err)
+	}
+	var claims IDTokenClaims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidIDToken, err)
+	}
+	discovery, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != discovery.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return nil, fmt.Errorf("%w: not issued for us", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.ClientID:
+		return nil, fmt.Errorf("%w: unexpected authorized party", ErrInvalidIDToken)
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidIDToken)
+	case now.Add(oidcClockSkew).Before(time.Unix(claims.IssuedAt, 0)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	return &claims, nil
+}
+
+// Returns the discovery document, fetching it if needed.
+func (p *OIDCProvider) discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil && time.Since(p.discoveredAt) < oidcCacheDuration {
+		return p.discovery, nil
+	}
+	var discovery oidcDiscovery
+	wellKnown := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	err := p.getJSON(wellKnown, &discovery)
+	if err != nil {
+		return nil, fmt.Errorf("discover %s: %w", p.Name, err)
+	}
+	if discovery.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discover %s: issuer mismatch: %q", p.Name, discovery.Issuer)
+	}
+	keys, err := p.fetchKeys(discovery.JWKSURI)
+	if err != nil {
+		return nil, fmt.Errorf("discover %s: %w", p.Name, err)
+	}
+	p.discovery = &discovery
+	p.keys = keys
+	p.discoveredAt = time.Now()
+	return p.discovery, nil
+}
+
+// Returns the signing key with the given ID. If we don't know it, the keys
+// may have been rotated, so discovery is done again (at most once a minute).
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	_, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.discoveredAt) > time.Minute {
+		p.discovery = nil // force a refresh
+	}
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	_, err = p.discover()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok = p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, kid)
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) fetchKeys(jwksURI string) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err := p.getJSON(jwksURI, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("fetch keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{
+				Curve: curve,
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (p *OIDCProvider) getJSON(url string, v any) error {
+	resp, err := p.httpClient().Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *OIDCProvider) httpClient() *http.Client {
+	if p.HTTPClient == nil {
+		return &http.Client{Timeout: 10 * time.Second}
+	}
+	return p.HTTPClient
+}
+
+func (p *OIDCProvider) scopes() []string {
+	if len(p.Scopes) == 0 {
+		return []string{"openid", "email"}
+	}
+	return p.Scopes
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		// Notably rejects "none" and the HMAC algorithms.
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	var digest []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256([]byte(signed))
+		digest = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signed))
+		digest = sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512([]byte(signed))
+		digest = sum[:]
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %q doesn't match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("alg %q doesn't match EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
+
+// "aud" can be a string or an array of strings.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var multiple []string
+	err := json.Unmarshal(b, &multiple)
+	*a = multiple
+	return err
+}
+
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// Some providers send "email_verified" as a string ("true").
+type oidcBool bool
+
+func (ob *oidcBool) UnmarshalJSON(b []byte) error {
+	var v bool
+	if json.Unmarshal(b, &v) == nil {
+		*ob = oidcBool(v)
+		return nil
+	}
+	var s string
+	err := json.Unmarshal(b, &s)
+	*ob = oidcBool(s == "true")
+	return err
+}
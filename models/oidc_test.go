@@ -0,0 +1,389 @@
+package models
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	stubClientID    = "lenslocked"
+	stubRedirectURL = "https://lenslocked.test/oauth/stub/callback"
+)
+
+// An OpenID Connect provider serving discovery, JWKS and token endpoints.
+// The authorization endpoint is skipped: authorize plays the part of the user
+// signing in, and returns the code the provider would send back.
+type stubOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]stubAuthorization
+	// Changes the claims of the next ID tokens (e.g. to make them invalid).
+	claims func(claims map[string]any)
+}
+
+type stubAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+func newStubOIDCProvider(t *testing.T) *stubOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	stub := &stubOIDCProvider{
+		key:   key,
+		codes: make(map[string]stubAuthorization),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.URL,
+			"authorization_endpoint": stub.URL + "/authorize",
+			"token_endpoint":         stub.URL + "/token",
+			"jwks_uri":               stub.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kid": "stub-key",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("POST /token", stub.token)
+	stub.Server = httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (stub *stubOIDCProvider) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:         "stub",
+		DisplayName:  "Stub",
+		Issuer:       stub.URL,
+		ClientID:     stubClientID,
+		ClientSecret: "secret",
+		HTTPClient:   stub.Client(),
+	}
+}
+
+// Signs the user in at the provider, and returns the authorization code.
+func (stub *stubOIDCProvider) authorize(t *testing.T, authURL string, subject, email string, emailVerified bool) string {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse auth url: %v", err)
+	}
+	vals := u.Query()
+	if vals.Get("code_challenge_method") != "S256" {
+		t.Fatalf("code_challenge_method = %q, want S256", vals.Get("code_challenge_method"))
+	}
+	code := subject + "|" + email + "|" + map[bool]string{true: "verified", false: "unverified"}[emailVerified]
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.codes[code] = stubAuthorization{
+		challenge: vals.Get("code_challenge"),
+		nonce:     vals.Get("nonce"),
+	}
+	return code
+}
+
+func (stub *stubOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	stub.mu.Lock()
+	authorization, ok := stub.codes[code]
+	delete(stub.codes, code)
+	claimsFunc := stub.claims
+	stub.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || r.FormValue("client_id") != stubClientID ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != authorization.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	parts := strings.SplitN(code, "|", 3)
+	now := time.Now()
+	claims := map[string]any{
+		"iss":            stub.URL,
+		"aud":            stubClientID,
+		"sub":            parts[0],
+		"email":          parts[1],
+		"email_verified": parts[2] == "verified",
+		"nonce":          authorization.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+	if claimsFunc != nil {
+		claimsFunc(claims)
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"id_token": stub.sign(claims),
+	})
+}
+
+func (stub *stubOIDCProvider) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "stub-key", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, stub.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCProviderExchange(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes the claims of the ID token.
+		claims func(claims map[string]any)
+		// Changes what we send to the token endpoint.
+		codeVerifier func(verifier string) string
+		nonce        func(nonce string) string
+		wantErr      bool
+	}{
+		{name: "valid"},
+		{
+			name:         "wrong PKCE verifier",
+			codeVerifier: func(verifier string) string { return verifier + "x" },
+			wantErr:      true,
+		},
+		{
+			name:    "nonce mismatch",
+			nonce:   func(nonce string) string { return nonce + "x" },
+			wantErr: true,
+		},
+		{
+			name:    "no nonce in the token",
+			claims:  func(claims map[string]any) { delete(claims, "nonce") },
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			claims:  func(claims map[string]any) { claims["iss"] = "https://attacker.test" },
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			claims:  func(claims map[string]any) { claims["aud"] = "someone-else" },
+			wantErr: true,
+		},
+		{
+			name: "several audiences, we are the authorized party",
+			claims: func(claims map[string]any) {
+				claims["aud"] = []string{"someone-else", stubClientID}
+				claims["azp"] = stubClientID
+			},
+		},
+		{
+			name:    "several audiences, someone else is the authorized party",
+			claims:  func(claims map[string]any) { claims["aud"] = []string{"someone-else", stubClientID} },
+			wantErr: true,
+		},
+		{
+			name:   "expired within the clock skew",
+			claims: func(claims map[string]any) { claims["exp"] = time.Now().Add(-30 * time.Second).Unix() },
+		},
+		{
+			name:    "expired",
+			claims:  func(claims map[string]any) { claims["exp"] = time.Now().Add(-5 * time.Minute).Unix() },
+			wantErr: true,
+		},
+		{
+			name:    "issued in the future",
+			claims:  func(claims map[string]any) { claims["iat"] = time.Now().Add(5 * time.Minute).Unix() },
+			wantErr: true,
+		},
+		{
+			name:    "no subject",
+			claims:  func(claims map[string]any) { claims["sub"] = "" },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newStubOIDCProvider(t)
+			stub.claims = tt.claims
+			provider := stub.provider()
+
+			verifier := "a-code-verifier-long-enough-for-rfc-7636-0123456789"
+			nonce := "the-nonce"
+			authURL, err := provider.AuthCodeURL(stubRedirectURL, "the-state", nonce, verifier)
+			if err != nil {
+				t.Fatalf("AuthCodeURL() err = %v", err)
+			}
+			code := stub.authorize(t, authURL, "subject-1", "jon@example.com", true)
+			if tt.codeVerifier != nil {
+				verifier = tt.codeVerifier(verifier)
+			}
+			if tt.nonce != nil {
+				nonce = tt.nonce(nonce)
+			}
+			claims, err := provider.Exchange(code, stubRedirectURL, verifier, nonce)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Exchange() = %+v, want an error", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange() err = %v", err)
+			}
+			if claims.Subject != "subject-1" || claims.Email != "jon@example.com" || !claims.EmailVerified {
+				t.Errorf("Exchange() = %+v, want subject-1 and a verified jon@example.com", claims)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderExchangeBadSignature(t *testing.T) {
+	stub := newStubOIDCProvider(t)
+	provider := stub.provider()
+	// Signed with another key, but claiming to use the provider's.
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	stub.key = otherKey
+	authURL, err := provider.AuthCodeURL(stubRedirectURL, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL() err = %v", err)
+	}
+	code := stub.authorize(t, authURL, "subject-1", "jon@example.com", true)
+	_, err = provider.Exchange(code, stubRedirectURL, "verifier", "nonce")
+	if !errors.Is(err, ErrInvalidIDToken) {
+		t.Errorf("Exchange() err = %v, want %v", err, ErrInvalidIDToken)
+	}
+}
+
+// Goes through Begin and Complete, as the controllers do.
+func completeOIDCLogin(t *testing.T, svc *OIDCService, stub *stubOIDCProvider, subject, email string, emailVerified bool) (*User, error) {
+	t.Helper()
+	authURL, state, err := svc.Begin("stub", stubRedirectURL)
+	if err != nil {
+		t.Fatalf("Begin() err = %v", err)
+	}
+	code := stub.authorize(t, authURL, subject, email, emailVerified)
+	return svc.Complete("stub", state, code, stubRedirectURL)
+}
+
+func TestOIDCServiceComplete(t *testing.T) {
+	db := testDB(t)
+	stub := newStubOIDCProvider(t)
+	svc := &OIDCService{
+		DB:        db,
+		Providers: map[string]*OIDCProvider{"stub": stub.provider()},
+	}
+	createUser := func(t *testing.T, email string) uint {
+		t.Helper()
+		var id uint
+		err := db.QueryRow(`
+			INSERT INTO users (email, password_hash)
+			VALUES ($1, '')
+			RETURNING id;
+		`, email).Scan(&id)
+		if err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		return id
+	}
+
+	t.Run("links the account with the same verified email", func(t *testing.T) {
+		email := testEmail("oidc-link")
+		userID := createUser(t, email)
+		subject := testEmail("subject")
+		user, err := completeOIDCLogin(t, svc, stub, subject, strings.ToUpper(email), true)
+		if err != nil {
+			t.Fatalf("Complete() err = %v", err)
+		}
+		if user.ID != userID {
+			t.Errorf("Complete() user = %d, want %d", user.ID, userID)
+		}
+		// Next time, the subject is enough: the email may have changed.
+		user, err = completeOIDCLogin(t, svc, stub, subject, testEmail("changed"), false)
+		if err != nil {
+			t.Fatalf("Complete() again err = %v", err)
+		}
+		if user.ID != userID {
+			t.Errorf("Complete() again user = %d, want %d", user.ID, userID)
+		}
+	})
+
+	t.Run("creates an account", func(t *testing.T) {
+		email := testEmail("oidc-new")
+		user, err := completeOIDCLogin(t, svc, stub, testEmail("subject"), email, true)
+		if err != nil {
+			t.Fatalf("Complete() err = %v", err)
+		}
+		if user.Email != email || user.PasswordHash != "" {
+			t.Errorf("Complete() = %+v, want a new account for %s without password", user, email)
+		}
+	})
+
+	t.Run("refuses unverified emails", func(t *testing.T) {
+		email := testEmail("oidc-unverified")
+		userID := createUser(t, email)
+		_, err := completeOIDCLogin(t, svc, stub, testEmail("subject"), email, false)
+		if !errors.Is(err, ErrUnverifiedEmail) {
+			t.Fatalf("Complete() err = %v, want %v", err, ErrUnverifiedEmail)
+		}
+		var identities int
+		err = db.QueryRow(`SELECT COUNT(*) FROM user_identities WHERE user_id = $1;`, userID).Scan(&identities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identities != 0 {
+			t.Errorf("%d identities linked, want none", identities)
+		}
+	})
+
+	t.Run("invite only doesn't create accounts", func(t *testing.T) {
+		inviteOnly := *svc
+		inviteOnly.InviteOnly = true
+		_, err := completeOIDCLogin(t, &inviteOnly, stub, testEmail("subject"), testEmail("oidc-closed"), true)
+		if !errors.Is(err, ErrSignupClosed) {
+			t.Fatalf("Complete() err = %v, want %v", err, ErrSignupClosed)
+		}
+	})
+
+	t.Run("the state can only be used once", func(t *testing.T) {
+		authURL, state, err := svc.Begin("stub", stubRedirectURL)
+		if err != nil {
+			t.Fatalf("Begin() err = %v", err)
+		}
+		email := testEmail("oidc-replay")
+		code := stub.authorize(t, authURL, testEmail("subject"), email, true)
+		_, err = svc.Complete("stub", state, code, stubRedirectURL)
+		if err != nil {
+			t.Fatalf("Complete() err = %v", err)
+		}
+		code = stub.authorize(t, authURL, testEmail("subject"), email, true)
+		_, err = svc.Complete("stub", state, code, stubRedirectURL)
+		if !errors.Is(err, ErrInvalidOIDCState) {
+			t.Errorf("Complete() again err = %v, want %v", err, ErrInvalidOIDCState)
+		}
+	})
+}
@@ -0,0 +1,558 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/mail"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Roles of organization members.
+const (
+	OrgRoleOwner  = "owner"  // everything, including deleting the organization
+	OrgRoleAdmin  = "admin"  // manage members (except owners), delete galleries
+	OrgRoleMember = "member" // create and edit galleries
+)
+
+var OrgRoles = []string{OrgRoleOwner, OrgRoleAdmin, OrgRoleMember}
+
+type Organization struct {
+	ID        uint
+	Name      string
+	CreatedAt time.Time
+}
+
+// An organization, as seen by one of its members.
+type Membership struct {
+	Organization
+	Role string
+}
+
+// Whether the member can add, remove or change the role of members with the
+// given role (or give that role to someone).
+func (m Membership) CanManage(role string) bool {
+	switch m.Role {
+	case OrgRoleOwner:
+		return true
+	case OrgRoleAdmin:
+		return role != OrgRoleOwner
+	}
+	return false
+}
+
+// A member, as seen from the organization.
+type Member struct {
+	UserID   uint
+	Email    string
+	Role     string
+	JoinedAt time.Time
+}
+
+/*
+OrganizationService manages organizations (e.g. a studio) and their members.
+Organizations own galleries that all their members share (see
+GalleryService.Authorize for who can do what with them).
+
+Nobody is added to an organization without their consent: members are invited
+by email, and join once they accept.
+
+An organization always keeps at least one owner: removing or demoting the last
+one fails with ErrLastOwner.
+*/
+type OrganizationService struct {
+	DB *sql.DB
+	// Deletes the images of the galleries of deleted organizations.
+	GalleryService *GalleryService
+	// Stores the invitations to join organizations.
+	InvitationService *InvitationService
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *OrganizationService) WithActor(actor Actor) *OrganizationService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+// Creates an organization, with ownerId as its first owner.
+func (svc *OrganizationService) Create(name string, ownerId uint) (*Organization, error) {
+	org := Organization{
+		Name: strings.TrimSpace(name),
+	}
+	if org.Name == "" {
+		return nil, fmt.Errorf("create organization: %w", ErrOrganizationNameRequired)
+	}
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow(`
+		INSERT INTO organizations (name)
+		VALUES ($1)
+		RETURNING id, created_at;
+	`, org.Name)
+	err = row.Scan(&org.ID, &org.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO organization_members (organization_id, user_id, role)
+		VALUES ($1, $2, $3);
+	`, org.ID, ownerId, OrgRoleOwner)
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create organization: %w", err)
+	}
+	svc.record(ownerId, AuditOrganizationCreated, map[string]any{
+		"organization_id": org.ID,
+		"name":            org.Name,
+	})
+	return &org, nil
+}
+
+// The organizations of the user, by name.
+func (svc *OrganizationService) Memberships(userId uint) ([]Membership, error) {
+	rows, err := svc.DB.Query(`
+		SELECT organizations.id, organizations.name, organizations.created_at,
+			organization_members.role
+		FROM organization_members
+			JOIN organizations ON organizations.id = organization_members.organization_id
+		WHERE organization_members.user_id = $1
+		ORDER BY organizations.name, organizations.id;
+	`, userId)
+	if err != nil {
+		return nil, fmt.Errorf("memberships: %w", err)
+	}
+	defer rows.Close()
+	var memberships []Membership
+	for rows.Next() {
+		var membership Membership
+		err := rows.Scan(&membership.ID, &membership.Name, &membership.CreatedAt, &membership.Role)
+		if err != nil {
+			return nil, fmt.Errorf("memberships: %w", err)
+		}
+		memberships = append(memberships, membership)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("memberships: %w", err)
+	}
+	return memberships, nil
+}
+
+// The membership of the user in the organization. Returns ErrNotFound if
+// they aren't a member (or there's no such organization).
+func (svc *OrganizationService) Membership(organizationId, userId uint) (*Membership, error) {
+	var membership Membership
+	row := svc.DB.QueryRow(`
+		SELECT organizations.id, organizations.name, organizations.created_at,
+			organization_members.role
+		FROM organization_members
+			JOIN organizations ON organizations.id = organization_members.organization_id
+		WHERE organization_members.organization_id = $1
+			AND organization_members.user_id = $2;
+	`, organizationId, userId)
+	err := row.Scan(&membership.ID, &membership.Name, &membership.CreatedAt, &membership.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("membership: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("membership: %w", err)
+	}
+	return &membership, nil
+}
+
+// The members of the organization, owners first.
+func (svc *OrganizationService) Members(organizationId uint) ([]Member, error) {
+	rows, err := svc.DB.Query(`
+		SELECT users.id, users.email, organization_members.role,
+			organization_members.created_at
+		FROM organization_members
+			JOIN users ON users.id = organization_members.user_id
+		WHERE organization_members.organization_id = $1
+		ORDER BY array_position(ARRAY['owner', 'admin', 'member'], organization_members.role),
+			users.email;
+	`, organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("members: %w", err)
+	}
+	defer rows.Close()
+	var members []Member
+	for rows.Next() {
+		var member Member
+		err := rows.Scan(&member.UserID, &member.Email, &member.Role, &member.JoinedAt)
+		if err != nil {
+			return nil, fmt.Errorf("members: %w", err)
+		}
+		members = append(members, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("members: %w", err)
+	}
+	return members, nil
+}
+
+func (svc *OrganizationService) Rename(organizationId uint, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("rename organization: %w", ErrOrganizationNameRequired)
+	}
+	_, err := svc.DB.Exec(`
+		UPDATE organizations
+		SET name = $2
+		WHERE id = $1;
+	`, organizationId, name)
+	if err != nil {
+		return fmt.Errorf("rename organization: %w", err)
+	}
+	return nil
+}
+
+// Invites email to join the organization with the role: they become a
+// member once they accept (see AcceptInvitation), from the account with that
+// address. Whether there's such an account isn't revealed. Returns
+// ErrInvalidEmail for invalid addresses, and ErrAlreadyMember if it's the
+// address of a member.
+func (svc *OrganizationService) Invite(organizationId uint, email, role string) (*Invitation, error) {
+	if !validOrgRole(role) {
+		return nil, fmt.Errorf("invite member: unknown role %q", role)
+	}
+	email = strings.ToLower(strings.TrimSpace(email))
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return nil, fmt.Errorf("invite member: %w", ErrInvalidEmail)
+	}
+	var member bool
+	row := svc.DB.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1
+			FROM organization_members
+				JOIN users ON users.id = organization_members.user_id
+			WHERE organization_members.organization_id = $1 AND users.email = $2
+		);
+	`, organizationId, email)
+	err = row.Scan(&member)
+	if err != nil {
+		return nil, fmt.Errorf("invite member: %w", err)
+	}
+	if member {
+		return nil, fmt.Errorf("invite member: %w", ErrAlreadyMember)
+	}
+	invitation, err := svc.InvitationService.WithActor(svc.Actor).CreateForOrganization(organizationId, email, role)
+	if err != nil {
+		return nil, fmt.Errorf("invite member: %w", err)
+	}
+	svc.record(0, AuditOrganizationMemberInvited, map[string]any{
+		"organization_id": organizationId,
+		"invitation_id":   invitation.ID,
+		"email":           email,
+		"role":            role,
+	})
+	return invitation, nil
+}
+
+// Makes the user a member of the organization they were invited to with the
+// code. Returns ErrInvalidInvitation if the code is unknown, used up,
+// expired, or for another address, and ErrAlreadyMember if they are already
+// a member.
+func (svc *OrganizationService) AcceptInvitation(code string, user *User) (*Membership, error) {
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	defer tx.Rollback()
+	var membership Membership
+	row := tx.QueryRow(`
+		UPDATE invitations
+		SET uses = uses + 1
+		FROM organizations
+		WHERE invitations.code_hash = $1
+			AND invitations.organization_id = organizations.id
+			AND invitations.email = $2
+			AND invitations.uses < invitations.max_uses
+			AND invitations.expires_at > NOW()
+		RETURNING organizations.id, organizations.name, organizations.created_at,
+			invitations.role;
+	`, svc.InvitationService.hashCode(code), strings.ToLower(user.Email))
+	err = row.Scan(&membership.ID, &membership.Name, &membership.CreatedAt, &membership.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("accept invitation: %w", ErrInvalidInvitation)
+		}
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO organization_members (organization_id, user_id, role)
+		VALUES ($1, $2, $3);
+	`, membership.ID, user.ID, membership.Role)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return nil, fmt.Errorf("accept invitation: %w", ErrAlreadyMember)
+		}
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("accept invitation: %w", err)
+	}
+	svc.record(user.ID, AuditOrganizationMemberAdded, map[string]any{
+		"organization_id": membership.ID,
+		"role":            membership.Role,
+	})
+	return &membership, nil
+}
+
+// The invitations to join the organization that weren't accepted yet.
+func (svc *OrganizationService) Invitations(organizationId uint) ([]Invitation, error) {
+	return svc.InvitationService.ForOrganization(organizationId)
+}
+
+// Revokes an invitation to join the organization. Returns ErrNotFound if the
+// organization has no such invitation.
+func (svc *OrganizationService) RevokeInvitation(organizationId uint, id int) error {
+	return svc.InvitationService.RevokeForOrganization(organizationId, id)
+}
+
+// An invitation to join an organization, for EmailService.OrganizationInvitation.
+type OrganizationInvitationNotice struct {
+	OrganizationName string
+	Role             string
+	AcceptURL        string
+	ExpiresAt        time.Time
+}
+
+var organizationInvitationTextTemplate = texttemplate.Must(texttemplate.New("invitation").Parse(`You're invited to join {{.OrganizationName}} on LensLocked as {{.Role}}.
+
+Sign in with this address, then accept the invitation before {{.ExpiresAt.UTC.Format "January 2, 2006"}}: {{.AcceptURL}}
+`))
+
+var organizationInvitationHTMLTemplate = htmltemplate.Must(htmltemplate.New("invitation").Parse(`<h1>Join {{.OrganizationName}} on LensLocked</h1>
+<p>You're invited to join as {{.Role}}. Sign in with this address, then <a href="{{.AcceptURL}}">accept the invitation</a> before {{.ExpiresAt.UTC.Format "January 2, 2006"}}.</p>
+`))
+
+func (es *EmailService) OrganizationInvitation(to string, notice OrganizationInvitationNotice) error {
+	var plainText, html bytes.Buffer
+	err := organizationInvitationTextTemplate.Execute(&plainText, notice)
+	if err != nil {
+		return fmt.Errorf("organization invitation email: %w", err)
+	}
+	err = organizationInvitationHTMLTemplate.Execute(&html, notice)
+	if err != nil {
+		return fmt.Errorf("organization invitation email: %w", err)
+	}
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   fmt.Sprintf("Join %s on LensLocked", notice.OrganizationName),
+		PlainText: strings.TrimSpace(plainText.String()),
+		HTML:      html.String(),
+	}
+	err = es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
+
+// Changes the role of a member. Returns ErrLastOwner when demoting the last
+// owner.
+func (svc *OrganizationService) SetRole(organizationId, userId uint, role string) error {
+	if !validOrgRole(role) {
+		return fmt.Errorf("set member role: unknown role %q", role)
+	}
+	err := svc.changeMember(organizationId, userId, role != OrgRoleOwner, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(`
+			UPDATE organization_members
+			SET role = $3
+			WHERE organization_id = $1 AND user_id = $2;
+		`, organizationId, userId, role)
+	})
+	if err != nil {
+		return fmt.Errorf("set member role: %w", err)
+	}
+	svc.record(userId, AuditOrganizationMemberRoleChanged, map[string]any{
+		"organization_id": organizationId,
+		"role":            role,
+	})
+	return nil
+}
+
+// Removes a member (or lets them leave). Their galleries stay with the
+// organization. Returns ErrLastOwner when removing the last owner.
+func (svc *OrganizationService) RemoveMember(organizationId, userId uint) error {
+	err := svc.changeMember(organizationId, userId, true, func(tx *sql.Tx) (sql.Result, error) {
+		return tx.Exec(`
+			DELETE FROM organization_members
+			WHERE organization_id = $1 AND user_id = $2;
+		`, organizationId, userId)
+	})
+	if err != nil {
+		return fmt.Errorf("remove member: %w", err)
+	}
+	svc.record(userId, AuditOrganizationMemberRemoved, map[string]any{
+		"organization_id": organizationId,
+	})
+	return nil
+}
+
+// Runs change on the membership of userId in a transaction. When the change
+// makes them lose ownership, it's refused if they are the last owner.
+func (svc *OrganizationService) changeMember(organizationId, userId uint, losesOwnership bool, change func(*sql.Tx) (sql.Result, error)) error {
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Changes to the members of an organization happen one at a time, so
+	// that two owners can't demote each other at once.
+	_, err = tx.Exec(`
+		SELECT id
+		FROM organizations
+		WHERE id = $1
+		FOR UPDATE;
+	`, organizationId)
+	if err != nil {
+		return err
+	}
+	if losesOwnership {
+		var isOwner bool
+		var owners int
+		row := tx.QueryRow(`
+			SELECT COALESCE(BOOL_OR(user_id = $2), false), COUNT(*)
+			FROM organization_members
+			WHERE organization_id = $1 AND role = $3;
+		`, organizationId, userId, OrgRoleOwner)
+		err = row.Scan(&isOwner, &owners)
+		if err != nil {
+			return err
+		}
+		if isOwner && owners == 1 {
+			return ErrLastOwner
+		}
+	}
+	result, err := change(tx)
+	if err != nil {
+		return err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if changed == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+// Deletes the organization, with all its galleries and their images.
+func (svc *OrganizationService) Delete(organizationId uint) error {
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		DELETE FROM galleries
+		WHERE organization_id = $1
+		RETURNING id;
+	`, organizationId)
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	var galleryIds []int
+	for rows.Next() {
+		var galleryId int
+		err := rows.Scan(&galleryId)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("delete organization: %w", err)
+		}
+		galleryIds = append(galleryIds, galleryId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	var name string
+	row := tx.QueryRow(`
+		DELETE FROM organizations
+		WHERE id = $1
+		RETURNING name;
+	`, organizationId)
+	err = row.Scan(&name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("delete organization: %w", ErrNotFound)
+		}
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("delete organization: %w", err)
+	}
+	svc.record(svc.Actor.UserID, AuditOrganizationDeleted, map[string]any{
+		"organization_id": organizationId,
+		"name":            name,
+		"galleries":       len(galleryIds),
+	})
+	for _, galleryId := range galleryIds {
+		err = svc.GalleryService.DeleteImages(galleryId)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+	return nil
+}
+
+// The organizations the user is the only owner of (they would be left
+// without one if the user went away).
+func (svc *OrganizationService) SoleOwnerships(userId uint) ([]Organization, error) {
+	rows, err := svc.DB.Query(`
+		SELECT organizations.id, organizations.name, organizations.created_at
+		FROM organizations
+			JOIN organization_members ON organization_members.organization_id = organizations.id
+		WHERE organization_members.role = $2
+		GROUP BY organizations.id
+		HAVING COUNT(*) = 1 AND BOOL_OR(organization_members.user_id = $1)
+		ORDER BY organizations.name;
+	`, userId, OrgRoleOwner)
+	if err != nil {
+		return nil, fmt.Errorf("sole ownerships: %w", err)
+	}
+	defer rows.Close()
+	var orgs []Organization
+	for rows.Next() {
+		var org Organization
+		err := rows.Scan(&org.ID, &org.Name, &org.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("sole ownerships: %w", err)
+		}
+		orgs = append(orgs, org)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sole ownerships: %w", err)
+	}
+	return orgs, nil
+}
+
+func validOrgRole(role string) bool {
+	for _, orgRole := range OrgRoles {
+		if role == orgRole {
+			return true
+		}
+	}
+	return false
+}
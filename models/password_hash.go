@@ -0,0 +1,227 @@
+package models
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lifebalance/lenslocked/rand"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashAlgorithmBcrypt   = "bcrypt"
+	HashAlgorithmArgon2id = "argon2id"
+)
+
+// Defaults follow the OWASP recommendations for Argon2id.
+var DefaultArgon2Params = Argon2Params{
+	Time:       3,
+	Memory:     64 * 1024,
+	Threads:    2,
+	KeyLength:  32,
+	SaltLength: 16,
+}
+
+var errUnknownHashFormat = errors.New("unknown password hash format")
+
+// Memory is in KiB.
+type Argon2Params struct {
+	Time       uint32
+	Memory     uint32
+	Threads    uint8
+	KeyLength  uint32
+	SaltLength uint32
+}
+
+/*
+PasswordHasher hashes new passwords with the configured Algorithm, and verifies
+passwords against hashes made with any of the supported algorithms. Hashes are
+self-describing (the algorithm, its version and its parameters are stored in
+the hash itself), so they can be upgraded one at a time:
+
+  - bcrypt:   $2a$10$<salt+hash>
+  - argon2id: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash> (PHC string format)
+
+Zero fields use the defaults (bcrypt.DefaultCost, DefaultArgon2Params).
+*/
+type PasswordHasher struct {
+	Algorithm  string // Defaults to HashAlgorithmBcrypt
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// The longest password bcrypt can hash, in bytes.
+const bcryptMaxPasswordBytes = 72
+
+// Returns ErrPasswordTooLong if the password is too long for the algorithm
+// (see MaxPasswordBytes).
+func (ph *PasswordHasher) Hash(password string) (string, error) {
+	switch ph.algorithm() {
+	case HashAlgorithmBcrypt:
+		hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), ph.bcryptCost())
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			return "", fmt.Errorf("hash password: %w", ErrPasswordTooLong)
+		}
+		if err != nil {
+			return "", fmt.Errorf("hash password: %w", err)
+		}
+		return string(hashedBytes), nil
+	case HashAlgorithmArgon2id:
+		params := ph.argon2Params()
+		salt, err := rand.RandomBytes(int(params.SaltLength))
+		if err != nil {
+			return "", fmt.Errorf("hash password: %w", err)
+		}
+		key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version,
+			params.Memory,
+			params.Time,
+			params.Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+	return "", fmt.Errorf("hash password: unsupported algorithm %q", ph.Algorithm)
+}
+
+// Returns ErrInvalidCredentials when the password doesn't match the hash.
+func (ph *PasswordHasher) Verify(hash, password string) error {
+	switch {
+	case isBcryptHash(hash):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrInvalidCredentials
+		}
+		if err != nil {
+			return fmt.Errorf("verify password: %w", err)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return fmt.Errorf("verify password: %w", err)
+		}
+		otherKey := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+		if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+			return ErrInvalidCredentials
+		}
+		return nil
+	case hash == "":
+		// Accounts without a password can't sign in with one.
+		return ErrInvalidCredentials
+	}
+	return fmt.Errorf("verify password: %w", errUnknownHashFormat)
+}
+
+// Reports whether the hash was made with a different algorithm or different
+// parameters than the ones currently configured.
+func (ph *PasswordHasher) NeedsRehash(hash string) bool {
+	switch {
+	case isBcryptHash(hash):
+		if ph.algorithm() != HashAlgorithmBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != ph.bcryptCost()
+	case strings.HasPrefix(hash, "$argon2id$"):
+		if ph.algorithm() != HashAlgorithmArgon2id {
+			return true
+		}
+		params, salt, key, err := parseArgon2Hash(hash)
+		if err != nil {
+			return true
+		}
+		want := ph.argon2Params()
+		return params.Time != want.Time ||
+			params.Memory != want.Memory ||
+			params.Threads != want.Threads ||
+			uint32(len(key)) != want.KeyLength ||
+			uint32(len(salt)) != want.SaltLength
+	}
+	return false
+}
+
+// The longest password that can be hashed, in bytes, 0 for no limit. Past it
+// bcrypt refuses to hash, so the UserService checks it along with the
+// PasswordPolicy.
+func (ph *PasswordHasher) MaxPasswordBytes() int {
+	if ph.algorithm() == HashAlgorithmBcrypt {
+		return bcryptMaxPasswordBytes
+	}
+	return 0
+}
+
+func (ph *PasswordHasher) algorithm() string {
+	if ph.Algorithm == "" {
+		return HashAlgorithmBcrypt
+	}
+	return ph.Algorithm
+}
+
+func (ph *PasswordHasher) bcryptCost() int {
+	if ph.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return ph.BcryptCost
+}
+
+func (ph *PasswordHasher) argon2Params() Argon2Params {
+	params := ph.Argon2
+	if params.Time == 0 {
+		params.Time = DefaultArgon2Params.Time
+	}
+	if params.Memory == 0 {
+		params.Memory = DefaultArgon2Params.Memory
+	}
+	if params.Threads == 0 {
+		params.Threads = DefaultArgon2Params.Threads
+	}
+	if params.KeyLength == 0 {
+		params.KeyLength = DefaultArgon2Params.KeyLength
+	}
+	if params.SaltLength == 0 {
+		params.SaltLength = DefaultArgon2Params.SaltLength
+	}
+	return params
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") ||
+		strings.HasPrefix(hash, "$2b$") ||
+		strings.HasPrefix(hash, "$2y$")
+}
+
+// Parses "$argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>"
+func parseArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnknownHashFormat
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version: %s", parts[2])
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 key: %w", err)
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
@@ -0,0 +1,164 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters, to keep the tests fast.
+var (
+	testBcryptHasher = &PasswordHasher{BcryptCost: bcrypt.MinCost}
+	testArgon2Hasher = &PasswordHasher{
+		Algorithm: HashAlgorithmArgon2id,
+		Argon2:    Argon2Params{Time: 1, Memory: 1024, Threads: 1},
+	}
+)
+
+func TestPasswordHasherHashVerify(t *testing.T) {
+	tests := []struct {
+		name     string
+		hasher   *PasswordHasher
+		password string
+		prefix   string
+		wantErr  error // from Hash
+	}{
+		{"bcrypt", testBcryptHasher, "winter is coming", "$2a$04$", nil},
+		{"bcrypt, 72 bytes", testBcryptHasher, strings.Repeat("a", 72), "$2a$04$", nil},
+		{"bcrypt, 73 bytes", testBcryptHasher, strings.Repeat("a", 73), "", ErrPasswordTooLong},
+		{"argon2id", testArgon2Hasher, "winter is coming", "$argon2id$v=19$m=1024,t=1,p=1$", nil},
+		{"argon2id, long", testArgon2Hasher, strings.Repeat("a", 200), "$argon2id$", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := tt.hasher.Hash(tt.password)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Hash() err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Hash() err = %v", err)
+			}
+			if !strings.HasPrefix(hash, tt.prefix) {
+				t.Errorf("Hash() = %q, want prefix %q", hash, tt.prefix)
+			}
+			// Any hasher verifies any supported hash.
+			for _, verifier := range []*PasswordHasher{testBcryptHasher, testArgon2Hasher} {
+				if err := verifier.Verify(hash, tt.password); err != nil {
+					t.Errorf("Verify() err = %v", err)
+				}
+				err := verifier.Verify(hash, "x"+tt.password)
+				if !errors.Is(err, ErrInvalidCredentials) {
+					t.Errorf("Verify() with a wrong password err = %v, want %v", err, ErrInvalidCredentials)
+				}
+			}
+		})
+	}
+
+	t.Run("salted", func(t *testing.T) {
+		for _, hasher := range []*PasswordHasher{testBcryptHasher, testArgon2Hasher} {
+			hash1, _ := hasher.Hash("winter is coming")
+			hash2, _ := hasher.Hash("winter is coming")
+			if hash1 == hash2 {
+				t.Errorf("%s: same hash twice: %q", hasher.algorithm(), hash1)
+			}
+		}
+	})
+
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		_, err := (&PasswordHasher{Algorithm: "md5"}).Hash("winter is coming")
+		if err == nil {
+			t.Error("Hash() err = nil, want an error")
+		}
+	})
+}
+
+func TestPasswordHasherVerifyInvalidHashes(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+		want error // nil: any error but ErrInvalidCredentials
+	}{
+		{"no password", "", ErrInvalidCredentials},
+		{"unknown format", "$1$salt$hash", nil},
+		{"plain text", "winter is coming", nil},
+		{"truncated argon2id", "$argon2id$v=19$m=1024,t=1,p=1$c2FsdA", nil},
+		{"other argon2 version", "$argon2id$v=16$m=1024,t=1,p=1$c2FsdA$a2V5", nil},
+		{"malformed bcrypt", "$2a$04$tooshort", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := testBcryptHasher.Verify(tt.hash, "winter is coming")
+			switch {
+			case tt.want != nil && !errors.Is(err, tt.want):
+				t.Errorf("Verify() err = %v, want %v", err, tt.want)
+			case tt.want == nil && (err == nil || errors.Is(err, ErrInvalidCredentials)):
+				t.Errorf("Verify() err = %v, want an error about the hash", err)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherNeedsRehash(t *testing.T) {
+	bcryptHash, err := testBcryptHasher.Hash("winter is coming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Hash, err := testArgon2Hasher.Hash("winter is coming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		hasher *PasswordHasher
+		hash   string
+		want   bool
+	}{
+		{"bcrypt, same cost", testBcryptHasher, bcryptHash, false},
+		{"bcrypt, other cost", &PasswordHasher{BcryptCost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"bcrypt, default cost", &PasswordHasher{}, bcryptHash, true},
+		{"bcrypt to argon2id", testArgon2Hasher, bcryptHash, true},
+		{"argon2id, same parameters", testArgon2Hasher, argon2Hash, false},
+		{
+			"argon2id, more memory",
+			&PasswordHasher{
+				Algorithm: HashAlgorithmArgon2id,
+				Argon2:    Argon2Params{Time: 1, Memory: 2048, Threads: 1},
+			},
+			argon2Hash,
+			true,
+		},
+		{
+			"argon2id, longer keys",
+			&PasswordHasher{
+				Algorithm: HashAlgorithmArgon2id,
+				Argon2:    Argon2Params{Time: 1, Memory: 1024, Threads: 1, KeyLength: 64},
+			},
+			argon2Hash,
+			true,
+		},
+		{"argon2id to bcrypt", testBcryptHasher, argon2Hash, true},
+		{"argon2id, malformed", testArgon2Hasher, "$argon2id$v=19$garbage", true},
+		{"no password", testBcryptHasher, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.NeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("NeedsRehash(%q) = %v, want %v", tt.hash, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPasswordHasherMaxPasswordBytes(t *testing.T) {
+	if got := (&PasswordHasher{}).MaxPasswordBytes(); got != 72 {
+		t.Errorf("bcrypt MaxPasswordBytes() = %d, want 72", got)
+	}
+	if got := testArgon2Hasher.MaxPasswordBytes(); got != 0 {
+		t.Errorf("argon2id MaxPasswordBytes() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	DefaultPasswordMinLength = 8
+	DefaultPasswordMaxLength = 72 // bcrypt's limit, though it counts bytes
+)
+
+// Always banned, on top of PasswordPolicy.Banned.
+var defaultBannedPasswords = []string{
+	"password",
+	"password1",
+	"password123",
+	"12345678",
+	"123456789",
+	"1234567890",
+	"qwerty123",
+	"qwertyuiop",
+	"iloveyou",
+	"letmein123",
+	"lenslocked",
+}
+
+/*
+PasswordPolicy is checked by the UserService every time a password is set.
+
+  - MinLength/MaxLength are counted in characters (not bytes). The byte limit
+    of bcrypt is checked by the UserService (see
+    PasswordHasher.MaxPasswordBytes).
+  - Banned passwords are compared case-insensitively.
+  - AllowEmailSimilarity disables the check that rejects passwords that look
+    like the email address (e.g. "bob.smith" for "bob.smith@test.com").
+  - Breached is optional; when set, passwords found in the list are rejected.
+*/
+type PasswordPolicy struct {
+	MinLength            int // Defaults to DefaultPasswordMinLength
+	MaxLength            int // Defaults to DefaultPasswordMaxLength
+	Banned               []string
+	AllowEmailSimilarity bool
+	Breached             *BreachedPasswords
+}
+
+// Returns one of the ErrPassword* errors if the password breaks the policy.
+func (pp *PasswordPolicy) Validate(email, password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < pp.MinLen() {
+		return ErrPasswordTooShort
+	}
+	if length > pp.MaxLen() {
+		return ErrPasswordTooLong
+	}
+	if pp.isBanned(password) {
+		return ErrPasswordBanned
+	}
+	if !pp.AllowEmailSimilarity && similarToEmail(email, password) {
+		return ErrPasswordLikeEmail
+	}
+	if pp.Breached != nil && pp.Breached.Contains(password) {
+		return ErrPasswordBreached
+	}
+	return nil
+}
+
+// Minimum length in effect (so error messages can mention it).
+func (pp *PasswordPolicy) MinLen() int {
+	if pp.MinLength <= 0 {
+		return DefaultPasswordMinLength
+	}
+	return pp.MinLength
+}
+
+// Maximum length in effect (so error messages can mention it).
+func (pp *PasswordPolicy) MaxLen() int {
+	if pp.MaxLength <= 0 {
+		return DefaultPasswordMaxLength
+	}
+	return pp.MaxLength
+}
+
+func (pp *PasswordPolicy) isBanned(password string) bool {
+	lowercased := strings.ToLower(password)
+	for _, banned := range defaultBannedPasswords {
+		if lowercased == banned {
+			return true
+		}
+	}
+	for _, banned := range pp.Banned {
+		if lowercased == strings.ToLower(banned) {
+			return true
+		}
+	}
+	return false
+}
+
+// A password is too similar to the email when, ignoring case and anything
+// that isn't a letter or a digit, one of them contains the other.
+func similarToEmail(email, password string) bool {
+	localPart, _, _ := strings.Cut(email, "@")
+	normalizedEmail := normalizeForComparison(localPart)
+	normalizedPwd := normalizeForComparison(password)
+	if len(normalizedEmail) < 3 || normalizedPwd == "" {
+		return false
+	}
+	return strings.Contains(normalizedPwd, normalizedEmail) ||
+		strings.Contains(normalizedEmail, normalizedPwd)
+}
+
+func normalizeForComparison(s string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// Reads a list of banned passwords, one per line. Empty lines and lines
+// starting with # are skipped.
+func LoadBannedPasswords(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("load banned passwords: %w", err)
+	}
+	defer f.Close()
+	var banned []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		banned = append(banned, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("load banned passwords: %w", err)
+	}
+	return banned, nil
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	breached := newTestBreachedPasswords(t, "correct horse battery staple")
+	tests := []struct {
+		name     string
+		policy   PasswordPolicy
+		email    string
+		password string
+		want     error
+	}{
+		{"valid", PasswordPolicy{}, "jon@example.com", "winter is coming", nil},
+		{"too short", PasswordPolicy{}, "jon@example.com", "short", ErrPasswordTooShort},
+		{"custom min length", PasswordPolicy{MinLength: 12}, "jon@example.com", "elevenchars", ErrPasswordTooShort},
+		{"max length", PasswordPolicy{}, "jon@example.com", strings.Repeat("x", DefaultPasswordMaxLength), nil},
+		{"too long", PasswordPolicy{}, "jon@example.com", strings.Repeat("x", DefaultPasswordMaxLength+1), ErrPasswordTooLong},
+		// Characters, not bytes.
+		{"multibyte within max length", PasswordPolicy{MaxLength: 10}, "jon@example.com", strings.Repeat("é", 10), nil},
+		{"banned by default", PasswordPolicy{}, "jon@example.com", "Password123", ErrPasswordBanned},
+		{"banned by the policy", PasswordPolicy{Banned: []string{"Winterfell1"}}, "jon@example.com", "WINTERFELL1", ErrPasswordBanned},
+		{"email local part", PasswordPolicy{}, "jon.snow@example.com", "JonSnow!", ErrPasswordLikeEmail},
+		{"contains the email", PasswordPolicy{}, "jon.snow@example.com", "i am jon snow", ErrPasswordLikeEmail},
+		{"contained in the email", PasswordPolicy{}, "jonsnowofwinterfell@example.com", "snowofwinter", ErrPasswordLikeEmail},
+		{"email similarity allowed", PasswordPolicy{AllowEmailSimilarity: true}, "jon.snow@example.com", "JonSnow!", nil},
+		{"short local part", PasswordPolicy{}, "jo@example.com", "jojojojo", nil},
+		{"breached", PasswordPolicy{Breached: breached}, "jon@example.com", "correct horse battery staple", ErrPasswordBreached},
+		{"not breached", PasswordPolicy{Breached: breached}, "jon@example.com", "winter is coming", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate(tt.email, tt.password)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Validate(%q, %q) err = %v, want %v", tt.email, tt.password, err, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
@@ -28,6 +29,14 @@ type PasswordResetService struct {
 	DB            *sql.DB
 	BytesPerToken int
 	Duration      time.Duration // Defaults to DefaultResetDuration
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *PasswordResetService) WithActor(actor Actor) *PasswordResetService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
 }
 
 func (svc *PasswordResetService) Create(email string) (*PasswordReset, error) {
@@ -41,7 +50,9 @@ func (svc *PasswordResetService) Create(email string) (*PasswordReset, error) {
 	`, lowercasedEmail)
 	err := row.Scan(&userId)
 	if err != nil {
-		// TODO: return informative error about user not existing
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create: %w", ErrNotFound)
+		}
 		return nil, fmt.Errorf("create: %w", err)
 	}
 	// Generate token
@@ -77,11 +88,37 @@ func (svc *PasswordResetService) Create(email string) (*PasswordReset, error) {
 	if err != nil {
 		return nil, fmt.Errorf("create %w", err)
 	}
+	svc.record(uint(pwdReset.UserID), AuditPasswordResetRequested, nil)
 	// Return a ref. to the PasswordReset instance
 	return &pwdReset, nil
 }
 
+// Returns the user a (valid) reset token belongs to, without consuming it.
+func (svc *PasswordResetService) Lookup(resetToken string) (*User, error) {
+	_, user, err := svc.find(resetToken)
+	if err != nil {
+		return nil, fmt.Errorf("lookup: %w", err)
+	}
+	return user, nil
+}
+
 func (svc *PasswordResetService) Consume(resetToken string) (*User, error) {
+	pwdReset, user, err := svc.find(resetToken)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	// Delete token from DB
+	err = svc.deleteResetToken(pwdReset.ID)
+	if err != nil {
+		return nil, fmt.Errorf("consume: %w", err)
+	}
+	svc.record(user.ID, AuditPasswordResetCompleted, nil)
+
+	return user, nil
+}
+
+// Finds the (non-expired) reset token, and the user it belongs to.
+func (svc *PasswordResetService) find(resetToken string) (*PasswordReset, *User, error) {
 	var user User
 	var pwdReset PasswordReset
 	// Query DB for the reset token, and the user
@@ -91,7 +128,8 @@ func (svc *PasswordResetService) Consume(resetToken string) (*User, error) {
 		password_resets.expires_at,
 		users.id,
 		users.email,
-		users.password_hash
+		users.password_hash,
+		users.role
 	FROM password_resets
 		JOIN users ON users.id = password_resets.user_id
 	WHERE password_resets.token_hash=$1;
@@ -101,22 +139,17 @@ func (svc *PasswordResetService) Consume(resetToken string) (*User, error) {
 		&pwdReset.ExpiresAt,
 		&user.ID,
 		&user.Email,
-		&user.PasswordHash)
+		&user.PasswordHash,
+		&user.Role)
 	if err != nil {
-		return nil, fmt.Errorf("consume %w", err)
+		return nil, nil, err
 	}
 
 	// Check expiry date of token
 	if time.Now().After(pwdReset.ExpiresAt) {
-		return nil, fmt.Errorf("token expired: %v", resetToken)
-	}
-	// Delete token from DB
-	err = svc.deleteResetToken(pwdReset.ID)
-	if err != nil {
-		return nil, fmt.Errorf("consume: %w", err)
+		return nil, nil, fmt.Errorf("token expired: %v", resetToken)
 	}
-
-	return &user, nil
+	return &pwdReset, &user, nil
 }
 
 func (svc *PasswordResetService) hashToken(token string) string {
@@ -134,3 +167,15 @@ func (svc *PasswordResetService) deleteResetToken(tokenId int) error {
 	}
 	return nil
 }
+
+// Deletes every reset token of the user (e.g. once the password was changed).
+func (svc *PasswordResetService) DeleteForUser(userId uint) error {
+	_, err := svc.DB.Exec(`
+		DELETE FROM password_resets
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("delete for user: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lifebalance/lenslocked/migrations"
+)
+
+var migrateTestDB sync.Once
+
+// Returns a connection to the database in LENSLOCKED_TEST_DATABASE_URL, with
+// the migrations applied. Tests needing it are skipped when it isn't set.
+//
+// Tests share the database, so they must not depend on it being empty: use
+// testEmail for new accounts.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv("LENSLOCKED_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("LENSLOCKED_TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	var migrateErr error
+	migrateTestDB.Do(func() {
+		migrateErr = MigrateFS(db, migrations.FS, ".")
+	})
+	if migrateErr != nil {
+		t.Fatalf("migrate test db: %v", migrateErr)
+	}
+	return db
+}
+
+// Returns an email address no other test (or previous run) uses.
+func testEmail(name string) string {
+	return fmt.Sprintf("%s-%d@example.com", name, time.Now().UnixNano())
+}
@@ -0,0 +1,323 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	DefaultAvatarSize     = 256 // pixels, avatars are square
+	profileNameMaxLength  = 80
+	profileBioMaxLength   = 1000
+	profileWebsiteMaxSize = 200
+)
+
+var (
+	// Handles are lowercase, 2 to 30 letters, digits, "-" or "_".
+	handlePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,29}$`)
+	// Handles that could be mistaken for pages of the app.
+	reservedHandles = map[string]bool{
+		"admin": true, "api": true, "galleries": true, "me": true, "new": true,
+		"orgs": true, "scim": true, "settings": true, "signin": true,
+		"signup": true, "support": true, "users": true,
+	}
+	avatarFilenamePattern = regexp.MustCompile(`^user-\d+-[0-9a-f]+\.(jpg|png)$`)
+)
+
+type Profile struct {
+	UserID      uint
+	Email       string
+	Handle      string // "" until the user picks one (no public profile)
+	DisplayName string
+	Bio         string
+	Website     string
+	Avatar      string // filename in the avatars folder, "" for none
+}
+
+// What to call the user: their display name, or their handle.
+func (profile Profile) Name() string {
+	if profile.DisplayName != "" {
+		return profile.DisplayName
+	}
+	return profile.Handle
+}
+
+/*
+ProfileService manages what users show of themselves: display name, bio,
+website, avatar, and the handle of their public profile (/u/{handle}).
+
+Avatars go through the ImageProcessor, like gallery images, and are stored
+as square images in AvatarsDir. Each new avatar gets a new filename, so they
+can be cached forever.
+*/
+type ProfileService struct {
+	DB             *sql.DB
+	ImageProcessor *ImageProcessor
+	AvatarsDir     string // Defaults to "images/avatars"
+	AvatarSize     int    // Defaults to DefaultAvatarSize
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *ProfileService) WithActor(actor Actor) *ProfileService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+const profileColumns = `
+	id, email, COALESCE(handle, ''), display_name, bio, website, avatar`
+
+func scanProfile(row *sql.Row) (*Profile, error) {
+	var profile Profile
+	err := row.Scan(
+		&profile.UserID,
+		&profile.Email,
+		&profile.Handle,
+		&profile.DisplayName,
+		&profile.Bio,
+		&profile.Website,
+		&profile.Avatar,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &profile, nil
+}
+
+func (svc *ProfileService) ByUserId(userId uint) (*Profile, error) {
+	profile, err := scanProfile(svc.DB.QueryRow(`
+		SELECT `+profileColumns+`
+		FROM users
+		WHERE id = $1;
+	`, userId))
+	if err != nil {
+		return nil, fmt.Errorf("profile by user ID: %w", err)
+	}
+	return profile, nil
+}
+
+// The public profile of the handle. Disabled accounts have none.
+func (svc *ProfileService) ByHandle(handle string) (*Profile, error) {
+	profile, err := scanProfile(svc.DB.QueryRow(`
+		SELECT `+profileColumns+`
+		FROM users
+		WHERE handle = $1 AND disabled_at IS NULL;
+	`, strings.ToLower(handle)))
+	if err != nil {
+		return nil, fmt.Errorf("profile by handle: %w", err)
+	}
+	return profile, nil
+}
+
+// Updates the handle, display name, bio and website of the user (not the
+// avatar, see SetAvatar). Returns ErrInvalidProfile (wrapped with the
+// reason) or ErrHandleTaken when they can't be used.
+func (svc *ProfileService) Update(profile Profile) error {
+	err := normalizeProfile(&profile)
+	if err != nil {
+		return fmt.Errorf("update profile: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		UPDATE users
+		SET handle = NULLIF($2, ''), display_name = $3, bio = $4, website = $5
+		WHERE id = $1;
+	`, profile.UserID, profile.Handle, profile.DisplayName, profile.Bio, profile.Website)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return fmt.Errorf("update profile: %w", ErrHandleTaken)
+		}
+		return fmt.Errorf("update profile: %w", err)
+	}
+	svc.record(profile.UserID, AuditProfileUpdated, map[string]any{
+		"handle": profile.Handle,
+	})
+	return nil
+}
+
+func normalizeProfile(profile *Profile) error {
+	profile.Handle = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(profile.Handle), "@"))
+	if profile.Handle != "" && (!handlePattern.MatchString(profile.Handle) || reservedHandles[profile.Handle]) {
+		return fmt.Errorf("%w: handle %q", ErrInvalidProfile, profile.Handle)
+	}
+	profile.DisplayName = strings.TrimSpace(profile.DisplayName)
+	if utf8.RuneCountInString(profile.DisplayName) > profileNameMaxLength {
+		return fmt.Errorf("%w: display name too long", ErrInvalidProfile)
+	}
+	profile.Bio = strings.TrimSpace(profile.Bio)
+	if utf8.RuneCountInString(profile.Bio) > profileBioMaxLength {
+		return fmt.Errorf("%w: bio too long", ErrInvalidProfile)
+	}
+	website, err := normalizeWebsite(profile.Website)
+	if err != nil {
+		return err
+	}
+	profile.Website = website
+	return nil
+}
+
+// Websites are http(s) URLs, "https://" being added when there's no scheme.
+func normalizeWebsite(website string) (string, error) {
+	website = strings.TrimSpace(website)
+	if website == "" {
+		return "", nil
+	}
+	if !strings.Contains(website, "://") {
+		website = "https://" + website
+	}
+	u, err := url.Parse(website)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		len(website) > profileWebsiteMaxSize {
+		return "", fmt.Errorf("%w: website %q", ErrInvalidProfile, website)
+	}
+	return u.String(), nil
+}
+
+// Processes and stores the new avatar of the user, replacing the previous
+// one. Returns its filename.
+func (svc *ProfileService) SetAvatar(userId uint, r io.Reader) (string, error) {
+	size := svc.AvatarSize
+	if size == 0 {
+		size = DefaultAvatarSize
+	}
+	processed, err := svc.imageProcessor().Process(r, size, size, true)
+	if err != nil {
+		return "", fmt.Errorf("set avatar: %w", err)
+	}
+	suffix, err := rand.RandomBytes(8)
+	if err != nil {
+		return "", fmt.Errorf("set avatar: %w", err)
+	}
+	filename := fmt.Sprintf("user-%d-%s%s", userId, hex.EncodeToString(suffix), processed.Ext)
+	err = os.MkdirAll(svc.avatarsDir(), 0755)
+	if err != nil {
+		return "", fmt.Errorf("set avatar: %w", err)
+	}
+	err = writeFile(filepath.Join(svc.avatarsDir(), filename), bytes.NewReader(processed.Data))
+	if err != nil {
+		return "", fmt.Errorf("set avatar: %w", err)
+	}
+	err = svc.replaceAvatar(userId, filename)
+	if err != nil {
+		os.Remove(filepath.Join(svc.avatarsDir(), filename))
+		return "", fmt.Errorf("set avatar: %w", err)
+	}
+	return filename, nil
+}
+
+// Removes the avatar of the user.
+func (svc *ProfileService) RemoveAvatar(userId uint) error {
+	err := svc.replaceAvatar(userId, "")
+	if err != nil {
+		return fmt.Errorf("remove avatar: %w", err)
+	}
+	return nil
+}
+
+// Points the user to their new avatar, and deletes the previous one.
+func (svc *ProfileService) replaceAvatar(userId uint, filename string) error {
+	var previous string
+	row := svc.DB.QueryRow(`
+		UPDATE users
+		SET avatar = $2
+		FROM (SELECT avatar FROM users WHERE id = $1) AS previous
+		WHERE users.id = $1
+		RETURNING previous.avatar;
+	`, userId, filename)
+	err := row.Scan(&previous)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+	err = svc.deleteAvatarFile(previous)
+	if err != nil {
+		fmt.Println(err) // rudimentary logging
+	}
+	svc.record(userId, AuditAvatarUpdated, map[string]any{
+		"removed": filename == "",
+	})
+	return nil
+}
+
+// Deletes the file of an avatar, if there's one. Files that are already gone
+// aren't an error.
+func (svc *ProfileService) deleteAvatarFile(filename string) error {
+	if filename == "" || !avatarFilenamePattern.MatchString(filename) {
+		return nil
+	}
+	err := os.Remove(filepath.Join(svc.avatarsDir(), filename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// The path of the avatar file. Returns ErrNotFound for unknown avatars.
+func (svc *ProfileService) AvatarPath(filename string) (string, error) {
+	if !avatarFilenamePattern.MatchString(filename) {
+		return "", fmt.Errorf("avatar path: %w", ErrNotFound)
+	}
+	path := filepath.Join(svc.avatarsDir(), filename)
+	_, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("avatar path: %w", ErrNotFound)
+		}
+		return "", fmt.Errorf("avatar path: %w", err)
+	}
+	return path, nil
+}
+
+func (svc *ProfileService) imageProcessor() *ImageProcessor {
+	if svc.ImageProcessor == nil {
+		return &ImageProcessor{}
+	}
+	return svc.ImageProcessor
+}
+
+func (svc *ProfileService) avatarsDir() string {
+	if svc.AvatarsDir == "" {
+		return filepath.Join("images", "avatars")
+	}
+	return svc.AvatarsDir
+}
+
+// Writes the file through a temporary file, so that it's never seen half
+// written.
+func writeFile(path string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,589 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const (
+	// Name of the selection that holds the favorites of a client.
+	FavoritesSelectionName  = "Favorites"
+	selectionNameMaxLength  = 100
+	selectionNoteMaxLength  = 1000
+	shareLinkLabelMaxLength = 100
+)
+
+// Who proofs a gallery: a signed in user (UserID), or the client of a share
+// link (ShareLinkID), the other one being 0.
+type Proofer struct {
+	UserID      uint
+	ShareLinkID int
+}
+
+// A link to a gallery for one client. Whoever has it can see the gallery,
+// whatever its visibility, and proof it as that client.
+type ShareLink struct {
+	ID        int
+	GalleryID int
+	Label     string // who it's for, e.g. "Smith family"
+	Token     string // Only set by CreateShareLink (not stored in db)
+	CreatedBy uint
+	CreatedAt time.Time
+}
+
+// Images a client picked in a gallery, with a note for each if they want.
+// Every client has a Favorites selection (created when they add the first
+// favorite), and as many named ones as they like.
+type Selection struct {
+	ID          int
+	GalleryID   int
+	Proofer     Proofer
+	ProoferName string // email of the user, or label of the share link
+	Name        string
+	Favorites   bool
+	SubmittedAt time.Time // zero until submitted
+	Images      []SelectionImage
+}
+
+type SelectionImage struct {
+	Filename string
+	Note     string
+}
+
+/*
+ProofingService manages share links and the selections of clients.
+
+Clients work on their selections and submit them when done. Until then, the
+photographer doesn't see them; once submitted, they can still be changed and
+submitted again.
+*/
+type ProofingService struct {
+	DB             *sql.DB
+	GalleryService *GalleryService
+	BytesPerToken  int
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *ProofingService) WithActor(actor Actor) *ProofingService {
+	withActor := *svc
+	withActor.Actor = actor
+	return &withActor
+}
+
+// Creates a share link to the gallery for the client named label. Returns
+// ErrShareLinkLabelRequired without a label.
+func (svc *ProofingService) CreateShareLink(gallery *Gallery, label string, createdBy uint) (*ShareLink, error) {
+	label = strings.TrimSpace(label)
+	if label == "" || len(label) > shareLinkLabelMaxLength {
+		return nil, fmt.Errorf("create share link: %w", ErrShareLinkLabelRequired)
+	}
+	token, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerToken))
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	link := ShareLink{
+		GalleryID: gallery.ID,
+		Label:     label,
+		Token:     token,
+		CreatedBy: createdBy,
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO share_links (gallery_id, label, token_hash, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at;
+	`, link.GalleryID, link.Label, svc.hashToken(token), nullableId(createdBy))
+	err = row.Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("create share link: %w", err)
+	}
+	svc.record(gallery.historyUserId(), AuditShareLinkCreated, map[string]any{
+		"gallery_id":    gallery.ID,
+		"share_link_id": link.ID,
+		"label":         link.Label,
+	})
+	return &link, nil
+}
+
+// The share links of the gallery that weren't revoked, oldest first.
+func (svc *ProofingService) ShareLinks(galleryId int) ([]ShareLink, error) {
+	rows, err := svc.DB.Query(`
+		SELECT id, label, COALESCE(created_by, 0), created_at
+		FROM share_links
+		WHERE gallery_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at, id;
+	`, galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("share links: %w", err)
+	}
+	defer rows.Close()
+	var links []ShareLink
+	for rows.Next() {
+		link := ShareLink{GalleryID: galleryId}
+		err := rows.Scan(&link.ID, &link.Label, &link.CreatedBy, &link.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("share links: %w", err)
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("share links: %w", err)
+	}
+	return links, nil
+}
+
+// Revokes the share link of the gallery: it stops working, but what its
+// client submitted stays. Returns ErrNotFound if there's no such link.
+func (svc *ProofingService) RevokeShareLink(gallery *Gallery, id int) error {
+	result, err := svc.DB.Exec(`
+		UPDATE share_links
+		SET revoked_at = NOW()
+		WHERE id = $1 AND gallery_id = $2 AND revoked_at IS NULL;
+	`, id, gallery.ID)
+	if err != nil {
+		return fmt.Errorf("revoke share link: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("revoke share link: %w", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("revoke share link: %w", ErrNotFound)
+	}
+	svc.record(gallery.historyUserId(), AuditShareLinkRevoked, map[string]any{
+		"gallery_id":    gallery.ID,
+		"share_link_id": id,
+	})
+	return nil
+}
+
+// The share link with the token. Returns ErrNotFound for unknown and revoked
+// links.
+func (svc *ProofingService) ShareLinkByToken(token string) (*ShareLink, error) {
+	link := ShareLink{Token: token}
+	row := svc.DB.QueryRow(`
+		SELECT id, gallery_id, label, COALESCE(created_by, 0), created_at
+		FROM share_links
+		WHERE token_hash = $1 AND revoked_at IS NULL;
+	`, svc.hashToken(token))
+	err := row.Scan(&link.ID, &link.GalleryID, &link.Label, &link.CreatedBy, &link.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("share link by token: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("share link by token: %w", err)
+	}
+	return &link, nil
+}
+
+const selectionColumns = `
+	selections.id, selections.gallery_id, COALESCE(selections.user_id, 0),
+	COALESCE(selections.share_link_id, 0),
+	COALESCE(users.email, share_links.label, ''), selections.name,
+	selections.favorites, selections.submitted_at`
+
+const selectionJoins = `
+	LEFT JOIN users ON users.id = selections.user_id
+	LEFT JOIN share_links ON share_links.id = selections.share_link_id`
+
+// The selections of the proofer in the gallery, with their images: the
+// favorites first, then by name.
+func (svc *ProofingService) Selections(galleryId int, proofer Proofer) ([]Selection, error) {
+	selections, err := svc.querySelections(`
+		SELECT `+selectionColumns+`
+		FROM selections `+selectionJoins+`
+		WHERE selections.gallery_id = $1
+			AND selections.user_id IS NOT DISTINCT FROM $2
+			AND selections.share_link_id IS NOT DISTINCT FROM $3
+		ORDER BY selections.favorites DESC, lower(selections.name), selections.id;
+	`, galleryId, nullableId(proofer.UserID), nullableId(uint(proofer.ShareLinkID)))
+	if err != nil {
+		return nil, fmt.Errorf("selections: %w", err)
+	}
+	return selections, nil
+}
+
+// The selections of the gallery that were submitted, with their images, the
+// most recent first.
+func (svc *ProofingService) SubmittedSelections(galleryId int) ([]Selection, error) {
+	selections, err := svc.querySelections(`
+		SELECT `+selectionColumns+`
+		FROM selections `+selectionJoins+`
+		WHERE selections.gallery_id = $1 AND selections.submitted_at IS NOT NULL
+		ORDER BY selections.submitted_at DESC, selections.id;
+	`, galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("submitted selections: %w", err)
+	}
+	return selections, nil
+}
+
+// The submitted selection of the gallery, with its images. Returns
+// ErrNotFound if there's no such selection, or if it wasn't submitted.
+func (svc *ProofingService) SubmittedSelection(galleryId, id int) (*Selection, error) {
+	selections, err := svc.querySelections(`
+		SELECT `+selectionColumns+`
+		FROM selections `+selectionJoins+`
+		WHERE selections.id = $1 AND selections.gallery_id = $2
+			AND selections.submitted_at IS NOT NULL;
+	`, id, galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("submitted selection: %w", err)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("submitted selection: %w", ErrNotFound)
+	}
+	return &selections[0], nil
+}
+
+func (svc *ProofingService) querySelections(query string, args ...any) ([]Selection, error) {
+	rows, err := svc.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	var selections []Selection
+	for rows.Next() {
+		var selection Selection
+		var submittedAt sql.NullTime
+		err := rows.Scan(
+			&selection.ID,
+			&selection.GalleryID,
+			&selection.Proofer.UserID,
+			&selection.Proofer.ShareLinkID,
+			&selection.ProoferName,
+			&selection.Name,
+			&selection.Favorites,
+			&submittedAt,
+		)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		selection.SubmittedAt = submittedAt.Time
+		selections = append(selections, selection)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range selections {
+		selections[i].Images, err = svc.selectionImages(selections[i].ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return selections, nil
+}
+
+// The images of the selection, in the order they were added.
+func (svc *ProofingService) selectionImages(selectionId int) ([]SelectionImage, error) {
+	rows, err := svc.DB.Query(`
+		SELECT filename, note
+		FROM selection_images
+		WHERE selection_id = $1
+		ORDER BY added_at, filename;
+	`, selectionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var images []SelectionImage
+	for rows.Next() {
+		var image SelectionImage
+		err := rows.Scan(&image.Filename, &image.Note)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+// Creates a selection named name for the proofer. Returns
+// ErrSelectionNameRequired without a name, and ErrSelectionNameTaken if the
+// proofer already has a selection with that name.
+func (svc *ProofingService) CreateSelection(galleryId int, proofer Proofer, name string) (*Selection, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > selectionNameMaxLength {
+		return nil, fmt.Errorf("create selection: %w", ErrSelectionNameRequired)
+	}
+	if strings.EqualFold(name, FavoritesSelectionName) {
+		// Taken by the favorites, even before they exist.
+		return nil, fmt.Errorf("create selection: %w", ErrSelectionNameTaken)
+	}
+	selection := Selection{
+		GalleryID: galleryId,
+		Proofer:   proofer,
+		Name:      name,
+	}
+	row := svc.DB.QueryRow(`
+		INSERT INTO selections (gallery_id, user_id, share_link_id, name)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id;
+	`, galleryId, nullableId(proofer.UserID), nullableId(uint(proofer.ShareLinkID)), name)
+	err := row.Scan(&selection.ID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return nil, fmt.Errorf("create selection: %w", ErrSelectionNameTaken)
+		}
+		return nil, fmt.Errorf("create selection: %w", err)
+	}
+	return &selection, nil
+}
+
+// Adds the image to the favorites of the proofer, or removes it when
+// favorite is false. Returns ErrNotFound if the gallery has no such image.
+func (svc *ProofingService) Favorite(galleryId int, proofer Proofer, filename string, favorite bool) error {
+	if !favorite {
+		_, err := svc.DB.Exec(`
+			DELETE FROM selection_images
+			WHERE filename = $4 AND selection_id IN (
+				SELECT id
+				FROM selections
+				WHERE gallery_id = $1 AND favorites
+					AND user_id IS NOT DISTINCT FROM $2
+					AND share_link_id IS NOT DISTINCT FROM $3
+			);
+		`, galleryId, nullableId(proofer.UserID), nullableId(uint(proofer.ShareLinkID)), filename)
+		if err != nil {
+			return fmt.Errorf("favorite: %w", err)
+		}
+		return nil
+	}
+	err := svc.checkImage(galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("favorite: %w", err)
+	}
+	// The update makes RETURNING work when the favorites already exist.
+	var selectionId int
+	row := svc.DB.QueryRow(`
+		INSERT INTO selections (gallery_id, user_id, share_link_id, name, favorites)
+		VALUES ($1, $2, $3, $4, TRUE)
+		ON CONFLICT (gallery_id, COALESCE(user_id, 0), COALESCE(share_link_id, 0)) WHERE favorites
+		DO UPDATE SET favorites = TRUE
+		RETURNING id;
+	`, galleryId, nullableId(proofer.UserID), nullableId(uint(proofer.ShareLinkID)), FavoritesSelectionName)
+	err = row.Scan(&selectionId)
+	if err != nil {
+		return fmt.Errorf("favorite: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		INSERT INTO selection_images (selection_id, filename)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;
+	`, selectionId, filename)
+	if err != nil {
+		return fmt.Errorf("favorite: %w", err)
+	}
+	return nil
+}
+
+// Adds the image to the selection of the proofer, or updates its note if
+// it's in already. Returns ErrNotFound if the selection isn't the proofer's,
+// or if the gallery has no such image, and ErrNoteTooLong for long notes.
+func (svc *ProofingService) SetSelectionImage(selectionId int, proofer Proofer, filename, note string) error {
+	note = strings.TrimSpace(note)
+	if len(note) > selectionNoteMaxLength {
+		return fmt.Errorf("set selection image: %w", ErrNoteTooLong)
+	}
+	galleryId, err := svc.proofersSelection(selectionId, proofer)
+	if err != nil {
+		return fmt.Errorf("set selection image: %w", err)
+	}
+	err = svc.checkImage(galleryId, filename)
+	if err != nil {
+		return fmt.Errorf("set selection image: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		INSERT INTO selection_images (selection_id, filename, note)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (selection_id, filename) DO UPDATE
+		SET note = EXCLUDED.note;
+	`, selectionId, filename, note)
+	if err != nil {
+		return fmt.Errorf("set selection image: %w", err)
+	}
+	return nil
+}
+
+// Removes the image from the selection of the proofer. Returns ErrNotFound
+// if the selection isn't the proofer's.
+func (svc *ProofingService) RemoveSelectionImage(selectionId int, proofer Proofer, filename string) error {
+	_, err := svc.proofersSelection(selectionId, proofer)
+	if err != nil {
+		return fmt.Errorf("remove selection image: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		DELETE FROM selection_images
+		WHERE selection_id = $1 AND filename = $2;
+	`, selectionId, filename)
+	if err != nil {
+		return fmt.Errorf("remove selection image: %w", err)
+	}
+	return nil
+}
+
+// Submits the selection of the proofer to the photographer, and returns it.
+// Returns ErrNotFound if the selection isn't the proofer's.
+func (svc *ProofingService) SubmitSelection(selectionId int, proofer Proofer) (*Selection, error) {
+	galleryId, err := svc.proofersSelection(selectionId, proofer)
+	if err != nil {
+		return nil, fmt.Errorf("submit selection: %w", err)
+	}
+	_, err = svc.DB.Exec(`
+		UPDATE selections
+		SET submitted_at = NOW()
+		WHERE id = $1;
+	`, selectionId)
+	if err != nil {
+		return nil, fmt.Errorf("submit selection: %w", err)
+	}
+	selection, err := svc.SubmittedSelection(galleryId, selectionId)
+	if err != nil {
+		return nil, fmt.Errorf("submit selection: %w", err)
+	}
+	gallery, err := svc.GalleryService.GalleryById(galleryId)
+	if err != nil {
+		return nil, fmt.Errorf("submit selection: %w", err)
+	}
+	svc.record(gallery.historyUserId(), AuditSelectionSubmitted, map[string]any{
+		"gallery_id":   galleryId,
+		"selection_id": selectionId,
+		"name":         selection.Name,
+		"images":       len(selection.Images),
+	})
+	return selection, nil
+}
+
+// Returns the gallery of the selection, or ErrNotFound if the selection
+// isn't the proofer's.
+func (svc *ProofingService) proofersSelection(selectionId int, proofer Proofer) (int, error) {
+	var galleryId int
+	row := svc.DB.QueryRow(`
+		SELECT gallery_id
+		FROM selections
+		WHERE id = $1
+			AND user_id IS NOT DISTINCT FROM $2
+			AND share_link_id IS NOT DISTINCT FROM $3;
+	`, selectionId, nullableId(proofer.UserID), nullableId(uint(proofer.ShareLinkID)))
+	err := row.Scan(&galleryId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	return galleryId, nil
+}
+
+// Returns ErrNotFound unless the gallery has an image named filename.
+func (svc *ProofingService) checkImage(galleryId int, filename string) error {
+	if filename == "" || filename != filepath.Base(filename) || strings.HasPrefix(filename, ".") {
+		return ErrNotFound
+	}
+	_, err := svc.GalleryService.Image(galleryId, filename)
+	return err
+}
+
+func (svc *ProofingService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
+
+// Writes the images of the selection as CSV: a header, then the filename and
+// note of each image.
+func WriteSelectionCSV(w io.Writer, selection *Selection) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"filename", "note"})
+	if err != nil {
+		return fmt.Errorf("selection csv: %w", err)
+	}
+	for _, image := range selection.Images {
+		err = writer.Write([]string{image.Filename, image.Note})
+		if err != nil {
+			return fmt.Errorf("selection csv: %w", err)
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return fmt.Errorf("selection csv: %w", err)
+	}
+	return nil
+}
+
+// The images of the selection as a Lightroom filter: their names without
+// extension (so that RAW files match too), separated by commas. Pasted in the
+// Library Filter, as Text > Filename > Contains, it shows those images.
+func LightroomFilter(selection *Selection) string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, image := range selection.Images {
+		name := strings.TrimSuffix(image.Filename, filepath.Ext(image.Filename))
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// An email to the photographer about a submitted selection, sent by
+// EmailService.SelectionSubmitted.
+type SelectionSubmittedNotice struct {
+	GalleryTitle  string
+	SelectionName string
+	ProoferName   string // email of the user, or label of the share link
+	Images        int    // how many
+	URL           string // of the selections of the gallery
+}
+
+var selectionSubmittedTextTemplate = texttemplate.Must(texttemplate.New("selection").Parse(`{{.ProoferName}} submitted "{{.SelectionName}}" ({{.Images}} images) in your gallery "{{.GalleryTitle}}".
+
+See it, and export it as CSV or for Lightroom: {{.URL}}
+`))
+
+var selectionSubmittedHTMLTemplate = htmltemplate.Must(htmltemplate.New("selection").Parse(`<h1>{{.ProoferName}} submitted a selection</h1>
+<p>{{.ProoferName}} submitted "{{.SelectionName}}" ({{.Images}} images) in your gallery "{{.GalleryTitle}}".</p>
+<p><a href="{{.URL}}">See it</a>, and export it as CSV or for Lightroom.</p>
+`))
+
+func (es *EmailService) SelectionSubmitted(to string, notice SelectionSubmittedNotice) error {
+	var plainText, html bytes.Buffer
+	err := selectionSubmittedTextTemplate.Execute(&plainText, notice)
+	if err != nil {
+		return fmt.Errorf("selection submitted email: %w", err)
+	}
+	err = selectionSubmittedHTMLTemplate.Execute(&html, notice)
+	if err != nil {
+		return fmt.Errorf("selection submitted email: %w", err)
+	}
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   fmt.Sprintf("New selection in %s", notice.GalleryTitle),
+		PlainText: strings.TrimSpace(plainText.String()),
+		HTML:      html.String(),
+	}
+	err = es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
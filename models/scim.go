@@ -0,0 +1,466 @@
+package models
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lifebalance/lenslocked/rand"
+)
+
+const DefaultSCIMListLimit = 100
+
+// An account managed by an organization's identity provider, as SCIM sees it.
+type SCIMUser struct {
+	ID         uint
+	Email      string // the SCIM userName
+	ExternalID string // the ID of the identity provider
+	Active     bool
+	Role       string // in the organization, i.e. the SCIM group
+	CreatedAt  time.Time
+}
+
+// A filter of SCIM lists, e.g. `userName eq "bob@example.com"`.
+type SCIMFilter struct {
+	Attribute string // e.g. "userName", "externalId"
+	Operator  string // "eq", "ne", "co", "sw", "ew" or "pr"
+	Value     string
+}
+
+// The columns the SCIM user attributes that can be filtered on are stored in
+// (lowercase, since SCIM attribute names are case insensitive).
+var scimUserColumns = map[string]string{
+	"id":           "users.id::text",
+	"username":     "users.email",
+	"emails":       "users.email",
+	"emails.value": "users.email",
+	"externalid":   "users.scim_external_id",
+}
+
+/*
+SCIMService lets the identity provider of an organization (Okta, Entra ID...)
+provision its users through SCIM 2.0. Each organization has its own bearer
+token.
+
+Provisioned accounts are managed by the organization: they are members of it,
+and the identity provider can change their email, disable them (e.g. when
+somebody leaves the studio) and enable them again. Their galleries are never
+deleted through SCIM.
+
+Only the accounts created through SCIM are managed. Existing accounts, even
+those of members of the organization, belong to their users: provisioning
+their address fails with ErrEmailTaken.
+
+The roles of the organization are the SCIM groups.
+*/
+type SCIMService struct {
+	DB                  *sql.DB
+	UserService         *UserService
+	SessionService      *SessionService
+	OrganizationService *OrganizationService
+	BytesPerToken       int // Defaults to MinBytesPerToken
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (svc *SCIMService) WithActor(actor Actor) *SCIMService {
+	withActor := *svc
+	withActor.Actor = actor
+	withActor.UserService = svc.UserService.WithActor(actor)
+	withActor.SessionService = svc.SessionService.WithActor(actor)
+	withActor.OrganizationService = svc.OrganizationService.WithActor(actor)
+	return &withActor
+}
+
+// Creates the SCIM token of the organization, replacing the previous one.
+func (svc *SCIMService) CreateToken(organizationId uint) (string, error) {
+	token, err := rand.RandomBase64String(max(MinBytesPerToken, svc.BytesPerToken))
+	if err != nil {
+		return "", fmt.Errorf("create scim token: %w", err)
+	}
+	err = svc.setTokenHash(organizationId, svc.hashToken(token))
+	if err != nil {
+		return "", fmt.Errorf("create scim token: %w", err)
+	}
+	svc.record(svc.Actor.UserID, AuditSCIMTokenCreated, map[string]any{
+		"organization_id": organizationId,
+	})
+	return token, nil
+}
+
+// Revokes the SCIM token of the organization, which turns provisioning off.
+func (svc *SCIMService) RevokeToken(organizationId uint) error {
+	err := svc.setTokenHash(organizationId, nil)
+	if err != nil {
+		return fmt.Errorf("revoke scim token: %w", err)
+	}
+	svc.record(svc.Actor.UserID, AuditSCIMTokenRevoked, map[string]any{
+		"organization_id": organizationId,
+	})
+	return nil
+}
+
+func (svc *SCIMService) setTokenHash(organizationId uint, tokenHash any) error {
+	result, err := svc.DB.Exec(`
+		UPDATE organizations
+		SET scim_token_hash = $2
+		WHERE id = $1;
+	`, organizationId, tokenHash)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Whether the organization has a SCIM token.
+func (svc *SCIMService) Enabled(organizationId uint) (bool, error) {
+	var enabled bool
+	row := svc.DB.QueryRow(`
+		SELECT scim_token_hash IS NOT NULL
+		FROM organizations
+		WHERE id = $1;
+	`, organizationId)
+	err := row.Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("scim enabled: %w", err)
+	}
+	return enabled, nil
+}
+
+// The organization of the token. Returns ErrNotFound for unknown tokens.
+func (svc *SCIMService) Organization(token string) (*Organization, error) {
+	var org Organization
+	row := svc.DB.QueryRow(`
+		SELECT id, name, created_at
+		FROM organizations
+		WHERE scim_token_hash = $1;
+	`, svc.hashToken(token))
+	err := row.Scan(&org.ID, &org.Name, &org.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("scim organization: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("scim organization: %w", err)
+	}
+	return &org, nil
+}
+
+const scimUserColumnsSQL = `
+	users.id, users.email, COALESCE(users.scim_external_id, ''),
+	users.disabled_at IS NULL, COALESCE(organization_members.role, ''),
+	users.created_at`
+
+const scimUserFromSQL = `
+	FROM users
+		LEFT JOIN organization_members ON organization_members.user_id = users.id
+			AND organization_members.organization_id = users.scim_organization_id`
+
+// A *sql.Row, or *sql.Rows.
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSCIMUser(row scanner) (*SCIMUser, error) {
+	var user SCIMUser
+	err := row.Scan(&user.ID, &user.Email, &user.ExternalID, &user.Active, &user.Role, &user.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// The users managed by the organization, matching the filter (if not nil),
+// by ID. Also returns how many users match in total.
+func (svc *SCIMService) Users(organizationId uint, filter *SCIMFilter, offset, limit int) ([]SCIMUser, int, error) {
+	if limit <= 0 {
+		limit = DefaultSCIMListLimit
+	}
+	where := "users.scim_organization_id = $1"
+	args := []any{organizationId}
+	if filter != nil {
+		column, ok := scimUserColumns[strings.ToLower(filter.Attribute)]
+		if !ok {
+			return nil, 0, fmt.Errorf("scim users: %w", ErrInvalidSCIMFilter)
+		}
+		condition, arg, err := scimCondition(column, filter)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scim users: %w", err)
+		}
+		if arg != nil {
+			args = append(args, arg)
+			condition = fmt.Sprintf(condition, len(args))
+		}
+		where += " AND " + condition
+	}
+	var total int
+	row := svc.DB.QueryRow("SELECT COUNT(*) FROM users WHERE "+where, args...)
+	err := row.Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("scim users: %w", err)
+	}
+	query := "SELECT " + scimUserColumnsSQL + scimUserFromSQL + "\n\tWHERE " + where +
+		fmt.Sprintf("\n\tORDER BY users.id\n\tLIMIT $%d OFFSET $%d;", len(args)+1, len(args)+2)
+	rows, err := svc.DB.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("scim users: %w", err)
+	}
+	defer rows.Close()
+	var users []SCIMUser
+	for rows.Next() {
+		user, err := scanSCIMUser(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("scim users: %w", err)
+		}
+		users = append(users, *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("scim users: %w", err)
+	}
+	return users, total, nil
+}
+
+// Returns the SQL condition of the filter on column, with a %d placeholder
+// for its argument (nil for "pr").
+func scimCondition(column string, filter *SCIMFilter) (string, any, error) {
+	// Emails are stored in lowercase, and SCIM compares strings case
+	// insensitively unless the attribute says otherwise.
+	switch strings.ToLower(filter.Operator) {
+	case "eq":
+		return "LOWER(" + column + ") = LOWER($%d)", filter.Value, nil
+	case "ne":
+		return "LOWER(" + column + ") IS DISTINCT FROM LOWER($%d)", filter.Value, nil
+	case "co":
+		return column + " ILIKE $%d", "%" + escapeLike(filter.Value) + "%", nil
+	case "sw":
+		return column + " ILIKE $%d", escapeLike(filter.Value) + "%", nil
+	case "ew":
+		return column + " ILIKE $%d", "%" + escapeLike(filter.Value), nil
+	case "pr":
+		return column + " IS NOT NULL", nil, nil
+	}
+	return "", nil, ErrInvalidSCIMFilter
+}
+
+// A user managed by the organization. Returns ErrNotFound otherwise.
+func (svc *SCIMService) User(organizationId, userId uint) (*SCIMUser, error) {
+	row := svc.DB.QueryRow("SELECT "+scimUserColumnsSQL+scimUserFromSQL+`
+		WHERE users.id = $1 AND users.scim_organization_id = $2;`, userId, organizationId)
+	user, err := scanSCIMUser(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("scim user: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("scim user: %w", err)
+	}
+	return user, nil
+}
+
+// Provisions a user: creates their account (without a password: they sign in
+// with the identity provider or a magic link) and makes them a member of the
+// organization. Returns ErrEmailTaken if there's already an account with the
+// address.
+func (svc *SCIMService) CreateUser(organizationId uint, user SCIMUser) (*SCIMUser, error) {
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+	if !strings.Contains(user.Email, "@") {
+		return nil, fmt.Errorf("create scim user: %w: userName must be an email", ErrInvalidSCIMUser)
+	}
+	tx, err := svc.DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("create scim user: %w", err)
+	}
+	defer tx.Rollback()
+	row := tx.QueryRow(`
+		INSERT INTO users (email, password_hash, scim_organization_id, scim_external_id)
+		VALUES ($1, '', $2, NULLIF($3, ''))
+		ON CONFLICT (email) DO NOTHING
+		RETURNING id;
+	`, user.Email, organizationId, user.ExternalID)
+	err = row.Scan(&user.ID)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.Is(err, sql.ErrNoRows) ||
+			(errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation) {
+			return nil, fmt.Errorf("create scim user: %w", ErrEmailTaken)
+		}
+		return nil, fmt.Errorf("create scim user: %w", err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO organization_members (organization_id, user_id, role)
+		VALUES ($1, $2, $3);
+	`, organizationId, user.ID, OrgRoleMember)
+	if err != nil {
+		return nil, fmt.Errorf("create scim user: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("create scim user: %w", err)
+	}
+	svc.record(user.ID, AuditUserCreated, map[string]any{
+		"email":                user.Email,
+		"scim_organization_id": organizationId,
+	})
+	svc.record(user.ID, AuditSCIMUserProvisioned, map[string]any{
+		"organization_id": organizationId,
+		"external_id":     user.ExternalID,
+	})
+	if !user.Active {
+		err = svc.Deprovision(organizationId, user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("create scim user: %w", err)
+		}
+	}
+	return svc.User(organizationId, user.ID)
+}
+
+// Replaces the email, external ID and status of a user managed by the
+// organization (created through SCIM, see CreateUser). Returns ErrNotFound
+// for other accounts.
+func (svc *SCIMService) UpdateUser(organizationId uint, user SCIMUser) (*SCIMUser, error) {
+	current, err := svc.User(organizationId, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("update scim user: %w", err)
+	}
+	user.Email = strings.ToLower(strings.TrimSpace(user.Email))
+	if !strings.Contains(user.Email, "@") {
+		return nil, fmt.Errorf("update scim user: %w: userName must be an email", ErrInvalidSCIMUser)
+	}
+	if user.Email != current.Email {
+		err = svc.UserService.UpdateEmail(user.ID, user.Email)
+		if err != nil {
+			return nil, fmt.Errorf("update scim user: %w", err)
+		}
+	}
+	if user.ExternalID != current.ExternalID {
+		_, err = svc.DB.Exec(`
+			UPDATE users
+			SET scim_external_id = NULLIF($2, '')
+			WHERE id = $1;
+		`, user.ID, user.ExternalID)
+		if err != nil {
+			return nil, fmt.Errorf("update scim user: %w", err)
+		}
+	}
+	switch {
+	case user.Active && !current.Active:
+		err = svc.UserService.Enable(user.ID)
+	case !user.Active && current.Active:
+		err = svc.Deprovision(organizationId, user.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("update scim user: %w", err)
+	}
+	return svc.User(organizationId, user.ID)
+}
+
+// Deprovisions a user managed by the organization: their account is disabled
+// and signed out everywhere. Nothing is deleted, so they can be provisioned
+// again (made active) later.
+func (svc *SCIMService) Deprovision(organizationId, userId uint) error {
+	_, err := svc.User(organizationId, userId)
+	if err != nil {
+		return fmt.Errorf("deprovision scim user: %w", err)
+	}
+	err = svc.UserService.Disable(userId)
+	if err != nil {
+		return fmt.Errorf("deprovision scim user: %w", err)
+	}
+	err = svc.SessionService.DeleteForUser(userId)
+	if err != nil {
+		return fmt.Errorf("deprovision scim user: %w", err)
+	}
+	return nil
+}
+
+// A SCIM group: the users managed by the organization with one of its roles.
+type SCIMGroup struct {
+	Role    string // also the ID and display name of the group
+	Members []SCIMUser
+}
+
+// The groups of the organization: one per role.
+func (svc *SCIMService) Groups(organizationId uint) ([]SCIMGroup, error) {
+	rows, err := svc.DB.Query("SELECT "+scimUserColumnsSQL+scimUserFromSQL+`
+		WHERE users.scim_organization_id = $1
+		ORDER BY users.id;`, organizationId)
+	if err != nil {
+		return nil, fmt.Errorf("scim groups: %w", err)
+	}
+	defer rows.Close()
+	members := make(map[string][]SCIMUser)
+	for rows.Next() {
+		user, err := scanSCIMUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scim groups: %w", err)
+		}
+		members[user.Role] = append(members[user.Role], *user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("scim groups: %w", err)
+	}
+	var groups []SCIMGroup
+	for _, role := range OrgRoles {
+		groups = append(groups, SCIMGroup{
+			Role:    role,
+			Members: members[role],
+		})
+	}
+	return groups, nil
+}
+
+// Gives the role of the group to a user managed by the organization.
+func (svc *SCIMService) AddToGroup(organizationId uint, role string, userId uint) error {
+	if !validOrgRole(role) {
+		return fmt.Errorf("add to scim group: %w", ErrNotFound)
+	}
+	_, err := svc.User(organizationId, userId)
+	if err != nil {
+		return fmt.Errorf("add to scim group: %w", err)
+	}
+	err = svc.OrganizationService.SetRole(organizationId, userId, role)
+	if err != nil {
+		return fmt.Errorf("add to scim group: %w", err)
+	}
+	return nil
+}
+
+// Takes the role of the group from a user managed by the organization: they
+// become a simple member. Users can't be removed from the member group (they
+// are deprovisioned instead).
+func (svc *SCIMService) RemoveFromGroup(organizationId uint, role string, userId uint) error {
+	if !validOrgRole(role) {
+		return fmt.Errorf("remove from scim group: %w", ErrNotFound)
+	}
+	if role == OrgRoleMember {
+		return fmt.Errorf("remove from scim group: %w", ErrInvalidSCIMUser)
+	}
+	user, err := svc.User(organizationId, userId)
+	if err != nil {
+		return fmt.Errorf("remove from scim group: %w", err)
+	}
+	if user.Role != role {
+		return nil
+	}
+	err = svc.OrganizationService.SetRole(organizationId, userId, OrgRoleMember)
+	if err != nil {
+		return fmt.Errorf("remove from scim group: %w", err)
+	}
+	return nil
+}
+
+func (svc *SCIMService) hashToken(token string) string {
+	tokenHash := sha256.Sum256([]byte(token))
+	return base64.URLEncoding.EncodeToString(tokenHash[:])
+}
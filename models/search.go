@@ -0,0 +1,254 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultSearchLimit = 20
+	tagMaxLength       = 30
+	tagsMaxCount       = 20
+)
+
+// Around the matches in the snippets returned by Postgres (private use
+// characters, which real text doesn't have).
+const (
+	snippetMatchStart = "\ue000"
+	snippetMatchStop  = "\ue001"
+)
+
+// Parses comma separated tags, e.g. "Beach, #sunset,  family " gives
+// "beach", "sunset" and "family". Doesn't check their length or count (see
+// normalizeTags).
+func ParseTags(text string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, tag := range strings.Split(text, ",") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		tag = strings.TrimSpace(strings.TrimLeft(tag, "#"))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// Normalizes the tags like ParseTags, and returns ErrInvalidTags if there
+// are too many of them or some are too long.
+func normalizeTags(tags []string) ([]string, error) {
+	tags = ParseTags(strings.Join(tags, ","))
+	if len(tags) > tagsMaxCount {
+		return nil, fmt.Errorf("%w: more than %d tags", ErrInvalidTags, tagsMaxCount)
+	}
+	for _, tag := range tags {
+		if utf8.RuneCountInString(tag) > tagMaxLength {
+			return nil, fmt.Errorf("%w: %q is too long", ErrInvalidTags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// What to search for. Zero values don't filter, but there has to be some
+// text or some tags.
+type SearchQuery struct {
+	Text   string   // words, "quoted phrases", -excluded words, or (web search syntax)
+	Tags   []string // results have all of them
+	UserID uint     // who is searching (0 if nobody is signed in)
+	Limit  int      // Defaults to DefaultSearchLimit
+	Offset int
+}
+
+// A gallery, or an image of a gallery (Filename isn't empty), matching a
+// search.
+type SearchResult struct {
+	Gallery  Gallery
+	Filename string
+	Title    []SnippetPart // of the gallery, with the matches highlighted
+	Snippet  []SnippetPart // of the description or caption
+	Tags     []string      // of the gallery or image
+	Rank     float64
+}
+
+// Part of a snippet: a match, or the text around it.
+type SnippetPart struct {
+	Text  string
+	Match bool
+}
+
+// How often a tag is used, in galleries and images.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+/*
+SearchService searches galleries and images, by text (Postgres full-text
+search over titles, descriptions, captions and tags) and by tags.
+
+Only galleries the user may see show up: public ones, and those the user can
+edit (their own and their organizations'). Unlisted galleries are only for
+those who have the link, so they aren't searchable.
+*/
+type SearchService struct {
+	DB *sql.DB
+}
+
+// Galleries visible to the user $1, with the handle of their owner. (NOT
+// MATERIALIZED, so that the GIN indexes are used.)
+const searchableGalleries = `
+	searchable AS NOT MATERIALIZED (
+		SELECT galleries.*, COALESCE(users.handle, '') AS handle
+		FROM galleries
+			LEFT JOIN users ON users.id = galleries.user_id
+		WHERE users.disabled_at IS NULL
+			AND ((` + galleryVisibilitySQL + ` = 'public' AND ` + galleryLiveSQL + `)
+				OR galleries.user_id = $1
+				OR galleries.organization_id IN (
+					SELECT organization_id
+					FROM organization_members
+					WHERE user_id = $1
+				))
+	)`
+
+// The best matches first, galleries and images mixed.
+func (svc *SearchService) Search(query SearchQuery) ([]SearchResult, error) {
+	query.Text = strings.TrimSpace(query.Text)
+	query.Tags = ParseTags(strings.Join(query.Tags, ","))
+	if query.Text == "" && len(query.Tags) == 0 {
+		return nil, nil
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+	headline := fmt.Sprintf(`StartSel=%s, StopSel=%s, MaxWords=35, MinWords=15, MaxFragments=2, FragmentDelimiter=" … "`,
+		snippetMatchStart, snippetMatchStop)
+	titleHeadline := fmt.Sprintf("StartSel=%s, StopSel=%s, HighlightAll=true",
+		snippetMatchStart, snippetMatchStop)
+	rows, err := svc.DB.Query(`
+		WITH `+searchableGalleries+`,
+		query AS (
+			SELECT websearch_to_tsquery('english', $2) AS q
+		)
+		SELECT searchable.id, searchable.title, searchable.slug, searchable.handle,
+			'' AS filename,
+			ts_rank(searchable.search_vector, query.q) AS rank,
+			ts_headline('english', searchable.title, query.q, $7),
+			ts_headline('english', searchable.description, query.q, $6),
+			array_to_string(searchable.tags, ',')
+		FROM searchable, query
+		WHERE ($2 = '' OR searchable.search_vector @@ query.q)
+			AND searchable.tags @> string_to_array($3, ',')
+		UNION ALL
+		SELECT searchable.id, searchable.title, searchable.slug, searchable.handle,
+			images.filename,
+			ts_rank(images.search_vector, query.q) AS rank,
+			searchable.title,
+			ts_headline('english', images.caption, query.q, $6),
+			array_to_string(images.tags, ',')
+		FROM images
+			JOIN searchable ON searchable.id = images.gallery_id,
+			query
+		WHERE ($2 = '' OR images.search_vector @@ query.q)
+			AND (images.tags || searchable.tags) @> string_to_array($3, ',')
+		ORDER BY rank DESC, id DESC, filename
+		LIMIT $4 OFFSET $5;
+	`, query.UserID, query.Text, strings.Join(query.Tags, ","), limit, query.Offset,
+		headline, titleHeadline)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var result SearchResult
+		var title, snippet, tags string
+		err := rows.Scan(
+			&result.Gallery.ID,
+			&result.Gallery.Title,
+			&result.Gallery.Slug,
+			&result.Gallery.Handle,
+			&result.Filename,
+			&result.Rank,
+			&title,
+			&snippet,
+			&tags,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("search: %w", err)
+		}
+		result.Title = parseSnippet(title)
+		result.Snippet = parseSnippet(snippet)
+		result.Tags = ParseTags(tags)
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	return results, nil
+}
+
+// The most used tags in the galleries the user may see (and their images),
+// to filter searches with.
+func (svc *SearchService) PopularTags(userId uint, limit int) ([]TagCount, error) {
+	rows, err := svc.DB.Query(`
+		WITH `+searchableGalleries+`
+		SELECT tag, count(*)
+		FROM (
+			SELECT unnest(searchable.tags) AS tag
+			FROM searchable
+			UNION ALL
+			SELECT unnest(images.tags)
+			FROM images
+				JOIN searchable ON searchable.id = images.gallery_id
+		) AS tags
+		GROUP BY tag
+		ORDER BY count(*) DESC, tag
+		LIMIT $2;
+	`, userId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("popular tags: %w", err)
+	}
+	defer rows.Close()
+	var tags []TagCount
+	for rows.Next() {
+		var tag TagCount
+		err := rows.Scan(&tag.Tag, &tag.Count)
+		if err != nil {
+			return nil, fmt.Errorf("popular tags: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("popular tags: %w", err)
+	}
+	return tags, nil
+}
+
+// Splits a snippet from ts_headline into matches and the text around them.
+func parseSnippet(snippet string) []SnippetPart {
+	var parts []SnippetPart
+	for snippet != "" {
+		start := strings.Index(snippet, snippetMatchStart)
+		if start == -1 {
+			parts = append(parts, SnippetPart{Text: snippet})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, SnippetPart{Text: snippet[:start]})
+		}
+		snippet = snippet[start+len(snippetMatchStart):]
+		stop := strings.Index(snippet, snippetMatchStop)
+		if stop == -1 {
+			stop = len(snippet)
+		}
+		parts = append(parts, SnippetPart{Text: snippet[:stop], Match: true})
+		snippet = strings.TrimPrefix(snippet[stop:], snippetMatchStop)
+	}
+	return parts
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	check := func(text string, want ...string) {
+		t.Helper()
+		if got := ParseTags(text); !reflect.DeepEqual(got, want) {
+			t.Errorf("ParseTags(%q) = %q, want %q", text, got, want)
+		}
+	}
+	check("")
+	check(",, #, ")
+	check("beach", "beach")
+	check("Beach, #sunset,  family ", "beach", "sunset", "family")
+	check("  New   York , ##nyc", "new york", "nyc")
+	check("beach, BEACH, #beach", "beach")
+	check("été", "été")
+}
+
+func TestParseSnippet(t *testing.T) {
+	// How the snippets come out of ts_headline.
+	mark := func(text string) string {
+		return snippetMatchStart + text + snippetMatchStop
+	}
+	text := func(text string) SnippetPart { return SnippetPart{Text: text} }
+	match := func(text string) SnippetPart { return SnippetPart{Text: text, Match: true} }
+
+	if got := parseSnippet(""); got != nil {
+		t.Errorf("parseSnippet of an empty snippet = %+v, want nil", got)
+	}
+	snippets := map[string][]SnippetPart{
+		"sunset at the beach":                        {text("sunset at the beach")},
+		"sunset at the " + mark("beach") + " in May": {text("sunset at the "), match("beach"), text(" in May")},
+		mark("sunset") + " at the " + mark("beach"):  {match("sunset"), text(" at the "), match("beach")},
+		mark("sun") + mark("set"):                    {match("sun"), match("set")},
+		"the " + snippetMatchStart + "beach":         {text("the "), match("beach")}, // unterminated
+	}
+	for snippet, want := range snippets {
+		if got := parseSnippet(snippet); !reflect.DeepEqual(got, want) {
+			t.Errorf("parseSnippet(%q) = %+v, want %+v", snippet, got, want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Kinds of security notices. Users can opt out of each of them (see
+// NotificationService).
+const (
+	NoticeNewDevice        = "new_device"
+	NoticePasswordChanged  = "password_changed"
+	NoticeEmailChanged     = "email_changed"
+	NoticeTwoFactorChanged = "two_factor_changed"
+	NoticeAccountLocked    = "account_locked"
+)
+
+// The kinds of notices users can choose from, in the order they are shown in
+// the settings. NoticeTwoFactorChanged joins them once there's two-factor
+// authentication to change.
+var NoticeKinds = []string{
+	NoticeNewDevice,
+	NoticePasswordChanged,
+	NoticeEmailChanged,
+	NoticeAccountLocked,
+}
+
+// What the user reads about each kind of notice: in the settings (Label), and
+// in the email (Subject, Summary).
+type noticeText struct {
+	Label   string
+	Subject string
+	Summary string
+}
+
+var noticeTexts = map[string]noticeText{
+	NoticeNewDevice: {
+		Label:   "Sign in from a new device",
+		Subject: "New sign in to your account",
+		Summary: "Your LensLocked account was just signed in to from a device we haven't seen before.",
+	},
+	NoticePasswordChanged: {
+		Label:   "Password changes",
+		Subject: "Your password was changed",
+		Summary: "The password of your LensLocked account was just changed, and you were signed out everywhere.",
+	},
+	NoticeEmailChanged: {
+		Label:   "Email address changes",
+		Subject: "Your email address was changed",
+		Summary: "The email address of your LensLocked account was just changed.",
+	},
+	NoticeTwoFactorChanged: {
+		Label:   "Two-factor authentication changes",
+		Subject: "Your two-factor authentication settings changed",
+		Summary: "The two-factor authentication settings of your LensLocked account were just changed.",
+	},
+	NoticeAccountLocked: {
+		Label:   "Account locked after failed sign ins",
+		Subject: "Your account was locked",
+		Summary: "Your LensLocked account was temporarily locked after too many failed sign in attempts.",
+	},
+}
+
+// Label of a kind of notice, for the settings page.
+func NoticeLabel(kind string) string {
+	return noticeTexts[kind].Label
+}
+
+// A security notice, sent by EmailService.SecurityNotice.
+type SecurityNotice struct {
+	Kind      string
+	Time      time.Time
+	IP        string
+	UserAgent string
+	Details   string // e.g. the new email address
+	NotMeURL  string // "This wasn't me" link: revokes sessions, starts a reset
+}
+
+var noticeTextTemplate = texttemplate.Must(texttemplate.New("notice").Parse(`{{.Summary}}
+{{if .Details}}
+{{.Details}}
+{{end}}
+When: {{.When}}
+{{- if .IP}}
+IP address: {{.IP}}{{end}}
+{{- if .UserAgent}}
+Browser: {{.UserAgent}}{{end}}
+
+If this was you, there's nothing to do.
+
+This wasn't you? Sign out everywhere and reset your password: {{.NotMeURL}}
+
+You can choose which notices you get in your account settings.
+`))
+
+var noticeHTMLTemplate = htmltemplate.Must(htmltemplate.New("notice").Parse(`<h1>{{.Subject}}</h1>
+<p>{{.Summary}}</p>
+{{if .Details}}<p>{{.Details}}</p>{{end}}
+<ul>
+  <li>When: {{.When}}</li>
+  {{if .IP}}<li>IP address: {{.IP}}</li>{{end}}
+  {{if .UserAgent}}<li>Browser: {{.UserAgent}}</li>{{end}}
+</ul>
+<p>If this was you, there's nothing to do.</p>
+<p>This wasn't you? <a href="{{.NotMeURL}}">Sign out everywhere and reset your password</a>.</p>
+<p><small>You can choose which notices you get in your account settings.</small></p>
+`))
+
+func (es *EmailService) SecurityNotice(to string, notice SecurityNotice) error {
+	text, ok := noticeTexts[notice.Kind]
+	if !ok {
+		return fmt.Errorf("security notice: unknown kind %q", notice.Kind)
+	}
+	data := struct {
+		SecurityNotice
+		Subject string
+		Summary string
+		When    string
+	}{
+		SecurityNotice: notice,
+		Subject:        text.Subject,
+		Summary:        text.Summary,
+		When:           notice.Time.UTC().Format("January 2, 2006 at 15:04 MST"),
+	}
+	var plainText, html bytes.Buffer
+	err := noticeTextTemplate.Execute(&plainText, data)
+	if err != nil {
+		return fmt.Errorf("security notice: %w", err)
+	}
+	err = noticeHTMLTemplate.Execute(&html, data)
+	if err != nil {
+		return fmt.Errorf("security notice: %w", err)
+	}
+	msg := Email{
+		From:      DefaultSender,
+		To:        to,
+		Subject:   text.Subject,
+		PlainText: strings.TrimSpace(plainText.String()),
+		HTML:      html.String(),
+	}
+	err = es.Send(msg)
+	if err != nil {
+		return fmt.Errorf("error sending email %w", err)
+	}
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/lifebalance/lenslocked/rand"
 )
@@ -43,6 +45,14 @@ type Session struct {
 type SessionService struct {
 	DB            *sql.DB
 	BytesPerToken int
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (ss *SessionService) WithActor(actor Actor) *SessionService {
+	withActor := *ss
+	withActor.Actor = actor
+	return &withActor
 }
 
 func (ss *SessionService) Upsert(userId uint) (*Session, error) {
@@ -81,19 +91,26 @@ func (ss *SessionService) Upsert(userId uint) (*Session, error) {
 	// 	`, userId, session.TokenHash)
 	// 	err = row.Scan(&session.ID)
 	// }
+	// Disabled accounts don't get a session, whatever way they signed in.
 	row := ss.DB.QueryRow(`
 		INSERT INTO sessions (user_id, token_hash)
-		VALUES ($1, $2)
+		SELECT id, $2
+		FROM users
+		WHERE id = $1 AND disabled_at IS NULL
 		ON CONFLICT (user_id) DO
 		UPDATE
-		SET token_hash = $2
+		SET token_hash = $2, authenticated_at = NOW()
 		RETURNING id;
 	`, userId, session.TokenHash)
 	err = row.Scan(&session.ID)
 
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("create: %w", ErrAccountDisabled)
+		}
 		return nil, fmt.Errorf("create %w", err)
 	}
+	ss.record(session.UserID, AuditSessionCreated, nil)
 	// return the session
 	return &session, nil
 }
@@ -105,12 +122,21 @@ func (ss *SessionService) User(token string) (*User, error) {
 	// find details of the logged-in user, using the hashed token.
 	var user User
 	row := ss.DB.QueryRow(`
-		SELECT users.id, users.email, users.password_hash
+		SELECT users.id, users.email, users.password_hash, users.role,
+			COALESCE(users.handle, ''), users.display_name, users.avatar
 		FROM sessions
 		JOIN users ON users.id = sessions.user_id
-		WHERE sessions.token_hash = $1;
+		WHERE sessions.token_hash = $1 AND users.disabled_at IS NULL;
 	`, tokenHash)
-	err := row.Scan(&user.ID, &user.Email, &user.PasswordHash)
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.PasswordHash,
+		&user.Role,
+		&user.Handle,
+		&user.DisplayName,
+		&user.Avatar,
+	)
 	if err != nil {
 		return nil, fmt.Errorf("user: %w", err)
 	}
@@ -118,15 +144,73 @@ func (ss *SessionService) User(token string) (*User, error) {
 	return &user, nil
 }
 
+// When the user last proved who they are (signed in, or confirmed their
+// password) in this session.
+func (ss *SessionService) AuthenticatedAt(token string) (time.Time, error) {
+	var authenticatedAt time.Time
+	row := ss.DB.QueryRow(`
+		SELECT authenticated_at
+		FROM sessions
+		WHERE token_hash = $1;
+	`, ss.hashToken(token))
+	err := row.Scan(&authenticatedAt)
+	if err != nil {
+		return authenticatedAt, fmt.Errorf("authenticated at: %w", err)
+	}
+	return authenticatedAt, nil
+}
+
+// Records that the user just proved who they are again, without starting a
+// new session.
+func (ss *SessionService) Reauthenticate(token string) error {
+	var userId uint
+	row := ss.DB.QueryRow(`
+		UPDATE sessions
+		SET authenticated_at = NOW()
+		WHERE token_hash = $1
+		RETURNING user_id;
+	`, ss.hashToken(token))
+	err := row.Scan(&userId)
+	if err != nil {
+		return fmt.Errorf("reauthenticate: %w", err)
+	}
+	ss.record(userId, AuditSessionReauthenticated, nil)
+	return nil
+}
+
 func (ss *SessionService) DeleteSession(token string) error {
 	tokenHash := ss.hashToken(token)
-	_, err := ss.DB.Exec(`
+	var userId uint
+	row := ss.DB.QueryRow(`
 		DELETE FROM sessions
-		WHERE token_hash = $1;
+		WHERE token_hash = $1
+		RETURNING user_id;
 	`, tokenHash)
+	err := row.Scan(&userId)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil // already signed out
+		}
 		return fmt.Errorf("delete: %w", err)
 	}
+	ss.record(userId, AuditSessionDeleted, nil)
+	return nil
+}
+
+// Signs the user out everywhere.
+func (ss *SessionService) DeleteForUser(userId uint) error {
+	result, err := ss.DB.Exec(`
+		DELETE FROM sessions
+		WHERE user_id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("delete for user: %w", err)
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("delete for user: %w", err)
+	}
+	ss.record(userId, AuditSessionsRevoked, map[string]any{"count": revoked})
 	return nil
 }
 
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Counts shown on the admin dashboard.
+type SystemStats struct {
+	Users            int
+	Admins           int
+	DisabledUsers    int
+	NewUsers         int // in the last 7 days
+	SignedInUsers    int // with a session
+	Galleries        int
+	PendingDeletions int // accounts scheduled for deletion
+	OpenInvitations  int // not used up nor expired
+	FailedSignIns    int // in the last 24 hours
+}
+
+type StatsService struct {
+	DB *sql.DB
+}
+
+func (svc *StatsService) Stats() (*SystemStats, error) {
+	var stats SystemStats
+	row := svc.DB.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM users),
+			(SELECT COUNT(*) FROM users WHERE role = $1),
+			(SELECT COUNT(*) FROM users WHERE disabled_at IS NOT NULL),
+			(SELECT COUNT(*) FROM users WHERE created_at > NOW() - INTERVAL '7 days'),
+			(SELECT COUNT(*) FROM sessions),
+			(SELECT COUNT(*) FROM galleries),
+			(SELECT COUNT(*) FROM account_deletions),
+			(SELECT COUNT(*) FROM invitations
+				WHERE organization_id IS NULL AND uses < max_uses AND expires_at > NOW()),
+			(SELECT COUNT(*) FROM audit_events
+				WHERE action = $2 AND created_at > NOW() - INTERVAL '24 hours');
+	`, RoleAdmin, AuditSignInFailed)
+	err := row.Scan(
+		&stats.Users,
+		&stats.Admins,
+		&stats.DisabledUsers,
+		&stats.NewUsers,
+		&stats.SignedInUsers,
+		&stats.Galleries,
+		&stats.PendingDeletions,
+		&stats.OpenInvitations,
+		&stats.FailedSignIns,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("system stats: %w", err)
+	}
+	return &stats, nil
+}
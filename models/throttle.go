@@ -0,0 +1,151 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultThrottleFreeHits  = 5
+	DefaultThrottleBaseDelay = 1 * time.Second
+	DefaultThrottleMaxDelay  = 15 * time.Minute
+	DefaultThrottleWindow    = 1 * time.Hour
+)
+
+// Returned (wrapped in a ThrottledError) when a key is being throttled.
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (te ThrottledError) Error() string {
+	return fmt.Sprintf("throttled: retry after %s", te.RetryAfter)
+}
+
+// So that errors.Is(err, ErrThrottled) works with ThrottledError values.
+func (te ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+/*
+ThrottleService keeps per-key hit counters in Postgres, so they are shared by
+every instance of the app. Keys are free-form strings, e.g.:
+
+  - "signin:email:bob@test.com"
+  - "signin:ip:10.0.0.1"
+
+The first FreeHits hits are free. After that, every hit blocks the key with an
+exponential backoff (BaseDelay, 2*BaseDelay, 4*BaseDelay...) capped at
+MaxDelay. Counters start over once a key has gone Window without any hits.
+*/
+type ThrottleService struct {
+	DB        *sql.DB
+	FreeHits  int           // Defaults to DefaultThrottleFreeHits
+	BaseDelay time.Duration // Defaults to DefaultThrottleBaseDelay
+	MaxDelay  time.Duration // Defaults to DefaultThrottleMaxDelay
+	Window    time.Duration // Defaults to DefaultThrottleWindow
+}
+
+// Returns a ThrottledError if any of the keys is currently blocked.
+func (ts *ThrottleService) Check(keys ...string) error {
+	var retryAfter time.Duration
+	for _, key := range keys {
+		var blockedUntil sql.NullTime
+		row := ts.DB.QueryRow(`
+			SELECT blocked_until
+			FROM throttles
+			WHERE key = $1;
+		`, key)
+		err := row.Scan(&blockedUntil)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return fmt.Errorf("check throttle: %w", err)
+		}
+		if blockedUntil.Valid {
+			retryAfter = max(retryAfter, time.Until(blockedUntil.Time))
+		}
+	}
+	if retryAfter > 0 {
+		return ThrottledError{RetryAfter: retryAfter.Round(time.Second)}
+	}
+	return nil
+}
+
+// Registers a hit for the key, blocking it if it ran out of free hits.
+// Returns the number of hits within the current window.
+func (ts *ThrottleService) Hit(key string) (int, error) {
+	window := ts.Window
+	if window <= 0 {
+		window = DefaultThrottleWindow
+	}
+	var hits int
+	row := ts.DB.QueryRow(`
+		INSERT INTO throttles (key, hits, updated_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO
+		UPDATE
+		SET hits = CASE
+				WHEN throttles.updated_at < $2 THEN 1
+				ELSE throttles.hits + 1
+			END,
+			updated_at = NOW()
+		RETURNING hits;
+	`, key, time.Now().Add(-window))
+	err := row.Scan(&hits)
+	if err != nil {
+		return 0, fmt.Errorf("hit throttle: %w", err)
+	}
+
+	delay := ts.delay(hits)
+	if delay > 0 {
+		_, err = ts.DB.Exec(`
+			UPDATE throttles
+			SET blocked_until = $2
+			WHERE key = $1;
+		`, key, time.Now().Add(delay))
+		if err != nil {
+			return 0, fmt.Errorf("hit throttle: %w", err)
+		}
+	}
+	return hits, nil
+}
+
+// Clears the counters of the keys (e.g. after a successful sign in).
+func (ts *ThrottleService) Reset(keys ...string) error {
+	for _, key := range keys {
+		_, err := ts.DB.Exec(`
+			DELETE FROM throttles
+			WHERE key = $1;
+		`, key)
+		if err != nil {
+			return fmt.Errorf("reset throttle: %w", err)
+		}
+	}
+	return nil
+}
+
+func (ts *ThrottleService) delay(hits int) time.Duration {
+	freeHits := ts.FreeHits
+	if freeHits <= 0 {
+		freeHits = DefaultThrottleFreeHits
+	}
+	baseDelay := ts.BaseDelay
+	if baseDelay <= 0 {
+		baseDelay = DefaultThrottleBaseDelay
+	}
+	maxDelay := ts.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultThrottleMaxDelay
+	}
+	if hits <= freeHits {
+		return 0
+	}
+	delay := baseDelay
+	for i := freeHits + 1; i < hits && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
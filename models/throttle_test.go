@@ -0,0 +1,91 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestThrottleServiceDelay(t *testing.T) {
+	tests := []struct {
+		name string
+		ts   ThrottleService
+		hits int
+		want time.Duration
+	}{
+		{"defaults, free hit", ThrottleService{}, DefaultThrottleFreeHits, 0},
+		{"defaults, first blocked hit", ThrottleService{}, DefaultThrottleFreeHits + 1, DefaultThrottleBaseDelay},
+		{"defaults, capped", ThrottleService{}, 1000, DefaultThrottleMaxDelay},
+		{"no hits", ThrottleService{FreeHits: 2}, 0, 0},
+		{"first blocked hit", ThrottleService{FreeHits: 2, BaseDelay: time.Second}, 3, time.Second},
+		{"doubles", ThrottleService{FreeHits: 2, BaseDelay: time.Second}, 4, 2 * time.Second},
+		{"doubles again", ThrottleService{FreeHits: 2, BaseDelay: time.Second}, 6, 8 * time.Second},
+		{
+			"capped",
+			ThrottleService{FreeHits: 2, BaseDelay: time.Second, MaxDelay: 5 * time.Second},
+			6,
+			5 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ts.delay(tt.hits); got != tt.want {
+				t.Errorf("delay(%d) = %s, want %s", tt.hits, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottleService(t *testing.T) {
+	ts := &ThrottleService{
+		DB:        testDB(t),
+		FreeHits:  2,
+		BaseDelay: time.Minute,
+	}
+	key := "test:" + testEmail("throttle")
+	otherKey := "test:" + testEmail("throttle-other")
+
+	for want := 1; want <= 2; want++ {
+		hits, err := ts.Hit(key)
+		if err != nil {
+			t.Fatalf("Hit() err = %v", err)
+		}
+		if hits != want {
+			t.Errorf("Hit() = %d, want %d", hits, want)
+		}
+		if err := ts.Check(key, otherKey); err != nil {
+			t.Fatalf("Check() after %d free hits err = %v, want nil", hits, err)
+		}
+	}
+
+	_, err := ts.Hit(key)
+	if err != nil {
+		t.Fatalf("Hit() err = %v", err)
+	}
+	err = ts.Check(otherKey, key)
+	var throttledErr ThrottledError
+	if !errors.As(err, &throttledErr) || !errors.Is(err, ErrThrottled) {
+		t.Fatalf("Check() err = %v, want a ThrottledError", err)
+	}
+	if throttledErr.RetryAfter <= 0 || throttledErr.RetryAfter > time.Minute {
+		t.Errorf("RetryAfter = %s, want up to a minute", throttledErr.RetryAfter)
+	}
+	if err := ts.Check(otherKey); err != nil {
+		t.Errorf("Check() of another key err = %v, want nil", err)
+	}
+
+	err = ts.Reset(key)
+	if err != nil {
+		t.Fatalf("Reset() err = %v", err)
+	}
+	if err := ts.Check(key); err != nil {
+		t.Errorf("Check() after Reset() err = %v, want nil", err)
+	}
+	hits, err := ts.Hit(key)
+	if err != nil {
+		t.Fatalf("Hit() err = %v", err)
+	}
+	if hits != 1 {
+		t.Errorf("Hit() after Reset() = %d, want 1", hits)
+	}
+}
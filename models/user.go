@@ -4,35 +4,86 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
-	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
 )
 
 type User struct {
 	ID           uint
 	Email        string
 	PasswordHash string
+	Role         string
+	// From the profile (see ProfileService). Only loaded for the current user.
+	Handle      string
+	DisplayName string
+	Avatar      string
+}
+
+// What to call the user: their display name, or their email.
+func (user User) Name() string {
+	if user.DisplayName != "" {
+		return user.DisplayName
+	}
+	return user.Email
 }
 
+const (
+	DefaultLockoutThreshold = 10
+	DefaultLockoutDuration  = 30 * time.Minute
+)
+
+/*
+LockoutThreshold is the number of failed sign ins (counted by the
+ThrottleService) after which the account gets locked for LockoutDuration.
+Resetting the password clears the lock.
+
+Hasher defaults to bcrypt with bcrypt.DefaultCost. Changing its configuration
+is safe: existing hashes are upgraded the next time their owner signs in.
+
+Account creation, lockouts and credential changes are recorded in the audit
+log (see Auditor).
+*/
 type UserService struct {
-	DB *sql.DB
+	DB               *sql.DB
+	LockoutThreshold int           // Defaults to DefaultLockoutThreshold
+	LockoutDuration  time.Duration // Defaults to DefaultLockoutDuration
+	PasswordPolicy   *PasswordPolicy
+	Hasher           *PasswordHasher
+	Auditor
+}
+
+// Returns a copy of the service that records actor in the audit log.
+func (us *UserService) WithActor(actor Actor) *UserService {
+	withActor := *us
+	withActor.Actor = actor
+	return &withActor
 }
 
 func (us *UserService) Create(email, password string) (*User, error) {
 	email = strings.ToLower(email)
+	err := us.ValidatePassword(email, password)
+	if err != nil {
+		return nil, fmt.Errorf("create user: %w", err)
+	}
 	// hash the password
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashString, err := us.hasher().Hash(password)
 	if err != nil {
 		return nil, fmt.Errorf("create user: %w", err)
 	}
-	hashString := string(hashedBytes)
 
 	user := User{
 		Email:        email,
 		PasswordHash: hashString,
+		Role:         RoleUser,
 	}
 	row := us.DB.QueryRow(`
 	INSERT INTO users (email, password_hash)
@@ -49,6 +100,7 @@ func (us *UserService) Create(email, password string) (*User, error) {
 		}
 		return nil, fmt.Errorf("models: create: %w", err) // too much info for the baddies
 	}
+	us.record(user.ID, AuditUserCreated, map[string]any{"email": email})
 	return &user, nil
 }
 
@@ -57,41 +109,423 @@ func (us *UserService) Authenticate(email, password string) (*User, error) {
 	user := User{
 		Email: email,
 	}
+	var lockedUntil sql.NullTime
 	// fetch user from DB
 	row := us.DB.QueryRow(`
-	SELECT id, password_hash
+	SELECT id, password_hash, role, locked_until
 	FROM users
 	WHERE email=$1
 	`, email)
-	err := row.Scan(&user.ID, &user.PasswordHash)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.Role, &lockedUntil)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("authenticate: %w", ErrInvalidCredentials)
+		}
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
+	// Don't even compare the hashes while the account is locked.
+	if lockedUntil.Valid && time.Now().Before(lockedUntil.Time) {
+		return nil, fmt.Errorf("authenticate: %w", ErrAccountLocked)
+	}
 
 	// compare the password hashes
-	err = bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password))
+	err = us.hasher().Verify(user.PasswordHash, password)
 	if err != nil {
 		return nil, fmt.Errorf("authenticate: %w", err)
 	}
 
+	// We only have the plain text pwd now, so take the chance to upgrade
+	// outdated hashes. A failure here shouldn't prevent signing in.
+	if us.hasher().NeedsRehash(user.PasswordHash) {
+		err = us.rehash(&user, password)
+		if err != nil {
+			fmt.Println(err) // rudimentary logging
+		}
+	}
+
 	return &user, nil
 }
 
+func (us *UserService) ByID(userId uint) (*User, error) {
+	user := User{
+		ID: userId,
+	}
+	row := us.DB.QueryRow(`
+		SELECT email, password_hash, role
+		FROM users
+		WHERE id = $1;
+	`, userId)
+	err := row.Scan(&user.Email, &user.PasswordHash, &user.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user by ID: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("user by ID: %w", err)
+	}
+	return &user, nil
+}
+
+const (
+	DefaultUserSearchLimit = 50
+	// UserSearch.Status values
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+)
+
+// A user, with what the admin console shows about them.
+type UserSummary struct {
+	User
+	CreatedAt   time.Time
+	DisabledAt  time.Time // Zero if the account isn't disabled
+	LockedUntil time.Time // Zero if the account was never locked
+	Galleries   int
+	SignedIn    bool // Has a session
+}
+
+func (summary UserSummary) Disabled() bool {
+	return !summary.DisabledAt.IsZero()
+}
+
+func (summary UserSummary) Locked() bool {
+	return time.Now().Before(summary.LockedUntil)
+}
+
+// Filters for UserService.Search. Zero values don't filter.
+type UserSearch struct {
+	ID     uint
+	Query  string // part of the email, or a user ID
+	Role   string
+	Status string // UserStatusActive or UserStatusDisabled
+	Limit  int    // Defaults to DefaultUserSearchLimit
+	Offset int
+}
+
+// Returns the users matching the search, most recent first.
+func (us *UserService) Search(search UserSearch) ([]UserSummary, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if search.ID != 0 {
+		where("users.id = $%d", search.ID)
+	}
+	if query := strings.ToLower(strings.TrimSpace(search.Query)); query != "" {
+		if id, err := strconv.ParseUint(query, 10, 32); err == nil {
+			where("users.id = $%d", id)
+		} else {
+			where("users.email LIKE $%d", "%"+escapeLike(query)+"%")
+		}
+	}
+	if search.Role != "" {
+		where("users.role = $%d", search.Role)
+	}
+	switch search.Status {
+	case UserStatusActive:
+		conditions = append(conditions, "users.disabled_at IS NULL")
+	case UserStatusDisabled:
+		conditions = append(conditions, "users.disabled_at IS NOT NULL")
+	}
+	query := `
+		SELECT users.id, users.email, users.role, users.created_at,
+			users.disabled_at, users.locked_until,
+			(SELECT COUNT(*) FROM galleries WHERE galleries.user_id = users.id),
+			EXISTS (SELECT 1 FROM sessions WHERE sessions.user_id = users.id)
+		FROM users`
+	if len(conditions) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := search.Limit
+	if limit <= 0 {
+		limit = DefaultUserSearchLimit
+	}
+	args = append(args, limit, max(search.Offset, 0))
+	query += fmt.Sprintf("\n\t\tORDER BY users.id DESC\n\t\tLIMIT $%d OFFSET $%d;", len(args)-1, len(args))
+
+	rows, err := us.DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search users: %w", err)
+	}
+	defer rows.Close()
+	var users []UserSummary
+	for rows.Next() {
+		var summary UserSummary
+		var disabledAt, lockedUntil sql.NullTime
+		err := rows.Scan(
+			&summary.ID,
+			&summary.Email,
+			&summary.Role,
+			&summary.CreatedAt,
+			&disabledAt,
+			&lockedUntil,
+			&summary.Galleries,
+			&summary.SignedIn,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("search users: %w", err)
+		}
+		summary.DisabledAt = disabledAt.Time
+		summary.LockedUntil = lockedUntil.Time
+		users = append(users, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("search users: %w", err)
+	}
+	return users, nil
+}
+
+// Returns the summary of one user, or ErrNotFound.
+func (us *UserService) Summary(userId uint) (*UserSummary, error) {
+	users, err := us.Search(UserSearch{ID: userId, Limit: 1})
+	if err != nil {
+		return nil, fmt.Errorf("user summary: %w", err)
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("user summary: %w", ErrNotFound)
+	}
+	return &users[0], nil
+}
+
+// Disables the account: it can't sign in anymore, and its sessions stop
+// working (see SessionService). Disabling a disabled account does nothing.
+func (us *UserService) Disable(userId uint) error {
+	return us.setDisabled(userId, true)
+}
+
+// Re-enables a disabled account.
+func (us *UserService) Enable(userId uint) error {
+	return us.setDisabled(userId, false)
+}
+
+func (us *UserService) setDisabled(userId uint, disabled bool) error {
+	var changed bool
+	row := us.DB.QueryRow(`
+		UPDATE users
+		SET disabled_at = CASE
+			WHEN NOT $2 THEN NULL
+			ELSE COALESCE(disabled_at, NOW())
+		END
+		FROM (SELECT disabled_at IS NOT NULL AS disabled FROM users WHERE id = $1) AS previous
+		WHERE users.id = $1
+		RETURNING previous.disabled <> $2;
+	`, userId, disabled)
+	err := row.Scan(&changed)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("set user disabled: %w", ErrNotFound)
+		}
+		return fmt.Errorf("set user disabled: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+	if disabled {
+		us.record(userId, AuditUserDisabled, nil)
+	} else {
+		us.record(userId, AuditUserEnabled, nil)
+	}
+	return nil
+}
+
+// Gives the account with the given email a role (RoleUser or RoleAdmin).
+// Returns ErrNotFound if there's no such account.
+func (us *UserService) SetRole(email, role string) (*User, error) {
+	if role != RoleUser && role != RoleAdmin {
+		return nil, fmt.Errorf("set role: unknown role %q", role)
+	}
+	user := User{
+		Email: strings.ToLower(email),
+		Role:  role,
+	}
+	row := us.DB.QueryRow(`
+		UPDATE users
+		SET role = $2
+		WHERE email = $1
+		RETURNING id;
+	`, user.Email, role)
+	err := row.Scan(&user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("set role: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("set role: %w", err)
+	}
+	us.record(user.ID, AuditRoleChanged, map[string]any{"role": role})
+	return &user, nil
+}
+
+// Removes the password of the account, so it has to be reset before it can
+// be used to sign in again (e.g. because it leaked). Accounts that sign in
+// through a directory or an identity provider aren't affected.
+func (us *UserService) RequirePasswordReset(userId uint) error {
+	result, err := us.DB.Exec(`
+		UPDATE users
+		SET password_hash = ''
+		WHERE id = $1;
+	`, userId)
+	if err != nil {
+		return fmt.Errorf("require password reset: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("require password reset: %w", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("require password reset: %w", ErrNotFound)
+	}
+	us.record(userId, AuditPasswordResetForced, nil)
+	return nil
+}
+
+// Locks the account with the given email for LockoutDuration. Returns
+// ErrNotFound if there's no such account.
+func (us *UserService) Lock(email string) (*User, error) {
+	email = strings.ToLower(email)
+	duration := us.LockoutDuration
+	if duration <= 0 {
+		duration = DefaultLockoutDuration
+	}
+	user := User{
+		Email: email,
+	}
+	row := us.DB.QueryRow(`
+		UPDATE users
+		SET locked_until = $2
+		WHERE email = $1
+		RETURNING id;
+	`, email, time.Now().Add(duration))
+	err := row.Scan(&user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("lock user: %w", ErrNotFound)
+		}
+		return nil, fmt.Errorf("lock user: %w", err)
+	}
+	us.record(user.ID, AuditAccountLocked, map[string]any{"duration": duration.String()})
+	return &user, nil
+}
+
+// Records a failed sign in in the audit log. The account (if there's one with
+// that email) gets it in its history.
+func (us *UserService) SignInFailed(email string) {
+	email = strings.ToLower(email)
+	var userId uint
+	row := us.DB.QueryRow(`
+		SELECT id
+		FROM users
+		WHERE email = $1;
+	`, email)
+	err := row.Scan(&userId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		fmt.Println(err) // rudimentary logging
+	}
+	us.record(userId, AuditSignInFailed, map[string]any{"email": email})
+}
+
+// Returns true when the number of failed sign ins should lock the account.
+func (us *UserService) ShouldLock(failedSignIns int) bool {
+	threshold := us.LockoutThreshold
+	if threshold <= 0 {
+		threshold = DefaultLockoutThreshold
+	}
+	return failedSignIns >= threshold
+}
+
 func (us *UserService) UpdatePassword(userId uint, password string) error {
+	var email string
+	row := us.DB.QueryRow(`
+		SELECT email
+		FROM users
+		WHERE id = $1;
+	`, userId)
+	err := row.Scan(&email)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+	err = us.ValidatePassword(email, password)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
 	// Hash the pwd
-	hashedBytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	pwdHash, err := us.hasher().Hash(password)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
-	pwdHash := string(hashedBytes)
-	// Store the hashed pwd
+	// Store the hashed pwd (this also clears any lockout)
 	_, err = us.DB.Exec(`
 		UPDATE users
-		SET password_hash = $2
+		SET password_hash = $2, locked_until = NULL
 		WHERE id = $1;
 	`, userId, pwdHash)
 	if err != nil {
 		return fmt.Errorf("update password: %w", err)
 	}
+	us.record(userId, AuditPasswordChanged, nil)
+	return nil
+}
+
+func (us *UserService) UpdateEmail(userId uint, email string) error {
+	email = strings.ToLower(email)
+	var previousEmail string
+	row := us.DB.QueryRow(`
+		UPDATE users
+		SET email = $2
+		FROM (SELECT email FROM users WHERE id = $1) AS previous
+		WHERE users.id = $1
+		RETURNING previous.email;
+	`, userId, email)
+	err := row.Scan(&previousEmail)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+			return ErrEmailTaken
+		}
+		return fmt.Errorf("update email: %w", err)
+	}
+	us.record(userId, AuditEmailChanged, map[string]any{
+		"email":          email,
+		"previous_email": previousEmail,
+	})
+	return nil
+}
+
+// Checks the password against the PasswordPolicy (if any) and the limits of
+// the hasher, returning one of the ErrPassword* errors when it's not
+// acceptable.
+func (us *UserService) ValidatePassword(email, password string) error {
+	// The policy counts characters, bcrypt bytes: 72 characters with accents
+	// can be well past 72 bytes.
+	if maxBytes := us.hasher().MaxPasswordBytes(); maxBytes > 0 && len(password) > maxBytes {
+		return ErrPasswordTooLong
+	}
+	if us.PasswordPolicy == nil {
+		return nil
+	}
+	return us.PasswordPolicy.Validate(email, password)
+}
+
+func (us *UserService) hasher() *PasswordHasher {
+	if us.Hasher == nil {
+		return &PasswordHasher{}
+	}
+	return us.Hasher
+}
+
+func (us *UserService) rehash(user *User, password string) error {
+	pwdHash, err := us.hasher().Hash(password)
+	if err != nil {
+		return fmt.Errorf("rehash password: %w", err)
+	}
+	// Only replace the hash we verified, in case the pwd changed meanwhile.
+	_, err = us.DB.Exec(`
+		UPDATE users
+		SET password_hash = $3
+		WHERE id = $1 AND password_hash = $2;
+	`, user.ID, user.PasswordHash, pwdHash)
+	if err != nil {
+		return fmt.Errorf("rehash password: %w", err)
+	}
+	user.PasswordHash = pwdHash
 	return nil
 }
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUserServiceShouldLock(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		failures  int
+		want      bool
+	}{
+		{"default, below", 0, DefaultLockoutThreshold - 1, false},
+		{"default, at", 0, DefaultLockoutThreshold, true},
+		{"custom, below", 3, 2, false},
+		{"custom, at", 3, 3, true},
+		{"custom, past", 3, 7, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := UserService{LockoutThreshold: tt.threshold}
+			if got := us.ShouldLock(tt.failures); got != tt.want {
+				t.Errorf("ShouldLock(%d) = %v, want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserServiceValidatePassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		hasher   *PasswordHasher
+		password string
+		want     error
+	}{
+		{"bcrypt, 72 bytes", nil, strings.Repeat("a", 72), nil},
+		{"bcrypt, 73 bytes", nil, strings.Repeat("a", 73), ErrPasswordTooLong},
+		// 40 characters, but 80 bytes.
+		{"bcrypt, multibyte", nil, strings.Repeat("é", 40), ErrPasswordTooLong},
+		{"argon2id, multibyte", &PasswordHasher{Algorithm: HashAlgorithmArgon2id}, strings.Repeat("é", 40), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := UserService{
+				Hasher:         tt.hasher,
+				PasswordPolicy: &PasswordPolicy{MaxLength: 100},
+			}
+			err := us.ValidatePassword("jon@example.com", tt.password)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("ValidatePassword() err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
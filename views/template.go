@@ -41,6 +41,15 @@ func ParseFS(fs fs.FS, patterns ...string) (Template, error) {
 			"currentUser": func() (template.HTML, error) {
 				return "", fmt.Errorf("currentUser not implemented")
 			},
+			"impersonation": func() (template.HTML, error) {
+				return "", fmt.Errorf("impersonation not implemented")
+			},
+			"workspaces": func() (template.HTML, error) {
+				return "", fmt.Errorf("workspaces not implemented")
+			},
+			"currentWorkspace": func() (template.HTML, error) {
+				return "", fmt.Errorf("currentWorkspace not implemented")
+			},
 			"errors": func() []string {
 				return nil
 			},
@@ -80,6 +89,15 @@ func (t Template) Execute(
 		"currentUser": func() *models.User {
 			return context.User(r.Context())
 		},
+		"impersonation": func() *models.Impersonation {
+			return context.Impersonation(r.Context())
+		},
+		"workspaces": func() []models.Membership {
+			return context.Memberships(r.Context())
+		},
+		"currentWorkspace": func() *models.Membership {
+			return context.Workspace(r.Context())
+		},
 		"errors": func() []string {
 			return errMsgs
 		},